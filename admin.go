@@ -0,0 +1,383 @@
+package cache
+
+import (
+	"crypto/subtle"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-contrib/cache/persistence"
+	"github.com/gin-gonic/gin"
+)
+
+// HeaderCacheTag is the response header tagging a cached page, a comma
+// separated list of tags the admin routes can purge the page by
+const HeaderCacheTag = "Cache-Tag"
+
+// AdminOptions configures the admin routes
+type AdminOptions struct {
+	// Auth runs before every admin route and must abort the requests it
+	// refuses, AdminTokenAuth and gin.BasicAuth can be used. It is required
+	// unless Insecure is set.
+	Auth gin.HandlerFunc
+
+	// Insecure registers the routes without Auth, the group must then be
+	// protected by its own middlewares
+	Insecure bool
+
+	// Logger receives the audit log of the purges and flushes. When nil, the
+	// logger of the cache receives it once set with SetLogger, and standard
+	// error before, so the audit log is never dropped. The user is the one
+	// Auth sets under gin.AuthUserKey.
+	Logger persistence.Logger
+
+	// FlushAll makes POST /flush flush the whole store instead of purging
+	// the cached pages, the keys of the other services sharing the backend
+	// included
+	FlushAll bool
+}
+
+// AdminTokenAuth accepts the requests with an "Authorization: Bearer" header
+// holding one of the keys of tokens, and sets the user it maps to under
+// gin.AuthUserKey. The other requests are refused with a 401.
+func AdminTokenAuth(tokens map[string]string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		auth := c.GetHeader("Authorization")
+		if strings.HasPrefix(auth, "Bearer ") {
+			given := []byte(strings.TrimPrefix(auth, "Bearer "))
+			for token, user := range tokens {
+				if subtle.ConstantTimeCompare(given, []byte(token)) == 1 {
+					c.Set(gin.AuthUserKey, user)
+					return
+				}
+			}
+		}
+		c.Header("WWW-Authenticate", "Bearer")
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+	}
+}
+
+type admin struct {
+	cache    *cache
+	logger   persistence.Logger
+	flushAll bool
+}
+
+// RegisterAdmin adds the admin routes of the cache to group:
+//
+//	GET    /keys?prefix=&cursor=&count=  lists the keys of the store
+//	GET    /page?url= or ?key=           shows a cached page
+//	DELETE /page?url= or ?key=           purges a page
+//	DELETE /pages?prefix= or ?tag=       purges the pages whose URL starts
+//	                                     with prefix, or tagged with tag
+//	POST   /flush                        purges every cached page, or
+//	                                     flushes the store with FlushAll
+//	GET    /stats                        reports the outcomes of the cache
+//
+// URLs are keyed like CachePage does. Listing keys and purging by tag need a
+// store implementing persistence.Scanner, purging by prefix or every page a
+// Scanner or a persistence.PrefixFlusher (see PurgePrefix); the routes answer
+// 501 otherwise.
+//
+// RegisterAdmin panics when options has neither Auth nor Insecure, so the
+// routes purging the cache are never left open by mistake.
+func (ch *cache) RegisterAdmin(group *gin.RouterGroup, options *AdminOptions) {
+	if options == nil || (options.Auth == nil && !options.Insecure) {
+		panic("cache: RegisterAdmin without Auth, set Insecure to protect the routes otherwise")
+	}
+	a := &admin{cache: ch, logger: options.Logger, flushAll: options.FlushAll}
+	if options.Auth != nil {
+		group = group.Group("", options.Auth)
+	}
+	group.GET("/keys", a.keys)
+	group.GET("/page", a.page)
+	group.DELETE("/page", a.purgePage)
+	group.DELETE("/pages", a.purgePages)
+	group.POST("/flush", a.flush)
+	group.GET("/stats", a.stats)
+}
+
+// adminError answers with the status matching err
+func adminError(c *gin.Context, err error) {
+	status := http.StatusInternalServerError
+	switch err {
+	case persistence.ErrCacheMiss:
+		status = http.StatusNotFound
+	case persistence.ErrNotSupport:
+		status = http.StatusNotImplemented
+	case persistence.ErrInvalidCursor:
+		status = http.StatusBadRequest
+	case persistence.ErrCircuitOpen:
+		status = http.StatusServiceUnavailable
+	}
+	c.AbortWithStatusJSON(status, gin.H{"error": err.Error()})
+}
+
+func badRequest(c *gin.Context, msg string) {
+	c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": msg})
+}
+
+// ttlSeconds returns the seconds of a TTL, -1 for FOREVER
+func ttlSeconds(ttl time.Duration) int64 {
+	if ttl == persistence.FOREVER {
+		return -1
+	}
+	return int64(ttl / time.Second)
+}
+
+func (a *admin) keys(c *gin.Context) {
+	count := 0
+	if s := c.Query("count"); s != "" {
+		var err error
+		if count, err = strconv.Atoi(s); err != nil || count < 0 {
+			badRequest(c, "invalid count")
+			return
+		}
+	}
+	infos, next, err := persistence.Scan(a.cache.store, c.Query("prefix"), c.Query("cursor"), count)
+	if err != nil {
+		adminError(c, err)
+		return
+	}
+	keys := make([]gin.H, len(infos))
+	for i, info := range infos {
+		keys[i] = gin.H{"key": info.Key, "size": info.Size, "ttl_seconds": ttlSeconds(info.TTL)}
+	}
+	c.JSON(http.StatusOK, gin.H{"keys": keys, "cursor": next})
+}
+
+// pageKey returns the key of the page given by the url or key parameter
+func (a *admin) pageKey(c *gin.Context) (string, bool) {
+	if key := c.Query("key"); key != "" {
+		return key, true
+	}
+	raw := c.Query("url")
+	if raw == "" {
+		badRequest(c, "url or key required")
+		return "", false
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		badRequest(c, "invalid url")
+		return "", false
+	}
+	return CreateKey(a.cache.parseUrl(u).RequestURI()), true
+}
+
+func (a *admin) page(c *gin.Context) {
+	key, ok := a.pageKey(c)
+	if !ok {
+		return
+	}
+	var page ResponseCache
+	if err := a.cache.store.Get(key, &page); err != nil {
+		adminError(c, err)
+		return
+	}
+	res := gin.H{
+		"key":     key,
+		"status":  page.Status,
+		"headers": page.Header,
+		"size":    len(page.Data),
+		"created": page.Created,
+	}
+	if !page.Created.IsZero() {
+		res["age_seconds"] = int64(time.Since(page.Created) / time.Second)
+	}
+	if ttl, err := persistence.TTL(a.cache.store, key); err == nil {
+		res["ttl_seconds"] = ttlSeconds(ttl)
+	}
+	c.JSON(http.StatusOK, res)
+}
+
+func (a *admin) purgePage(c *gin.Context) {
+	key, ok := a.pageKey(c)
+	if !ok {
+		return
+	}
+	err := a.cache.store.Delete(key)
+	purged := 1
+	if err == persistence.ErrCacheMiss {
+		err, purged = nil, 0
+	}
+	a.audit(c, "page", key, purged, err)
+	if err != nil {
+		adminError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"purged": purged})
+}
+
+func (a *admin) purgePages(c *gin.Context) {
+	prefix, tag := c.Query("prefix"), c.Query("tag")
+	var purged int
+	var err error
+	switch {
+	case prefix != "":
+		purged, err = PurgePrefix(a.cache.store, prefix)
+		a.audit(c, "prefix", prefix, purged, err)
+		if err == nil && purged < 0 {
+			// the flusher does not count the keys it deletes
+			c.JSON(http.StatusOK, gin.H{})
+			return
+		}
+	case tag != "":
+		purged, err = purgeKeys(a.cache.store, PageCachePrefix+":", func(page *ResponseCache) bool {
+			return hasTag(page.Header, tag)
+		})
+		a.audit(c, "tag", tag, purged, err)
+	default:
+		badRequest(c, "prefix or tag required")
+		return
+	}
+	if err != nil {
+		adminError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"purged": purged})
+}
+
+// PurgePrefix deletes the cached pages of store whose URL starts with prefix
+// and returns their number, -1 when the store is a persistence.PrefixFlusher
+// but not a persistence.Scanner and the number is unknown. The pages of URLs
+// long enough to be keyed by their hash are missed.
+func PurgePrefix(store persistence.CacheStore, prefix string) (int, error) {
+	// not CreateKey, which hashes the long URLs
+	keyPrefix := PageCachePrefix + ":" + url.QueryEscape(prefix)
+	purged, err := purgeKeys(store, keyPrefix, nil)
+	if err == persistence.ErrNotSupport {
+		if flusher, ok := store.(persistence.PrefixFlusher); ok {
+			return -1, flusher.FlushPrefix(keyPrefix)
+		}
+	}
+	return purged, err
+}
+
+// purgeKeys deletes the keys of store starting with prefix, only the pages
+// match accepts when it is not nil, and returns the number of keys deleted
+func purgeKeys(store persistence.CacheStore, prefix string, match func(*ResponseCache) bool) (int, error) {
+	purged := 0
+	cursor := ""
+	for {
+		infos, next, err := persistence.Scan(store, prefix, cursor, 0)
+		if err != nil {
+			return purged, err
+		}
+		for _, info := range infos {
+			if match != nil {
+				var page ResponseCache
+				err := store.Get(info.Key, &page)
+				if err == persistence.ErrCacheMiss || (err == nil && !match(&page)) {
+					continue
+				}
+				if err != nil {
+					return purged, err
+				}
+			}
+			switch err := store.Delete(info.Key); err {
+			case nil:
+				purged++
+			case persistence.ErrCacheMiss:
+			default:
+				return purged, err
+			}
+		}
+		if next == "" {
+			return purged, nil
+		}
+		cursor = next
+	}
+}
+
+// hasTag tells whether the HeaderCacheTag of a page lists tag
+func hasTag(header http.Header, tag string) bool {
+	for _, v := range header[http.CanonicalHeaderKey(HeaderCacheTag)] {
+		for _, t := range strings.Split(v, ",") {
+			if strings.TrimSpace(t) == tag {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (a *admin) flush(c *gin.Context) {
+	if a.flushAll {
+		err := a.cache.store.Flush()
+		a.audit(c, "flush", "", -1, err)
+		if err != nil {
+			adminError(c, err)
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{})
+		return
+	}
+	// the other keys of the store may belong to other services
+	purged, err := PurgePrefix(a.cache.store, "")
+	a.audit(c, "flush", PageCachePrefix, purged, err)
+	switch {
+	case err != nil:
+		adminError(c, err)
+	case purged < 0:
+		c.JSON(http.StatusOK, gin.H{})
+	default:
+		c.JSON(http.StatusOK, gin.H{"purged": purged})
+	}
+}
+
+func (a *admin) stats(c *gin.Context) {
+	s := &a.cache.stats
+	hits, misses := atomic.LoadUint64(&s.hits), atomic.LoadUint64(&s.misses)
+	res := gin.H{
+		"store":  a.cache.storeName,
+		"hits":   hits,
+		"misses": misses,
+		"stored": atomic.LoadUint64(&s.stored),
+		"errors": atomic.LoadUint64(&s.errors),
+	}
+	if hits+misses > 0 {
+		res["hit_ratio"] = float64(hits) / float64(hits+misses)
+	}
+	if breaker, ok := a.cache.store.(persistence.CircuitBreaker); ok {
+		res["circuit_open"] = breaker.CircuitOpen()
+	}
+	c.JSON(http.StatusOK, res)
+}
+
+// stderrLogger receives the audit log when no logger is set
+var stderrLogger = persistence.NewStdLogger(log.New(os.Stderr, "", log.LstdFlags), persistence.LevelInfo)
+
+// auditLogger returns the logger of the audit log
+func (a *admin) auditLogger() persistence.Logger {
+	if a.logger != nil {
+		return a.logger
+	}
+	if _, nop := a.cache.logger.(persistence.NopLogger); !nop && a.cache.logger != nil {
+		return a.cache.logger
+	}
+	return stderrLogger
+}
+
+// audit logs a purge, purged is -1 when the number of keys is unknown
+func (a *admin) audit(c *gin.Context, action, target string, purged int, err error) {
+	logger := a.auditLogger()
+	fields := []persistence.Field{
+		{Key: "action", Value: action},
+		{Key: "target", Value: target},
+		{Key: "user", Value: c.GetString(gin.AuthUserKey)},
+		{Key: "remote", Value: c.ClientIP()},
+	}
+	if purged >= 0 {
+		fields = append(fields, persistence.Field{Key: "purged", Value: purged})
+	}
+	if err != nil {
+		logger.Log(persistence.LevelError, "cache: admin purge failed", append(fields, persistence.Field{Key: "error", Value: err})...)
+		return
+	}
+	logger.Log(persistence.LevelInfo, "cache: admin purge", fields...)
+}
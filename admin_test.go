@@ -0,0 +1,190 @@
+package cache
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/gin-contrib/cache/persistence"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func adminRequest(method, target, token string, router *gin.Engine) (*httptest.ResponseRecorder, map[string]interface{}) {
+	r := httptest.NewRequest(method, target, nil)
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	var body map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &body)
+	return w, body
+}
+
+func newAdminRouter(ch *cache, logger persistence.Logger) *gin.Engine {
+	router := gin.New()
+	router.GET("/page/*path", ch.CachePage(time.Hour), func(c *gin.Context) {
+		if c.Query("tag") != "" {
+			c.Header(HeaderCacheTag, "news, "+c.Query("tag"))
+		}
+		c.String(200, "page "+c.Param("path"))
+	})
+	ch.RegisterAdmin(router.Group("/_cache"), &AdminOptions{
+		Auth:   AdminTokenAuth(map[string]string{"secret": "ops"}),
+		Logger: logger,
+	})
+	return router
+}
+
+func TestAdminAuth(t *testing.T) {
+	router := newAdminRouter(NewMemoryCache(time.Minute), nil)
+
+	w, _ := adminRequest("GET", "/_cache/stats", "", router)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Equal(t, "Bearer", w.Header().Get("WWW-Authenticate"))
+	w, _ = adminRequest("GET", "/_cache/stats", "wrong", router)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	w, _ = adminRequest("GET", "/_cache/stats", "secret", router)
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestAdminRequiresAuth(t *testing.T) {
+	ch := NewMemoryCache(time.Minute)
+	assert.Panics(t, func() { ch.RegisterAdmin(gin.New().Group("/_cache"), nil) })
+	assert.Panics(t, func() { ch.RegisterAdmin(gin.New().Group("/_cache"), &AdminOptions{}) })
+
+	router := gin.New()
+	ch.RegisterAdmin(router.Group("/_cache"), &AdminOptions{Insecure: true})
+	w, _ := adminRequest("GET", "/_cache/stats", "", router)
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestAdminAuditLogger(t *testing.T) {
+	stderr := &recordLogger{}
+	defer func(l persistence.Logger) { stderrLogger = l }(stderrLogger)
+	stderrLogger = stderr
+	ch := NewMemoryCache(time.Minute)
+	router := newAdminRouter(ch, nil)
+
+	adminRequest("DELETE", "/_cache/page?url=/page/a", "secret", router)
+	assert.Len(t, stderr.entries, 1, "the audit log goes to standard error without a logger")
+	logger := &recordLogger{}
+	ch.SetLogger(logger)
+	adminRequest("DELETE", "/_cache/page?url=/page/a", "secret", router)
+	assert.Len(t, logger.entries, 1, "the audit log goes to the logger of the cache once set")
+	assert.Len(t, stderr.entries, 1)
+}
+
+func TestAdminInspect(t *testing.T) {
+	ch := NewMemoryCache(time.Minute)
+	router := newAdminRouter(ch, nil)
+	performRequest("GET", "/page/a", router)
+	performRequest("GET", "/page/a", router)
+	performRequest("GET", "/page/b", router)
+
+	w, body := adminRequest("GET", "/_cache/keys?prefix="+url.QueryEscape(PageCachePrefix), "secret", router)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Len(t, body["keys"], 2)
+	assert.Equal(t, "", body["cursor"])
+
+	w, body = adminRequest("GET", "/_cache/keys?count=1", "secret", router)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Len(t, body["keys"], 1)
+	assert.NotEqual(t, "", body["cursor"])
+	w, _ = adminRequest("GET", "/_cache/keys?count=x", "secret", router)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w, body = adminRequest("GET", "/_cache/page?url=/page/a", "secret", router)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, CreateKey("/page/a"), body["key"])
+	assert.Equal(t, float64(200), body["status"])
+	assert.Equal(t, float64(len("page /a")), body["size"])
+	assert.InDelta(t, 3600, body["ttl_seconds"], 5)
+	assert.Contains(t, body["headers"], "Content-Type")
+
+	w, _ = adminRequest("GET", "/_cache/page?url=/page/missing", "secret", router)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w, _ = adminRequest("GET", "/_cache/page", "secret", router)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w, body = adminRequest("GET", "/_cache/stats", "secret", router)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "InMemoryStore", body["store"])
+	assert.Equal(t, float64(1), body["hits"])
+	assert.Equal(t, float64(2), body["misses"])
+	assert.Equal(t, float64(2), body["stored"])
+	assert.InDelta(t, 1.0/3, body["hit_ratio"], 0.001)
+}
+
+func TestAdminPurge(t *testing.T) {
+	logger := &recordLogger{}
+	ch := NewMemoryCache(time.Minute)
+	router := newAdminRouter(ch, logger)
+	for _, u := range []string{"/page/a", "/page/blog/1", "/page/blog/2", "/page/c?tag=sport", "/page/d?tag=tech"} {
+		performRequest("GET", u, router)
+	}
+
+	w, body := adminRequest("DELETE", "/_cache/page?url=/page/a", "secret", router)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, float64(1), body["purged"])
+	w, _ = adminRequest("GET", "/_cache/page?url=/page/a", "secret", router)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	_, body = adminRequest("DELETE", "/_cache/page?url=/page/a", "secret", router)
+	assert.Equal(t, float64(0), body["purged"])
+
+	_, body = adminRequest("DELETE", "/_cache/pages?prefix=/page/blog/", "secret", router)
+	assert.Equal(t, float64(2), body["purged"])
+
+	_, body = adminRequest("DELETE", "/_cache/pages?tag=sport", "secret", router)
+	assert.Equal(t, float64(1), body["purged"])
+	w, _ = adminRequest("GET", "/_cache/page?url="+url.QueryEscape("/page/d?tag=tech"), "secret", router)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w, _ = adminRequest("DELETE", "/_cache/pages", "secret", router)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	ch.store.Set("other", "value", time.Minute)
+	w, body = adminRequest("POST", "/_cache/flush", "secret", router)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, float64(1), body["purged"])
+	_, body = adminRequest("GET", "/_cache/keys", "secret", router)
+	assert.Len(t, body["keys"], 1, "the keys other than the pages are kept")
+
+	assert.Equal(t, []string{
+		"INFO cache: admin purge [{action page} {target " + CreateKey("/page/a") + "} {user ops} {remote 192.0.2.1} {purged 1}]",
+		"INFO cache: admin purge [{action page} {target " + CreateKey("/page/a") + "} {user ops} {remote 192.0.2.1} {purged 0}]",
+		"INFO cache: admin purge [{action prefix} {target /page/blog/} {user ops} {remote 192.0.2.1} {purged 2}]",
+		"INFO cache: admin purge [{action tag} {target sport} {user ops} {remote 192.0.2.1} {purged 1}]",
+		"INFO cache: admin purge [{action flush} {target " + PageCachePrefix + "} {user ops} {remote 192.0.2.1} {purged 1}]",
+	}, logger.entries)
+}
+
+func TestAdminFlushAll(t *testing.T) {
+	ch := NewMemoryCache(time.Minute)
+	router := gin.New()
+	ch.RegisterAdmin(router.Group("/_cache"), &AdminOptions{
+		Auth:     AdminTokenAuth(map[string]string{"secret": "ops"}),
+		FlushAll: true,
+	})
+	ch.store.Set("other", "value", time.Minute)
+
+	w, _ := adminRequest("POST", "/_cache/flush", "secret", router)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var value string
+	assert.Equal(t, persistence.ErrCacheMiss, ch.store.Get("other", &value))
+}
+
+func TestAdminNotSupported(t *testing.T) {
+	// only the CacheStore methods of the in-memory store are visible
+	ch := NewCache(struct{ persistence.CacheStore }{persistence.NewInMemoryStore(time.Minute)})
+	router := newAdminRouter(ch, nil)
+
+	w, _ := adminRequest("GET", "/_cache/keys", "secret", router)
+	assert.Equal(t, http.StatusNotImplemented, w.Code)
+	w, _ = adminRequest("DELETE", "/_cache/pages?tag=sport", "secret", router)
+	assert.Equal(t, http.StatusNotImplemented, w.Code)
+}
@@ -2,10 +2,10 @@ package cache
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha1"
 	"encoding/gob"
 	"io"
-	"log"
 	"net/http"
 	"net/url"
 	"sync"
@@ -24,14 +24,32 @@ var (
 )
 
 type cache struct {
+	stats            stats // first for the alignment of its atomic counters
 	store            persistence.CacheStore
 	excludeQueryArgs []string // just support GET request
+	metrics          Metrics
+	storeName        string
+	tracer           persistence.Tracer
+	logger           persistence.Logger
+	hooks            []Hooks
+	debugHeaders     map[string]bool
+	beta             float64 // weight of the early expiration, disabled when 0
+	jitter           float64
+	rand             func() float64 // rand.Float64 when nil
+	lock             *LockOptions   // pages are rendered without locks when nil
 }
 
 func (ch *cache) SetExcludeQueryArgs(values ...string) {
 	ch.excludeQueryArgs = append(ch.excludeQueryArgs, values...)
 }
 
+// SetTracer traces the page cache middlewares with t. Stores implementing
+// persistence.ContextBinder, like persistence.TracedStore, are bound to the
+// request so their spans are children of the middleware span.
+func (ch *cache) SetTracer(t persistence.Tracer) {
+	ch.tracer = t
+}
+
 func (ch *cache) parseUrl(u *url.URL) *url.URL {
 	if len(ch.excludeQueryArgs) > 0 {
 		q := u.Query()
@@ -52,7 +70,10 @@ func (ch *cache) validResponse(method string, code int) bool {
 
 func NewCache(store persistence.CacheStore) *cache {
 	return &cache{
-		store: store,
+		store:     store,
+		storeName: storeName(store),
+		tracer:    persistence.NoopTracer{},
+		logger:    persistence.NopLogger{},
 	}
 }
 
@@ -71,21 +92,27 @@ func NewGoRedisCache(host string, password string, defaultExpiration time.Durati
 	return NewCache(store)
 }
 
-
 func NewMemcached(hostList []string, defaultExpiration time.Duration) *cache {
 	store := persistence.NewMemcachedStore(hostList, defaultExpiration)
 	return NewCache(store)
 }
 
-type responseCache struct {
-	Status int
-	Header http.Header
-	Data   []byte
+// ResponseCache is a page stored by the page cache middlewares
+type ResponseCache struct {
+	Status  int
+	Header  http.Header
+	Data    []byte
+	Created time.Time
+
+	// Cost is the time the handlers took to render the page
+	Cost time.Duration
+	// Expire is the expiration the page was cached with, jitter included
+	Expire time.Duration
 }
 
-// RegisterResponseCacheGob registers the responseCache type with the encoding/gob package
+// RegisterResponseCacheGob registers the ResponseCache type with the encoding/gob package
 func RegisterResponseCacheGob() {
-	gob.Register(responseCache{})
+	gob.Register(ResponseCache{})
 }
 
 type cachedWriter struct {
@@ -95,6 +122,12 @@ type cachedWriter struct {
 	store   persistence.CacheStore
 	expire  time.Duration
 	key     string
+	cache   *cache
+	ctx     *gin.Context
+	created time.Time
+	body    []byte   // the response written so far
+	failed  bool     // a write of the response was not cached, the next ones are not either
+	debug   []string // the debug headers added by the middleware, not cached
 }
 
 var _ gin.ResponseWriter = &cachedWriter{}
@@ -119,7 +152,7 @@ func urlEscape(prefix string, u string) string {
 }
 
 func newCachedWriter(store persistence.CacheStore, expire time.Duration, writer gin.ResponseWriter, key string) *cachedWriter {
-	return &cachedWriter{writer, 0, false, store, expire, key}
+	return &cachedWriter{ResponseWriter: writer, store: store, expire: expire, key: key, created: time.Now()}
 }
 
 func (w *cachedWriter) WriteHeader(code int) {
@@ -138,25 +171,9 @@ func (w *cachedWriter) Written() bool {
 
 func (w *cachedWriter) Write(data []byte) (int, error) {
 	ret, err := w.ResponseWriter.Write(data)
-	if err == nil {
-		store := w.store
-		var cache responseCache
-		if err := store.Get(w.key, &cache); err == nil {
-			data = append(cache.Data, data...)
-		}
-
-		//cache responses with a status code < 300
-		if w.Status() < 300 {
-			val := responseCache{
-				w.Status(),
-				w.Header(),
-				data,
-			}
-			err = store.Set(w.key, val, w.expire)
-			if err != nil {
-				// need logger
-			}
-		}
+	//cache responses with a status code < 300
+	if err == nil && !w.failed && w.Status() < 300 {
+		w.set(data)
 	}
 	return ret, err
 }
@@ -164,18 +181,51 @@ func (w *cachedWriter) Write(data []byte) (int, error) {
 func (w *cachedWriter) WriteString(data string) (n int, err error) {
 	ret, err := w.ResponseWriter.WriteString(data)
 	//cache responses with a status code < 300
-	if err == nil && w.Status() < 300 {
-		store := w.store
-		val := responseCache{
-			w.Status(),
-			w.Header(),
-			[]byte(data),
-		}
-		store.Set(w.key, val, w.expire)
+	if err == nil && !w.failed && w.Status() < 300 {
+		w.set([]byte(data))
 	}
 	return ret, err
 }
 
+// set caches the response written so far followed by data. The body is kept
+// by the writer, the page cached under its key may be an older one being
+// rendered again. A failure is reported but does not fail the write since the
+// response already went to the client.
+func (w *cachedWriter) set(data []byte) {
+	w.body = append(w.body, data...)
+	// the page stored must not share the buffer appended to by the next writes
+	data = append([]byte(nil), w.body...)
+	val := ResponseCache{
+		w.Status(),
+		w.Header().Clone(),
+		data,
+		w.created,
+		time.Since(w.created),
+		w.expire,
+	}
+	stripDebugHeaders(val.Header, w.debug)
+	if err := w.cache.onStore(w.ctx, w.key, &val); err != nil {
+		w.drop()
+		return
+	}
+	if err := w.store.Set(w.key, val, w.expire); err != nil {
+		w.cache.reportError(w.ctx, "cache: failed to store the response", w.key, err)
+		// the next writes would be cached without this one
+		w.failed = true
+		return
+	}
+	w.cache.observeStored(w.ctx, len(data))
+}
+
+// drop deletes the previous writes of a response that can't be cached whole,
+// and stops caching its next ones
+func (w *cachedWriter) drop() {
+	w.failed = true
+	if err := w.store.Delete(w.key); err != nil && err != persistence.ErrCacheMiss {
+		w.cache.reportError(w.ctx, "cache: failed to drop the partial response", w.key, err)
+	}
+}
+
 // Cache Middleware
 func (ch *cache) Cache() gin.HandlerFunc {
 	return func(c *gin.Context) {
@@ -186,52 +236,43 @@ func (ch *cache) Cache() gin.HandlerFunc {
 
 func (ch *cache) SiteCache(expire time.Duration) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		var repCache responseCache
 		u := ch.parseUrl(c.Request.URL)
 		key := CreateKey(u.RequestURI())
-		if err := ch.store.Get(key, &repCache); err != nil {
+		ctx, span := ch.startSpan(c, key)
+		defer span.End()
+
+		if ch.bypass(c, span, key) {
 			c.Next()
-		} else {
-			c.Writer.WriteHeader(repCache.Status)
-			for k, vals := range repCache.Header {
-				for _, v := range vals {
-					c.Writer.Header().Set(k, v)
-				}
-			}
-			c.Writer.Write(repCache.Data)
-			c.Abort()
+			return
 		}
+		repCache, status := ch.lookup(c, ch.bind(ctx), key)
+		span.SetAttribute("cache.hit", status == StatusHit)
+		if status != StatusHit {
+			ch.setDebugHeaders(c, status, key, nil)
+			c.Next()
+			return
+		}
+		setResponseAttributes(span, repCache.Status, len(repCache.Data))
+		ch.writeResponse(c, key, repCache, StatusHit, true)
 	}
 }
 
 // CachePage Decorator
 func (ch *cache) CachePage(expire time.Duration) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		var repCache responseCache
 		u := ch.parseUrl(c.Request.URL)
-		key := CreateKey(u.RequestURI())
-		if err := ch.store.Get(key, &repCache); err != nil {
-			if err != persistence.ErrCacheMiss {
-				log.Println(err.Error())
-			}
-			// replace writer
-			writer := newCachedWriter(ch.store, expire, c.Writer, key)
-			c.Writer = writer
-			c.Next()
-			// Drop caches of aborted contexts
-			if c.IsAborted() {
-				ch.store.Delete(key)
-			}
-		} else {
-			c.Writer.WriteHeader(repCache.Status)
-			for k, vals := range repCache.Header {
-				for _, v := range vals {
-					c.Writer.Header().Set(k, v)
-				}
-			}
-			c.Writer.Write(repCache.Data)
-			c.Abort()
-		}
+		ch.servePage(c, CreateKey(u.RequestURI()), expire, true, false)
+	}
+}
+
+// CachePageSliding Decorator, the expiration of a page is pushed back by
+// expire when it is served while less than half of expire is left, so the
+// pages that keep being requested stay cached. The store must implement
+// persistence.ExpiryStore, pages are cached like CachePage otherwise.
+func (ch *cache) CachePageSliding(expire time.Duration) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		u := ch.parseUrl(c.Request.URL)
+		ch.servePage(c, CreateKey(u.RequestURI()), expire, true, true)
 	}
 }
 
@@ -249,52 +290,164 @@ func (ch *cache) CachePageAtomic(expire time.Duration) gin.HandlerFunc {
 // CachePageWithoutQuery add ability to ignore GET query parameters.
 func (ch *cache) CachePageWithoutQuery(expire time.Duration) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		var repCache responseCache
-
-		key := CreateKey(c.Request.URL.Path)
-		if err := ch.store.Get(key, &repCache); err != nil {
-			if err != persistence.ErrCacheMiss {
-				log.Println(err.Error())
-			}
-			// replace writer
-			writer := newCachedWriter(ch.store, expire, c.Writer, key)
-			c.Writer = writer
-			c.Next()
-		} else {
-			c.Writer.WriteHeader(repCache.Status)
-			for k, vals := range repCache.Header {
-				for _, v := range vals {
-					c.Writer.Header().Set(k, v)
-				}
-			}
-			c.Writer.Write(repCache.Data)
-			c.Abort()
-		}
+		ch.servePage(c, CreateKey(c.Request.URL.Path), expire, true, false)
 	}
 }
 
 func (ch *cache) CachePageWithoutHeader(expire time.Duration) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		var repCache responseCache
 		u := ch.parseUrl(c.Request.URL)
-		key := CreateKey(u.RequestURI())
-		if err := ch.store.Get(key, &repCache); err != nil {
-			if err != persistence.ErrCacheMiss {
-				log.Println(err.Error())
-			}
-			// replace writer
-			writer := newCachedWriter(ch.store, expire, c.Writer, key)
-			c.Writer = writer
-			c.Next()
+		ch.servePage(c, CreateKey(u.RequestURI()), expire, false, false)
+	}
+}
+
+// servePage writes the page cached under key, or runs the remaining handlers
+// and caches their response when there is none, Warm is refreshing it or it
+// expires early. With locking, only the request holding the lock of the page
+// renders it. sliding extends the expiration of the pages served.
+func (ch *cache) servePage(c *gin.Context, key string, expire time.Duration, withHeader bool, sliding bool) {
+	ctx, span := ch.startSpan(c, key)
+	defer span.End()
+
+	if ch.bypass(c, span, key) {
+		c.Next()
+		return
+	}
+	store := ch.bind(ctx)
+	var repCache *ResponseCache
+	status := StatusMiss
+	if !refreshing(ctx) {
+		repCache, status = ch.lookup(c, store, key)
+	}
+	var stale *ResponseCache
+	if status == StatusHit && ch.expireEarly(c, store, key, repCache) {
+		stale, repCache, status = repCache, nil, StatusMiss
+	}
+	if status == StatusMiss && ch.lock != nil {
+		var lock *persistence.Lock
+		lock, repCache, status = ch.lockPage(c, store, key, stale)
+		if lock != nil {
+			defer ch.unlockPage(c, lock, key)
+		}
+	}
+	span.SetAttribute("cache.hit", status == StatusHit || status == StatusStale)
+	if status == StatusHit || status == StatusStale {
+		setResponseAttributes(span, repCache.Status, len(repCache.Data))
+		if sliding && status == StatusHit {
+			ch.slide(c, store, key, expire)
+		}
+		ch.writeResponse(c, key, repCache, status, withHeader)
+		return
+	}
+	debug := ch.setDebugHeaders(c, status, key, nil)
+	if ctx != c.Request.Context() {
+		// let the handlers parent their spans
+		c.Request = c.Request.WithContext(ctx)
+	}
+	// replace writer
+	writer := newCachedWriter(store, ch.expiration(expire), c.Writer, key)
+	writer.cache, writer.ctx, writer.debug = ch, c, debug
+	c.Writer = writer
+	c.Next()
+	setResponseAttributes(span, c.Writer.Status(), c.Writer.Size())
+
+	// Drop caches of aborted contexts
+	if c.IsAborted() {
+		if err := store.Delete(key); err != nil && err != persistence.ErrCacheMiss {
+			ch.reportError(c, "cache: failed to drop the page of an aborted request", key, err)
+		}
+		ch.onEvict(c, key)
+	}
+}
+
+// lookup fetches the page cached under key and returns its cache status. Hits
+// rejected by a hook are handled as a miss, and store errors as a bypass.
+func (ch *cache) lookup(c *gin.Context, store persistence.CacheStore, key string) (*ResponseCache, string) {
+	var repCache ResponseCache
+	status := StatusMiss
+	if err := store.Get(key, &repCache); err != nil {
+		if err != persistence.ErrCacheMiss {
+			ch.reportError(c, "cache: failed to get the page", key, err)
+			status = StatusBypass
+		}
+	} else if ch.onHit(c, key, &repCache) == nil {
+		ch.observeHit(c)
+		return &repCache, StatusHit
+	}
+	ch.observeMiss(c)
+	ch.onMiss(c, key)
+	return nil, status
+}
+
+// slide pushes the expiration of the page cached under key back by expire
+// once less than half of it is left, or every time when the store can't
+// report the TTL of its keys
+func (ch *cache) slide(c *gin.Context, store persistence.CacheStore, key string, expire time.Duration) {
+	if expire == persistence.FOREVER {
+		return
+	}
+	ttl, err := persistence.TTL(store, key)
+	switch err {
+	case nil:
+		if ttl == persistence.FOREVER || (expire > 0 && ttl > expire/2) {
+			return
+		}
+	case persistence.ErrNotSupport:
+	case persistence.ErrCacheMiss:
+		return
+	default:
+		ch.reportError(c, "cache: failed to get the TTL of the page", key, err)
+		return
+	}
+	err = persistence.Touch(store, key, expire)
+	if err != nil && err != persistence.ErrCacheMiss && err != persistence.ErrNotSupport {
+		ch.reportError(c, "cache: failed to extend the page", key, err)
+	}
+}
+
+// bypass tells whether the cache must be skipped because the circuit of the
+// store is open
+func (ch *cache) bypass(c *gin.Context, span persistence.Span, key string) bool {
+	breaker, ok := ch.store.(persistence.CircuitBreaker)
+	if !ok || !breaker.CircuitOpen() {
+		return false
+	}
+	span.SetAttribute("cache.bypass", true)
+	ch.setDebugHeaders(c, StatusBypass, key, nil)
+	return true
+}
+
+// startSpan starts the span of a page cache middleware
+func (ch *cache) startSpan(c *gin.Context, key string) (context.Context, persistence.Span) {
+	ctx, span := ch.tracer.Start(c.Request.Context(), "cache.page")
+	span.SetAttribute("cache.key_hash", persistence.HashKey(key))
+	return ctx, span
+}
+
+func setResponseAttributes(span persistence.Span, status int, size int) {
+	span.SetAttribute("http.status_code", status)
+	span.SetAttribute("cache.payload_size", size)
+}
+
+// bind returns the store to use for a request carrying ctx
+func (ch *cache) bind(ctx context.Context) persistence.CacheStore {
+	if binder, ok := ch.store.(persistence.ContextBinder); ok {
+		return binder.WithContext(ctx)
+	}
+	return ch.store
+}
 
-			// Drop caches of aborted contexts
-			if c.IsAborted() {
-				ch.store.Delete(key)
+// writeResponse writes a cached page, status is StatusHit or StatusStale
+func (ch *cache) writeResponse(c *gin.Context, key string, repCache *ResponseCache, status string, withHeader bool) {
+	c.Writer.WriteHeader(repCache.Status)
+	if withHeader {
+		for k, vals := range repCache.Header {
+			for _, v := range vals {
+				c.Writer.Header().Set(k, v)
 			}
-		} else {
-			c.Writer.WriteHeader(repCache.Status)
-			c.Writer.Write(repCache.Data)
-			c.Abort()
 		}
 	}
+	ch.setDebugHeaders(c, status, key, repCache)
+	c.Writer.Write(repCache.Data)
+	c.Abort()
 }
@@ -2,10 +2,13 @@ package cache
 
 import (
 	"bytes"
+	"context"
 	"encoding/gob"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"sync"
 	"testing"
 	"time"
 
@@ -277,13 +280,13 @@ func TestCachePageWithoutQuery(t *testing.T) {
 
 func TestRegisterResponseCacheGob(t *testing.T) {
 	RegisterResponseCacheGob()
-	r := responseCache{Status: 200, Data: []byte("test")}
+	r := ResponseCache{Status: 200, Data: []byte("test")}
 	mCache := new(bytes.Buffer)
 	encCache := gob.NewEncoder(mCache)
 	err := encCache.Encode(r)
 	assert.Nil(t, err)
 
-	var decodedResp responseCache
+	var decodedResp ResponseCache
 	pCache := bytes.NewBuffer(mCache.Bytes())
 	decCache := gob.NewDecoder(pCache)
 	err = decCache.Decode(&decodedResp)
@@ -311,6 +314,475 @@ func TestCacheWithExcludeQueryArgs(t *testing.T) {
 	assert.Equal(t, w1.Body.String(), w2.Body.String())
 }
 
+type testSpan struct {
+	name   string
+	parent *testSpan
+	attrs  map[string]interface{}
+	ended  bool
+}
+
+func (s *testSpan) SetAttribute(key string, value interface{}) { s.attrs[key] = value }
+func (s *testSpan) SetError(err error)                         { s.attrs["error"] = err }
+func (s *testSpan) End()                                       { s.ended = true }
+
+type spanKey struct{}
+
+type testTracer struct {
+	mu    sync.Mutex
+	spans []*testSpan
+}
+
+func (t *testTracer) Start(ctx context.Context, name string) (context.Context, persistence.Span) {
+	parent, _ := ctx.Value(spanKey{}).(*testSpan)
+	span := &testSpan{name: name, parent: parent, attrs: map[string]interface{}{}}
+	t.mu.Lock()
+	t.spans = append(t.spans, span)
+	t.mu.Unlock()
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+func TestCachePageTracing(t *testing.T) {
+	tracer := &testTracer{}
+	ch := NewCache(persistence.NewTracedStore(persistence.NewInMemoryStore(time.Minute), "memory", tracer))
+	ch.SetTracer(tracer)
+
+	router := gin.New()
+	router.GET("/traced", ch.CachePage(time.Minute), func(c *gin.Context) {
+		_, span := tracer.Start(c.Request.Context(), "handler")
+		span.End()
+		c.String(200, "pong")
+	})
+
+	performRequest("GET", "/traced", router)
+	var names []string
+	for _, span := range tracer.spans {
+		names = append(names, span.name)
+		assert.True(t, span.ended)
+	}
+	assert.Equal(t, []string{"cache.page", "cache.get", "handler", "cache.set"}, names)
+	page := tracer.spans[0]
+	assert.Nil(t, page.parent)
+	for _, span := range tracer.spans[1:] {
+		assert.Equal(t, page, span.parent)
+	}
+	key := persistence.HashKey(CreateKey("/traced"))
+	assert.Equal(t, key, page.attrs["cache.key_hash"])
+	assert.Equal(t, false, page.attrs["cache.hit"])
+	assert.Equal(t, 200, page.attrs["http.status_code"])
+	assert.Equal(t, 4, page.attrs["cache.payload_size"])
+	assert.Equal(t, key, tracer.spans[1].attrs["cache.key_hash"])
+	assert.Equal(t, "memory", tracer.spans[1].attrs["cache.store"])
+
+	tracer.spans = nil
+	w := performRequest("GET", "/traced", router)
+	assert.Equal(t, "pong", w.Body.String())
+	assert.Len(t, tracer.spans, 2)
+	assert.Equal(t, true, tracer.spans[0].attrs["cache.hit"])
+	assert.Equal(t, true, tracer.spans[1].attrs["cache.hit"])
+}
+
+type recordLogger struct {
+	entries []string
+}
+
+func (l *recordLogger) Log(level persistence.Level, msg string, fields ...persistence.Field) {
+	l.entries = append(l.entries, fmt.Sprint(level, " ", msg, " ", fields))
+}
+
+type failingStore struct {
+	*persistence.InMemoryStore
+	err error
+}
+
+func (s *failingStore) Get(key string, value interface{}) error {
+	return s.err
+}
+
+func (s *failingStore) Set(key string, value interface{}, expires time.Duration) error {
+	return s.err
+}
+
+func TestCachePageLogsStoreErrors(t *testing.T) {
+	logger := &recordLogger{}
+	ch := NewCache(&failingStore{persistence.NewInMemoryStore(time.Minute), errors.New("down")})
+	ch.SetLogger(logger)
+
+	router := gin.New()
+	router.GET("/failing", ch.CachePage(time.Minute), func(c *gin.Context) {
+		c.Writer.Write([]byte("pong"))
+	})
+
+	w := performRequest("GET", "/failing", router)
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "pong", w.Body.String())
+
+	key := CreateKey("/failing")
+	assert.Equal(t, []string{
+		"ERROR cache: failed to get the page [{key " + key + "} {route /failing} {store failingStore} {error down}]",
+		"ERROR cache: failed to store the response [{key " + key + "} {route /failing} {store failingStore} {error down}]",
+	}, logger.entries)
+}
+
+func TestCachePageHooks(t *testing.T) {
+	ch := NewMemoryCache(60 * time.Second)
+	var events []string
+	ch.AddHooks(Hooks{
+		OnHit: func(c *gin.Context, key string, page *ResponseCache) error {
+			events = append(events, "hit "+key)
+			page.Header.Set("X-Cache", "HIT")
+			return nil
+		},
+		OnMiss: func(c *gin.Context, key string) {
+			events = append(events, "miss "+key)
+		},
+		OnStore: func(c *gin.Context, key string, page *ResponseCache) error {
+			events = append(events, "store "+key)
+			if c.Query("nostore") != "" {
+				return errors.New("rejected")
+			}
+			return nil
+		},
+		OnEvict: func(c *gin.Context, key string) {
+			events = append(events, "evict "+key)
+		},
+	})
+
+	router := gin.New()
+	router.GET("/hooks", ch.CachePage(time.Minute), func(c *gin.Context) {
+		c.String(200, "pong "+fmt.Sprint(time.Now().UnixNano()))
+	})
+	router.GET("/aborted", ch.CachePage(time.Minute), func(c *gin.Context) {
+		c.AbortWithStatus(200)
+	})
+
+	w1 := performRequest("GET", "/hooks", router)
+	w2 := performRequest("GET", "/hooks", router)
+	assert.Equal(t, "", w1.Header().Get("X-Cache"))
+	assert.Equal(t, "HIT", w2.Header().Get("X-Cache"))
+	assert.Equal(t, w1.Body.String(), w2.Body.String())
+
+	w3 := performRequest("GET", "/hooks?nostore=1", router)
+	w4 := performRequest("GET", "/hooks?nostore=1", router)
+	assert.NotEqual(t, w3.Body.String(), w4.Body.String())
+
+	performRequest("GET", "/aborted", router)
+
+	key, nostore := CreateKey("/hooks"), CreateKey("/hooks?nostore=1")
+	assert.Equal(t, []string{
+		"miss " + key, "store " + key,
+		"hit " + key,
+		"miss " + nostore, "store " + nostore,
+		"miss " + nostore, "store " + nostore,
+		"miss " + CreateKey("/aborted"), "evict " + CreateKey("/aborted"),
+	}, events)
+}
+
+type undeletableStore struct {
+	*persistence.InMemoryStore
+}
+
+func (s undeletableStore) Delete(key string) error {
+	return errors.New("down")
+}
+
+func TestCachePageRejectedWrite(t *testing.T) {
+	logger := &recordLogger{}
+	store := persistence.NewInMemoryStore(time.Minute)
+	ch := NewCache(store)
+	ch.SetLogger(logger)
+	ch.AddHooks(Hooks{
+		OnStore: func(c *gin.Context, key string, page *ResponseCache) error {
+			if string(page.Data) == "first" {
+				return errors.New("rejected")
+			}
+			return nil
+		},
+	})
+
+	router := gin.New()
+	router.GET("/chunks", ch.CachePage(time.Minute), func(c *gin.Context) {
+		c.Writer.Write([]byte("first"))
+		c.Writer.Write([]byte("second"))
+	})
+
+	w := performRequest("GET", "/chunks", router)
+	assert.Equal(t, "firstsecond", w.Body.String())
+	var page ResponseCache
+	assert.Equal(t, persistence.ErrCacheMiss, store.Get(CreateKey("/chunks"), &page), "the next writes are not cached alone")
+	assert.Empty(t, logger.entries)
+
+	ch.store = undeletableStore{store}
+	performRequest("GET", "/chunks", router)
+	key := CreateKey("/chunks")
+	assert.Equal(t, []string{
+		"ERROR cache: failed to drop the partial response [{key " + key + "} {route /chunks} {store InMemoryStore} {error down}]",
+	}, logger.entries)
+}
+
+func TestCachePageRejectHit(t *testing.T) {
+	ch := NewMemoryCache(60 * time.Second)
+	var errs []error
+	ch.AddHooks(Hooks{
+		OnHit: func(c *gin.Context, key string, page *ResponseCache) error {
+			return errors.New("stale")
+		},
+		OnError: func(c *gin.Context, key string, err error) {
+			errs = append(errs, err)
+		},
+	})
+
+	router := gin.New()
+	router.GET("/reject", ch.CachePage(time.Minute), func(c *gin.Context) {
+		c.String(200, "pong "+fmt.Sprint(time.Now().UnixNano()))
+	})
+
+	w1 := performRequest("GET", "/reject", router)
+	w2 := performRequest("GET", "/reject", router)
+	assert.NotEqual(t, w1.Body.String(), w2.Body.String())
+	assert.Empty(t, errs)
+}
+
+func TestCachePageRejectHitThenHit(t *testing.T) {
+	ch := NewMemoryCache(60 * time.Second)
+	veto := false
+	ch.AddHooks(Hooks{
+		OnHit: func(c *gin.Context, key string, page *ResponseCache) error {
+			if veto {
+				return errors.New("stale")
+			}
+			return nil
+		},
+	})
+	router := gin.New()
+	router.GET("/reject", ch.CachePage(time.Minute), func(c *gin.Context) {
+		c.Writer.Write([]byte("body"))
+	})
+
+	assert.Equal(t, "body", performRequest("GET", "/reject", router).Body.String())
+	veto = true
+	assert.Equal(t, "body", performRequest("GET", "/reject", router).Body.String())
+	veto = false
+	assert.Equal(t, "body", performRequest("GET", "/reject", router).Body.String(), "the page rendered again replaces the rejected one")
+}
+
+func TestCachePageErrorHook(t *testing.T) {
+	ch := NewCache(&failingStore{persistence.NewInMemoryStore(time.Minute), errors.New("down")})
+	var errs []string
+	ch.AddHooks(Hooks{
+		OnError: func(c *gin.Context, key string, err error) {
+			errs = append(errs, err.Error())
+		},
+	})
+
+	router := gin.New()
+	router.GET("/failing", ch.CachePage(time.Minute), func(c *gin.Context) {
+		c.String(200, "pong")
+	})
+
+	w := performRequest("GET", "/failing", router)
+	assert.Equal(t, "pong", w.Body.String())
+	assert.Equal(t, []string{"down", "down"}, errs)
+}
+
+func TestCachePageDebugHeaders(t *testing.T) {
+	store := persistence.NewInMemoryStore(60 * time.Second)
+	ch := NewCache(store)
+	ch.EnableDebugHeaders()
+
+	router := gin.New()
+	router.GET("/debug", ch.CachePage(time.Minute), func(c *gin.Context) {
+		c.String(200, "pong "+fmt.Sprint(time.Now().UnixNano()))
+	})
+
+	key := CreateKey("/debug")
+	w1 := performRequest("GET", "/debug", router)
+	assert.Equal(t, StatusMiss, w1.Header().Get(HeaderCacheStatus))
+	assert.Equal(t, persistence.HashKey(key), w1.Header().Get(HeaderCacheKey))
+	assert.Equal(t, "", w1.Header().Get(HeaderAge))
+
+	var page ResponseCache
+	assert.Nil(t, store.Get(key, &page))
+	assert.Empty(t, page.Header.Get(HeaderCacheStatus))
+	assert.Empty(t, page.Header.Get(HeaderCacheKey))
+
+	page.Created = time.Now().Add(-10 * time.Second)
+	store.Set(key, page, time.Minute)
+	w2 := performRequest("GET", "/debug", router)
+	assert.Equal(t, w1.Body.String(), w2.Body.String())
+	assert.Equal(t, StatusHit, w2.Header().Get(HeaderCacheStatus))
+	assert.Equal(t, persistence.HashKey(key), w2.Header().Get(HeaderCacheKey))
+	assert.Equal(t, "10", w2.Header().Get(HeaderAge))
+	assert.Equal(t, "", w2.Header().Get(HeaderExpires))
+}
+
+func TestCachePageDebugHeadersExpires(t *testing.T) {
+	store := persistence.NewInMemoryStore(time.Minute)
+	ch := NewCache(store)
+	ch.EnableDebugHeaders(HeaderExpires)
+
+	router := gin.New()
+	router.GET("/expires", ch.CachePage(time.Hour), func(c *gin.Context) {
+		c.String(200, "pong")
+	})
+	router.GET("/forever", ch.CachePage(persistence.FOREVER), func(c *gin.Context) {
+		c.String(200, "pong")
+	})
+
+	w1 := performRequest("GET", "/expires", router)
+	assert.Equal(t, "", w1.Header().Get(HeaderExpires))
+	w2 := performRequest("GET", "/expires", router)
+	expires, err := http.ParseTime(w2.Header().Get(HeaderExpires))
+	assert.Nil(t, err)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), expires, 2*time.Second)
+
+	performRequest("GET", "/forever", router)
+	w3 := performRequest("GET", "/forever", router)
+	assert.Equal(t, "pong", w3.Body.String())
+	assert.Equal(t, "", w3.Header().Get(HeaderExpires))
+}
+
+func TestCachePageDebugHeadersHandlerExpires(t *testing.T) {
+	store := persistence.NewInMemoryStore(time.Minute)
+	ch := NewCache(store)
+	ch.EnableDebugHeaders(HeaderCacheStatus, HeaderAge, HeaderExpires)
+
+	expires := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC).Format(http.TimeFormat)
+	router := gin.New()
+	router.GET("/expires", ch.CachePage(time.Hour), func(c *gin.Context) {
+		c.Header(HeaderExpires, expires)
+		c.Header(HeaderAge, "5")
+		c.String(200, "pong")
+	})
+
+	w1 := performRequest("GET", "/expires", router)
+	assert.Equal(t, expires, w1.Header().Get(HeaderExpires))
+
+	var page ResponseCache
+	assert.Nil(t, store.Get(CreateKey("/expires"), &page))
+	assert.Equal(t, expires, page.Header.Get(HeaderExpires))
+	assert.Equal(t, "5", page.Header.Get(HeaderAge))
+	assert.Empty(t, page.Header.Get(HeaderCacheStatus))
+
+	w2 := performRequest("GET", "/expires", router)
+	assert.Equal(t, StatusHit, w2.Header().Get(HeaderCacheStatus))
+	assert.Equal(t, expires, w2.Header().Get(HeaderExpires))
+	assert.Equal(t, "5", w2.Header().Get(HeaderAge))
+}
+
+func TestCachePageSliding(t *testing.T) {
+	store := persistence.NewInMemoryStore(time.Minute)
+	ch := NewCache(store)
+
+	router := gin.New()
+	router.GET("/sliding", ch.CachePageSliding(time.Hour), func(c *gin.Context) {
+		c.String(200, "pong "+fmt.Sprint(time.Now().UnixNano()))
+	})
+
+	key := CreateKey("/sliding")
+	w1 := performRequest("GET", "/sliding", router)
+
+	// more than half of the expiration is left, the page is left alone
+	assert.Nil(t, persistence.Touch(store, key, 40*time.Minute))
+	w2 := performRequest("GET", "/sliding", router)
+	assert.Equal(t, w1.Body.String(), w2.Body.String())
+	ttl, err := store.TTL(key)
+	assert.Nil(t, err)
+	assert.True(t, ttl <= 40*time.Minute, "ttl %s", ttl)
+
+	// a hit with less than half of it left extends the page
+	assert.Nil(t, persistence.Touch(store, key, 10*time.Minute))
+	w3 := performRequest("GET", "/sliding", router)
+	assert.Equal(t, w1.Body.String(), w3.Body.String())
+	ttl, err = store.TTL(key)
+	assert.Nil(t, err)
+	assert.True(t, ttl > 59*time.Minute, "ttl %s", ttl)
+}
+
+func TestCachePageDebugHeadersAllowlist(t *testing.T) {
+	ch := NewCache(&failingStore{persistence.NewInMemoryStore(time.Minute), errors.New("down")})
+	ch.EnableDebugHeaders("x-cache")
+
+	router := gin.New()
+	router.GET("/debug", ch.CachePage(time.Minute), func(c *gin.Context) {
+		c.String(200, "pong")
+	})
+
+	w := performRequest("GET", "/debug", router)
+	assert.Equal(t, StatusBypass, w.Header().Get(HeaderCacheStatus))
+	assert.Equal(t, "", w.Header().Get(HeaderCacheKey))
+	assert.Equal(t, "", w.Header().Get(HeaderAge))
+}
+
+func TestCachePageWithoutDebugHeaders(t *testing.T) {
+	ch := NewMemoryCache(60 * time.Second)
+
+	router := gin.New()
+	router.GET("/debug", ch.CachePage(time.Minute), func(c *gin.Context) {
+		c.String(200, "pong")
+	})
+
+	performRequest("GET", "/debug", router)
+	w := performRequest("GET", "/debug", router)
+	assert.Equal(t, "", w.Header().Get(HeaderCacheStatus))
+}
+
+func TestCachePageCircuitOpen(t *testing.T) {
+	failing := &failingStore{persistence.NewInMemoryStore(time.Minute), errors.New("down")}
+	store := persistence.NewBreakerStore(failing, &persistence.BreakerOptions{ConsecutiveFailures: 2, OpenTimeout: time.Hour})
+	logger := &recordLogger{}
+	ch := NewCache(store)
+	ch.SetLogger(logger)
+	ch.EnableDebugHeaders(HeaderCacheStatus)
+
+	router := gin.New()
+	router.GET("/failing", ch.CachePage(time.Minute), func(c *gin.Context) {
+		c.String(200, "pong")
+	})
+
+	// the failed Get and Set of the first request open the circuit
+	w := performRequest("GET", "/failing", router)
+	assert.Equal(t, StatusBypass, w.Header().Get(HeaderCacheStatus))
+	assert.Equal(t, persistence.BreakerOpen, store.State())
+	assert.Len(t, logger.entries, 2)
+
+	w = performRequest("GET", "/failing", router)
+	assert.Equal(t, "pong", w.Body.String())
+	assert.Equal(t, StatusBypass, w.Header().Get(HeaderCacheStatus))
+	assert.Len(t, logger.entries, 2)
+}
+
+func TestCachePageChaos(t *testing.T) {
+	store := persistence.NewChaosStore(persistence.NewInMemoryStore(time.Minute), 1,
+		persistence.Fault{Kind: persistence.FaultCorrupt, Keys: CreateKey("/corrupt")},
+		persistence.Fault{Kind: persistence.FaultLostReply, Keys: CreateKey("/lost")},
+	)
+	logger := &recordLogger{}
+	ch := NewCache(store)
+	ch.SetLogger(logger)
+	ch.EnableDebugHeaders(HeaderCacheStatus)
+
+	router := gin.New()
+	handler := func(c *gin.Context) {
+		c.String(200, "pong "+fmt.Sprint(time.Now().UnixNano()))
+	}
+	router.GET("/corrupt", ch.CachePage(time.Minute), handler)
+	router.GET("/lost", ch.CachePage(time.Minute), handler)
+
+	// a corrupted page is never served
+	w1 := performRequest("GET", "/corrupt", router)
+	w2 := performRequest("GET", "/corrupt", router)
+	assert.Equal(t, StatusMiss, w1.Header().Get(HeaderCacheStatus))
+	assert.Equal(t, StatusBypass, w2.Header().Get(HeaderCacheStatus))
+	assert.NotEqual(t, w1.Body.String(), w2.Body.String())
+
+	// a page whose write was reported as failed may still be served
+	w1 = performRequest("GET", "/lost", router)
+	w2 = performRequest("GET", "/lost", router)
+	assert.Equal(t, StatusHit, w2.Header().Get(HeaderCacheStatus))
+	assert.Equal(t, w1.Body.String(), w2.Body.String())
+	assert.Contains(t, logger.entries[len(logger.entries)-1], "ERROR cache: failed to store the response")
+}
+
 func performRequest(method, target string, router *gin.Engine) *httptest.ResponseRecorder {
 	r := httptest.NewRequest(method, target, nil)
 	w := httptest.NewRecorder()
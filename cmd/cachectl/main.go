@@ -0,0 +1,315 @@
+// Command cachectl inspects and purges the pages cached by the cache
+// middleware, in a memory snapshot file, redis or memcached:
+//
+//	cachectl -redis localhost:6379 page /news?page=2
+//	cachectl -memcached 10.0.0.1:11211,10.0.0.2:11211 delete /news
+//	cachectl -memory cache.gob purge /blog/
+//
+// Run cachectl -h for the flags and commands.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-contrib/cache"
+	"github.com/gin-contrib/cache/persistence"
+)
+
+const usage = `usage: cachectl [flags] command [args]
+
+commands:
+  key URL        prints the key CachePage stores the page of URL under
+  page URL       shows the cached page of URL
+  get KEY        shows the cached page stored under KEY
+  delete URL     deletes the cached page of URL
+  purge PREFIX   deletes the cached pages whose URL starts with PREFIX
+  keys [PREFIX]  lists the keys starting with PREFIX
+  stats          counts the keys and pages of the store
+
+flags:
+`
+
+var errUsage = errors.New("cachectl: invalid usage")
+
+type options struct {
+	memory    string
+	redis     string
+	password  string
+	db        int
+	memcached string
+	namespace string
+	preview   int
+	timeout   time.Duration
+}
+
+func main() {
+	if err := run(os.Args[1:], os.Stdout, os.Stderr); err != nil {
+		if err != errUsage {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		os.Exit(1)
+	}
+}
+
+func run(args []string, stdout, stderr io.Writer) error {
+	var o options
+	flags := flag.NewFlagSet("cachectl", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.StringVar(&o.memory, "memory", "", "memory snapshot `file`, written by InMemoryStore.SaveFile and updated by delete and purge")
+	flags.StringVar(&o.redis, "redis", "", "redis `address`")
+	flags.StringVar(&o.password, "password", "", "redis password")
+	flags.IntVar(&o.db, "db", 0, "redis database")
+	flags.StringVar(&o.memcached, "memcached", "", "comma separated memcached `addresses`")
+	flags.StringVar(&o.namespace, "namespace", "", "namespace of the keys, as given to NewPrefixedStore")
+	flags.IntVar(&o.preview, "preview", 512, "bytes of the body shown by page and get")
+	flags.DurationVar(&o.timeout, "timeout", 5*time.Second, "timeout to connect to the store")
+	flags.Usage = func() {
+		fmt.Fprint(stderr, usage)
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return errUsage
+	}
+	args = flags.Args()
+	if len(args) == 0 {
+		flags.Usage()
+		return errUsage
+	}
+
+	if args[0] == "key" {
+		if len(args) != 2 {
+			flags.Usage()
+			return errUsage
+		}
+		key, err := pageKey(args[1])
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(stdout, key)
+		return nil
+	}
+
+	store, save, err := o.open()
+	if err != nil {
+		return err
+	}
+	switch {
+	case args[0] == "page" && len(args) == 2:
+		key, err := pageKey(args[1])
+		if err != nil {
+			return err
+		}
+		return showPage(stdout, store, key, o.preview)
+	case args[0] == "get" && len(args) == 2:
+		return showPage(stdout, store, args[1], o.preview)
+	case args[0] == "delete" && len(args) == 2:
+		key, err := pageKey(args[1])
+		if err != nil {
+			return err
+		}
+		if err := store.Delete(key); err != nil {
+			return err
+		}
+		fmt.Fprintln(stdout, "deleted", key)
+		return save()
+	case args[0] == "purge" && len(args) == 2:
+		purged, err := cache.PurgePrefix(store, args[1])
+		if err != nil {
+			return err
+		}
+		if purged < 0 {
+			fmt.Fprintln(stdout, "purged")
+		} else {
+			fmt.Fprintln(stdout, "purged", purged, "pages")
+		}
+		return save()
+	case args[0] == "keys" && len(args) <= 2:
+		prefix := ""
+		if len(args) == 2 {
+			prefix = args[1]
+		}
+		return scan(store, prefix, func(info persistence.KeyInfo) {
+			fmt.Fprintf(stdout, "%s\t%s\t%s\n", info.Key, size(info.Size), ttl(info.TTL))
+		})
+	case args[0] == "stats" && len(args) == 1:
+		return stats(stdout, store)
+	}
+	flags.Usage()
+	return errUsage
+}
+
+// open connects to the store given by the flags, save writes the memory
+// snapshot back once it is changed
+func (o *options) open() (store persistence.CacheStore, save func() error, err error) {
+	save = func() error { return nil }
+	given := 0
+	for _, s := range []string{o.memory, o.redis, o.memcached} {
+		if s != "" {
+			given++
+		}
+	}
+	if given != 1 {
+		return nil, nil, errors.New("cachectl: exactly one of -memory, -redis and -memcached is required")
+	}
+	if strings.Contains(o.namespace, ":") {
+		return nil, nil, errors.New("cachectl: -namespace can not contain ':'")
+	}
+	switch {
+	case o.memory != "":
+		cache.RegisterResponseCacheGob()
+		memory := persistence.NewInMemoryStore(persistence.FOREVER)
+		if err := memory.LoadFile(o.memory); err != nil {
+			return nil, nil, err
+		}
+		store = memory
+		save = func() error { return memory.SaveFile(o.memory) }
+	case o.redis != "":
+		store = persistence.NewRedisCacheWithOptions(o.redis, &persistence.RedisOptions{
+			Password:    o.password,
+			DB:          o.db,
+			DialTimeout: o.timeout,
+		}, persistence.DEFAULT)
+	default:
+		store = persistence.NewMemcachedStore(strings.Split(o.memcached, ","), persistence.DEFAULT)
+	}
+	if o.namespace != "" {
+		store = persistence.NewPrefixedStore(store, o.namespace)
+	}
+	return store, save, nil
+}
+
+// pageKey returns the key of the page of a URL, the path and query of an
+// absolute one are used
+func pageKey(raw string) (string, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", err
+	}
+	return cache.CreateKey(u.RequestURI()), nil
+}
+
+func showPage(w io.Writer, store persistence.CacheStore, key string, preview int) error {
+	page, err := getPage(store, key)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(w, "key:", key)
+	fmt.Fprintln(w, "status:", page.Status)
+	if !page.Created.IsZero() {
+		fmt.Fprintf(w, "created: %s (%s ago)\n", page.Created.Format(time.RFC3339), time.Since(page.Created).Round(time.Second))
+	}
+	if d, err := persistence.TTL(store, key); err == nil {
+		fmt.Fprintln(w, "ttl:", ttl(d))
+	}
+	if page.Cost > 0 {
+		fmt.Fprintln(w, "cost:", page.Cost)
+	}
+	fmt.Fprintln(w, "size:", len(page.Data))
+	names := make([]string, 0, len(page.Header))
+	for name := range page.Header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, v := range page.Header[name] {
+			fmt.Fprintf(w, "%s: %s\n", name, v)
+		}
+	}
+	fmt.Fprintln(w)
+	body := page.Data
+	if preview >= 0 && len(body) > preview {
+		body = body[:preview]
+	}
+	if !utf8.Valid(body) {
+		fmt.Fprintf(w, "(%d bytes of binary data)\n", len(page.Data))
+		return nil
+	}
+	fmt.Fprintf(w, "%s\n", body)
+	if len(body) < len(page.Data) {
+		fmt.Fprintf(w, "(%d more bytes)\n", len(page.Data)-len(body))
+	}
+	return nil
+}
+
+// getPage reads the page stored under key. The in-memory store panics when
+// the value is not a ResponseCache.
+func getPage(store persistence.CacheStore, key string) (page cache.ResponseCache, err error) {
+	defer func() {
+		if recover() != nil {
+			err = fmt.Errorf("cachectl: %s is not a cached page", key)
+		}
+	}()
+	err = store.Get(key, &page)
+	return page, err
+}
+
+// scan calls fn with every key of store starting with prefix
+func scan(store persistence.CacheStore, prefix string, fn func(persistence.KeyInfo)) error {
+	cursor := ""
+	for {
+		infos, next, err := persistence.Scan(store, prefix, cursor, 0)
+		if err != nil {
+			return err
+		}
+		for _, info := range infos {
+			fn(info)
+		}
+		if next == "" {
+			return nil
+		}
+		cursor = next
+	}
+}
+
+func stats(w io.Writer, store persistence.CacheStore) error {
+	var keys, pages, bytes, unknown, forever int
+	err := scan(store, "", func(info persistence.KeyInfo) {
+		keys++
+		if strings.HasPrefix(info.Key, cache.PageCachePrefix+":") {
+			pages++
+		}
+		if info.Size < 0 {
+			unknown++
+		} else {
+			bytes += info.Size
+		}
+		if info.TTL == persistence.FOREVER {
+			forever++
+		}
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(w, "keys:", keys)
+	fmt.Fprintln(w, "pages:", pages)
+	fmt.Fprintln(w, "bytes:", bytes)
+	fmt.Fprintln(w, "unknown size:", unknown)
+	fmt.Fprintln(w, "never expiring:", forever)
+	return nil
+}
+
+func size(n int) string {
+	if n < 0 {
+		return "-"
+	}
+	return fmt.Sprint(n)
+}
+
+func ttl(d time.Duration) string {
+	switch {
+	case d == persistence.FOREVER:
+		return "forever"
+	case d == 0:
+		return "-"
+	}
+	return d.Round(time.Second).String()
+}
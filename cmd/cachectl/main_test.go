@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-contrib/cache"
+	"github.com/gin-contrib/cache/persistence"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+// snapshot writes the pages of urls and a counter to a memory snapshot in dir
+func snapshot(t *testing.T, dir string, urls ...string) string {
+	store := persistence.NewInMemoryStore(time.Hour)
+	router := gin.New()
+	router.GET("/*path", cache.NewCache(store).CachePage(time.Hour), func(c *gin.Context) {
+		c.String(200, "page "+c.Param("path"))
+	})
+	for _, u := range urls {
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", u, nil))
+	}
+	store.Set("counter", 1, persistence.FOREVER)
+
+	file := filepath.Join(dir, "cache.gob")
+	cache.RegisterResponseCacheGob()
+	if err := store.SaveFile(file); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "cachectl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func cachectl(args ...string) (string, error) {
+	var stdout, stderr bytes.Buffer
+	err := run(args, &stdout, &stderr)
+	return stdout.String() + stderr.String(), err
+}
+
+func TestKey(t *testing.T) {
+	out, err := cachectl("key", "http://example.com/news?page=2")
+	assert.NoError(t, err)
+	assert.Equal(t, cache.CreateKey("/news?page=2")+"\n", out)
+
+	_, err = cachectl("key")
+	assert.Equal(t, errUsage, err)
+}
+
+func TestPage(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	file := snapshot(t, dir, "/a", "/b")
+
+	out, err := cachectl("-memory", file, "page", "/a")
+	assert.NoError(t, err)
+	assert.Contains(t, out, "status: 200\n")
+	assert.Contains(t, out, "size: 7\n")
+	assert.Contains(t, out, "ttl: 1h0m0s\n")
+	assert.Contains(t, out, "Content-Type: text/plain; charset=utf-8\n")
+	assert.True(t, strings.HasSuffix(out, "\npage /a\n"))
+
+	out, err = cachectl("-memory", file, "-preview", "4", "get", cache.CreateKey("/b"))
+	assert.NoError(t, err)
+	assert.True(t, strings.HasSuffix(out, "\npage\n(3 more bytes)\n"))
+
+	_, err = cachectl("-memory", file, "page", "/missing")
+	assert.Equal(t, persistence.ErrCacheMiss, err)
+	_, err = cachectl("-memory", file, "get", "counter")
+	assert.EqualError(t, err, "cachectl: counter is not a cached page")
+}
+
+func TestPurge(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	file := snapshot(t, dir, "/a", "/blog/1", "/blog/2")
+
+	out, err := cachectl("-memory", file, "purge", "/blog/")
+	assert.NoError(t, err)
+	assert.Equal(t, "purged 2 pages\n", out)
+	out, err = cachectl("-memory", file, "delete", "/a")
+	assert.NoError(t, err)
+	assert.Equal(t, "deleted "+cache.CreateKey("/a")+"\n", out)
+
+	out, err = cachectl("-memory", file, "keys")
+	assert.NoError(t, err)
+	assert.Equal(t, "counter\t-\tforever\n", out)
+}
+
+func TestStats(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	file := snapshot(t, dir, "/a", "/b")
+
+	out, err := cachectl("-memory", file, "stats")
+	assert.NoError(t, err)
+	assert.Equal(t, "keys: 3\npages: 2\nbytes: 0\nunknown size: 3\nnever expiring: 1\n", out)
+}
+
+func TestStoreFlags(t *testing.T) {
+	_, err := cachectl("stats")
+	assert.Error(t, err)
+	_, err = cachectl("-memory", "cache.gob", "-redis", "localhost:6379", "stats")
+	assert.Error(t, err)
+	_, err = cachectl("-memory", "cache.gob", "unknown")
+	assert.Error(t, err)
+	_, err = cachectl("-memory", "cache.gob", "-namespace", "a:b", "stats")
+	assert.EqualError(t, err, "cachectl: -namespace can not contain ':'")
+	_, err = cachectl("-unknown")
+	assert.Equal(t, errUsage, err)
+}
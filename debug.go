@@ -0,0 +1,99 @@
+package cache
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-contrib/cache/persistence"
+	"github.com/gin-gonic/gin"
+)
+
+// Debug headers added by the page cache middlewares
+const (
+	// HeaderCacheStatus is the cache status of the response, one of
+	// StatusHit, StatusMiss, StatusStale or StatusBypass
+	HeaderCacheStatus = "X-Cache"
+	// HeaderAge is the number of seconds since the page was cached
+	HeaderAge = "Age"
+	// HeaderCacheKey is the hash of the cache key of the page
+	HeaderCacheKey = "X-Cache-Key"
+	// HeaderExpires is the date the cached page expires at, when the store
+	// reports the TTL of its keys
+	HeaderExpires = "Expires"
+)
+
+// Cache status reported in HeaderCacheStatus
+const (
+	// StatusHit is a page served from the cache
+	StatusHit = "HIT"
+	// StatusMiss is a page rendered by the handlers
+	StatusMiss = "MISS"
+	// StatusStale is an outdated page served from the cache
+	StatusStale = "STALE"
+	// StatusBypass is a page rendered by the handlers because the cache
+	// could not be used
+	StatusBypass = "BYPASS"
+)
+
+// EnableDebugHeaders makes the page cache middlewares add debug headers to
+// the responses. Only the given headers among HeaderCacheStatus, HeaderAge,
+// HeaderCacheKey and HeaderExpires are added, all of them but HeaderExpires
+// when none is given: unlike the others it lets the clients and proxies cache
+// the page, so it must be asked for.
+func (ch *cache) EnableDebugHeaders(headers ...string) {
+	if len(headers) == 0 {
+		headers = []string{HeaderCacheStatus, HeaderAge, HeaderCacheKey}
+	}
+	ch.debugHeaders = map[string]bool{}
+	for _, h := range headers {
+		ch.debugHeaders[http.CanonicalHeaderKey(h)] = true
+	}
+}
+
+// setDebugHeaders adds the allowed debug headers to the response and returns
+// the ones it set, page is nil when the response does not come from the
+// cache. HeaderAge and HeaderExpires are only added to cached pages, and never
+// replace the ones already in the response, such as the page's own.
+func (ch *cache) setDebugHeaders(c *gin.Context, status string, key string, page *ResponseCache) []string {
+	if len(ch.debugHeaders) == 0 {
+		return nil
+	}
+	var added []string
+	header := c.Writer.Header()
+	if ch.debugHeaders[HeaderCacheStatus] {
+		header.Set(HeaderCacheStatus, status)
+		added = append(added, HeaderCacheStatus)
+	}
+	if ch.debugHeaders[HeaderCacheKey] {
+		header.Set(HeaderCacheKey, persistence.HashKey(key))
+		added = append(added, HeaderCacheKey)
+	}
+	if page == nil {
+		return added
+	}
+	if ch.debugHeaders[HeaderAge] && header.Get(HeaderAge) == "" && !page.Created.IsZero() {
+		age := time.Since(page.Created) / time.Second
+		if age < 0 {
+			age = 0
+		}
+		header.Set(HeaderAge, strconv.FormatInt(int64(age), 10))
+		added = append(added, HeaderAge)
+	}
+	if ch.debugHeaders[HeaderExpires] && header.Get(HeaderExpires) == "" {
+		// pages that never expire, or whose store can't tell, get none
+		if ttl, err := persistence.TTL(ch.store, key); err == nil && ttl > 0 {
+			header.Set(HeaderExpires, time.Now().Add(ttl).UTC().Format(http.TimeFormat))
+			added = append(added, HeaderExpires)
+		}
+	}
+	return added
+}
+
+// stripDebugHeaders removes the debug headers added to a response from its
+// page before it is cached
+func stripDebugHeaders(header http.Header, added []string) {
+	for _, h := range added {
+		header.Del(h)
+	}
+}
@@ -0,0 +1,77 @@
+package cache
+
+import (
+	"math"
+	"math/rand"
+	"time"
+
+	"github.com/gin-contrib/cache/persistence"
+	"github.com/gin-gonic/gin"
+)
+
+// EnableEarlyExpiration makes the page cache middlewares render the pages
+// again before they expire, so they are not all rendered at once when they
+// do. A hit is turned into a miss at random, more likely as the page nears
+// its expiration and as it was long to render (XFetch). beta weights the
+// cost of the pages, 1 is a good start and larger values render the pages
+// earlier; early expiration is disabled with 0.
+//
+// The expiration of the pages is read from stores implementing
+// persistence.ExpiryStore, and computed from the date they were cached
+// otherwise.
+func (ch *cache) EnableEarlyExpiration(beta float64) {
+	ch.beta = beta
+}
+
+// SetExpirationJitter shortens the expiration of the pages cached by a random
+// fraction of it up to jitter, between 0 and 1, so the pages cached together
+// do not expire together. Pages cached with the default expiration of the
+// store or forever are not changed.
+func (ch *cache) SetExpirationJitter(jitter float64) {
+	ch.jitter = jitter
+}
+
+// random returns a number in [0, 1)
+func (ch *cache) random() float64 {
+	if ch.rand != nil {
+		return ch.rand()
+	}
+	return rand.Float64()
+}
+
+// expiration returns the expiration to cache a page for, with the jitter
+func (ch *cache) expiration(expire time.Duration) time.Duration {
+	if ch.jitter <= 0 || expire <= 0 {
+		return expire
+	}
+	return expire - time.Duration(ch.jitter*ch.random()*float64(expire))
+}
+
+// expireEarly tells whether the page cached under key must be rendered again
+// ahead of its expiration
+func (ch *cache) expireEarly(c *gin.Context, store persistence.CacheStore, key string, page *ResponseCache) bool {
+	if ch.beta <= 0 || page.Cost <= 0 {
+		return false
+	}
+	ttl, err := persistence.TTL(store, key)
+	switch err {
+	case nil:
+		if ttl == persistence.FOREVER {
+			return false
+		}
+	case persistence.ErrNotSupport:
+		if page.Expire <= 0 || page.Created.IsZero() {
+			return false
+		}
+		ttl = time.Until(page.Created.Add(page.Expire))
+	case persistence.ErrCacheMiss:
+		return true
+	default:
+		ch.reportError(c, "cache: failed to get the TTL of the page", key, err)
+		return false
+	}
+	// XFetch: -log(rand) follows an exponential distribution, the page is
+	// rendered once a draw scaled by its cost exceeds the time left
+	early := -float64(page.Cost) * ch.beta * math.Log(1-ch.random())
+	return early >= float64(ttl)
+}
@@ -0,0 +1,123 @@
+package cache
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/gin-contrib/cache/persistence"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+// newEarlyRouter returns a router caching /page for expire with ch, whose
+// random numbers are read from draw
+func newEarlyRouter(ch *cache, expire time.Duration, draw *float64) *gin.Engine {
+	ch.rand = func() float64 { return *draw }
+	renders := 0
+	router := gin.New()
+	router.GET("/page", ch.CachePage(expire), func(c *gin.Context) {
+		renders++
+		c.String(200, fmt.Sprint("render ", renders))
+	})
+	return router
+}
+
+func TestEarlyExpirationCost(t *testing.T) {
+	ch := NewMemoryCache(time.Hour)
+	router := gin.New()
+	router.GET("/page", ch.CachePage(time.Hour), func(c *gin.Context) {
+		time.Sleep(20 * time.Millisecond)
+		c.String(200, "page")
+	})
+	performRequest("GET", "/page", router)
+
+	var page ResponseCache
+	assert.NoError(t, ch.store.Get(CreateKey("/page"), &page))
+	assert.True(t, page.Cost >= 20*time.Millisecond, "cost %s", page.Cost)
+}
+
+func TestEarlyExpiration(t *testing.T) {
+	draw := 0.99
+	ch := NewMemoryCache(time.Hour)
+	router := newEarlyRouter(ch, time.Minute, &draw)
+	key := CreateKey("/page")
+	ch.store.Set(key, ResponseCache{Status: 200, Data: []byte("cached"), Created: time.Now(), Cost: 10 * time.Second}, 30*time.Second)
+
+	// disabled
+	assert.Equal(t, "cached", performRequest("GET", "/page", router).Body.String())
+
+	ch.EnableEarlyExpiration(1)
+	// 10s * -log(0.5) = 6.9s, 30s are left
+	draw = 0.5
+	assert.Equal(t, "cached", performRequest("GET", "/page", router).Body.String())
+	// 10s * -log(0.01) = 46s
+	draw = 0.99
+	assert.Equal(t, "render 1", performRequest("GET", "/page", router).Body.String())
+
+	ttl, err := persistence.TTL(ch.store, key)
+	assert.NoError(t, err)
+	assert.True(t, ttl > 59*time.Second, "the page is cached again for a minute")
+	// rendering the page is cheap now
+	assert.Equal(t, "render 1", performRequest("GET", "/page", router).Body.String())
+}
+
+func TestEarlyExpirationRenderAgain(t *testing.T) {
+	draw := 0.5
+	ch := NewMemoryCache(time.Hour)
+	ch.EnableEarlyExpiration(1)
+	ch.rand = func() float64 { return draw }
+	renders := 0
+	router := gin.New()
+	router.GET("/page", ch.CachePage(time.Minute), func(c *gin.Context) {
+		renders++
+		c.Writer.Write([]byte("render "))
+		c.Writer.Write([]byte(fmt.Sprint(renders)))
+	})
+	assert.Equal(t, "render 1", performRequest("GET", "/page", router).Body.String())
+	var page ResponseCache
+	assert.NoError(t, ch.store.Get(CreateKey("/page"), &page))
+	page.Cost = 10 * time.Minute
+	ch.store.Set(CreateKey("/page"), page, time.Minute)
+
+	// 10m * -log(0.5) = 6.9m, the page is rendered again while still cached
+	w := performRequest("GET", "/page", router)
+	assert.Equal(t, "render 2", w.Body.String())
+	assert.NoError(t, ch.store.Get(CreateKey("/page"), &page))
+	assert.Equal(t, "render 2", string(page.Data), "the page replaces the cached one")
+	draw = 0
+	assert.Equal(t, "render 2", performRequest("GET", "/page", router).Body.String())
+}
+
+func TestEarlyExpirationWithoutTTL(t *testing.T) {
+	draw := 0.5
+	// only the CacheStore methods of the in-memory store are visible
+	ch := NewCache(struct{ persistence.CacheStore }{persistence.NewInMemoryStore(time.Hour)})
+	ch.EnableEarlyExpiration(1)
+	router := newEarlyRouter(ch, time.Minute, &draw)
+	ch.store.Set(CreateKey("/page"), ResponseCache{Status: 200, Data: []byte("cached"), Created: time.Now().Add(-50 * time.Second), Cost: 10 * time.Second, Expire: time.Minute}, time.Minute)
+
+	// 10s * -log(0.5) = 6.9s, 10s are left
+	assert.Equal(t, "cached", performRequest("GET", "/page", router).Body.String())
+	// 10s * -log(0.3) = 12s
+	draw = 0.7
+	assert.Equal(t, "render 1", performRequest("GET", "/page", router).Body.String())
+}
+
+func TestExpirationJitter(t *testing.T) {
+	draw := 0.5
+	ch := NewMemoryCache(time.Hour)
+	ch.SetExpirationJitter(0.2)
+	router := newEarlyRouter(ch, time.Hour, &draw)
+	performRequest("GET", "/page", router)
+
+	ttl, err := persistence.TTL(ch.store, CreateKey("/page"))
+	assert.NoError(t, err)
+	assert.InDelta(t, float64(54*time.Minute), float64(ttl), float64(time.Second))
+	var page ResponseCache
+	assert.NoError(t, ch.store.Get(CreateKey("/page"), &page))
+	assert.Equal(t, 54*time.Minute, page.Expire, "the page keeps the expiration with the jitter")
+
+	assert.Equal(t, persistence.DEFAULT, ch.expiration(persistence.DEFAULT))
+	assert.Equal(t, persistence.FOREVER, ch.expiration(persistence.FOREVER))
+}
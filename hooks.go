@@ -0,0 +1,79 @@
+package cache
+
+import (
+	"github.com/gin-gonic/gin"
+)
+
+// Hooks are called by the page cache middlewares, nil hooks are skipped.
+//
+// OnHit and OnStore receive the cached page and may modify it, for example to
+// add a header, or reject it by returning an error: a rejected hit is served
+// as a miss, and a rejected response is not cached.
+type Hooks struct {
+	// OnHit is called before a page found in the cache is written
+	OnHit func(c *gin.Context, key string, page *ResponseCache) error
+	// OnMiss is called before the handlers run for a page not in the cache
+	OnMiss func(c *gin.Context, key string)
+	// OnStore is called before a response is cached, on every write of the
+	// handlers since the page is stored as it is written
+	OnStore func(c *gin.Context, key string, page *ResponseCache) error
+	// OnEvict is called when the page of an aborted request is dropped
+	OnEvict func(c *gin.Context, key string)
+	// OnError is called when the store fails, the request is then served
+	// uncached
+	OnError func(c *gin.Context, key string, err error)
+}
+
+// AddHooks registers hooks, they are called in the order they were added
+func (ch *cache) AddHooks(h Hooks) {
+	ch.hooks = append(ch.hooks, h)
+}
+
+func (ch *cache) onHit(c *gin.Context, key string, page *ResponseCache) error {
+	for _, h := range ch.hooks {
+		if h.OnHit != nil {
+			if err := h.OnHit(c, key, page); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (ch *cache) onMiss(c *gin.Context, key string) {
+	for _, h := range ch.hooks {
+		if h.OnMiss != nil {
+			h.OnMiss(c, key)
+		}
+	}
+}
+
+func (ch *cache) onStore(c *gin.Context, key string, page *ResponseCache) error {
+	if ch == nil {
+		return nil
+	}
+	for _, h := range ch.hooks {
+		if h.OnStore != nil {
+			if err := h.OnStore(c, key, page); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (ch *cache) onEvict(c *gin.Context, key string) {
+	for _, h := range ch.hooks {
+		if h.OnEvict != nil {
+			h.OnEvict(c, key)
+		}
+	}
+}
+
+func (ch *cache) onError(c *gin.Context, key string, err error) {
+	for _, h := range ch.hooks {
+		if h.OnError != nil {
+			h.OnError(c, key, err)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package cache
+
+import (
+	"time"
+
+	"github.com/gin-contrib/cache/persistence"
+	"github.com/gin-gonic/gin"
+)
+
+// PageLockPrefix is the prefix of the keys of the locks of the pages
+var PageLockPrefix = "gincontrib.page.lock"
+
+// LockOptions configures the locks of the pages, see EnableLocking
+type LockOptions struct {
+	// TTL is the lease of a lock, renewed while its page renders, 10 seconds
+	// when 0
+	TTL time.Duration
+
+	// Wait bounds the time a request waits for the page another process
+	// renders before rendering it too, 5 seconds when 0
+	Wait time.Duration
+
+	// Poll is the interval the store is polled at for the page another
+	// process renders, 50 milliseconds when 0
+	Poll time.Duration
+}
+
+// EnableLocking makes the page cache middlewares render a page once across
+// the processes sharing the store, with a persistence.Lock taken with the Add
+// of the store. On a miss the request taking the lock renders the page while
+// the others poll the store for it. A page expiring early (see
+// EnableEarlyExpiration) keeps being served while another process renders
+// it.
+func (ch *cache) EnableLocking(options *LockOptions) {
+	o := LockOptions{TTL: 10 * time.Second, Wait: 5 * time.Second, Poll: 50 * time.Millisecond}
+	if options != nil {
+		if options.TTL > 0 {
+			o.TTL = options.TTL
+		}
+		if options.Wait > 0 {
+			o.Wait = options.Wait
+		}
+		if options.Poll > 0 {
+			o.Poll = options.Poll
+		}
+	}
+	ch.lock = &o
+}
+
+// lockPage takes the lock of the page cached under key before rendering it.
+// When another process holds it, the page to serve instead is returned with
+// its status: the stale one expiring early with StatusStale, or the one
+// rendered while polling with StatusHit. The page is nil and the status
+// StatusMiss when it must be rendered, with the lock when it is not nil.
+func (ch *cache) lockPage(c *gin.Context, store persistence.CacheStore, key string, stale *ResponseCache) (*persistence.Lock, *ResponseCache, string) {
+	lockKey := PageLockPrefix + ":" + key
+	lock, err := persistence.TryLock(store, lockKey, ch.lock.TTL)
+	switch err {
+	case nil:
+		lock.KeepAlive()
+		return lock, nil, StatusMiss
+	case persistence.ErrLocked:
+	default:
+		ch.reportError(c, "cache: failed to lock the page", key, err)
+		return nil, nil, StatusMiss
+	}
+	if stale != nil {
+		return nil, stale, StatusStale
+	}
+
+	deadline := time.Now().Add(ch.lock.Wait)
+	for time.Now().Before(deadline) {
+		select {
+		case <-time.After(ch.lock.Poll):
+		case <-c.Request.Context().Done():
+			return nil, nil, StatusMiss
+		}
+		var page ResponseCache
+		switch err := store.Get(key, &page); err {
+		case nil:
+			return nil, &page, StatusHit
+		case persistence.ErrCacheMiss:
+		default:
+			ch.reportError(c, "cache: failed to get the page", key, err)
+			return nil, nil, StatusMiss
+		}
+		// the page was not cached by the owner of the lock
+		var token string
+		if err := store.Get(lockKey, &token); err != nil {
+			return nil, nil, StatusMiss
+		}
+	}
+	return nil, nil, StatusMiss
+}
+
+// unlockPage releases the lock of the page cached under key
+func (ch *cache) unlockPage(c *gin.Context, lock *persistence.Lock, key string) {
+	if err := lock.Release(); err != nil && err != persistence.ErrLockLost {
+		ch.reportError(c, "cache: failed to unlock the page", key, err)
+	}
+}
@@ -0,0 +1,101 @@
+package cache
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-contrib/cache/persistence"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+// newLockRouter returns the router of a replica rendering /page slowly, and
+// the counter of the pages it rendered
+func newLockRouter(ch *cache, renders *int64) *gin.Engine {
+	router := gin.New()
+	router.GET("/page", ch.CachePage(time.Hour), func(c *gin.Context) {
+		atomic.AddInt64(renders, 1)
+		time.Sleep(50 * time.Millisecond)
+		c.String(200, "page")
+	})
+	return router
+}
+
+func TestLockingReplicas(t *testing.T) {
+	var renders int64
+	store := persistence.NewInMemoryStore(time.Hour)
+	var routers []*gin.Engine
+	for i := 0; i < 3; i++ {
+		ch := NewCache(store)
+		ch.EnableLocking(&LockOptions{Poll: 5 * time.Millisecond})
+		routers = append(routers, newLockRouter(ch, &renders))
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 12; i++ {
+		wg.Add(1)
+		go func(router *gin.Engine) {
+			defer wg.Done()
+			w := performRequest("GET", "/page", router)
+			assert.Equal(t, "page", w.Body.String())
+		}(routers[i%3])
+	}
+	wg.Wait()
+	assert.Equal(t, int64(1), atomic.LoadInt64(&renders))
+
+	_, err := persistence.TryLock(store, PageLockPrefix+":"+CreateKey("/page"), time.Minute)
+	assert.NoError(t, err, "the lock is released")
+}
+
+func TestLockingStale(t *testing.T) {
+	var renders int64
+	ch := NewMemoryCache(time.Hour)
+	ch.EnableLocking(nil)
+	ch.EnableEarlyExpiration(1)
+	ch.rand = func() float64 { return 0.99 }
+	ch.EnableDebugHeaders(HeaderCacheStatus)
+	router := newLockRouter(ch, &renders)
+	key := CreateKey("/page")
+	ch.store.Set(key, ResponseCache{Status: 200, Data: []byte("stale"), Created: time.Now(), Cost: time.Minute}, time.Minute)
+
+	lock, err := persistence.TryLock(ch.store, PageLockPrefix+":"+key, time.Minute)
+	assert.NoError(t, err)
+	w := performRequest("GET", "/page", router)
+	assert.Equal(t, "stale", w.Body.String())
+	assert.Equal(t, StatusStale, w.Header().Get(HeaderCacheStatus))
+	assert.Equal(t, int64(0), renders)
+
+	assert.NoError(t, lock.Release())
+	w = performRequest("GET", "/page", router)
+	assert.Equal(t, "page", w.Body.String())
+	assert.Equal(t, StatusMiss, w.Header().Get(HeaderCacheStatus))
+	assert.Equal(t, int64(1), renders)
+}
+
+func TestLockingWait(t *testing.T) {
+	var renders int64
+	ch := NewMemoryCache(time.Hour)
+	ch.EnableLocking(&LockOptions{Wait: 30 * time.Millisecond, Poll: 5 * time.Millisecond})
+	router := newLockRouter(ch, &renders)
+	lock, err := persistence.TryLock(ch.store, PageLockPrefix+":"+CreateKey("/page"), time.Minute)
+	assert.NoError(t, err)
+
+	start := time.Now()
+	assert.Equal(t, "page", performRequest("GET", "/page", router).Body.String())
+	assert.True(t, time.Since(start) >= 30*time.Millisecond, "the request waits for the owner of the lock")
+	assert.Equal(t, int64(1), renders)
+	assert.NoError(t, lock.Release(), "the lock of the owner is kept")
+
+	// the owner releases the lock without caching the page
+	ch.store.Delete(CreateKey("/page"))
+	lock, err = persistence.TryLock(ch.store, PageLockPrefix+":"+CreateKey("/page"), time.Minute)
+	assert.NoError(t, err)
+	time.AfterFunc(10*time.Millisecond, func() { lock.Release() })
+	ch.EnableLocking(&LockOptions{Wait: time.Minute, Poll: 5 * time.Millisecond})
+	start = time.Now()
+	assert.Equal(t, "page", performRequest("GET", "/page", router).Body.String())
+	assert.True(t, time.Since(start) < time.Second, "the request stops waiting once the lock is released")
+	assert.Equal(t, int64(2), renders)
+}
@@ -0,0 +1,35 @@
+package cache
+
+import (
+	"sync/atomic"
+
+	"github.com/gin-contrib/cache/persistence"
+	"github.com/gin-gonic/gin"
+)
+
+// SetLogger reports the store errors met by the middlewares to l, they are
+// discarded by default
+func (ch *cache) SetLogger(l persistence.Logger) {
+	ch.logger = l
+}
+
+// reportError logs a store error, counts it in the metrics and passes it to
+// the OnError hooks, the request is served uncached. ErrCircuitOpen is not
+// reported.
+func (ch *cache) reportError(c *gin.Context, msg string, key string, err error) {
+	// the breaker already reported the outage when it opened
+	if ch == nil || err == persistence.ErrCircuitOpen {
+		return
+	}
+	ch.logger.Log(persistence.LevelError, msg,
+		persistence.Field{Key: "key", Value: key},
+		persistence.Field{Key: "route", Value: c.FullPath()},
+		persistence.Field{Key: "store", Value: ch.storeName},
+		persistence.Field{Key: "error", Value: err},
+	)
+	atomic.AddUint64(&ch.stats.errors, 1)
+	if ch.metrics != nil {
+		ch.metrics.Error(c.FullPath(), ch.storeName, err)
+	}
+	ch.onError(c, key, err)
+}
@@ -0,0 +1,75 @@
+package cache
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+
+	"github.com/gin-contrib/cache/persistence"
+	"github.com/gin-gonic/gin"
+)
+
+// Metrics receives the outcome of the page cache middlewares, labeled by the
+// route of the request and the name of the store.
+// metrics.Registry implements it in the Prometheus text format.
+type Metrics interface {
+	// Hit is called when a page is served from the cache
+	Hit(route, store string)
+	// Miss is called when a page is not in the cache and the handlers run
+	Miss(route, store string)
+	// Stored is called when a response of size bytes has been cached
+	Stored(route, store string, size int)
+	// Error is called when the store fails, the request is then served uncached
+	Error(route, store string, err error)
+}
+
+// SetMetrics reports the cache hits, misses, stores and errors to m
+func (ch *cache) SetMetrics(m Metrics) {
+	ch.metrics = m
+}
+
+// stats counts the outcomes of the page cache middlewares for the admin
+// routes, whatever the Metrics
+type stats struct {
+	hits, misses, stored, errors uint64
+}
+
+func (ch *cache) observeHit(c *gin.Context) {
+	if ch == nil {
+		return
+	}
+	atomic.AddUint64(&ch.stats.hits, 1)
+	if ch.metrics != nil {
+		ch.metrics.Hit(c.FullPath(), ch.storeName)
+	}
+}
+
+func (ch *cache) observeMiss(c *gin.Context) {
+	if ch == nil {
+		return
+	}
+	atomic.AddUint64(&ch.stats.misses, 1)
+	if ch.metrics != nil {
+		ch.metrics.Miss(c.FullPath(), ch.storeName)
+	}
+}
+
+func (ch *cache) observeStored(c *gin.Context, size int) {
+	if ch == nil {
+		return
+	}
+	atomic.AddUint64(&ch.stats.stored, 1)
+	if ch.metrics != nil {
+		ch.metrics.Stored(c.FullPath(), ch.storeName, size)
+	}
+}
+
+// storeName returns the name of a store used in metrics labels, stores may
+// provide one with a Name method.
+func storeName(store persistence.CacheStore) string {
+	if named, ok := store.(interface{ Name() string }); ok {
+		return named.Name()
+	}
+	name := fmt.Sprintf("%T", store)
+	return name[strings.LastIndex(name, ".")+1:]
+}
@@ -0,0 +1,249 @@
+// Package metrics collects the page cache and store metrics and exposes them
+// in the Prometheus text format, without depending on the Prometheus client.
+package metrics
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-contrib/cache/persistence"
+)
+
+const namespace = "gincontrib_cache"
+
+// DefaultBuckets are the upper bounds, in seconds, of the store latency
+// histogram buckets
+var DefaultBuckets = []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1}
+
+// Registry holds the counters and histograms of the cache. It implements the
+// cache.Metrics, persistence.StoreObserver and persistence.DivergenceObserver
+// interfaces, and serves the collected values as an http.Handler.
+type Registry struct {
+	mu            sync.Mutex
+	hits          *vec
+	misses        *vec
+	sets          *vec
+	storedBytes   *vec
+	errors        *vec
+	storeOps      *vec
+	storeDuration *vec
+	divergences   *vec
+}
+
+// NewRegistry returns a Registry using DefaultBuckets
+func NewRegistry() *Registry {
+	return NewRegistryWithBuckets(DefaultBuckets)
+}
+
+// NewRegistryWithBuckets returns a Registry using the provided latency buckets
+func NewRegistryWithBuckets(buckets []float64) *Registry {
+	b := append([]float64(nil), buckets...)
+	sort.Float64s(b)
+	return &Registry{
+		hits:          newVec("hits_total", "Pages served from the cache.", "counter", nil, "route", "store"),
+		misses:        newVec("misses_total", "Pages not found in the cache.", "counter", nil, "route", "store"),
+		sets:          newVec("sets_total", "Responses stored in the cache.", "counter", nil, "route", "store"),
+		storedBytes:   newVec("stored_bytes_total", "Bytes of response stored in the cache.", "counter", nil, "route", "store"),
+		errors:        newVec("errors_total", "Store errors met by the middleware.", "counter", nil, "route", "store"),
+		storeOps:      newVec("store_operations_total", "Calls made to the store by result.", "counter", nil, "store", "op", "result"),
+		storeDuration: newVec("store_duration_seconds", "Latency of the calls made to the store.", "histogram", b, "store", "op"),
+		divergences:   newVec("mirror_divergences_total", "Differences found by the shadow reads of a mirror store.", "counter", nil, "store", "secondary", "kind"),
+	}
+}
+
+// Hit (see cache.Metrics interface)
+func (r *Registry) Hit(route, store string) {
+	r.mu.Lock()
+	r.hits.get(route, store).value++
+	r.mu.Unlock()
+}
+
+// Miss (see cache.Metrics interface)
+func (r *Registry) Miss(route, store string) {
+	r.mu.Lock()
+	r.misses.get(route, store).value++
+	r.mu.Unlock()
+}
+
+// Stored (see cache.Metrics interface)
+func (r *Registry) Stored(route, store string, size int) {
+	r.mu.Lock()
+	r.sets.get(route, store).value++
+	r.storedBytes.get(route, store).value += float64(size)
+	r.mu.Unlock()
+}
+
+// Error (see cache.Metrics interface)
+func (r *Registry) Error(route, store string, err error) {
+	r.mu.Lock()
+	r.errors.get(route, store).value++
+	r.mu.Unlock()
+}
+
+// ObserveStore (see persistence.StoreObserver interface)
+func (r *Registry) ObserveStore(store, op string, elapsed time.Duration, err error) {
+	r.mu.Lock()
+	r.storeOps.get(store, op, result(err)).value++
+	r.storeDuration.observe(r.storeDuration.get(store, op), elapsed.Seconds())
+	r.mu.Unlock()
+}
+
+// ObserveDivergence (see persistence.DivergenceObserver interface)
+func (r *Registry) ObserveDivergence(store, secondary, kind string) {
+	r.mu.Lock()
+	r.divergences.get(store, secondary, kind).value++
+	r.mu.Unlock()
+}
+
+// result classifies a store error, misses are part of the normal operation
+func result(err error) string {
+	switch err {
+	case nil:
+		return "ok"
+	case persistence.ErrCacheMiss:
+		return "miss"
+	case persistence.ErrNotStored:
+		return "not_stored"
+	case persistence.ErrNotSupport:
+		return "not_supported"
+	}
+	return "error"
+}
+
+// ServeHTTP writes the metrics in the Prometheus text format
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.WriteTo(w)
+}
+
+// WriteTo writes the metrics in the Prometheus text format to w
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	bw := bufio.NewWriter(w)
+	cw := &countWriter{w: bw}
+	r.mu.Lock()
+	for _, v := range []*vec{r.hits, r.misses, r.sets, r.storedBytes, r.errors, r.storeOps, r.storeDuration, r.divergences} {
+		v.write(cw)
+	}
+	r.mu.Unlock()
+	err := bw.Flush()
+	return cw.n, err
+}
+
+// vec is a metric family, its series are keyed by their label values
+type vec struct {
+	name    string
+	help    string
+	kind    string
+	buckets []float64
+	labels  []string
+	series  map[string]*series
+}
+
+type series struct {
+	labels []string
+	value  float64 // counter value, or histogram sum
+	count  uint64
+	counts []uint64
+}
+
+func newVec(name, help, kind string, buckets []float64, labels ...string) *vec {
+	return &vec{
+		name:    namespace + "_" + name,
+		help:    help,
+		kind:    kind,
+		buckets: buckets,
+		labels:  labels,
+		series:  map[string]*series{},
+	}
+}
+
+func (v *vec) get(values ...string) *series {
+	key := strings.Join(values, "\xff")
+	s, ok := v.series[key]
+	if !ok {
+		s = &series{labels: values}
+		if v.buckets != nil {
+			s.counts = make([]uint64, len(v.buckets))
+		}
+		v.series[key] = s
+	}
+	return s
+}
+
+// observe records value in the histogram series s
+func (v *vec) observe(s *series, value float64) {
+	s.value += value
+	s.count++
+	// counts are per bucket, they are accumulated when written
+	if i := sort.SearchFloat64s(v.buckets, value); i < len(v.buckets) {
+		s.counts[i]++
+	}
+}
+
+func (v *vec) write(w io.Writer) {
+	if len(v.series) == 0 {
+		return
+	}
+	io.WriteString(w, "# HELP "+v.name+" "+v.help+"\n")
+	io.WriteString(w, "# TYPE "+v.name+" "+v.kind+"\n")
+
+	keys := make([]string, 0, len(v.series))
+	for k := range v.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		s := v.series[k]
+		labels := v.formatLabels(s.labels)
+		if v.buckets == nil {
+			io.WriteString(w, v.name+"{"+labels+"} "+formatFloat(s.value)+"\n")
+			continue
+		}
+		var cumulative uint64
+		for i, bound := range v.buckets {
+			cumulative += s.counts[i]
+			io.WriteString(w, v.name+"_bucket{"+labels+`,le="`+formatFloat(bound)+`"} `+strconv.FormatUint(cumulative, 10)+"\n")
+		}
+		io.WriteString(w, v.name+"_bucket{"+labels+`,le="+Inf"} `+strconv.FormatUint(s.count, 10)+"\n")
+		io.WriteString(w, v.name+"_sum{"+labels+"} "+formatFloat(s.value)+"\n")
+		io.WriteString(w, v.name+"_count{"+labels+"} "+strconv.FormatUint(s.count, 10)+"\n")
+	}
+}
+
+func (v *vec) formatLabels(values []string) string {
+	var b strings.Builder
+	for i, name := range v.labels {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(name)
+		b.WriteString(`="`)
+		b.WriteString(labelEscaper.Replace(values[i]))
+		b.WriteByte('"')
+	}
+	return b.String()
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// countWriter counts the bytes written for WriteTo
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
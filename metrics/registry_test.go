@@ -0,0 +1,101 @@
+package metrics
+
+import (
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-contrib/cache"
+	"github.com/gin-contrib/cache/persistence"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+var (
+	_ cache.Metrics                  = (*Registry)(nil)
+	_ persistence.StoreObserver      = (*Registry)(nil)
+	_ persistence.DivergenceObserver = (*Registry)(nil)
+)
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+func scrape(t *testing.T, r *Registry) string {
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "text/plain; version=0.0.4; charset=utf-8", w.Header().Get("Content-Type"))
+	return w.Body.String()
+}
+
+func TestRegistry_CachePage(t *testing.T) {
+	reg := NewRegistry()
+	store := persistence.NewInstrumentedStore(persistence.NewInMemoryStore(time.Minute), "memory", reg)
+	ch := cache.NewCache(store)
+	ch.SetMetrics(reg)
+
+	router := gin.New()
+	router.GET("/ping/:id", ch.CachePage(time.Minute), func(c *gin.Context) {
+		c.String(200, "pong")
+	})
+	for i := 0; i < 3; i++ {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", "/ping/1", nil))
+		assert.Equal(t, "pong", w.Body.String())
+	}
+
+	body := scrape(t, reg)
+	assert.Contains(t, body, "# TYPE gincontrib_cache_hits_total counter\n")
+	assert.Contains(t, body, `gincontrib_cache_hits_total{route="/ping/:id",store="memory"} 2`+"\n")
+	assert.Contains(t, body, `gincontrib_cache_misses_total{route="/ping/:id",store="memory"} 1`+"\n")
+	assert.Contains(t, body, `gincontrib_cache_sets_total{route="/ping/:id",store="memory"} 1`+"\n")
+	assert.Contains(t, body, `gincontrib_cache_stored_bytes_total{route="/ping/:id",store="memory"} 4`+"\n")
+	assert.Contains(t, body, `gincontrib_cache_store_operations_total{store="memory",op="get",result="miss"} 1`+"\n")
+	assert.Contains(t, body, `gincontrib_cache_store_operations_total{store="memory",op="get",result="ok"} 2`+"\n")
+	assert.Contains(t, body, "# TYPE gincontrib_cache_store_duration_seconds histogram\n")
+	assert.Contains(t, body, `gincontrib_cache_store_duration_seconds_count{store="memory",op="get"} 3`+"\n")
+	assert.NotContains(t, body, "gincontrib_cache_errors_total")
+}
+
+func TestRegistry_Histogram(t *testing.T) {
+	reg := NewRegistryWithBuckets([]float64{0.1, 0.01})
+	reg.ObserveStore("redis", "set", 5*time.Millisecond, nil)
+	reg.ObserveStore("redis", "set", 50*time.Millisecond, errors.New("timeout"))
+	reg.ObserveStore("redis", "set", time.Second, nil)
+
+	body := scrape(t, reg)
+	expected := strings.Join([]string{
+		`gincontrib_cache_store_duration_seconds_bucket{store="redis",op="set",le="0.01"} 1`,
+		`gincontrib_cache_store_duration_seconds_bucket{store="redis",op="set",le="0.1"} 2`,
+		`gincontrib_cache_store_duration_seconds_bucket{store="redis",op="set",le="+Inf"} 3`,
+		`gincontrib_cache_store_duration_seconds_sum{store="redis",op="set"} 1.055`,
+		`gincontrib_cache_store_duration_seconds_count{store="redis",op="set"} 3`,
+	}, "\n")
+	assert.Contains(t, body, expected)
+	assert.Contains(t, body, `gincontrib_cache_store_operations_total{store="redis",op="set",result="error"} 1`)
+	assert.Contains(t, body, `gincontrib_cache_store_operations_total{store="redis",op="set",result="ok"} 2`)
+}
+
+func TestRegistry_EscapeLabels(t *testing.T) {
+	reg := NewRegistry()
+	reg.Error("/a\"b\\c\n", "memory", errors.New("down"))
+
+	assert.Contains(t, scrape(t, reg), `gincontrib_cache_errors_total{route="/a\"b\\c\n",store="memory"} 1`)
+}
+
+func TestRegistry_MirrorDivergences(t *testing.T) {
+	reg := NewRegistry()
+	primary, secondary := persistence.NewInMemoryStore(time.Minute), persistence.NewInMemoryStore(time.Minute)
+	store := persistence.NewMirrorStore(primary, &persistence.MirrorOptions{Name: "migration", ShadowReads: true, Observer: reg})
+	store.AddSecondary("redis", secondary)
+
+	assert.NoError(t, primary.Set("key", "value", persistence.DEFAULT))
+	var value string
+	assert.NoError(t, store.Get("key", &value))
+	store.Wait()
+
+	assert.Contains(t, scrape(t, reg), `gincontrib_cache_mirror_divergences_total{store="migration",secondary="redis",kind="missing"} 1`+"\n")
+}
@@ -0,0 +1,418 @@
+package persistence
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+)
+
+var (
+	ErrCircuitOpen = errors.New("cache: circuit open.")
+	ErrTimeout     = errors.New("cache: store timeout.")
+)
+
+// CircuitBreaker is implemented by stores that know when their backend is
+// down, the page cache middlewares then bypass the cache altogether
+type CircuitBreaker interface {
+	CircuitOpen() bool
+}
+
+// BreakerState is the state of the circuit of a BreakerStore
+type BreakerState int
+
+// Breaker states
+const (
+	// BreakerClosed lets every command through
+	BreakerClosed BreakerState = iota
+	// BreakerOpen fails every command with ErrCircuitOpen
+	BreakerOpen
+	// BreakerHalfOpen lets a few probes through to check the store is back
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	}
+	return fmt.Sprintf("BreakerState(%d)", int(s))
+}
+
+// BreakerOptions configures a BreakerStore. Misses and refused writes are not
+// failures, errors and timeouts are.
+type BreakerOptions struct {
+	// ConsecutiveFailures opens the circuit after that many failures in a
+	// row, 5 when 0
+	ConsecutiveFailures int
+
+	// FailureRate opens the circuit when the share of failed commands over
+	// Window reaches it, once MinRequests commands were made. It is disabled
+	// when 0.
+	FailureRate float64
+	MinRequests int           // 20 when 0
+	Window      time.Duration // 10s when 0
+
+	// OpenTimeout is how long the circuit stays open before probes are let
+	// through, 5s when 0
+	OpenTimeout time.Duration
+
+	// HalfOpenProbes is the number of probes that must succeed to close the
+	// circuit, 1 when 0. The commands beyond them fail with ErrCircuitOpen.
+	HalfOpenProbes int
+
+	// Timeout fails a command with ErrTimeout when the store hasn't answered
+	// in time, it is disabled when 0. The command still runs to completion
+	// in the background.
+	Timeout time.Duration
+
+	// Logger receives the changes of state, it can be changed later with
+	// SetLogger
+	Logger Logger
+}
+
+// BreakerStore stops calling the wrapped CacheStore while it keeps failing,
+// commands then fail at once with ErrCircuitOpen instead of waiting for the
+// store to time out. It implements CircuitBreaker, so the page cache
+// middlewares skip the cache while the circuit is open, as long as the
+// BreakerStore is the store given to the cache.
+type BreakerStore struct {
+	store   CacheStore
+	options BreakerOptions
+
+	mu          sync.Mutex
+	state       BreakerState
+	generation  uint64 // incremented on every change of state
+	consecutive int
+	windowStart time.Time
+	calls       int
+	failures    int
+	openedAt    time.Time
+	probes      int // probes in flight
+	succeeded   int // successful probes
+	logger      Logger
+}
+
+// NewBreakerStore returns a BreakerStore wrapping store
+func NewBreakerStore(store CacheStore, options *BreakerOptions) *BreakerStore {
+	o := BreakerOptions{}
+	if options != nil {
+		o = *options
+	}
+	if o.ConsecutiveFailures <= 0 {
+		o.ConsecutiveFailures = 5
+	}
+	if o.MinRequests <= 0 {
+		o.MinRequests = 20
+	}
+	if o.Window <= 0 {
+		o.Window = 10 * time.Second
+	}
+	if o.OpenTimeout <= 0 {
+		o.OpenTimeout = 5 * time.Second
+	}
+	if o.HalfOpenProbes <= 0 {
+		o.HalfOpenProbes = 1
+	}
+	logger := o.Logger
+	if logger == nil {
+		logger = NopLogger{}
+	}
+	return &BreakerStore{store: store, options: o, windowStart: time.Now(), logger: logger}
+}
+
+// SetLogger reports the changes of state to l
+func (s *BreakerStore) SetLogger(l Logger) {
+	s.mu.Lock()
+	s.logger = l
+	s.mu.Unlock()
+}
+
+// State returns the state of the circuit
+func (s *BreakerStore) State() BreakerState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.advance(time.Now())
+	return s.state
+}
+
+// CircuitOpen (see CircuitBreaker interface)
+func (s *BreakerStore) CircuitOpen() bool {
+	return s.State() == BreakerOpen
+}
+
+// advance moves an open circuit to half-open once OpenTimeout has passed,
+// s.mu must be held
+func (s *BreakerStore) advance(now time.Time) {
+	if s.state == BreakerOpen && now.Sub(s.openedAt) >= s.options.OpenTimeout {
+		s.setState(BreakerHalfOpen, now, nil)
+	}
+}
+
+// setState changes the state of the circuit and resets its counters, s.mu
+// must be held
+func (s *BreakerStore) setState(state BreakerState, now time.Time, err error) {
+	s.state = state
+	s.generation++
+	s.consecutive, s.calls, s.failures = 0, 0, 0
+	s.windowStart = now
+	s.probes, s.succeeded = 0, 0
+	switch state {
+	case BreakerOpen:
+		s.openedAt = now
+		s.logger.Log(LevelWarn, "cache: circuit opened", Field{"retry_in", s.options.OpenTimeout}, Field{"error", err})
+	case BreakerClosed:
+		s.logger.Log(LevelInfo, "cache: circuit closed")
+	}
+}
+
+// allow tells whether a command can run, and returns the generation to pass
+// to record
+func (s *BreakerStore) allow() (uint64, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.advance(time.Now())
+	switch s.state {
+	case BreakerOpen:
+		return 0, false
+	case BreakerHalfOpen:
+		if s.probes+s.succeeded >= s.options.HalfOpenProbes {
+			return 0, false
+		}
+		s.probes++
+	}
+	return s.generation, true
+}
+
+// record updates the circuit with the outcome of a command allowed in
+// generation, the outcomes of an earlier state are ignored
+func (s *BreakerStore) record(generation uint64, err error) {
+	failed := err != nil && err != ErrCacheMiss && err != ErrNotStored && err != ErrNotSupport
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if generation != s.generation {
+		return
+	}
+	now := time.Now()
+	switch s.state {
+	case BreakerHalfOpen:
+		s.probes--
+		if failed {
+			s.setState(BreakerOpen, now, err)
+			return
+		}
+		s.succeeded++
+		if s.succeeded >= s.options.HalfOpenProbes {
+			s.setState(BreakerClosed, now, nil)
+		}
+	case BreakerClosed:
+		if now.Sub(s.windowStart) >= s.options.Window {
+			s.windowStart, s.calls, s.failures = now, 0, 0
+		}
+		s.calls++
+		if !failed {
+			s.consecutive = 0
+			return
+		}
+		s.consecutive++
+		s.failures++
+		rate := s.options.FailureRate > 0 && s.calls >= s.options.MinRequests &&
+			float64(s.failures)/float64(s.calls) >= s.options.FailureRate
+		if s.consecutive >= s.options.ConsecutiveFailures || rate {
+			s.setState(BreakerOpen, now, err)
+		}
+	}
+}
+
+// do runs f through the circuit
+func (s *BreakerStore) do(f func() error) error {
+	generation, ok := s.allow()
+	if !ok {
+		return ErrCircuitOpen
+	}
+	err := s.withTimeout(f)
+	s.record(generation, err)
+	return err
+}
+
+// withTimeout runs f and gives up after options.Timeout
+func (s *BreakerStore) withTimeout(f func() error) error {
+	if s.options.Timeout <= 0 {
+		return f()
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- f()
+	}()
+	timer := time.NewTimer(s.options.Timeout)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		return err
+	case <-timer.C:
+		return ErrTimeout
+	}
+}
+
+// Get (see CacheStore interface)
+func (s *BreakerStore) Get(key string, value interface{}) error {
+	t := reflect.TypeOf(value)
+	if s.options.Timeout <= 0 || t == nil || t.Kind() != reflect.Ptr {
+		return s.do(func() error {
+			return s.store.Get(key, value)
+		})
+	}
+	// a Get still running after its timeout must not write to value
+	tmp := reflect.New(t.Elem())
+	err := s.do(func() error {
+		return s.store.Get(key, tmp.Interface())
+	})
+	if err == nil {
+		reflect.ValueOf(value).Elem().Set(tmp.Elem())
+	}
+	return err
+}
+
+// Set (see CacheStore interface)
+func (s *BreakerStore) Set(key string, value interface{}, expires time.Duration) error {
+	return s.do(func() error {
+		return s.store.Set(key, value, expires)
+	})
+}
+
+// Add (see CacheStore interface)
+func (s *BreakerStore) Add(key string, value interface{}, expires time.Duration) error {
+	return s.do(func() error {
+		return s.store.Add(key, value, expires)
+	})
+}
+
+// Replace (see CacheStore interface)
+func (s *BreakerStore) Replace(key string, value interface{}, expires time.Duration) error {
+	return s.do(func() error {
+		return s.store.Replace(key, value, expires)
+	})
+}
+
+// Delete (see CacheStore interface)
+func (s *BreakerStore) Delete(key string) error {
+	return s.do(func() error {
+		return s.store.Delete(key)
+	})
+}
+
+// Increment (see CacheStore interface)
+func (s *BreakerStore) Increment(key string, delta uint64) (uint64, error) {
+	var n uint64
+	err := s.do(func() error {
+		var err error
+		n, err = s.store.Increment(key, delta)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// Decrement (see CacheStore interface)
+func (s *BreakerStore) Decrement(key string, delta uint64) (uint64, error) {
+	var n uint64
+	err := s.do(func() error {
+		var err error
+		n, err = s.store.Decrement(key, delta)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// TTL (see ExpiryStore interface)
+func (s *BreakerStore) TTL(key string) (time.Duration, error) {
+	var ttl time.Duration
+	err := s.do(func() error {
+		var err error
+		ttl, err = TTL(s.store, key)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return ttl, nil
+}
+
+// Touch (see ExpiryStore interface)
+func (s *BreakerStore) Touch(key string, expires time.Duration) error {
+	return s.do(func() error {
+		return Touch(s.store, key, expires)
+	})
+}
+
+// GetWithVersion (see CASStore interface)
+func (s *BreakerStore) GetWithVersion(key string, value interface{}) (uint64, error) {
+	var version uint64
+	t := reflect.TypeOf(value)
+	if s.options.Timeout <= 0 || t == nil || t.Kind() != reflect.Ptr {
+		err := s.do(func() error {
+			var err error
+			version, err = GetWithVersion(s.store, key, value)
+			return err
+		})
+		return version, err
+	}
+	// like Get, a read still running after its timeout must not write to value
+	tmp := reflect.New(t.Elem())
+	err := s.do(func() error {
+		var err error
+		version, err = GetWithVersion(s.store, key, tmp.Interface())
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	reflect.ValueOf(value).Elem().Set(tmp.Elem())
+	return version, nil
+}
+
+// CompareAndSwap (see CASStore interface)
+func (s *BreakerStore) CompareAndSwap(key string, value interface{}, version uint64, expires time.Duration) error {
+	return s.do(func() error {
+		return CompareAndSwap(s.store, key, value, version, expires)
+	})
+}
+
+// CompareAndDelete (see CASDeleter interface)
+func (s *BreakerStore) CompareAndDelete(key string, version uint64) error {
+	return s.do(func() error {
+		return CompareAndDelete(s.store, key, version)
+	})
+}
+
+// Scan (see Scanner interface)
+func (s *BreakerStore) Scan(prefix, cursor string, count int) ([]KeyInfo, string, error) {
+	var infos []KeyInfo
+	var next string
+	err := s.do(func() error {
+		var err error
+		infos, next, err = Scan(s.store, prefix, cursor, count)
+		return err
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return infos, next, nil
+}
+
+// Flush (see CacheStore interface)
+func (s *BreakerStore) Flush() error {
+	return s.do(func() error {
+		return s.store.Flush()
+	})
+}
@@ -0,0 +1,112 @@
+package persistence
+
+import (
+	"bytes"
+	"log"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBreakerStore_ConsecutiveFailures(t *testing.T) {
+	var buf bytes.Buffer
+	backend := &downStore{InMemoryStore: NewInMemoryStore(time.Hour), down: true}
+	s := NewBreakerStore(backend, &BreakerOptions{
+		ConsecutiveFailures: 3,
+		OpenTimeout:         50 * time.Millisecond,
+		Logger:              NewStdLogger(log.New(&buf, "", 0), LevelInfo),
+	})
+
+	var value string
+	for i := 0; i < 3; i++ {
+		if err := s.Get("key", &value); err != errShardDown {
+			t.Fatalf("Expected the error of the store, got %v", err)
+		}
+	}
+	if !s.CircuitOpen() {
+		t.Fatalf("Expected the circuit to open, got %s", s.State())
+	}
+	if err := s.Set("key", "value", DEFAULT); err != ErrCircuitOpen {
+		t.Errorf("Expected ErrCircuitOpen, got %v", err)
+	}
+	if !strings.Contains(buf.String(), "WARN cache: circuit opened retry_in=50ms error=shard down") {
+		t.Errorf("Expected the opening to be logged, got %q", buf.String())
+	}
+
+	// a failed probe opens the circuit again
+	time.Sleep(60 * time.Millisecond)
+	if state := s.State(); state != BreakerHalfOpen {
+		t.Fatalf("Expected the circuit to be half-open, got %s", state)
+	}
+	if err := s.Get("key", &value); err != errShardDown {
+		t.Errorf("Expected the probe to reach the store, got %v", err)
+	}
+	if state := s.State(); state != BreakerOpen {
+		t.Fatalf("Expected the circuit to open again, got %s", state)
+	}
+
+	// a successful probe closes it
+	backend.down = false
+	time.Sleep(60 * time.Millisecond)
+	if err := s.Get("key", &value); err != ErrCacheMiss {
+		t.Errorf("Expected the probe to reach the store, got %v", err)
+	}
+	if state := s.State(); state != BreakerClosed {
+		t.Fatalf("Expected the circuit to close, got %s", state)
+	}
+	if !strings.Contains(buf.String(), "INFO cache: circuit closed") {
+		t.Errorf("Expected the closing to be logged, got %q", buf.String())
+	}
+}
+
+func TestBreakerStore_FailureRate(t *testing.T) {
+	backend := &downStore{InMemoryStore: NewInMemoryStore(time.Hour)}
+	s := NewBreakerStore(backend, &BreakerOptions{
+		ConsecutiveFailures: 100,
+		FailureRate:         0.5,
+		MinRequests:         10,
+	})
+
+	var value string
+	for i := 0; i < 10; i++ {
+		backend.down = i%2 == 1
+		s.Get("key", &value)
+		if i < 9 && s.CircuitOpen() {
+			t.Fatalf("Expected the circuit to wait for MinRequests, opened after %d", i+1)
+		}
+	}
+	if !s.CircuitOpen() {
+		t.Errorf("Expected a failure rate of 50%% to open the circuit, got %s", s.State())
+	}
+}
+
+// slowStore answers Get after delay
+type slowStore struct {
+	*InMemoryStore
+	delay time.Duration
+}
+
+func (s *slowStore) Get(key string, value interface{}) error {
+	time.Sleep(s.delay)
+	return s.InMemoryStore.Get(key, value)
+}
+
+func TestBreakerStore_Timeout(t *testing.T) {
+	backend := &slowStore{NewInMemoryStore(time.Hour), 100 * time.Millisecond}
+	s := NewBreakerStore(backend, &BreakerOptions{Timeout: 10 * time.Millisecond})
+	backend.Set("key", "value", DEFAULT)
+
+	value := "unchanged"
+	if err := s.Get("key", &value); err != ErrTimeout {
+		t.Errorf("Expected ErrTimeout, got %v", err)
+	}
+	time.Sleep(150 * time.Millisecond)
+	if value != "unchanged" {
+		t.Errorf("Expected a Get that timed out to leave the value alone, got %q", value)
+	}
+
+	s = NewBreakerStore(backend.InMemoryStore, &BreakerOptions{Timeout: 10 * time.Millisecond})
+	if err := s.Get("key", &value); err != nil || value != "value" {
+		t.Errorf("Expected the value, got %q, %v", value, err)
+	}
+}
@@ -0,0 +1,54 @@
+package persistence
+
+import (
+	"time"
+)
+
+// CASStore is implemented by stores able to write a key only when it hasn't
+// changed since it was read, for optimistic concurrency on shared values
+type CASStore interface {
+	// GetWithVersion reads key like Get and returns the version of its
+	// value, which is never 0
+	GetWithVersion(key string, value interface{}) (uint64, error)
+
+	// CompareAndSwap sets key like Set as long as its version is still
+	// version. It returns ErrNotStored when key was written since, and
+	// ErrCacheMiss when key is not in the cache anymore.
+	CompareAndSwap(key string, value interface{}, version uint64, expires time.Duration) error
+}
+
+// CASDeleter is implemented by the CASStores able to delete a key only when
+// it hasn't changed since it was read
+type CASDeleter interface {
+	// CompareAndDelete deletes key as long as its version is still version.
+	// It returns ErrNotStored when key was written since, and ErrCacheMiss
+	// when key is not in the cache anymore.
+	CompareAndDelete(key string, version uint64) error
+}
+
+// GetWithVersion reads key and its version from store, ErrNotSupport is
+// returned when store is not a CASStore
+func GetWithVersion(store CacheStore, key string, value interface{}) (uint64, error) {
+	if s, ok := store.(CASStore); ok {
+		return s.GetWithVersion(key, value)
+	}
+	return 0, ErrNotSupport
+}
+
+// CompareAndSwap sets key in store when it is still at version, ErrNotSupport
+// is returned when store is not a CASStore
+func CompareAndSwap(store CacheStore, key string, value interface{}, version uint64, expires time.Duration) error {
+	if s, ok := store.(CASStore); ok {
+		return s.CompareAndSwap(key, value, version, expires)
+	}
+	return ErrNotSupport
+}
+
+// CompareAndDelete deletes key from store when it is still at version,
+// ErrNotSupport is returned when store is not a CASDeleter
+func CompareAndDelete(store CacheStore, key string, version uint64) error {
+	if s, ok := store.(CASDeleter); ok {
+		return s.CompareAndDelete(key, version)
+	}
+	return ErrNotSupport
+}
@@ -0,0 +1,313 @@
+package persistence
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/gin-contrib/cache/utils"
+)
+
+// ErrInjected is the error returned by the faults of a ChaosStore without an
+// error of their own
+var ErrInjected = errors.New("cache: injected fault.")
+
+// FaultKind is the kind of fault a ChaosStore injects
+type FaultKind int
+
+// Fault kinds
+const (
+	// FaultLatency delays the command by Fault.Latency, it adds up with the
+	// other faults
+	FaultLatency FaultKind = iota
+	// FaultError fails the command with Fault.Err without running it
+	FaultError
+	// FaultMiss makes Get report ErrCacheMiss for a key that may exist
+	FaultMiss
+	// FaultCorrupt makes Get return garbage: the bytes of a []byte are
+	// altered, other values are decoded from random bytes, which usually
+	// fails like a corrupted payload does
+	FaultCorrupt
+	// FaultLostReply runs Set, Add or Replace to completion and fails them
+	// with Fault.Err anyway, as when the store applies a write but its reply
+	// is lost: the caller sees an error for a value that is stored
+	FaultLostReply
+)
+
+func (k FaultKind) String() string {
+	switch k {
+	case FaultLatency:
+		return "latency"
+	case FaultError:
+		return "error"
+	case FaultMiss:
+		return "miss"
+	case FaultCorrupt:
+		return "corrupt"
+	case FaultLostReply:
+		return "lost_reply"
+	}
+	return fmt.Sprintf("FaultKind(%d)", int(k))
+}
+
+// Fault is a fault injected by a ChaosStore in the commands it matches
+type Fault struct {
+	Kind FaultKind
+
+	// Ops are the lowercase names of the CacheStore methods the fault
+	// applies to, every method when empty
+	Ops []string
+
+	// Keys is a path.Match pattern of the keys the fault applies to, every
+	// key when empty
+	Keys string
+
+	// Rate is the probability, between 0 and 1, that a matching command is
+	// hit, every matching command is when 0
+	Rate float64
+
+	Latency time.Duration
+
+	// Err is returned by FaultError and FaultLostReply, ErrInjected when
+	// nil
+	Err error
+}
+
+func (f *Fault) matches(op, key string) bool {
+	if len(f.Ops) > 0 && !containsString(f.Ops, op) {
+		return false
+	}
+	if f.Keys == "" {
+		return true
+	}
+	ok, _ := path.Match(f.Keys, key)
+	return ok
+}
+
+func containsString(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *Fault) err() error {
+	if f.Err != nil {
+		return f.Err
+	}
+	return ErrInjected
+}
+
+// ChaosStore injects faults in the commands of the wrapped CacheStore, to
+// test how an application copes with a misbehaving cache. The faults are
+// drawn from a generator seeded at creation, so a sequence of commands meets
+// the same faults on every run.
+type ChaosStore struct {
+	store CacheStore
+
+	mu     sync.Mutex
+	rnd    *rand.Rand
+	faults []Fault
+}
+
+// NewChaosStore returns a ChaosStore wrapping store and injecting faults
+func NewChaosStore(store CacheStore, seed int64, faults ...Fault) *ChaosStore {
+	return &ChaosStore{
+		store:  store,
+		rnd:    rand.New(rand.NewSource(seed)),
+		faults: faults,
+	}
+}
+
+// SetFaults replaces the faults injected by the store, none are injected
+// anymore when faults is empty
+func (s *ChaosStore) SetFaults(faults ...Fault) {
+	s.mu.Lock()
+	s.faults = faults
+	s.mu.Unlock()
+}
+
+// inject waits for the latency drawn for op on key, and returns the first
+// other fault drawn, nil if none
+func (s *ChaosStore) inject(op, key string) *Fault {
+	var latency time.Duration
+	var fault *Fault
+	s.mu.Lock()
+	for i := range s.faults {
+		f := &s.faults[i]
+		if !f.matches(op, key) || (f.Rate > 0 && s.rnd.Float64() >= f.Rate) {
+			continue
+		}
+		switch {
+		case f.Kind == FaultLatency:
+			latency += f.Latency
+		case fault != nil:
+		case f.Kind == FaultError,
+			f.Kind == FaultMiss && op == "get",
+			f.Kind == FaultCorrupt && op == "get",
+			f.Kind == FaultLostReply && (op == "set" || op == "add" || op == "replace"):
+			drawn := *f
+			fault = &drawn
+		}
+	}
+	s.mu.Unlock()
+	if latency > 0 {
+		time.Sleep(latency)
+	}
+	return fault
+}
+
+// corrupt replaces the value read by Get with garbage
+func (s *ChaosStore) corrupt(value interface{}) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if b, ok := value.(*[]byte); ok {
+		if len(*b) > 0 {
+			garbled := append([]byte(nil), *b...)
+			garbled[s.rnd.Intn(len(garbled))] ^= 0xff
+			*b = garbled
+		}
+		return nil
+	}
+	garbage := make([]byte, 16)
+	s.rnd.Read(garbage)
+	return utils.Deserialize(garbage, value)
+}
+
+// Get (see CacheStore interface)
+func (s *ChaosStore) Get(key string, value interface{}) error {
+	fault := s.inject("get", key)
+	if fault == nil {
+		return s.store.Get(key, value)
+	}
+	switch fault.Kind {
+	case FaultMiss:
+		return ErrCacheMiss
+	case FaultCorrupt:
+		if err := s.store.Get(key, value); err != nil {
+			return err
+		}
+		return s.corrupt(value)
+	}
+	return fault.err()
+}
+
+// write runs a Set, Add or Replace through the faults
+func (s *ChaosStore) write(op, key string, f func() error) error {
+	fault := s.inject(op, key)
+	if fault == nil {
+		return f()
+	}
+	if fault.Kind == FaultLostReply {
+		if err := f(); err != nil {
+			return err
+		}
+	}
+	return fault.err()
+}
+
+// Set (see CacheStore interface)
+func (s *ChaosStore) Set(key string, value interface{}, expires time.Duration) error {
+	return s.write("set", key, func() error {
+		return s.store.Set(key, value, expires)
+	})
+}
+
+// Add (see CacheStore interface)
+func (s *ChaosStore) Add(key string, value interface{}, expires time.Duration) error {
+	return s.write("add", key, func() error {
+		return s.store.Add(key, value, expires)
+	})
+}
+
+// Replace (see CacheStore interface)
+func (s *ChaosStore) Replace(key string, value interface{}, expires time.Duration) error {
+	return s.write("replace", key, func() error {
+		return s.store.Replace(key, value, expires)
+	})
+}
+
+// Delete (see CacheStore interface)
+func (s *ChaosStore) Delete(key string) error {
+	if fault := s.inject("delete", key); fault != nil {
+		return fault.err()
+	}
+	return s.store.Delete(key)
+}
+
+// Increment (see CacheStore interface)
+func (s *ChaosStore) Increment(key string, delta uint64) (uint64, error) {
+	if fault := s.inject("increment", key); fault != nil {
+		return 0, fault.err()
+	}
+	return s.store.Increment(key, delta)
+}
+
+// Decrement (see CacheStore interface)
+func (s *ChaosStore) Decrement(key string, delta uint64) (uint64, error) {
+	if fault := s.inject("decrement", key); fault != nil {
+		return 0, fault.err()
+	}
+	return s.store.Decrement(key, delta)
+}
+
+// TTL (see ExpiryStore interface)
+func (s *ChaosStore) TTL(key string) (time.Duration, error) {
+	if fault := s.inject("ttl", key); fault != nil {
+		return 0, fault.err()
+	}
+	return TTL(s.store, key)
+}
+
+// Touch (see ExpiryStore interface)
+func (s *ChaosStore) Touch(key string, expires time.Duration) error {
+	if fault := s.inject("touch", key); fault != nil {
+		return fault.err()
+	}
+	return Touch(s.store, key, expires)
+}
+
+// GetWithVersion (see CASStore interface)
+func (s *ChaosStore) GetWithVersion(key string, value interface{}) (uint64, error) {
+	if fault := s.inject("getwithversion", key); fault != nil {
+		return 0, fault.err()
+	}
+	return GetWithVersion(s.store, key, value)
+}
+
+// CompareAndSwap (see CASStore interface)
+func (s *ChaosStore) CompareAndSwap(key string, value interface{}, version uint64, expires time.Duration) error {
+	if fault := s.inject("compareandswap", key); fault != nil {
+		return fault.err()
+	}
+	return CompareAndSwap(s.store, key, value, version, expires)
+}
+
+// CompareAndDelete (see CASDeleter interface)
+func (s *ChaosStore) CompareAndDelete(key string, version uint64) error {
+	if fault := s.inject("compareanddelete", key); fault != nil {
+		return fault.err()
+	}
+	return CompareAndDelete(s.store, key, version)
+}
+
+// Scan (see Scanner interface), the faults are matched against the prefix
+func (s *ChaosStore) Scan(prefix, cursor string, count int) ([]KeyInfo, string, error) {
+	if fault := s.inject("scan", prefix); fault != nil {
+		return nil, "", fault.err()
+	}
+	return Scan(s.store, prefix, cursor, count)
+}
+
+// Flush (see CacheStore interface)
+func (s *ChaosStore) Flush() error {
+	if fault := s.inject("flush", ""); fault != nil {
+		return fault.err()
+	}
+	return s.store.Flush()
+}
@@ -0,0 +1,107 @@
+package persistence
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestChaosStore_Deterministic(t *testing.T) {
+	run := func() []error {
+		s := NewChaosStore(NewInMemoryStore(time.Hour), 42, Fault{Kind: FaultError, Rate: 0.5})
+		errs := make([]error, 20)
+		for i := range errs {
+			errs[i] = s.Set("key", "value", DEFAULT)
+		}
+		return errs
+	}
+	first, second := run(), run()
+	failed := 0
+	for i := range first {
+		if first[i] != second[i] {
+			t.Fatalf("Expected the same faults with the same seed, call %d got %v then %v", i, first[i], second[i])
+		}
+		if first[i] == ErrInjected {
+			failed++
+		}
+	}
+	if failed == 0 || failed == len(first) {
+		t.Errorf("Expected about half of the calls to fail, %d of %d did", failed, len(first))
+	}
+}
+
+func TestChaosStore_Matching(t *testing.T) {
+	down := errors.New("down")
+	backend := NewInMemoryStore(time.Hour)
+	s := NewChaosStore(backend, 1,
+		Fault{Kind: FaultError, Ops: []string{"set"}, Keys: "page:*", Err: down},
+		Fault{Kind: FaultMiss, Keys: "missing:*"},
+	)
+
+	if err := s.Set("page:1", "value", DEFAULT); err != down {
+		t.Errorf("Expected the fault on a matching key, got %v", err)
+	}
+	var value string
+	if err := backend.Get("page:1", &value); err != ErrCacheMiss {
+		t.Errorf("Expected the failed write not to reach the store, got %v", err)
+	}
+	if err := s.Set("other", "value", DEFAULT); err != nil {
+		t.Errorf("Expected no fault on another key, got %v", err)
+	}
+	if err := s.Add("page:2", "value", DEFAULT); err != nil {
+		t.Errorf("Expected no fault on another op, got %v", err)
+	}
+
+	backend.Set("missing:1", "value", DEFAULT)
+	if err := s.Get("missing:1", &value); err != ErrCacheMiss {
+		t.Errorf("Expected a spurious miss, got %v", err)
+	}
+	if err := s.Set("missing:1", "value", DEFAULT); err != nil {
+		t.Errorf("Expected misses to only affect Get, got %v", err)
+	}
+
+	s.SetFaults()
+	if err := s.Get("missing:1", &value); err != nil || value != "value" {
+		t.Errorf("Expected no fault anymore, got %q, %v", value, err)
+	}
+}
+
+func TestChaosStore_Payloads(t *testing.T) {
+	backend := NewInMemoryStore(time.Hour)
+	s := NewChaosStore(backend, 1,
+		Fault{Kind: FaultCorrupt, Keys: "corrupt:*"},
+		Fault{Kind: FaultLostReply, Keys: "lost:*"},
+		Fault{Kind: FaultLatency, Keys: "slow", Latency: 20 * time.Millisecond},
+	)
+
+	backend.Set("corrupt:bytes", []byte("payload"), DEFAULT)
+	var b []byte
+	if err := s.Get("corrupt:bytes", &b); err != nil || string(b) == "payload" || len(b) != len("payload") {
+		t.Errorf("Expected altered bytes, got %q, %v", b, err)
+	}
+	var stored []byte
+	backend.Get("corrupt:bytes", &stored)
+	if string(stored) != "payload" {
+		t.Errorf("Expected the stored payload to be left alone, got %q", stored)
+	}
+
+	backend.Set("corrupt:page", map[string]string{"key": "value"}, DEFAULT)
+	var page map[string]string
+	if err := s.Get("corrupt:page", &page); err == nil {
+		t.Errorf("Expected a decoding error, got %v", page)
+	}
+
+	if err := s.Set("lost:1", "value", DEFAULT); err != ErrInjected {
+		t.Errorf("Expected ErrInjected, got %v", err)
+	}
+	var value string
+	if err := backend.Get("lost:1", &value); err != nil || value != "value" {
+		t.Errorf("Expected the write to reach the store, got %q, %v", value, err)
+	}
+
+	start := time.Now()
+	s.Get("slow", &value)
+	if elapsed := time.Since(start); elapsed < 20*time.Millisecond {
+		t.Errorf("Expected a latency of 20ms, took %s", elapsed)
+	}
+}
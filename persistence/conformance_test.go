@@ -0,0 +1,194 @@
+package persistence_test
+
+import (
+	"bufio"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/gin-contrib/cache/persistence"
+	"github.com/gin-contrib/cache/persistence/storetest"
+	"github.com/memcachier/mc"
+)
+
+func init() {
+	// the stores and the fakes expire keys on time
+	storetest.ExpirationWait = 1200 * time.Millisecond
+}
+
+var newInMemoryStore = func(_ *testing.T, defaultExpiration time.Duration) persistence.CacheStore {
+	return persistence.NewInMemoryStore(defaultExpiration)
+}
+
+func TestInMemoryCache(t *testing.T) {
+	storetest.Run(t, newInMemoryStore)
+}
+
+var newPrefixedStore = func(_ *testing.T, defaultExpiration time.Duration) persistence.CacheStore {
+	return persistence.NewPrefixedStore(persistence.NewInMemoryStore(defaultExpiration), "prefix")
+}
+
+func TestPrefixedStore(t *testing.T) {
+	storetest.Run(t, newPrefixedStore)
+}
+
+var newTracedStore = func(_ *testing.T, defaultExpiration time.Duration) persistence.CacheStore {
+	return persistence.NewTracedStore(persistence.NewInMemoryStore(defaultExpiration), "memory", persistence.NoopTracer{})
+}
+
+func TestTracedStore(t *testing.T) {
+	storetest.Run(t, newTracedStore)
+}
+
+var newInstrumentedStore = func(_ *testing.T, defaultExpiration time.Duration) persistence.CacheStore {
+	return persistence.NewInstrumentedStore(persistence.NewInMemoryStore(defaultExpiration), "memory", nopObserver{})
+}
+
+func TestInstrumentedStore(t *testing.T) {
+	storetest.Run(t, newInstrumentedStore)
+}
+
+var newShardedStore = func(_ *testing.T, defaultExpiration time.Duration) persistence.CacheStore {
+	store := persistence.NewShardedStore(nil)
+	for _, name := range []string{"a", "b", "c"} {
+		store.AddShard(name, persistence.NewInMemoryStore(defaultExpiration))
+	}
+	return store
+}
+
+func TestShardedStore(t *testing.T) {
+	storetest.Run(t, newShardedStore)
+}
+
+var newMirrorStore = func(_ *testing.T, defaultExpiration time.Duration) persistence.CacheStore {
+	store := persistence.NewMirrorStore(persistence.NewInMemoryStore(defaultExpiration), &persistence.MirrorOptions{ShadowReads: true})
+	store.AddSecondary("memory", persistence.NewInMemoryStore(defaultExpiration))
+	return store
+}
+
+func TestMirrorStore(t *testing.T) {
+	storetest.Run(t, newMirrorStore)
+}
+
+var newBreakerStore = func(_ *testing.T, defaultExpiration time.Duration) persistence.CacheStore {
+	return persistence.NewBreakerStore(persistence.NewInMemoryStore(defaultExpiration), &persistence.BreakerOptions{Timeout: time.Second})
+}
+
+func TestBreakerStore(t *testing.T) {
+	storetest.Run(t, newBreakerStore)
+}
+
+var newRetryStore = func(_ *testing.T, defaultExpiration time.Duration) persistence.CacheStore {
+	return persistence.NewRetryStore(persistence.NewInMemoryStore(defaultExpiration), nil)
+}
+
+func TestRetryStore(t *testing.T) {
+	storetest.Run(t, newRetryStore)
+}
+
+type nopObserver struct{}
+
+func (nopObserver) ObserveStore(store, op string, elapsed time.Duration, err error) {}
+
+// The redis tests run against an in-process fake of redis
+var newRedisStore = func(t *testing.T, defaultExpiration time.Duration) persistence.CacheStore {
+	redisCache := persistence.NewRedisCache(persistence.FakeRedisAddr(t), "", defaultExpiration)
+	if err := redisCache.Flush(); err != nil {
+		t.Fatalf("couldn't flush the fake redis: %s", err)
+	}
+	return redisCache
+}
+
+func TestRedisCache(t *testing.T) {
+	storetest.Run(t, newRedisStore)
+}
+
+var newRedisSentinelStore = func(t *testing.T, defaultExpiration time.Duration) persistence.CacheStore {
+	redisCache := persistence.NewRedisSentinelCache("mymaster", []string{persistence.FakeRedisSentinelAddr(t)}, nil, defaultExpiration)
+	if err := redisCache.Flush(); err != nil {
+		t.Fatalf("couldn't flush the fake redis: %s", err)
+	}
+	return redisCache
+}
+
+func TestRedisSentinelCache(t *testing.T) {
+	storetest.Run(t, newRedisSentinelStore)
+}
+
+var newRedisClusterStore = func(t *testing.T, defaultExpiration time.Duration) persistence.CacheStore {
+	redisCache := persistence.NewRedisClusterCache(persistence.FakeRedisClusterAddrs(t), nil, defaultExpiration)
+	if err := redisCache.Flush(); err != nil {
+		t.Fatalf("couldn't flush the fake redis cluster: %s", err)
+	}
+	return redisCache
+}
+
+func TestRedisClusterCache(t *testing.T) {
+	storetest.Run(t, newRedisClusterStore)
+}
+
+var newGoRedisStore = func(t *testing.T, defaultExpiration time.Duration) persistence.CacheStore {
+	redisCache := persistence.NewGoRedisStore(persistence.FakeRedisAddr(t), "", defaultExpiration)
+	if err := redisCache.Flush(); err != nil {
+		t.Fatalf("couldn't flush the fake redis: %s", err)
+	}
+	return redisCache
+}
+
+func TestGoRedisCache(t *testing.T) {
+	storetest.Run(t, newGoRedisStore)
+}
+
+// The memcached tests run against an in-process fake of memcached
+var newMemcachedStore = func(t *testing.T, defaultExpiration time.Duration) persistence.CacheStore {
+	server := persistence.FakeMemcachedAddr(t)
+	c, err := net.Dial("tcp", server)
+	if err == nil {
+		// wait for the reply so that the flush can not overtake the test
+		c.Write([]byte("flush_all\r\n"))
+		bufio.NewReader(c).ReadString('\n')
+		c.Close()
+		return persistence.NewMemcachedStore([]string{server}, defaultExpiration)
+	}
+	t.Errorf("couldn't connect to memcached on %s", server)
+	t.FailNow()
+	panic("")
+}
+
+func TestMemcachedCache(t *testing.T) {
+	storetest.Run(t, newMemcachedStore)
+}
+
+var newMcStore = func(t *testing.T, defaultExpiration time.Duration) persistence.CacheStore {
+	server := persistence.FakeMemcachedAddr(t)
+	mcStore := persistence.NewMemcachedBinaryStore(server, "", "", defaultExpiration)
+	err := mcStore.Flush()
+	if err == nil {
+		return mcStore
+	}
+	t.Errorf("Failed to connect to memcached on %s with %s", server, err)
+	t.FailNow()
+	panic("")
+}
+
+func TestMemcachedBinary(t *testing.T) {
+	storetest.Run(t, newMcStore)
+}
+
+var newMcStoreWithConfig = func(t *testing.T, defaultExpiration time.Duration) persistence.CacheStore {
+	config := mc.DefaultConfig()
+	config.PoolSize = 2
+	server := persistence.FakeMemcachedAddr(t)
+	mcStore := persistence.NewMemcachedBinaryStoreWithConfig(server, "", "", defaultExpiration, config)
+	err := mcStore.Flush()
+	if err == nil {
+		return mcStore
+	}
+	t.Errorf("Failed to connect to memcached on %s with %s", server, err)
+	t.FailNow()
+	panic("")
+}
+
+func TestMemcachedBinaryWithConfig(t *testing.T) {
+	storetest.Run(t, newMcStoreWithConfig)
+}
@@ -0,0 +1,35 @@
+package persistence
+
+import (
+	"time"
+)
+
+// ExpiryStore is implemented by stores able to tell how long an item has
+// left and to change its expiration without rewriting its value
+type ExpiryStore interface {
+	// TTL returns the time left before key expires, FOREVER when it never
+	// does, and ErrCacheMiss when key is not in the cache
+	TTL(key string) (time.Duration, error)
+
+	// Touch sets the expiration of key like Set does, DEFAULT and FOREVER
+	// included, and returns ErrCacheMiss when key is not in the cache
+	Touch(key string, expires time.Duration) error
+}
+
+// TTL returns the time left before key expires in store, ErrNotSupport when
+// store is not an ExpiryStore
+func TTL(store CacheStore, key string) (time.Duration, error) {
+	if s, ok := store.(ExpiryStore); ok {
+		return s.TTL(key)
+	}
+	return 0, ErrNotSupport
+}
+
+// Touch sets the expiration of key in store, ErrNotSupport is returned when
+// store is not an ExpiryStore
+func Touch(store CacheStore, key string, expires time.Duration) error {
+	if s, ok := store.(ExpiryStore); ok {
+		return s.Touch(key, expires)
+	}
+	return ErrNotSupport
+}
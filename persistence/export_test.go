@@ -0,0 +1,44 @@
+package persistence
+
+import (
+	"sync"
+	"testing"
+)
+
+// FakeRedisAddr returns the address of the in-process fake of redis shared by
+// the tests, for the tests of package persistence_test
+func FakeRedisAddr(t *testing.T) string {
+	return fakeRedisServer(t).Addr()
+}
+
+// FakeMemcachedAddr returns the address of the in-process fake of memcached
+// shared by the tests, for the tests of package persistence_test
+func FakeMemcachedAddr(t *testing.T) string {
+	return fakeMemcachedServer(t).Addr()
+}
+
+var (
+	fakeRedisClusterOnce   sync.Once
+	sharedFakeRedisCluster *fakeRedisCluster
+	fakeSentinelOnce       sync.Once
+	sharedFakeSentinel     *fakeRedis
+)
+
+// FakeRedisClusterAddrs returns the addresses of the nodes of the in-process
+// fake of a redis cluster shared by the tests
+func FakeRedisClusterAddrs(t *testing.T) []string {
+	fakeRedisClusterOnce.Do(func() {
+		sharedFakeRedisCluster = newFakeRedisCluster(t, 3)
+	})
+	return sharedFakeRedisCluster.Addrs()
+}
+
+// FakeRedisSentinelAddr returns the address of an in-process fake of a
+// sentinel, which reports the fake of FakeRedisAddr as the master "mymaster"
+func FakeRedisSentinelAddr(t *testing.T) string {
+	fakeSentinelOnce.Do(func() {
+		sharedFakeSentinel = newFakeRedis(t)
+		sharedFakeSentinel.Monitor("mymaster", FakeRedisAddr(t))
+	})
+	return sharedFakeSentinel.Addr()
+}
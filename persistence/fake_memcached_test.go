@@ -0,0 +1,538 @@
+package persistence
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeMemcached is an in-process server speaking enough of the memcached text
+// and binary protocols for the memcached stores. Like memcached, it tells the
+// protocol of a connection by its first byte.
+type fakeMemcached struct {
+	ln    net.Listener
+	mu    sync.Mutex
+	data  map[string]*fakeMemcachedItem
+	cas   uint64
+	conns map[net.Conn]bool
+}
+
+type fakeMemcachedItem struct {
+	value  []byte
+	flags  uint32
+	expire time.Time
+	cas    uint64
+}
+
+// results of the commands, each protocol has its own way to report them
+const (
+	fakeMcOK = iota
+	fakeMcNotStored
+	fakeMcExists
+	fakeMcNotFound
+	fakeMcNonNumeric
+)
+
+// memcached handles expirations over 30 days as unix timestamps
+const fakeMcRelativeExpirationLimit = 60 * 60 * 24 * 30
+
+func newFakeMemcached(t *testing.T) *fakeMemcached {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("couldn't start the fake memcached: %s", err)
+	}
+	f := &fakeMemcached{
+		ln:    ln,
+		data:  map[string]*fakeMemcachedItem{},
+		conns: map[net.Conn]bool{},
+	}
+	go f.serve()
+	return f
+}
+
+var (
+	fakeMemcachedOnce   sync.Once
+	sharedFakeMemcached *fakeMemcached
+)
+
+// fakeMemcachedServer returns the fake shared by the tests of the package
+func fakeMemcachedServer(t *testing.T) *fakeMemcached {
+	fakeMemcachedOnce.Do(func() {
+		sharedFakeMemcached = newFakeMemcached(t)
+	})
+	return sharedFakeMemcached
+}
+
+func (f *fakeMemcached) Addr() string {
+	return f.ln.Addr().String()
+}
+
+func (f *fakeMemcached) Close() {
+	f.ln.Close()
+	f.mu.Lock()
+	for conn := range f.conns {
+		conn.Close()
+	}
+	f.mu.Unlock()
+}
+
+func (f *fakeMemcached) serve() {
+	for {
+		conn, err := f.ln.Accept()
+		if err != nil {
+			return
+		}
+		f.mu.Lock()
+		f.conns[conn] = true
+		f.mu.Unlock()
+		go f.handle(conn)
+	}
+}
+
+func (f *fakeMemcached) handle(conn net.Conn) {
+	defer func() {
+		conn.Close()
+		f.mu.Lock()
+		delete(f.conns, conn)
+		f.mu.Unlock()
+	}()
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	first, err := r.Peek(1)
+	if err != nil {
+		return
+	}
+	if first[0] == fakeMcMagicRequest {
+		f.serveBinary(r, w)
+	} else {
+		f.serveText(r, w)
+	}
+}
+
+// item returns the live item of key, expired items are dropped
+func (f *fakeMemcached) item(key string) *fakeMemcachedItem {
+	it, ok := f.data[key]
+	if !ok {
+		return nil
+	}
+	if !it.expire.IsZero() && !time.Now().Before(it.expire) {
+		delete(f.data, key)
+		return nil
+	}
+	return it
+}
+
+// expiration converts a memcached expiration to a deadline, the zero time
+// means no expiration
+func fakeMcExpiration(exptime int64) time.Time {
+	switch {
+	case exptime == 0:
+		return time.Time{}
+	case exptime < 0:
+		return time.Now()
+	case exptime <= fakeMcRelativeExpirationLimit:
+		return time.Now().Add(time.Duration(exptime) * time.Second)
+	}
+	return time.Unix(exptime, 0)
+}
+
+// store runs set, add, replace and cas, a non zero cas must match the one of
+// the item
+func (f *fakeMemcached) store(cmd, key string, value []byte, flags uint32, exptime int64, cas uint64) int {
+	current := f.item(key)
+	switch {
+	case cmd == "add" && current != nil:
+		return fakeMcNotStored
+	case cmd == "replace" && current == nil:
+		return fakeMcNotStored
+	case cas != 0 && current == nil:
+		return fakeMcNotFound
+	case cas != 0 && current.cas != cas:
+		return fakeMcExists
+	}
+	f.cas++
+	f.data[key] = &fakeMemcachedItem{value, flags, fakeMcExpiration(exptime), f.cas}
+	return fakeMcOK
+}
+
+// count runs incr and decr: increments wrap around and decrements stop at 0
+func (f *fakeMemcached) count(key string, delta uint64, incr bool) (uint64, int) {
+	it := f.item(key)
+	if it == nil {
+		return 0, fakeMcNotFound
+	}
+	current, err := strconv.ParseUint(strings.TrimRight(string(it.value), " "), 10, 64)
+	if err != nil {
+		return 0, fakeMcNonNumeric
+	}
+	switch {
+	case incr:
+		current += delta
+	case delta >= current:
+		current = 0
+	default:
+		current -= delta
+	}
+	f.cas++
+	it.value, it.cas = []byte(strconv.FormatUint(current, 10)), f.cas
+	return current, fakeMcOK
+}
+
+func (f *fakeMemcached) touch(key string, exptime int64) *fakeMemcachedItem {
+	it := f.item(key)
+	if it != nil {
+		it.expire = fakeMcExpiration(exptime)
+	}
+	return it
+}
+
+func (f *fakeMemcached) flush() {
+	f.data = map[string]*fakeMemcachedItem{}
+}
+
+// text protocol
+
+var fakeMcTextReplies = map[int]string{
+	fakeMcOK:         "STORED",
+	fakeMcNotStored:  "NOT_STORED",
+	fakeMcExists:     "EXISTS",
+	fakeMcNotFound:   "NOT_FOUND",
+	fakeMcNonNumeric: "CLIENT_ERROR cannot increment or decrement non-numeric value",
+}
+
+func (f *fakeMemcached) serveText(r *bufio.Reader, w *bufio.Writer) {
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		args := strings.Fields(line)
+		if len(args) == 0 {
+			continue
+		}
+		cmd := args[0]
+		if cmd == "quit" {
+			return
+		}
+		var data []byte
+		switch cmd {
+		case "set", "add", "replace", "cas":
+			if len(args) < 5 {
+				w.WriteString("ERROR\r\n")
+				break
+			}
+			size, err := strconv.Atoi(args[4])
+			if err != nil || size < 0 {
+				w.WriteString("CLIENT_ERROR bad data chunk\r\n")
+				break
+			}
+			data = make([]byte, size+2)
+			if _, err := io.ReadFull(r, data); err != nil {
+				return
+			}
+			data = data[:size]
+		}
+		noreply := args[len(args)-1] == "noreply"
+		if noreply {
+			args = args[:len(args)-1]
+		}
+		f.mu.Lock()
+		reply := f.execText(cmd, args[1:], data)
+		f.mu.Unlock()
+		if !noreply {
+			w.WriteString(reply)
+		}
+		if err := w.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+func (f *fakeMemcached) execText(cmd string, args []string, data []byte) string {
+	switch cmd {
+	case "get", "gets", "gat", "gats":
+		withCAS := cmd == "gets" || cmd == "gats"
+		var touch bool
+		var exptime int64
+		if cmd == "gat" || cmd == "gats" {
+			if len(args) < 2 {
+				return "ERROR\r\n"
+			}
+			var err error
+			if exptime, err = strconv.ParseInt(args[0], 10, 64); err != nil {
+				return "CLIENT_ERROR invalid exptime argument\r\n"
+			}
+			touch, args = true, args[1:]
+		}
+		var b strings.Builder
+		for _, key := range args {
+			it := f.item(key)
+			if it == nil {
+				continue
+			}
+			if touch {
+				it.expire = fakeMcExpiration(exptime)
+			}
+			b.WriteString("VALUE " + key + " " + strconv.FormatUint(uint64(it.flags), 10) + " " + strconv.Itoa(len(it.value)))
+			if withCAS {
+				b.WriteString(" " + strconv.FormatUint(it.cas, 10))
+			}
+			b.WriteString("\r\n" + string(it.value) + "\r\n")
+		}
+		b.WriteString("END\r\n")
+		return b.String()
+	case "set", "add", "replace", "cas":
+		if len(args) < 4 || (cmd == "cas" && len(args) < 5) {
+			return "ERROR\r\n"
+		}
+		flags, err1 := strconv.ParseUint(args[1], 10, 32)
+		exptime, err2 := strconv.ParseInt(args[2], 10, 64)
+		var cas uint64
+		var err3 error
+		if cmd == "cas" {
+			cas, err3 = strconv.ParseUint(args[4], 10, 64)
+		}
+		if err1 != nil || err2 != nil || err3 != nil {
+			return "CLIENT_ERROR bad command line format\r\n"
+		}
+		return fakeMcTextReplies[f.store(cmd, args[0], data, uint32(flags), exptime, cas)] + "\r\n"
+	case "delete":
+		if len(args) < 1 {
+			return "ERROR\r\n"
+		}
+		if f.item(args[0]) == nil {
+			return "NOT_FOUND\r\n"
+		}
+		delete(f.data, args[0])
+		return "DELETED\r\n"
+	case "incr", "decr":
+		if len(args) != 2 {
+			return "ERROR\r\n"
+		}
+		delta, err := strconv.ParseUint(args[1], 10, 64)
+		if err != nil {
+			return "CLIENT_ERROR invalid numeric delta argument\r\n"
+		}
+		value, result := f.count(args[0], delta, cmd == "incr")
+		if result != fakeMcOK {
+			return fakeMcTextReplies[result] + "\r\n"
+		}
+		return strconv.FormatUint(value, 10) + "\r\n"
+	case "touch":
+		if len(args) != 2 {
+			return "ERROR\r\n"
+		}
+		exptime, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			return "CLIENT_ERROR invalid exptime argument\r\n"
+		}
+		if f.touch(args[0], exptime) == nil {
+			return "NOT_FOUND\r\n"
+		}
+		return "TOUCHED\r\n"
+	case "flush_all":
+		f.flush()
+		return "OK\r\n"
+	case "version":
+		return "VERSION fake\r\n"
+	}
+	return "ERROR\r\n"
+}
+
+// binary protocol
+
+const (
+	fakeMcMagicRequest  = 0x80
+	fakeMcMagicResponse = 0x81
+)
+
+const (
+	fakeMcOpGet       = 0x00
+	fakeMcOpSet       = 0x01
+	fakeMcOpAdd       = 0x02
+	fakeMcOpReplace   = 0x03
+	fakeMcOpDelete    = 0x04
+	fakeMcOpIncrement = 0x05
+	fakeMcOpDecrement = 0x06
+	fakeMcOpQuit      = 0x07
+	fakeMcOpFlush     = 0x08
+	fakeMcOpNoop      = 0x0a
+	fakeMcOpVersion   = 0x0b
+	fakeMcOpGetK      = 0x0c
+	fakeMcOpTouch     = 0x1c
+	fakeMcOpGAT       = 0x1d
+)
+
+const (
+	fakeMcStatusOK             = 0x00
+	fakeMcStatusNotFound       = 0x01
+	fakeMcStatusKeyExists      = 0x02
+	fakeMcStatusInvalidArgs    = 0x04
+	fakeMcStatusNotStored      = 0x05
+	fakeMcStatusNonNumeric     = 0x06
+	fakeMcStatusUnknownCommand = 0x81
+)
+
+// fakeMcHeader is the header of the binary requests and responses
+type fakeMcHeader struct {
+	Magic    uint8
+	Op       uint8
+	KeyLen   uint16
+	ExtraLen uint8
+	DataType uint8
+	Status   uint16
+	BodyLen  uint32
+	Opaque   uint32
+	CAS      uint64
+}
+
+type fakeMcResponse struct {
+	status uint16
+	cas    uint64
+	extras []byte
+	key    string
+	value  []byte
+}
+
+func (f *fakeMemcached) serveBinary(r *bufio.Reader, w *bufio.Writer) {
+	for {
+		var req fakeMcHeader
+		if err := binary.Read(r, binary.BigEndian, &req); err != nil {
+			return
+		}
+		body := make([]byte, req.BodyLen)
+		if _, err := io.ReadFull(r, body); err != nil {
+			return
+		}
+		if req.Op == fakeMcOpQuit {
+			return
+		}
+		extras := body[:req.ExtraLen]
+		key := string(body[int(req.ExtraLen) : int(req.ExtraLen)+int(req.KeyLen)])
+		value := body[int(req.ExtraLen)+int(req.KeyLen):]
+
+		f.mu.Lock()
+		res := f.execBinary(req, extras, key, value)
+		f.mu.Unlock()
+
+		binary.Write(w, binary.BigEndian, fakeMcHeader{
+			Magic:    fakeMcMagicResponse,
+			Op:       req.Op,
+			KeyLen:   uint16(len(res.key)),
+			ExtraLen: uint8(len(res.extras)),
+			Status:   res.status,
+			BodyLen:  uint32(len(res.extras) + len(res.key) + len(res.value)),
+			Opaque:   req.Opaque,
+			CAS:      res.cas,
+		})
+		w.Write(res.extras)
+		w.WriteString(res.key)
+		w.Write(res.value)
+		if err := w.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+func fakeMcError(status uint16, msg string) fakeMcResponse {
+	return fakeMcResponse{status: status, value: []byte(msg)}
+}
+
+func (f *fakeMemcached) execBinary(req fakeMcHeader, extras []byte, key string, value []byte) fakeMcResponse {
+	switch req.Op {
+	case fakeMcOpGet, fakeMcOpGetK, fakeMcOpGAT:
+		var it *fakeMemcachedItem
+		if req.Op == fakeMcOpGAT {
+			if len(extras) != 4 {
+				return fakeMcError(fakeMcStatusInvalidArgs, "Invalid arguments")
+			}
+			it = f.touch(key, int64(binary.BigEndian.Uint32(extras)))
+		} else {
+			it = f.item(key)
+		}
+		if it == nil {
+			return fakeMcError(fakeMcStatusNotFound, "Not found")
+		}
+		res := fakeMcResponse{cas: it.cas, extras: make([]byte, 4), value: it.value}
+		binary.BigEndian.PutUint32(res.extras, it.flags)
+		if req.Op == fakeMcOpGetK {
+			res.key = key
+		}
+		return res
+	case fakeMcOpSet, fakeMcOpAdd, fakeMcOpReplace:
+		if len(extras) != 8 {
+			return fakeMcError(fakeMcStatusInvalidArgs, "Invalid arguments")
+		}
+		cmd := map[uint8]string{fakeMcOpSet: "set", fakeMcOpAdd: "add", fakeMcOpReplace: "replace"}[req.Op]
+		flags := binary.BigEndian.Uint32(extras[:4])
+		exptime := int64(binary.BigEndian.Uint32(extras[4:]))
+		switch f.store(cmd, key, value, flags, exptime, req.CAS) {
+		case fakeMcOK:
+			return fakeMcResponse{cas: f.data[key].cas}
+		case fakeMcNotStored:
+			if req.Op == fakeMcOpAdd {
+				return fakeMcError(fakeMcStatusKeyExists, "Data exists for key.")
+			}
+			return fakeMcError(fakeMcStatusNotFound, "Not found")
+		case fakeMcExists:
+			return fakeMcError(fakeMcStatusKeyExists, "Data exists for key.")
+		}
+		return fakeMcError(fakeMcStatusNotFound, "Not found")
+	case fakeMcOpDelete:
+		it := f.item(key)
+		if it == nil {
+			return fakeMcError(fakeMcStatusNotFound, "Not found")
+		}
+		if req.CAS != 0 && req.CAS != it.cas {
+			return fakeMcError(fakeMcStatusKeyExists, "Data exists for key.")
+		}
+		delete(f.data, key)
+		return fakeMcResponse{}
+	case fakeMcOpIncrement, fakeMcOpDecrement:
+		if len(extras) != 20 {
+			return fakeMcError(fakeMcStatusInvalidArgs, "Invalid arguments")
+		}
+		delta := binary.BigEndian.Uint64(extras[:8])
+		initial := binary.BigEndian.Uint64(extras[8:16])
+		exptime := binary.BigEndian.Uint32(extras[16:])
+		if f.item(key) == nil {
+			// an expiration of all ones asks not to create the counter
+			if exptime == 0xffffffff {
+				return fakeMcError(fakeMcStatusNotFound, "Not found")
+			}
+			f.store("set", key, []byte(strconv.FormatUint(initial, 10)), 0, int64(exptime), 0)
+			delta = 0
+		}
+		n, result := f.count(key, delta, req.Op == fakeMcOpIncrement)
+		if result == fakeMcNonNumeric {
+			return fakeMcError(fakeMcStatusNonNumeric, "Non-numeric server-side value for incr or decr")
+		}
+		res := fakeMcResponse{cas: f.data[key].cas, value: make([]byte, 8)}
+		binary.BigEndian.PutUint64(res.value, n)
+		return res
+	case fakeMcOpFlush:
+		f.flush()
+		return fakeMcResponse{}
+	case fakeMcOpNoop:
+		return fakeMcResponse{}
+	case fakeMcOpVersion:
+		return fakeMcResponse{value: []byte("fake")}
+	case fakeMcOpTouch:
+		if len(extras) != 4 {
+			return fakeMcError(fakeMcStatusInvalidArgs, "Invalid arguments")
+		}
+		it := f.touch(key, int64(binary.BigEndian.Uint32(extras)))
+		if it == nil {
+			return fakeMcError(fakeMcStatusNotFound, "Not found")
+		}
+		return fakeMcResponse{cas: it.cas}
+	}
+	// the SASL commands are unknown too, like on a memcached without SASL
+	return fakeMcError(fakeMcStatusUnknownCommand, "Unknown command")
+}
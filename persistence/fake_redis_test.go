@@ -0,0 +1,956 @@
+package persistence
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRedis is an in-process server speaking enough of RESP for the redis
+// stores. Commands run one at a time, like on a real server, and the Lua
+// scripts of the stores are run by their Go equivalent in fakeScripts.
+//
+// It can also require authentication, be a replica, act as a sentinel or be
+// a node of a fakeRedisCluster.
+type fakeRedis struct {
+	ln      net.Listener
+	mu      sync.Mutex
+	dbs     map[int]map[string]*fakeRedisEntry
+	data    map[string]*fakeRedisEntry // keyspace of the running command
+	scripts map[string]string          // sha1 => source
+	conns   map[net.Conn]bool
+
+	users     map[string]string // username => password, no auth when empty
+	replicaOf string
+	masters   map[string]string // sentinel: master name => address
+	cluster   *fakeRedisCluster
+	drop      string // command run but answered by closing the connection
+}
+
+// fakeRedisSession is the state of a connection
+type fakeRedisSession struct {
+	user   string
+	db     int
+	asking bool
+}
+
+type fakeRedisEntry struct {
+	value  string
+	expire time.Time
+}
+
+type fakeRedisError string
+
+type fakeRedisStatus string
+
+// fakeScripts are the Go equivalents of the Lua scripts of the stores, the
+// scripts themselves run against a real server (see redisServerAddr)
+var fakeScripts = map[string]func(f *fakeRedis, keys, args []string) interface{}{
+	redisCounterScript:   fakeCounterScript,
+	redisTouchScript:     fakeTouchScript,
+	redisCASScript:       fakeCASScript,
+	redisGetScript:       fakeGetScript,
+	redisCASDeleteScript: fakeCASDeleteScript,
+}
+
+func newFakeRedis(t *testing.T) *fakeRedis {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("couldn't start the fake redis: %s", err)
+	}
+	return startFakeRedis(ln)
+}
+
+// newFakeRedisTLS returns a fake accepting TLS connections only, and a client
+// configuration trusting its certificate
+func newFakeRedisTLS(t *testing.T) (*fakeRedis, *tls.Config) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("couldn't generate a key: %s", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "fake redis"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IsCA:         true,
+
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("couldn't create a certificate: %s", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("couldn't parse the certificate: %s", err)
+	}
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+	})
+	if err != nil {
+		t.Fatalf("couldn't start the fake redis: %s", err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	return startFakeRedis(ln), &tls.Config{RootCAs: roots}
+}
+
+func startFakeRedis(ln net.Listener) *fakeRedis {
+	f := &fakeRedis{
+		ln:      ln,
+		dbs:     map[int]map[string]*fakeRedisEntry{},
+		scripts: map[string]string{},
+		conns:   map[net.Conn]bool{},
+		users:   map[string]string{},
+		masters: map[string]string{},
+	}
+	f.data = f.keyspace(0)
+	go f.serve()
+	return f
+}
+
+var (
+	fakeRedisOnce   sync.Once
+	sharedFakeRedis *fakeRedis
+)
+
+// fakeRedisServer returns the fake shared by the tests of the package
+func fakeRedisServer(t *testing.T) *fakeRedis {
+	fakeRedisOnce.Do(func() {
+		sharedFakeRedis = newFakeRedis(t)
+	})
+	return sharedFakeRedis
+}
+
+func (f *fakeRedis) Addr() string {
+	return f.ln.Addr().String()
+}
+
+// RequireAuth makes the fake refuse commands until AUTH succeeds, a password
+// alone authenticates the default user
+func (f *fakeRedis) RequireAuth(user, password string) {
+	f.mu.Lock()
+	f.users[user] = password
+	f.mu.Unlock()
+}
+
+// ReplicaOf makes the fake a replica of addr, or a master when addr is empty
+func (f *fakeRedis) ReplicaOf(addr string) {
+	f.mu.Lock()
+	f.replicaOf = addr
+	f.mu.Unlock()
+}
+
+// Monitor makes the fake a sentinel reporting addr as the master of name
+func (f *fakeRedis) Monitor(name, addr string) {
+	f.mu.Lock()
+	f.masters[name] = addr
+	f.mu.Unlock()
+}
+
+// Keys returns the keys stored in db
+func (f *fakeRedis) Keys(db int) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.data = f.keyspace(db)
+	var keys []string
+	for key := range f.data {
+		if f.get(key) != nil {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// keyspace returns the keys of db
+func (f *fakeRedis) keyspace(db int) map[string]*fakeRedisEntry {
+	if f.dbs[db] == nil {
+		f.dbs[db] = map[string]*fakeRedisEntry{}
+	}
+	return f.dbs[db]
+}
+
+// DropReplies makes the fake run cmd and close the connection instead of
+// replying, as a connection reset after a command was sent. No reply is
+// dropped with "".
+func (f *fakeRedis) DropReplies(cmd string) {
+	f.mu.Lock()
+	f.drop = cmd
+	f.mu.Unlock()
+}
+
+func (f *fakeRedis) Close() {
+	f.ln.Close()
+	f.mu.Lock()
+	for conn := range f.conns {
+		conn.Close()
+	}
+	f.mu.Unlock()
+}
+
+func (f *fakeRedis) serve() {
+	for {
+		conn, err := f.ln.Accept()
+		if err != nil {
+			return
+		}
+		f.mu.Lock()
+		f.conns[conn] = true
+		f.mu.Unlock()
+		go f.handle(conn)
+	}
+}
+
+func (f *fakeRedis) handle(conn net.Conn) {
+	defer func() {
+		conn.Close()
+		f.mu.Lock()
+		delete(f.conns, conn)
+		f.mu.Unlock()
+	}()
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	session := &fakeRedisSession{}
+	for {
+		args, err := readRESPCommand(r)
+		if err != nil {
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+		f.mu.Lock()
+		cmd := strings.ToUpper(args[0])
+		reply := f.run(session, cmd, args[1:])
+		drop := f.drop == cmd
+		f.mu.Unlock()
+		if drop {
+			return
+		}
+		writeRESP(w, reply)
+		if err := w.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+func readRESPCommand(r *bufio.Reader) ([]string, error) {
+	line, err := readRESPLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 || line[0] != '*' {
+		// inline command
+		return strings.Fields(line), nil
+	}
+	n, err := strconv.Atoi(line[1:])
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, n)
+	for i := range args {
+		line, err := readRESPLine(r)
+		if err != nil {
+			return nil, err
+		}
+		if len(line) == 0 || line[0] != '$' {
+			return nil, errors.New("expected a bulk string")
+		}
+		size, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		args[i] = string(buf[:size])
+	}
+	return args, nil
+}
+
+func readRESPLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func writeRESP(w *bufio.Writer, reply interface{}) {
+	switch v := reply.(type) {
+	case nil:
+		w.WriteString("$-1\r\n")
+	case fakeRedisStatus:
+		w.WriteString("+" + string(v) + "\r\n")
+	case fakeRedisError:
+		w.WriteString("-" + string(v) + "\r\n")
+	case int:
+		w.WriteString(":" + strconv.Itoa(v) + "\r\n")
+	case int64:
+		w.WriteString(":" + strconv.FormatInt(v, 10) + "\r\n")
+	case string:
+		w.WriteString("$" + strconv.Itoa(len(v)) + "\r\n" + v + "\r\n")
+	case []interface{}:
+		if v == nil {
+			w.WriteString("*-1\r\n")
+			return
+		}
+		w.WriteString("*" + strconv.Itoa(len(v)) + "\r\n")
+		for _, item := range v {
+			writeRESP(w, item)
+		}
+	default:
+		panic(fmt.Sprintf("fake redis: unexpected reply %T", reply))
+	}
+}
+
+var (
+	fakeRedisOK        = fakeRedisStatus("OK")
+	fakeRedisErrSyntax = fakeRedisError("ERR syntax error")
+	fakeRedisErrInt    = fakeRedisError("ERR value is not an integer or out of range")
+)
+
+// get returns the live entry of key, expired entries are dropped
+func (f *fakeRedis) get(key string) *fakeRedisEntry {
+	e, ok := f.data[key]
+	if !ok {
+		return nil
+	}
+	if !e.expire.IsZero() && !time.Now().Before(e.expire) {
+		delete(f.data, key)
+		return nil
+	}
+	return e
+}
+
+// TTL returns the time to live of key in milliseconds, as PTTL
+func (f *fakeRedis) TTL(key string) int64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.data = f.keyspace(0)
+	return f.pttl(key)
+}
+
+// run checks the session can run the command, and runs it on the keyspace
+// of the session
+func (f *fakeRedis) run(session *fakeRedisSession, cmd string, args []string) interface{} {
+	switch cmd {
+	case "AUTH":
+		user, password := "default", ""
+		switch len(args) {
+		case 1:
+			password = args[0]
+		case 2:
+			user, password = args[0], args[1]
+		default:
+			return fakeRedisErrSyntax
+		}
+		if len(f.users) == 0 && len(args) == 1 {
+			return fakeRedisError("ERR AUTH <password> called without any password configured for the default user")
+		}
+		if expected, ok := f.users[user]; !ok || expected != password {
+			return fakeRedisError("WRONGPASS invalid username-password pair or user is disabled.")
+		}
+		session.user = user
+		return fakeRedisOK
+	case "QUIT":
+		return fakeRedisOK
+	}
+	if len(f.users) > 0 && session.user == "" {
+		return fakeRedisError("NOAUTH Authentication required.")
+	}
+	switch cmd {
+	case "SELECT":
+		if len(args) != 1 {
+			return fakeRedisErrSyntax
+		}
+		db, err := strconv.Atoi(args[0])
+		if err != nil || db < 0 || db > 15 {
+			return fakeRedisError("ERR DB index is out of range")
+		}
+		if f.cluster != nil && db != 0 {
+			return fakeRedisError("ERR SELECT is not allowed in cluster mode")
+		}
+		session.db = db
+		return fakeRedisOK
+	case "ASKING":
+		session.asking = true
+		return fakeRedisOK
+	}
+	asking := session.asking
+	session.asking = false
+	f.data = f.keyspace(session.db)
+	if f.cluster != nil {
+		if redirect := f.cluster.route(f, cmd, args, asking); redirect != nil {
+			return redirect
+		}
+	}
+	return f.exec(cmd, args)
+}
+
+func (f *fakeRedis) pttl(key string) int64 {
+	e := f.get(key)
+	switch {
+	case e == nil:
+		return -2
+	case e.expire.IsZero():
+		return -1
+	}
+	return int64(time.Until(e.expire) / time.Millisecond)
+}
+
+func (f *fakeRedis) exec(cmd string, args []string) interface{} {
+	switch cmd {
+	case "PING":
+		if len(args) > 0 {
+			return args[0]
+		}
+		return fakeRedisStatus("PONG")
+	case "READONLY":
+		return fakeRedisOK
+	case "ROLE":
+		if f.replicaOf == "" {
+			return []interface{}{"master", int64(0), []interface{}{}}
+		}
+		host, port, _ := net.SplitHostPort(f.replicaOf)
+		p, _ := strconv.Atoi(port)
+		return []interface{}{"slave", host, p, "connected", int64(0)}
+	case "SENTINEL":
+		if len(args) != 2 || strings.ToLower(args[0]) != "get-master-addr-by-name" {
+			return fakeRedisErrSyntax
+		}
+		addr, ok := f.masters[args[1]]
+		if !ok {
+			return []interface{}(nil)
+		}
+		host, port, _ := net.SplitHostPort(addr)
+		return []interface{}{host, port}
+	case "CLUSTER":
+		if f.cluster == nil {
+			return fakeRedisError("ERR This instance has cluster support disabled")
+		}
+		if len(args) != 1 || strings.ToUpper(args[0]) != "SLOTS" {
+			return fakeRedisErrSyntax
+		}
+		return f.cluster.slotsReply()
+	case "GET":
+		if len(args) != 1 {
+			return fakeRedisErrSyntax
+		}
+		if e := f.get(args[0]); e != nil {
+			return e.value
+		}
+		return nil
+	case "STRLEN":
+		if len(args) != 1 {
+			return fakeRedisErrSyntax
+		}
+		if e := f.get(args[0]); e != nil {
+			return len(e.value)
+		}
+		return 0
+	case "SET":
+		return f.set(args)
+	case "SETNX":
+		if len(args) != 2 {
+			return fakeRedisErrSyntax
+		}
+		if f.set(append(args, "NX")) == nil {
+			return 0
+		}
+		return 1
+	case "SETEX", "PSETEX":
+		if len(args) != 3 {
+			return fakeRedisErrSyntax
+		}
+		ttl, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil || ttl <= 0 {
+			return fakeRedisError("ERR invalid expire time")
+		}
+		unit := time.Second
+		if cmd == "PSETEX" {
+			unit = time.Millisecond
+		}
+		f.data[args[0]] = &fakeRedisEntry{args[2], time.Now().Add(time.Duration(ttl) * unit)}
+		return fakeRedisOK
+	case "DEL", "EXISTS":
+		n := 0
+		for _, key := range args {
+			if f.get(key) != nil {
+				n++
+				if cmd == "DEL" {
+					delete(f.data, key)
+				}
+			}
+		}
+		return n
+	case "INCRBY", "DECRBY":
+		if len(args) != 2 {
+			return fakeRedisErrSyntax
+		}
+		delta, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			return fakeRedisErrInt
+		}
+		e := f.get(args[0])
+		if e == nil {
+			e = &fakeRedisEntry{value: "0"}
+			f.data[args[0]] = e
+		}
+		n, err := strconv.ParseInt(e.value, 10, 64)
+		if err != nil {
+			return fakeRedisErrInt
+		}
+		if cmd == "DECRBY" {
+			delta = -delta
+		}
+		e.value = strconv.FormatInt(n+delta, 10)
+		return n + delta
+	case "PTTL", "TTL":
+		if len(args) != 1 {
+			return fakeRedisErrSyntax
+		}
+		ttl := f.pttl(args[0])
+		if cmd == "TTL" && ttl > 0 {
+			ttl = (ttl + 500) / 1000
+		}
+		return ttl
+	case "FLUSHALL":
+		for _, keyspace := range f.dbs {
+			for key := range keyspace {
+				delete(keyspace, key)
+			}
+		}
+		return fakeRedisOK
+	case "FLUSHDB":
+		for key := range f.data {
+			delete(f.data, key)
+		}
+		return fakeRedisOK
+	case "SCAN":
+		return f.scan(args)
+	case "SCRIPT":
+		if len(args) == 2 && strings.ToUpper(args[0]) == "LOAD" {
+			return f.loadScript(args[1])
+		}
+		return fakeRedisErrSyntax
+	case "EVAL", "EVALSHA":
+		if len(args) < 2 {
+			return fakeRedisErrSyntax
+		}
+		src := args[0]
+		if cmd == "EVALSHA" {
+			var ok bool
+			if src, ok = f.scripts[strings.ToLower(args[0])]; !ok {
+				return fakeRedisError("NOSCRIPT No matching script. Please use EVAL.")
+			}
+		} else {
+			f.loadScript(src)
+		}
+		script, ok := fakeScripts[src]
+		if !ok {
+			return fakeRedisError("ERR unknown script")
+		}
+		n, err := strconv.Atoi(args[1])
+		if err != nil || n < 0 || n > len(args)-2 {
+			return fakeRedisError("ERR Number of keys can't be greater than number of args")
+		}
+		return script(f, args[2:2+n], args[2+n:])
+	}
+	return fakeRedisError("ERR unknown command '" + cmd + "'")
+}
+
+func (f *fakeRedis) set(args []string) interface{} {
+	if len(args) < 2 {
+		return fakeRedisErrSyntax
+	}
+	key, value := args[0], args[1]
+	var expire time.Time
+	var nx, xx, keepTTL bool
+	for i := 2; i < len(args); i++ {
+		switch opt := strings.ToUpper(args[i]); opt {
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		case "KEEPTTL":
+			keepTTL = true
+		case "EX", "PX":
+			if i+1 >= len(args) {
+				return fakeRedisErrSyntax
+			}
+			i++
+			ttl, err := strconv.ParseInt(args[i], 10, 64)
+			if err != nil || ttl <= 0 {
+				return fakeRedisError("ERR invalid expire time in 'set' command")
+			}
+			unit := time.Second
+			if opt == "PX" {
+				unit = time.Millisecond
+			}
+			expire = time.Now().Add(time.Duration(ttl) * unit)
+		default:
+			return fakeRedisErrSyntax
+		}
+	}
+	current := f.get(key)
+	if (nx && current != nil) || (xx && current == nil) {
+		return nil
+	}
+	if keepTTL && current != nil {
+		expire = current.expire
+	}
+	f.data[key] = &fakeRedisEntry{value, expire}
+	return fakeRedisOK
+}
+
+func (f *fakeRedis) scan(args []string) interface{} {
+	if len(args) < 1 {
+		return fakeRedisErrSyntax
+	}
+	cursor, err := strconv.Atoi(args[0])
+	if err != nil {
+		return fakeRedisError("ERR invalid cursor")
+	}
+	pattern, count := "*", 10
+	for i := 1; i+1 < len(args); i += 2 {
+		switch strings.ToUpper(args[i]) {
+		case "MATCH":
+			pattern = args[i+1]
+		case "COUNT":
+			if count, err = strconv.Atoi(args[i+1]); err != nil {
+				return fakeRedisErrInt
+			}
+		default:
+			return fakeRedisErrSyntax
+		}
+	}
+	keys := make([]string, 0, len(f.data))
+	for key := range f.data {
+		if f.get(key) != nil {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	// an empty page is an empty array, not a nil one
+	matched := []interface{}{}
+	next := 0
+	for i := cursor; i < len(keys); i++ {
+		if fakeRedisMatch(pattern, keys[i]) {
+			matched = append(matched, keys[i])
+		}
+		if i+1-cursor >= count && i+1 < len(keys) {
+			next = i + 1
+			break
+		}
+	}
+	return []interface{}{strconv.Itoa(next), matched}
+}
+
+// fakeRedisMatch matches s against a redis glob pattern
+func fakeRedisMatch(pattern, s string) bool {
+	var b strings.Builder
+	b.WriteString("^")
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; c {
+		case '*':
+			b.WriteString(".*")
+		case '?':
+			b.WriteString(".")
+		case '[':
+			end := strings.IndexByte(pattern[i:], ']')
+			if end < 0 {
+				b.WriteString(`\[`)
+				continue
+			}
+			b.WriteString(pattern[i : i+end+1])
+			i += end
+		case '\\':
+			if i+1 < len(pattern) {
+				i++
+			}
+			b.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString("$")
+	re, err := regexp.Compile(b.String())
+	return err == nil && re.MatchString(s)
+}
+
+func (f *fakeRedis) loadScript(src string) string {
+	h := sha1.Sum([]byte(src))
+	sha := hex.EncodeToString(h[:])
+	f.scripts[sha] = src
+	return sha
+}
+
+// fakeCounterScript is the Go equivalent of redisCounterScript
+func fakeCounterScript(f *fakeRedis, keys, args []string) interface{} {
+	e := f.get(keys[0])
+	if e == nil {
+		return nil
+	}
+	current, err := strconv.ParseUint(e.value, 10, 64)
+	if err != nil {
+		return fakeRedisErrInt
+	}
+	delta, _ := strconv.ParseUint(args[0], 10, 64)
+	switch {
+	case args[1] == "incr":
+		current += delta
+	case delta >= current:
+		current = 0
+	default:
+		current -= delta
+	}
+	e.value = strconv.FormatUint(current, 10)
+	return e.value
+}
+
+// fakeTouchScript is the Go equivalent of redisTouchScript
+func fakeTouchScript(f *fakeRedis, keys, args []string) interface{} {
+	e := f.get(keys[0])
+	if e == nil {
+		return 0
+	}
+	ms, _ := strconv.ParseInt(args[0], 10, 64)
+	if ms == 0 {
+		e.expire = time.Time{}
+	} else {
+		e.expire = time.Now().Add(time.Duration(ms) * time.Millisecond)
+	}
+	return 1
+}
+
+// fakeGetScript is the Go equivalent of redisGetScript
+func fakeGetScript(f *fakeRedis, keys, args []string) interface{} {
+	if e := f.get(keys[0]); e != nil {
+		return e.value
+	}
+	return nil
+}
+
+// fakeCASScript is the Go equivalent of redisCASScript
+func fakeCASScript(f *fakeRedis, keys, args []string) interface{} {
+	e := f.get(keys[0])
+	if e == nil {
+		return -1
+	}
+	h := sha1.Sum([]byte(e.value))
+	if hex.EncodeToString(h[:])[:16] != args[0] {
+		return 0
+	}
+	entry := &fakeRedisEntry{value: args[1]}
+	if ms, _ := strconv.ParseInt(args[2], 10, 64); ms > 0 {
+		entry.expire = time.Now().Add(time.Duration(ms) * time.Millisecond)
+	}
+	f.data[keys[0]] = entry
+	return 1
+}
+
+// fakeCASDeleteScript is the Go equivalent of redisCASDeleteScript
+func fakeCASDeleteScript(f *fakeRedis, keys, args []string) interface{} {
+	e := f.get(keys[0])
+	if e == nil {
+		return -1
+	}
+	h := sha1.Sum([]byte(e.value))
+	if hex.EncodeToString(h[:])[:16] != args[0] {
+		return 0
+	}
+	delete(f.data, keys[0])
+	return 1
+}
+
+// fakeRedisCluster shares the slots of a redis cluster between fake nodes,
+// which redirect the commands on keys of other nodes with MOVED and ASK
+type fakeRedisCluster struct {
+	nodes []*fakeRedis
+
+	mu        sync.Mutex
+	owners    []int       // node of each slot
+	migrating map[int]int // slot => node its keys are moving to
+}
+
+// newFakeRedisCluster returns a cluster of n nodes sharing the slots evenly
+func newFakeRedisCluster(t *testing.T, n int) *fakeRedisCluster {
+	c := &fakeRedisCluster{
+		owners:    make([]int, redisClusterSlots),
+		migrating: map[int]int{},
+	}
+	for slot := range c.owners {
+		c.owners[slot] = slot * n / redisClusterSlots
+	}
+	for i := 0; i < n; i++ {
+		node := newFakeRedis(t)
+		node.mu.Lock()
+		node.cluster = c
+		node.mu.Unlock()
+		c.nodes = append(c.nodes, node)
+	}
+	return c
+}
+
+func (c *fakeRedisCluster) Addrs() []string {
+	var addrs []string
+	for _, node := range c.nodes {
+		addrs = append(addrs, node.Addr())
+	}
+	return addrs
+}
+
+// Owner returns the node serving slot
+func (c *fakeRedisCluster) Owner(slot int) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.owners[slot]
+}
+
+// Move gives slot and its keys to the node to
+func (c *fakeRedisCluster) Move(slot, to int) {
+	c.mu.Lock()
+	from := c.nodes[c.owners[slot]]
+	c.owners[slot] = to
+	delete(c.migrating, slot)
+	c.mu.Unlock()
+	c.moveKeys(from, c.nodes[to], slot, nil)
+}
+
+// Migrate starts to move slot to the node to, with only keys moved yet. The
+// owner replies ASK for the keys it does not have until Move is called.
+func (c *fakeRedisCluster) Migrate(slot, to int, keys ...string) {
+	c.mu.Lock()
+	from := c.nodes[c.owners[slot]]
+	c.migrating[slot] = to
+	c.mu.Unlock()
+	c.moveKeys(from, c.nodes[to], slot, keys)
+}
+
+// moveKeys moves the keys of slot from a node to another, only the keys in
+// only when it is not nil
+func (c *fakeRedisCluster) moveKeys(from, to *fakeRedis, slot int, only []string) {
+	moved := map[string]*fakeRedisEntry{}
+	from.mu.Lock()
+	keyspace := from.keyspace(0)
+	for key, e := range keyspace {
+		if redisClusterSlot(key) != slot {
+			continue
+		}
+		if only != nil && !containsString(only, key) {
+			continue
+		}
+		moved[key] = e
+		delete(keyspace, key)
+	}
+	from.mu.Unlock()
+
+	to.mu.Lock()
+	keyspace = to.keyspace(0)
+	for key, e := range moved {
+		keyspace[key] = e
+	}
+	to.mu.Unlock()
+}
+
+func (c *fakeRedisCluster) Close() {
+	for _, node := range c.nodes {
+		node.Close()
+	}
+}
+
+// route returns the redirection of a command sent to node, nil when node
+// runs it
+func (c *fakeRedisCluster) route(node *fakeRedis, cmd string, args []string, asking bool) interface{} {
+	keys := fakeRedisKeys(cmd, args)
+	if len(keys) == 0 {
+		return nil
+	}
+	slot := redisClusterSlot(keys[0])
+	for _, key := range keys[1:] {
+		if redisClusterSlot(key) != slot {
+			return fakeRedisError("CROSSSLOT Keys in request don't hash to the same slot")
+		}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	owner := c.nodes[c.owners[slot]]
+	if to, ok := c.migrating[slot]; ok {
+		switch {
+		case node == owner && node.get(keys[0]) == nil:
+			return fakeRedisError(fmt.Sprintf("ASK %d %s", slot, c.nodes[to].Addr()))
+		case node == c.nodes[to] && asking:
+			return nil
+		}
+	}
+	if node != owner {
+		return fakeRedisError(fmt.Sprintf("MOVED %d %s", slot, owner.Addr()))
+	}
+	return nil
+}
+
+// fakeRedisKeys returns the keys of a command
+func fakeRedisKeys(cmd string, args []string) []string {
+	switch cmd {
+	case "GET", "STRLEN", "SET", "SETNX", "SETEX", "PSETEX", "INCRBY", "DECRBY", "PTTL", "TTL":
+		if len(args) > 0 {
+			return args[:1]
+		}
+	case "DEL", "EXISTS":
+		return args
+	case "EVAL", "EVALSHA":
+		if len(args) >= 2 {
+			if n, err := strconv.Atoi(args[1]); err == nil && n >= 0 && n <= len(args)-2 {
+				return args[2 : 2+n]
+			}
+		}
+	}
+	return nil
+}
+
+// slotsReply is the reply of CLUSTER SLOTS
+func (c *fakeRedisCluster) slotsReply() interface{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var reply []interface{}
+	start := 0
+	for slot := 1; slot <= redisClusterSlots; slot++ {
+		if slot < redisClusterSlots && c.owners[slot] == c.owners[start] {
+			continue
+		}
+		owner := c.owners[start]
+		host, port, _ := net.SplitHostPort(c.nodes[owner].Addr())
+		p, _ := strconv.Atoi(port)
+		reply = append(reply, []interface{}{
+			int64(start), int64(slot - 1),
+			[]interface{}{host, int64(p), fmt.Sprintf("node%d", owner)},
+		})
+		start = slot
+	}
+	return reply
+}
@@ -1,52 +1,237 @@
 package persistence
 
 import (
-	"github.com/gin-contrib/cache/utils"
-	"github.com/go-redis/redis"
+	"crypto/tls"
+	"errors"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/gin-contrib/cache/utils"
+	"github.com/go-redis/redis"
 )
 
 // GoRedisStore represents the cache with redis persistence
 type GoRedisStore struct {
 	cli               redis.UniversalClient
 	defaultExpiration time.Duration
+	logger            Logger
+
+	// replicas serve Get in turn when set, see GoRedisOptions.ReplicaAddrs
+	replicas []*redis.Client
+	next     uint32
 }
 
-// NewRedisCache returns a GoRedisStore
-// until redigo supports sharding/clustering, only one host will be in hostList
-func NewGoRedisStore(host string, password string, defaultExpiration time.Duration) *GoRedisStore {
-	addrs := strings.Split(host, ",")
-	cli := redis.NewUniversalClient(&redis.UniversalOptions{
-		Addrs:          addrs,
-		DialTimeout:    time.Duration(2) * time.Second,
-		ReadTimeout:    time.Duration(2) * time.Second,
-		IdleTimeout:    time.Duration(3) * time.Minute,
-		PoolSize:       2,
-		PoolTimeout:    30 * time.Second,
-		ReadOnly:       true,
-		RouteByLatency: true,
-		Password:       password,
+// GoRedisOptions configures a GoRedisStore. The zero value of the timeouts
+// and of the pool size keeps the defaults of go-redis.
+type GoRedisOptions struct {
+	// Addrs is the address of a single server, the seed nodes of a cluster
+	// when there are several, or the sentinels when MasterName is set
+	Addrs      []string
+	MasterName string
+
+	Password string
+
+	// DB is the database selected once connected, redis cluster only has 0
+	DB int
+
+	// TLSConfig enables TLS when set
+	TLSConfig *tls.Config
+
+	DialTimeout  time.Duration
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	PoolSize     int
+	PoolTimeout  time.Duration
+	IdleTimeout  time.Duration
+
+	// MaxRetries is the number of times go-redis retries a command failing
+	// with a network error
+	MaxRetries int
+
+	// ReadFromReplicas sends Get to the replicas: to the closest node serving
+	// the slot in a cluster, or in turn to ReplicaAddrs otherwise. Writes,
+	// counters and the checks of Add and Replace always run on the master, so
+	// replicas only make reads of a key written lately return a stale value or
+	// a miss until they catch up.
+	ReadFromReplicas bool
+	ReplicaAddrs     []string
+
+	// LazyConnect returns the store without checking the servers, the
+	// connections are made by the first commands
+	LazyConnect bool
+
+	// HealthCheckRetries is the number of times the servers are pinged again
+	// before the store is returned when the first ping fails. The delay between
+	// two pings starts at HealthCheckInterval, 100ms when 0, and doubles.
+	HealthCheckRetries  int
+	HealthCheckInterval time.Duration
+
+	// Logger receives the failed health checks and replica reads, it can be
+	// changed later with SetLogger
+	Logger Logger
+}
+
+func (o *GoRedisOptions) universal() *redis.UniversalOptions {
+	return &redis.UniversalOptions{
+		Addrs:          o.Addrs,
+		MasterName:     o.MasterName,
+		Password:       o.Password,
+		DB:             o.DB,
+		TLSConfig:      o.TLSConfig,
+		DialTimeout:    o.DialTimeout,
+		ReadTimeout:    o.ReadTimeout,
+		WriteTimeout:   o.WriteTimeout,
+		PoolSize:       o.PoolSize,
+		PoolTimeout:    o.PoolTimeout,
+		IdleTimeout:    o.IdleTimeout,
+		MaxRetries:     o.MaxRetries,
+		ReadOnly:       o.ReadFromReplicas,
+		RouteByLatency: o.ReadFromReplicas,
+	}
+}
+
+func (o *GoRedisOptions) replica(addr string) *redis.Client {
+	return redis.NewClient(&redis.Options{
+		Addr:         addr,
+		Password:     o.Password,
+		DB:           o.DB,
+		TLSConfig:    o.TLSConfig,
+		DialTimeout:  o.DialTimeout,
+		ReadTimeout:  o.ReadTimeout,
+		WriteTimeout: o.WriteTimeout,
+		PoolSize:     o.PoolSize,
+		PoolTimeout:  o.PoolTimeout,
+		IdleTimeout:  o.IdleTimeout,
+		MaxRetries:   o.MaxRetries,
 	})
-	cmd := cli.Ping()
-	if cmd.Err() != nil {
-		panic(cmd.Err())
+}
+
+func (o *GoRedisOptions) validate() error {
+	cluster := o.MasterName == "" && len(o.Addrs) > 1
+	switch {
+	case len(o.Addrs) == 0:
+		return errors.New("redis: no address configured")
+	case cluster && o.DB != 0:
+		return errors.New("redis: a cluster only has the database 0")
+	case len(o.ReplicaAddrs) > 0 && !o.ReadFromReplicas:
+		return errors.New("redis: ReplicaAddrs is set without ReadFromReplicas")
+	case len(o.ReplicaAddrs) > 0 && cluster:
+		return errors.New("redis: the replicas of a cluster are found by the client, ReplicaAddrs must be empty")
+	case o.ReadFromReplicas && !cluster && len(o.ReplicaAddrs) == 0:
+		return errors.New("redis: ReadFromReplicas needs a cluster or ReplicaAddrs")
 	}
+	return nil
+}
 
-	return &GoRedisStore{cli, defaultExpiration}
+// NewGoRedisStoreWithOptions returns a GoRedisStore configured by options.
+// Unless options.LazyConnect is set, the servers are pinged and an error is
+// returned when they don't answer after options.HealthCheckRetries retries.
+func NewGoRedisStoreWithOptions(options *GoRedisOptions, defaultExpiration time.Duration) (*GoRedisStore, error) {
+	if err := options.validate(); err != nil {
+		return nil, err
+	}
+	store := NewGoRedisStoreWithClient(redis.NewUniversalClient(options.universal()), defaultExpiration)
+	if options.Logger != nil {
+		store.logger = options.Logger
+	}
+	for _, addr := range options.ReplicaAddrs {
+		store.replicas = append(store.replicas, options.replica(addr))
+	}
+	if options.LazyConnect {
+		return store, nil
+	}
+	if err := store.healthCheck(options.HealthCheckRetries, options.HealthCheckInterval); err != nil {
+		store.Close()
+		return nil, err
+	}
+	return store, nil
 }
 
+// NewGoRedisStore returns a GoRedisStore for the server, or the cluster when
+// host lists several nodes separated by commas, and panics when they can't
+// be reached. NewGoRedisStoreWithOptions returns an error instead.
+func NewGoRedisStore(host string, password string, defaultExpiration time.Duration) *GoRedisStore {
+	addrs := strings.Split(host, ",")
+	store, err := NewGoRedisStoreWithOptions(&GoRedisOptions{
+		Addrs:            addrs,
+		Password:         password,
+		DialTimeout:      2 * time.Second,
+		ReadTimeout:      2 * time.Second,
+		IdleTimeout:      3 * time.Minute,
+		PoolSize:         2,
+		PoolTimeout:      30 * time.Second,
+		ReadFromReplicas: len(addrs) > 1,
+	}, defaultExpiration)
+	if err != nil {
+		panic(err)
+	}
+	return store
+}
+
+// NewGoRedisStoreWithOption returns a GoRedisStore using a client created
+// with opt, and panics when the servers can't be reached
 func NewGoRedisStoreWithOption(opt *redis.UniversalOptions, defaultExpiration time.Duration) *GoRedisStore {
 	cli := redis.NewUniversalClient(opt)
 	cmd := cli.Ping()
 	if cmd.Err() != nil {
 		panic(cmd.Err())
 	}
-	return &GoRedisStore{cli, defaultExpiration}
+	return &GoRedisStore{cli: cli, defaultExpiration: defaultExpiration, logger: NopLogger{}}
 }
 
+// NewGoRedisStoreWithClient returns a GoRedisStore using cli
 func NewGoRedisStoreWithClient(cli redis.UniversalClient, defaultExpiration time.Duration) *GoRedisStore {
-	return &GoRedisStore{cli, defaultExpiration}
+	return &GoRedisStore{cli: cli, defaultExpiration: defaultExpiration, logger: NopLogger{}}
+}
+
+// Ping checks that the master and the replicas answer
+func (c *GoRedisStore) Ping() error {
+	if err := c.cli.Ping().Err(); err != nil {
+		return err
+	}
+	for _, replica := range c.replicas {
+		if err := replica.Ping().Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// healthCheck pings the servers until they answer or retries is exhausted
+func (c *GoRedisStore) healthCheck(retries int, interval time.Duration) error {
+	if interval <= 0 {
+		interval = 100 * time.Millisecond
+	}
+	for attempt := 0; ; attempt++ {
+		err := c.Ping()
+		if err == nil || attempt >= retries {
+			return err
+		}
+		c.logger.Log(LevelWarn, "cache: redis health check failed",
+			Field{"attempt", attempt + 1}, Field{"retry_in", interval}, Field{"error", err})
+		time.Sleep(interval)
+		interval *= 2
+	}
+}
+
+// Close closes the clients of the store
+func (c *GoRedisStore) Close() error {
+	err := c.cli.Close()
+	for _, replica := range c.replicas {
+		if e := replica.Close(); err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// SetLogger reports the errors the store can not return to l
+func (c *GoRedisStore) SetLogger(l Logger) {
+	c.logger = l
 }
 
 // Set (see CacheStore interface)
@@ -55,33 +240,45 @@ func (c *GoRedisStore) Set(key string, value interface{}, expires time.Duration)
 	if err != nil {
 		return err
 	}
-	err = c.cli.Set(key, b, expires).Err()
-	return err
+	return c.cli.Set(key, b, c.expiration(expires)).Err()
 }
 
 // Add (see CacheStore interface)
 func (c *GoRedisStore) Add(key string, value interface{}, expires time.Duration) error {
-	if !c.exists(key) {
-		return ErrNotStored
+	b, err := utils.Serialize(value)
+	if err != nil {
+		return err
 	}
-	err := c.Set(key, value, expires)
-	return err
+	return notStored(c.cli.SetNX(key, b, c.expiration(expires)).Result())
 }
 
 // Replace (see CacheStore interface)
 func (c *GoRedisStore) Replace(key string, value interface{}, expires time.Duration) error {
-	if !c.exists(key) {
+	b, err := utils.Serialize(value)
+	if err != nil {
+		return err
+	}
+	return notStored(c.cli.SetXX(key, b, c.expiration(expires)).Result())
+}
+
+// expiration converts a CacheStore expiration to the one of go-redis, where 0
+// means no expiration
+func (c *GoRedisStore) expiration(expires time.Duration) time.Duration {
+	return time.Duration(redisExpiration(expires, c.defaultExpiration)) * time.Millisecond
+}
+
+func notStored(stored bool, err error) error {
+	if err == nil && !stored {
 		return ErrNotStored
 	}
-	err := c.Set(key, value, expires)
 	return err
 }
 
 // Get (see CacheStore interface)
 func (c *GoRedisStore) Get(key string, ptrValue interface{}) error {
-	raw, err := c.cli.Get(key).Result()
+	raw, err := c.read(key)
 	if err == redis.Nil {
-		return ErrNotStored
+		return ErrCacheMiss
 	}
 	if err != nil {
 		return err
@@ -89,37 +286,254 @@ func (c *GoRedisStore) Get(key string, ptrValue interface{}) error {
 	return utils.Deserialize([]byte(raw), ptrValue)
 }
 
-func (c *GoRedisStore) exists(key string) bool {
-	ret, _ := c.cli.Exists(key).Result()
-	return ret == 1
+// read reads key from the next replica, or from the master when there are
+// no replicas or the replica fails
+func (c *GoRedisStore) read(key string) (string, error) {
+	if len(c.replicas) == 0 {
+		return c.cli.Get(key).Result()
+	}
+	i := atomic.AddUint32(&c.next, 1) % uint32(len(c.replicas))
+	raw, err := c.replicas[i].Get(key).Result()
+	if err == nil || err == redis.Nil {
+		return raw, err
+	}
+	c.logger.Log(LevelWarn, "cache: redis replica read failed, reading from the master",
+		Field{"key", key}, Field{"replica", c.replicas[i].Options().Addr}, Field{"error", err})
+	return c.cli.Get(key).Result()
 }
 
 // Delete (see CacheStore interface)
 func (c *GoRedisStore) Delete(key string) error {
-	err := c.cli.Del(key).Err()
+	n, err := c.cli.Del(key).Result()
+	if err == nil && n == 0 {
+		return ErrCacheMiss
+	}
 	return err
 }
 
 // Increment (see CacheStore interface)
 func (c *GoRedisStore) Increment(key string, delta uint64) (uint64, error) {
-	val, err := c.cli.IncrBy(key, int64(delta)).Result()
+	return c.count(key, delta, "incr")
+}
+
+// Decrement (see CacheStore interface)
+func (c *GoRedisStore) Decrement(key string, delta uint64) (newValue uint64, err error) {
+	return c.count(key, delta, "decr")
+}
+
+var goRedisCounterScript = redis.NewScript(redisCounterScript)
+
+// count runs redisCounterScript (see RedisStore.count)
+func (c *GoRedisStore) count(key string, delta uint64, op string) (uint64, error) {
+	val, err := goRedisCounterScript.Run(c.cli, []string{key}, strconv.FormatUint(delta, 10), op).String()
+	if err == redis.Nil {
+		return 0, ErrCacheMiss
+	}
 	if err != nil {
 		return 0, err
 	}
-	return uint64(val), nil
+	return strconv.ParseUint(val, 10, 64)
 }
 
-// Decrement (see CacheStore interface)
-func (c *GoRedisStore) Decrement(key string, delta uint64) (newValue uint64, err error) {
-	val, err := c.cli.DecrBy(key, int64(delta)).Result()
+// Retryable (see RetryClassifier interface). Increment and Decrement are
+// retried when the connection could not be made, before the command is sent;
+// the other commands as IsRetryable tells.
+func (c *GoRedisStore) Retryable(op string, err error) bool {
+	if op != "increment" && op != "decrement" {
+		return IsRetryable(err)
+	}
+	return isDialError(err)
+}
+
+var goRedisTouchScript = redis.NewScript(redisTouchScript)
+
+// TTL (see ExpiryStore interface)
+func (c *GoRedisStore) TTL(key string) (time.Duration, error) {
+	// go-redis converts the reply of PTTL to a duration, -1 and -2 included
+	d, err := c.cli.PTTL(key).Result()
+	return redisTTL(int64(d/time.Millisecond), err)
+}
+
+// Touch (see ExpiryStore interface)
+func (c *GoRedisStore) Touch(key string, expires time.Duration) error {
+	ms := redisExpiration(expires, c.defaultExpiration)
+	touched, err := goRedisTouchScript.Run(c.cli, []string{key}, ms).Int64()
+	if err == nil && touched == 0 {
+		return ErrCacheMiss
+	}
+	return err
+}
+
+var (
+	goRedisGetScript = redis.NewScript(redisGetScript)
+	goRedisCASScript = redis.NewScript(redisCASScript)
+)
+
+// GetWithVersion (see CASStore interface), the version is the one of
+// RedisStore.GetWithVersion. The key is read by a script, which runs on the
+// master even when the reads go to the replicas, so the version is not the
+// one of a lagging replica.
+func (c *GoRedisStore) GetWithVersion(key string, ptrValue interface{}) (uint64, error) {
+	raw, err := goRedisGetScript.Run(c.cli, []string{key}).String()
+	if err == redis.Nil {
+		return 0, ErrCacheMiss
+	}
 	if err != nil {
 		return 0, err
 	}
-	return uint64(val), nil
+	if err := utils.Deserialize([]byte(raw), ptrValue); err != nil {
+		return 0, err
+	}
+	return valueVersion([]byte(raw)), nil
+}
+
+// CompareAndSwap (see CASStore interface)
+func (c *GoRedisStore) CompareAndSwap(key string, value interface{}, version uint64, expires time.Duration) error {
+	b, err := utils.Serialize(value)
+	if err != nil {
+		return err
+	}
+	ms := redisExpiration(expires, c.defaultExpiration)
+	n, err := goRedisCASScript.Run(c.cli, []string{key}, redisVersionArg(version), b, ms).Int()
+	return redisCASResult(n, err)
+}
+
+var goRedisCASDeleteScript = redis.NewScript(redisCASDeleteScript)
+
+// CompareAndDelete (see CASDeleter interface)
+func (c *GoRedisStore) CompareAndDelete(key string, version uint64) error {
+	n, err := goRedisCASDeleteScript.Run(c.cli, []string{key}, redisVersionArg(version)).Int()
+	return redisCASResult(n, err)
 }
 
 // FlushAll (see CacheStore interface)
 func (c *GoRedisStore) Flush() error {
 	err := c.cli.FlushAll().Err()
 	return err
-}
\ No newline at end of file
+}
+
+// FlushPrefix (see PrefixFlusher interface)
+func (c *GoRedisStore) FlushPrefix(prefix string) error {
+	if cluster, ok := c.cli.(*redis.ClusterClient); ok {
+		return cluster.ForEachMaster(func(cli *redis.Client) error {
+			return flushPrefix(cli, prefix)
+		})
+	}
+	return flushPrefix(c.cli, prefix)
+}
+
+// Scan (see Scanner interface), see RedisStore.Scan
+func (c *GoRedisStore) Scan(prefix, cursor string, count int) ([]KeyInfo, string, error) {
+	node, next, err := parseNodeCursor(cursor)
+	if err != nil {
+		return nil, "", err
+	}
+	var pos uint64
+	if next != "" {
+		if pos, err = strconv.ParseUint(next, 10, 64); err != nil {
+			return nil, "", ErrInvalidCursor
+		}
+	}
+	nodes, err := c.masters()
+	if err != nil {
+		return nil, "", err
+	}
+	if node >= len(nodes) {
+		return nil, "", ErrInvalidCursor
+	}
+	cli := nodes[node]
+	keys, pos, err := cli.Scan(pos, escapeGlob(prefix)+"*", int64(scanCount(count))).Result()
+	if err != nil {
+		return nil, "", err
+	}
+	infos, err := goRedisKeyInfos(cli, keys)
+	if err != nil {
+		return nil, "", err
+	}
+	next = ""
+	if pos != 0 {
+		next = strconv.FormatUint(pos, 10)
+	}
+	return infos, nodeCursor(node, next, len(nodes)), nil
+}
+
+// masters returns the clients of the masters, in the order of their address
+// for a cluster
+func (c *GoRedisStore) masters() ([]redis.Cmdable, error) {
+	cluster, ok := c.cli.(*redis.ClusterClient)
+	if !ok {
+		return []redis.Cmdable{c.cli}, nil
+	}
+	var mu sync.Mutex
+	var clients []*redis.Client
+	err := cluster.ForEachMaster(func(cli *redis.Client) error {
+		mu.Lock()
+		clients = append(clients, cli)
+		mu.Unlock()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(clients, func(i, j int) bool {
+		return clients[i].Options().Addr < clients[j].Options().Addr
+	})
+	nodes := make([]redis.Cmdable, len(clients))
+	for i, cli := range clients {
+		nodes[i] = cli
+	}
+	return nodes, nil
+}
+
+// goRedisKeyInfos pipelines STRLEN and PTTL for keys, like redisKeyInfos
+func goRedisKeyInfos(cli redis.Cmdable, keys []string) ([]KeyInfo, error) {
+	if len(keys) == 0 {
+		return nil, nil
+	}
+	sizes := make([]*redis.IntCmd, len(keys))
+	ttls := make([]*redis.DurationCmd, len(keys))
+	pipe := cli.Pipeline()
+	for i, key := range keys {
+		sizes[i] = pipe.StrLen(key)
+		ttls[i] = pipe.PTTL(key)
+	}
+	// the errors are checked command by command: STRLEN fails on the keys
+	// that aren't strings, PTTL only when the connection does
+	pipe.Exec()
+	infos := make([]KeyInfo, 0, len(keys))
+	for i, key := range keys {
+		size, err := sizes[i].Result()
+		if err != nil {
+			size = -1
+		}
+		d, err := ttls[i].Result()
+		ttl, err := redisTTL(int64(d/time.Millisecond), err)
+		if err == ErrCacheMiss {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, KeyInfo{key, int(size), ttl})
+	}
+	return infos, nil
+}
+
+func flushPrefix(cli redis.Cmdable, prefix string) error {
+	var cursor uint64
+	for {
+		keys, next, err := cli.Scan(cursor, escapeGlob(prefix)+"*", 100).Result()
+		if err != nil {
+			return err
+		}
+		if len(keys) > 0 {
+			if err := cli.Del(keys...).Err(); err != nil {
+				return err
+			}
+		}
+		if next == 0 {
+			return nil
+		}
+		cursor = next
+	}
+}
@@ -1,45 +1,183 @@
 package persistence
 
 import (
+	"bytes"
+	"log"
 	"net"
+	"strings"
 	"testing"
 	"time"
+
+	"github.com/go-redis/redis"
 )
 
-var newGoRedisStore = func(t *testing.T, defaultExpiration time.Duration) CacheStore {
-	c, err := net.Dial("tcp", redisTestServer)
-	if err == nil {
-		c.Write([]byte("flush_all\r\n"))
-		c.Close()
-		redisCache := NewGoRedisCache(redisTestServer, "", defaultExpiration)
-		//redisCache.Flush()
-		return redisCache
-	}
-	t.Errorf("couldn't connect to redis on %s", redisTestServer)
-	t.FailNow()
-	panic("")
+func TestGoRedisCache_IncrDecrKeepsExpiration(t *testing.T) {
+	fake := newFakeRedis(t)
+	defer fake.Close()
+	store := NewGoRedisStore(fake.Addr(), "", time.Hour)
+
+	if err := store.Set("int", 10, time.Hour); err != nil {
+		t.Fatalf("Error setting int: %s", err)
+	}
+	if _, err := store.Increment("int", 1); err != nil {
+		t.Fatalf("Error incrementing int: %s", err)
+	}
+	if _, err := store.Decrement("int", 1); err != nil {
+		t.Fatalf("Error decrementing int: %s", err)
+	}
+	if ttl := fake.TTL("int"); ttl <= 0 || ttl > int64(time.Hour/time.Millisecond) {
+		t.Errorf("Expected the expiration to be kept, got a ttl of %dms", ttl)
+	}
 }
 
-func TestGoRedisCache_TypicalGetSet(t *testing.T) {
-	typicalGetSet(t, newGoRedisStore)
+// unusedAddr returns an address nothing listens on
+func unusedAddr(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("couldn't reserve an address: %s", err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	return addr
 }
 
-func TestGoRedisCache_IncrDecr(t *testing.T) {
-	incrDecr(t, newGoRedisStore)
+func TestGoRedisCache_InvalidOptions(t *testing.T) {
+	for _, options := range []*GoRedisOptions{
+		{},
+		{Addrs: []string{"a:6379", "b:6379"}, DB: 1},
+		{Addrs: []string{"a:6379"}, ReadFromReplicas: true},
+		{Addrs: []string{"a:6379"}, ReplicaAddrs: []string{"b:6379"}},
+		{Addrs: []string{"a:6379", "b:6379"}, ReadFromReplicas: true, ReplicaAddrs: []string{"c:6379"}},
+	} {
+		if _, err := NewGoRedisStoreWithOptions(options, time.Hour); err == nil {
+			t.Errorf("Expected an error for %+v", options)
+		}
+	}
 }
 
-func TestGoRedisCache_Expiration(t *testing.T) {
-	expiration(t, newGoRedisStore)
+func TestGoRedisCache_HealthCheckFails(t *testing.T) {
+	var buf bytes.Buffer
+	store, err := NewGoRedisStoreWithOptions(&GoRedisOptions{
+		Addrs:               []string{unusedAddr(t)},
+		HealthCheckRetries:  2,
+		HealthCheckInterval: time.Millisecond,
+		Logger:              NewStdLogger(log.New(&buf, "", 0), LevelWarn),
+	}, time.Hour)
+	if err == nil || store != nil {
+		t.Fatalf("Expected an error, got %v and %v", store, err)
+	}
+	if n := strings.Count(buf.String(), "WARN cache: redis health check failed attempt="); n != 2 {
+		t.Errorf("Expected 2 failed health checks to be logged, got %q", buf.String())
+	}
 }
 
-func TestGoRedisCache_EmptyCache(t *testing.T) {
-	emptyCache(t, newGoRedisStore)
+func TestGoRedisCache_HealthCheckRetry(t *testing.T) {
+	addr := unusedAddr(t)
+	started := make(chan *fakeRedis)
+	go func() {
+		time.Sleep(30 * time.Millisecond)
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			started <- nil
+			return
+		}
+		started <- startFakeRedis(ln)
+	}()
+	store, err := NewGoRedisStoreWithOptions(&GoRedisOptions{
+		Addrs:               []string{addr},
+		HealthCheckRetries:  5,
+		HealthCheckInterval: 20 * time.Millisecond,
+	}, time.Hour)
+	fake := <-started
+	if fake == nil {
+		t.Skip("the address was taken in between")
+	}
+	defer fake.Close()
+	if err != nil {
+		t.Fatalf("Expected the health check to be retried until the server starts, got %s", err)
+	}
+	defer store.Close()
+	if err := store.Set("key", "value", time.Hour); err != nil {
+		t.Errorf("Error setting a value: %s", err)
+	}
 }
 
-func TestGoRedisCache_Replace(t *testing.T) {
-	testReplace(t, newGoRedisStore)
+func TestGoRedisCache_LazyConnect(t *testing.T) {
+	addr := unusedAddr(t)
+	store, err := NewGoRedisStoreWithOptions(&GoRedisOptions{
+		Addrs:       []string{addr},
+		LazyConnect: true,
+	}, time.Hour)
+	if err != nil {
+		t.Fatalf("Expected a lazy store to be returned without a server, got %s", err)
+	}
+	defer store.Close()
+	if err := store.Set("key", "value", time.Hour); err == nil {
+		t.Errorf("Expected an error without a server")
+	}
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Skipf("the address was taken in between: %s", err)
+	}
+	fake := startFakeRedis(ln)
+	defer fake.Close()
+	if err := store.Set("key", "value", time.Hour); err != nil {
+		t.Errorf("Expected the store to connect once the server is up, got %s", err)
+	}
 }
 
-func TestGoRedisCache_Add(t *testing.T) {
-	testAdd(t, newGoRedisStore)
+func TestGoRedisCache_ReplicaReads(t *testing.T) {
+	master := newFakeRedis(t)
+	defer master.Close()
+	replica := newFakeRedis(t)
+	defer replica.Close()
+	replica.ReplicaOf(master.Addr())
+
+	var buf bytes.Buffer
+	store, err := NewGoRedisStoreWithOptions(&GoRedisOptions{
+		Addrs:            []string{master.Addr()},
+		ReadFromReplicas: true,
+		ReplicaAddrs:     []string{replica.Addr()},
+		Logger:           NewStdLogger(log.New(&buf, "", 0), LevelWarn),
+	}, time.Hour)
+	if err != nil {
+		t.Fatalf("Error creating the store: %s", err)
+	}
+	defer store.Close()
+
+	// writes go to the master, the fake replica never catches up
+	if err := store.Set("key", "master", time.Hour); err != nil {
+		t.Fatalf("Error setting a value: %s", err)
+	}
+	if keys := master.Keys(0); len(keys) != 1 || keys[0] != "key" {
+		t.Errorf("Expected the key to be written to the master, got %q", keys)
+	}
+	if keys := replica.Keys(0); len(keys) != 0 {
+		t.Errorf("Expected nothing to be written to the replica, got %q", keys)
+	}
+	if err := store.Add("key", "other", time.Hour); err != ErrNotStored {
+		t.Errorf("Expected Add to check the master, got %v", err)
+	}
+	var value string
+	if err := store.Get("key", &value); err != ErrCacheMiss {
+		t.Errorf("Expected Get to read from the replica, got %q, %v", value, err)
+	}
+
+	direct := NewGoRedisStoreWithClient(redis.NewClient(&redis.Options{Addr: replica.Addr()}), time.Hour)
+	defer direct.Close()
+	if err := direct.Set("key", "replica", time.Hour); err != nil {
+		t.Fatalf("Error setting a value on the replica: %s", err)
+	}
+	if err := store.Get("key", &value); err != nil || value != "replica" {
+		t.Errorf("Expected the value of the replica, got %q, %v", value, err)
+	}
+
+	replica.Close()
+	if err := store.Get("key", &value); err != nil || value != "master" {
+		t.Errorf("Expected a fallback to the master, got %q, %v", value, err)
+	}
+	if !strings.Contains(buf.String(), "WARN cache: redis replica read failed, reading from the master key=key") {
+		t.Errorf("Expected the failed replica read to be logged, got %q", buf.String())
+	}
 }
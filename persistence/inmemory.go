@@ -1,7 +1,13 @@
 package persistence
 
 import (
+	"encoding/gob"
+	"io"
+	"os"
 	"reflect"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/robfig/go-cache"
@@ -10,11 +16,32 @@ import (
 //InMemoryStore represents the cache with memory persistence
 type InMemoryStore struct {
 	cache.Cache
+	defaultExpiration time.Duration
+
+	// go-cache doesn't expose the expiration of its items nor versions them,
+	// both are kept aside for the items written through the store. Items
+	// written directly to the embedded cache.Cache are reported as never
+	// expiring, and get a version when first read with GetWithVersion.
+	mu        sync.Mutex
+	items     map[string]inMemoryItem
+	version   uint64 // last version given to an item
+	lastSweep time.Time
+}
+
+// inMemoryItem is the expiration and version of an item of an InMemoryStore
+type inMemoryItem struct {
+	expires time.Time // zero when the item never expires
+	version uint64
 }
 
 // NewInMemoryStore returns a InMemoryStore
 func NewInMemoryStore(defaultExpiration time.Duration) *InMemoryStore {
-	return &InMemoryStore{*cache.New(defaultExpiration, time.Minute)}
+	return &InMemoryStore{
+		Cache:             *cache.New(defaultExpiration, time.Minute),
+		defaultExpiration: defaultExpiration,
+		items:             map[string]inMemoryItem{},
+		lastSweep:         time.Now(),
+	}
 }
 
 // Get (see CacheStore interface)
@@ -34,30 +61,44 @@ func (c *InMemoryStore) Get(key string, value interface{}) error {
 
 // Set (see CacheStore interface)
 func (c *InMemoryStore) Set(key string, value interface{}, expires time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	// NOTE: go-cache understands the values of DEFAULT and FOREVER
 	c.Cache.Set(key, value, expires)
+	c.track(key, expires)
 	return nil
 }
 
 // Add (see CacheStore interface)
 func (c *InMemoryStore) Add(key string, value interface{}, expires time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	err := c.Cache.Add(key, value, expires)
 	if err == cache.ErrKeyExists {
 		return ErrNotStored
 	}
+	if err == nil {
+		c.track(key, expires)
+	}
 	return err
 }
 
 // Replace (see CacheStore interface)
 func (c *InMemoryStore) Replace(key string, value interface{}, expires time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	if err := c.Cache.Replace(key, value, expires); err != nil {
 		return ErrNotStored
 	}
+	c.track(key, expires)
 	return nil
 }
 
 // Delete (see CacheStore interface)
 func (c *InMemoryStore) Delete(key string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.items, key)
 	if found := c.Cache.Delete(key); !found {
 		return ErrCacheMiss
 	}
@@ -66,24 +107,251 @@ func (c *InMemoryStore) Delete(key string) error {
 
 // Increment (see CacheStore interface)
 func (c *InMemoryStore) Increment(key string, n uint64) (uint64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	newValue, err := c.Cache.Increment(key, n)
 	if err == cache.ErrCacheMiss {
 		return 0, ErrCacheMiss
 	}
+	if err == nil {
+		c.bump(key)
+	}
 	return newValue, err
 }
 
 // Decrement (see CacheStore interface)
 func (c *InMemoryStore) Decrement(key string, n uint64) (uint64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	newValue, err := c.Cache.Decrement(key, n)
 	if err == cache.ErrCacheMiss {
 		return 0, ErrCacheMiss
 	}
+	if err == nil {
+		c.bump(key)
+	}
 	return newValue, err
 }
 
 // Flush (see CacheStore interface)
 func (c *InMemoryStore) Flush() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	c.Cache.Flush()
+	c.items = map[string]inMemoryItem{}
+	return nil
+}
+
+// TTL (see ExpiryStore interface)
+func (c *InMemoryStore) TTL(key string) (time.Duration, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, found := c.Cache.Get(key); !found {
+		delete(c.items, key)
+		return 0, ErrCacheMiss
+	}
+	expires := c.items[key].expires
+	if expires.IsZero() {
+		return FOREVER, nil
+	}
+	ttl := time.Until(expires)
+	if ttl <= 0 {
+		return 0, ErrCacheMiss
+	}
+	return ttl, nil
+}
+
+// Touch (see ExpiryStore interface)
+func (c *InMemoryStore) Touch(key string, expires time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	value, found := c.Cache.Get(key)
+	if !found {
+		delete(c.items, key)
+		return ErrCacheMiss
+	}
+	c.Cache.Set(key, value, expires)
+	item := c.items[key]
+	item.expires = c.expiration(expires)
+	c.items[key] = item
+	return nil
+}
+
+// GetWithVersion (see CASStore interface)
+func (c *InMemoryStore) GetWithVersion(key string, value interface{}) (uint64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.Get(key, value); err != nil {
+		return 0, err
+	}
+	item, ok := c.items[key]
+	if !ok || item.version == 0 {
+		c.bump(key)
+		item = c.items[key]
+	}
+	return item.version, nil
+}
+
+// CompareAndSwap (see CASStore interface)
+func (c *InMemoryStore) CompareAndSwap(key string, value interface{}, version uint64, expires time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, found := c.Cache.Get(key); !found {
+		delete(c.items, key)
+		return ErrCacheMiss
+	}
+	if c.items[key].version != version {
+		return ErrNotStored
+	}
+	c.Cache.Set(key, value, expires)
+	c.track(key, expires)
 	return nil
 }
+
+// CompareAndDelete (see CASDeleter interface)
+func (c *InMemoryStore) CompareAndDelete(key string, version uint64) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, found := c.Cache.Get(key); !found {
+		delete(c.items, key)
+		return ErrCacheMiss
+	}
+	if c.items[key].version != version {
+		return ErrNotStored
+	}
+	c.Cache.Delete(key)
+	delete(c.items, key)
+	return nil
+}
+
+// Scan (see Scanner interface). The keys are listed in order, the cursor is
+// the last key of the page so it must start with prefix. The size is only
+// known for the values stored as a []byte or a string, and the items written
+// directly to the embedded cache.Cache are not listed.
+func (c *InMemoryStore) Scan(prefix, cursor string, count int) ([]KeyInfo, string, error) {
+	if cursor != "" && !strings.HasPrefix(cursor, prefix) {
+		return nil, "", ErrInvalidCursor
+	}
+	count = scanCount(count)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var keys []string
+	for key := range c.items {
+		if key > cursor && strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	now := time.Now()
+	infos := make([]KeyInfo, 0, count)
+	for _, key := range keys {
+		if len(infos) == count {
+			return infos, infos[count-1].Key, nil
+		}
+		value, found := c.Cache.Get(key)
+		if !found {
+			continue
+		}
+		info := KeyInfo{Key: key, Size: -1, TTL: FOREVER}
+		switch v := value.(type) {
+		case []byte:
+			info.Size = len(v)
+		case string:
+			info.Size = len(v)
+		}
+		if expires := c.items[key].expires; !expires.IsZero() {
+			if info.TTL = expires.Sub(now); info.TTL <= 0 {
+				continue
+			}
+		}
+		infos = append(infos, info)
+	}
+	return infos, "", nil
+}
+
+// inMemorySnapshotItem is an item of the snapshots written by the SaveFile
+// of go-cache
+type inMemorySnapshotItem struct {
+	Object     interface{}
+	Expiration *time.Time
+}
+
+// Load adds the items of a snapshot written by Save, skipping the keys
+// already in the store like go-cache does, but keeping track of their
+// expiration so TTL and Scan report them. The types of the values must be
+// registered with gob, see cache.RegisterResponseCacheGob for the cached
+// pages.
+func (c *InMemoryStore) Load(r io.Reader) error {
+	items := map[string]*inMemorySnapshotItem{}
+	if err := gob.NewDecoder(r).Decode(&items); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	for key, item := range items {
+		if _, found := c.Cache.Get(key); found {
+			continue
+		}
+		expires := FOREVER
+		if item.Expiration != nil {
+			if expires = item.Expiration.Sub(now); expires <= 0 {
+				continue
+			}
+		}
+		c.Cache.Set(key, item.Object, expires)
+		c.track(key, expires)
+	}
+	return nil
+}
+
+// LoadFile adds the items of the snapshot file written by SaveFile (see Load)
+func (c *InMemoryStore) LoadFile(fname string) error {
+	f, err := os.Open(fname)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return c.Load(f)
+}
+
+// expiration returns the date an item written with expires expires at, zero
+// when it never does
+func (c *InMemoryStore) expiration(expires time.Duration) time.Time {
+	if expires == DEFAULT {
+		expires = c.defaultExpiration
+	}
+	if expires <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(expires)
+}
+
+// bump gives a new version to the item of key keeping its expiration, c.mu
+// must be held
+func (c *InMemoryStore) bump(key string) {
+	c.version++
+	item := c.items[key]
+	item.version = c.version
+	c.items[key] = item
+}
+
+// track records the expiration and a new version of an item written with
+// expires, c.mu must be held. The items dropped by go-cache are swept once a
+// minute.
+func (c *InMemoryStore) track(key string, expires time.Duration) {
+	c.version++
+	c.items[key] = inMemoryItem{c.expiration(expires), c.version}
+	now := time.Now()
+	if now.Sub(c.lastSweep) < time.Minute {
+		return
+	}
+	c.lastSweep = now
+	for k, item := range c.items {
+		if !item.expires.IsZero() && !now.Before(item.expires) {
+			delete(c.items, k)
+		} else if _, found := c.Cache.Get(k); !found {
+			delete(c.items, k)
+		}
+	}
+}
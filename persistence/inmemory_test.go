@@ -1,35 +1,50 @@
 package persistence
 
 import (
+	"bytes"
 	"testing"
 	"time"
 )
 
-var newInMemoryStore = func(_ *testing.T, defaultExpiration time.Duration) CacheStore {
-	return NewInMemoryStore(defaultExpiration)
-}
-
-// Test typical cache interactions
-func TestInMemoryCache_TypicalGetSet(t *testing.T) {
-	typicalGetSet(t, newInMemoryStore)
-}
-
-func TestInMemoryCache_IncrDecr(t *testing.T) {
-	incrDecr(t, newInMemoryStore)
-}
-
-func TestInMemoryCache_Expiration(t *testing.T) {
-	expiration(t, newInMemoryStore)
-}
-
-func TestInMemoryCache_EmptyCache(t *testing.T) {
-	emptyCache(t, newInMemoryStore)
-}
-
-func TestInMemoryCache_Replace(t *testing.T) {
-	testReplace(t, newInMemoryStore)
-}
-
-func TestInMemoryCache_Add(t *testing.T) {
-	testAdd(t, newInMemoryStore)
+func TestInMemoryStore_Load(t *testing.T) {
+	saved := NewInMemoryStore(time.Hour)
+	if err := saved.Set("expiring", "a", time.Hour); err != nil {
+		t.Fatalf("Error setting a value: %s", err)
+	}
+	if err := saved.Set("forever", []byte("b"), FOREVER); err != nil {
+		t.Fatalf("Error setting a value: %s", err)
+	}
+	if err := saved.Set("kept", "saved", FOREVER); err != nil {
+		t.Fatalf("Error setting a value: %s", err)
+	}
+	var snapshot bytes.Buffer
+	if err := saved.Save(&snapshot); err != nil {
+		t.Fatalf("Error saving the store: %s", err)
+	}
+
+	store := NewInMemoryStore(time.Hour)
+	if err := store.Set("kept", "current", FOREVER); err != nil {
+		t.Fatalf("Error setting a value: %s", err)
+	}
+	if err := store.Load(&snapshot); err != nil {
+		t.Fatalf("Error loading the store: %s", err)
+	}
+
+	var value string
+	if err := store.Get("expiring", &value); err != nil || value != "a" {
+		t.Errorf("Expected to load a, got %q, %v", value, err)
+	}
+	if err := store.Get("kept", &value); err != nil || value != "current" {
+		t.Errorf("Expected the current value to be kept, got %q, %v", value, err)
+	}
+	if ttl, err := store.TTL("expiring"); err != nil || ttl < 59*time.Minute || ttl > time.Hour {
+		t.Errorf("Expected the expiration to be loaded, got %s, %v", ttl, err)
+	}
+	if ttl, err := store.TTL("forever"); err != nil || ttl != FOREVER {
+		t.Errorf("Expected the item to never expire, got %s, %v", ttl, err)
+	}
+	infos, _, err := store.Scan("", "", 0)
+	if err != nil || len(infos) != 3 {
+		t.Errorf("Expected the loaded items to be listed, got %v, %v", infos, err)
+	}
 }
@@ -0,0 +1,143 @@
+package persistence
+
+import (
+	"time"
+)
+
+// StoreObserver receives the outcome and latency of every call made through
+// an InstrumentedStore. metrics.Registry implements it in the Prometheus text
+// format.
+type StoreObserver interface {
+	ObserveStore(store, op string, elapsed time.Duration, err error)
+}
+
+// InstrumentedStore reports every call of the wrapped CacheStore to a
+// StoreObserver
+type InstrumentedStore struct {
+	store    CacheStore
+	name     string
+	observer StoreObserver
+}
+
+// NewInstrumentedStore returns an InstrumentedStore, name is used to label
+// the observations
+func NewInstrumentedStore(store CacheStore, name string, observer StoreObserver) *InstrumentedStore {
+	return &InstrumentedStore{store, name, observer}
+}
+
+// Name returns the name of the store
+func (s *InstrumentedStore) Name() string {
+	return s.name
+}
+
+// Get (see CacheStore interface)
+func (s *InstrumentedStore) Get(key string, value interface{}) error {
+	start := time.Now()
+	err := s.store.Get(key, value)
+	s.observer.ObserveStore(s.name, "get", time.Since(start), err)
+	return err
+}
+
+// Set (see CacheStore interface)
+func (s *InstrumentedStore) Set(key string, value interface{}, expires time.Duration) error {
+	start := time.Now()
+	err := s.store.Set(key, value, expires)
+	s.observer.ObserveStore(s.name, "set", time.Since(start), err)
+	return err
+}
+
+// Add (see CacheStore interface)
+func (s *InstrumentedStore) Add(key string, value interface{}, expires time.Duration) error {
+	start := time.Now()
+	err := s.store.Add(key, value, expires)
+	s.observer.ObserveStore(s.name, "add", time.Since(start), err)
+	return err
+}
+
+// Replace (see CacheStore interface)
+func (s *InstrumentedStore) Replace(key string, value interface{}, expires time.Duration) error {
+	start := time.Now()
+	err := s.store.Replace(key, value, expires)
+	s.observer.ObserveStore(s.name, "replace", time.Since(start), err)
+	return err
+}
+
+// Delete (see CacheStore interface)
+func (s *InstrumentedStore) Delete(key string) error {
+	start := time.Now()
+	err := s.store.Delete(key)
+	s.observer.ObserveStore(s.name, "delete", time.Since(start), err)
+	return err
+}
+
+// Increment (see CacheStore interface)
+func (s *InstrumentedStore) Increment(key string, delta uint64) (uint64, error) {
+	start := time.Now()
+	n, err := s.store.Increment(key, delta)
+	s.observer.ObserveStore(s.name, "increment", time.Since(start), err)
+	return n, err
+}
+
+// Decrement (see CacheStore interface)
+func (s *InstrumentedStore) Decrement(key string, delta uint64) (uint64, error) {
+	start := time.Now()
+	n, err := s.store.Decrement(key, delta)
+	s.observer.ObserveStore(s.name, "decrement", time.Since(start), err)
+	return n, err
+}
+
+// TTL (see ExpiryStore interface)
+func (s *InstrumentedStore) TTL(key string) (time.Duration, error) {
+	start := time.Now()
+	ttl, err := TTL(s.store, key)
+	s.observer.ObserveStore(s.name, "ttl", time.Since(start), err)
+	return ttl, err
+}
+
+// Touch (see ExpiryStore interface)
+func (s *InstrumentedStore) Touch(key string, expires time.Duration) error {
+	start := time.Now()
+	err := Touch(s.store, key, expires)
+	s.observer.ObserveStore(s.name, "touch", time.Since(start), err)
+	return err
+}
+
+// GetWithVersion (see CASStore interface)
+func (s *InstrumentedStore) GetWithVersion(key string, value interface{}) (uint64, error) {
+	start := time.Now()
+	version, err := GetWithVersion(s.store, key, value)
+	s.observer.ObserveStore(s.name, "getwithversion", time.Since(start), err)
+	return version, err
+}
+
+// CompareAndSwap (see CASStore interface)
+func (s *InstrumentedStore) CompareAndSwap(key string, value interface{}, version uint64, expires time.Duration) error {
+	start := time.Now()
+	err := CompareAndSwap(s.store, key, value, version, expires)
+	s.observer.ObserveStore(s.name, "compareandswap", time.Since(start), err)
+	return err
+}
+
+// CompareAndDelete (see CASDeleter interface)
+func (s *InstrumentedStore) CompareAndDelete(key string, version uint64) error {
+	start := time.Now()
+	err := CompareAndDelete(s.store, key, version)
+	s.observer.ObserveStore(s.name, "compareanddelete", time.Since(start), err)
+	return err
+}
+
+// Scan (see Scanner interface)
+func (s *InstrumentedStore) Scan(prefix, cursor string, count int) ([]KeyInfo, string, error) {
+	start := time.Now()
+	infos, next, err := Scan(s.store, prefix, cursor, count)
+	s.observer.ObserveStore(s.name, "scan", time.Since(start), err)
+	return infos, next, err
+}
+
+// Flush (see CacheStore interface)
+func (s *InstrumentedStore) Flush() error {
+	start := time.Now()
+	err := s.store.Flush()
+	s.observer.ObserveStore(s.name, "flush", time.Since(start), err)
+	return err
+}
@@ -0,0 +1,44 @@
+package persistence
+
+import (
+	"testing"
+	"time"
+)
+
+type recordObserver struct {
+	ops []string
+}
+
+func (o *recordObserver) ObserveStore(store, op string, elapsed time.Duration, err error) {
+	result := "ok"
+	if err != nil {
+		result = err.Error()
+	}
+	o.ops = append(o.ops, store+" "+op+" "+result)
+}
+
+func TestInstrumentedStore_Observe(t *testing.T) {
+	observer := &recordObserver{}
+	store := NewInstrumentedStore(NewInMemoryStore(time.Hour), "memory", observer)
+
+	var value string
+	store.Get("key", &value)
+	store.Set("key", "value", DEFAULT)
+	store.Add("key", "value", DEFAULT)
+	store.Delete("key")
+
+	expected := []string{
+		"memory get " + ErrCacheMiss.Error(),
+		"memory set ok",
+		"memory add " + ErrNotStored.Error(),
+		"memory delete ok",
+	}
+	if len(observer.ops) != len(expected) {
+		t.Fatalf("Expected %v, got %v", expected, observer.ops)
+	}
+	for i := range expected {
+		if observer.ops[i] != expected[i] {
+			t.Errorf("Expected %q, got %q", expected[i], observer.ops[i])
+		}
+	}
+}
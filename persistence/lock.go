@@ -0,0 +1,160 @@
+package persistence
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrLocked is returned by TryLock when the lock is held
+	ErrLocked = errors.New("cache: lock held.")
+	// ErrLockLost is returned by the methods of a Lock whose lease expired,
+	// the lock may be held by someone else since
+	ErrLockLost = errors.New("cache: lock lost.")
+)
+
+// Lock is a lock held in a CacheStore, for the processes sharing the store
+// to do some work only once. It is held for a lease, extended by Renew or
+// KeepAlive, and stores a random token so only its owner releases it.
+//
+// Renew is atomic on the stores implementing CASStore, and Release on the
+// stores implementing CASDeleter. On the other stores they check the token
+// before extending or deleting the lock: a lease expiring in between lets the
+// next owner lose the lock, so leases must be renewed well before they expire.
+type Lock struct {
+	store CacheStore
+	key   string
+	token string
+	ttl   time.Duration
+
+	mu   sync.Mutex
+	done chan struct{} // closed by Release once KeepAlive started
+}
+
+// TryLock takes the lock stored under key for a lease of ttl, with the Add
+// of the store. ErrLocked is returned when the lock is already held.
+func TryLock(store CacheStore, key string, ttl time.Duration) (*Lock, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	l := &Lock{store: store, key: key, token: hex.EncodeToString(b), ttl: ttl}
+	switch err := store.Add(key, l.token, ttl); err {
+	case nil:
+		return l, nil
+	case ErrNotStored:
+		return nil, ErrLocked
+	default:
+		return nil, err
+	}
+}
+
+// Key returns the key of the lock
+func (l *Lock) Key() string {
+	return l.key
+}
+
+// Token returns the token identifying the owner of the lock
+func (l *Lock) Token() string {
+	return l.token
+}
+
+// Renew extends the lease of the lock to its TTL
+func (l *Lock) Renew() error {
+	var token string
+	version, err := GetWithVersion(l.store, l.key, &token)
+	if err == ErrNotSupport {
+		if err = l.held(); err != nil {
+			return err
+		}
+		return l.store.Replace(l.key, l.token, l.ttl)
+	}
+	if err == ErrCacheMiss || (err == nil && token != l.token) {
+		return ErrLockLost
+	}
+	if err != nil {
+		return err
+	}
+	switch err := CompareAndSwap(l.store, l.key, l.token, version, l.ttl); err {
+	case ErrNotStored, ErrCacheMiss:
+		return ErrLockLost
+	default:
+		return err
+	}
+}
+
+// KeepAlive renews the lease of the lock in the background, three times per
+// TTL, until the lock is released or lost
+func (l *Lock) KeepAlive() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.done != nil || l.ttl <= 0 {
+		return
+	}
+	l.done = make(chan struct{})
+	go func(done chan struct{}) {
+		ticker := time.NewTicker(l.ttl / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if l.Renew() == ErrLockLost {
+					return
+				}
+			case <-done:
+				return
+			}
+		}
+	}(l.done)
+}
+
+// Release deletes the lock when it is still held, ErrLockLost is returned
+// otherwise
+func (l *Lock) Release() error {
+	l.mu.Lock()
+	if l.done != nil {
+		close(l.done)
+		l.done = nil
+	}
+	l.mu.Unlock()
+	var token string
+	version, err := GetWithVersion(l.store, l.key, &token)
+	if err == ErrNotSupport {
+		err = l.held()
+	} else if err == ErrCacheMiss || (err == nil && token != l.token) {
+		return ErrLockLost
+	}
+	if err != nil {
+		return err
+	}
+	err = CompareAndDelete(l.store, l.key, version)
+	if err == ErrNotSupport {
+		err = l.store.Delete(l.key)
+	}
+	switch err {
+	case ErrNotStored, ErrCacheMiss:
+		return ErrLockLost
+	default:
+		return err
+	}
+}
+
+// held checks that the lock still holds its token. The token is read with
+// GetWithVersion when the store supports it, which reads from the master of
+// the stores reading from replicas.
+func (l *Lock) held() error {
+	var token string
+	_, err := GetWithVersion(l.store, l.key, &token)
+	if err == ErrNotSupport {
+		err = l.store.Get(l.key, &token)
+	}
+	switch {
+	case err == ErrCacheMiss || (err == nil && token != l.token):
+		return ErrLockLost
+	default:
+		return err
+	}
+}
@@ -0,0 +1,142 @@
+package persistence_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gin-contrib/cache/persistence"
+	"github.com/gin-contrib/cache/persistence/storetest"
+)
+
+func testLock(t *testing.T, newStore storetest.Factory) {
+	store := newStore(t, time.Hour)
+
+	lock, err := persistence.TryLock(store, "lock", time.Minute)
+	if err != nil {
+		t.Fatalf("Error taking the lock: %s", err)
+	}
+	if _, err := persistence.TryLock(store, "lock", time.Minute); err != persistence.ErrLocked {
+		t.Errorf("Expected ErrLocked, got %v", err)
+	}
+	if err := lock.Renew(); err != nil {
+		t.Errorf("Error renewing the lock: %s", err)
+	}
+	if err := lock.Release(); err != nil {
+		t.Errorf("Error releasing the lock: %s", err)
+	}
+	if err := lock.Release(); err != persistence.ErrLockLost {
+		t.Errorf("Expected ErrLockLost releasing twice, got %v", err)
+	}
+
+	// the lease expires and another owner takes the lock
+	lock, err = persistence.TryLock(store, "lock", time.Minute)
+	if err != nil {
+		t.Fatalf("Error taking the lock again: %s", err)
+	}
+	store.Delete("lock")
+	other, err := persistence.TryLock(store, "lock", time.Minute)
+	if err != nil {
+		t.Fatalf("Error taking the expired lock: %s", err)
+	}
+	if other.Token() == lock.Token() {
+		t.Errorf("Expected the owners to have their own token")
+	}
+	if err := lock.Renew(); err != persistence.ErrLockLost {
+		t.Errorf("Expected ErrLockLost renewing a lost lock, got %v", err)
+	}
+	if err := lock.Release(); err != persistence.ErrLockLost {
+		t.Errorf("Expected ErrLockLost releasing a lost lock, got %v", err)
+	}
+	if _, err := persistence.TryLock(store, "lock", time.Minute); err != persistence.ErrLocked {
+		t.Errorf("Expected the lock of the other owner to be kept, got %v", err)
+	}
+	if err := other.Release(); err != nil {
+		t.Errorf("Error releasing the lock: %s", err)
+	}
+}
+
+func TestLock(t *testing.T) {
+	for name, newStore := range map[string]storetest.Factory{
+		"memory": newInMemoryStore,
+		// without GetWithVersion and CompareAndSwap
+		"no cas": func(t *testing.T, defaultExpiration time.Duration) persistence.CacheStore {
+			return struct{ persistence.CacheStore }{persistence.NewInMemoryStore(defaultExpiration)}
+		},
+		"redis":     newRedisStore,
+		"goredis":   newGoRedisStore,
+		"memcached": newMemcachedStore,
+	} {
+		t.Run(name, func(t *testing.T) {
+			testLock(t, newStore)
+		})
+	}
+}
+
+func TestLock_KeepAlive(t *testing.T) {
+	store := persistence.NewInMemoryStore(time.Hour)
+	lock, err := persistence.TryLock(store, "lock", 60*time.Millisecond)
+	if err != nil {
+		t.Fatalf("Error taking the lock: %s", err)
+	}
+	lock.KeepAlive()
+	time.Sleep(150 * time.Millisecond)
+	if _, err := persistence.TryLock(store, "lock", time.Minute); err != persistence.ErrLocked {
+		t.Errorf("Expected the lease to be renewed, got %v", err)
+	}
+	if err := lock.Release(); err != nil {
+		t.Errorf("Error releasing the lock: %s", err)
+	}
+	if _, err := persistence.TryLock(store, "lock", time.Minute); err != nil {
+		t.Errorf("Expected the lock to be released, got %v", err)
+	}
+}
+
+// expiringStore lets the lease of the lock expire, and another owner take it,
+// right after each token read of GetWithVersion
+type expiringStore struct {
+	persistence.CacheStore
+	t     *testing.T
+	other *persistence.Lock
+}
+
+func (s *expiringStore) GetWithVersion(key string, value interface{}) (uint64, error) {
+	version, err := persistence.GetWithVersion(s.CacheStore, key, value)
+	if err == nil && s.other == nil {
+		s.CacheStore.Delete(key)
+		if s.other, err = persistence.TryLock(s.CacheStore, key, time.Minute); err != nil {
+			s.t.Fatalf("Error taking the expired lock: %s", err)
+		}
+	}
+	return version, err
+}
+
+func (s *expiringStore) CompareAndSwap(key string, value interface{}, version uint64, expires time.Duration) error {
+	return persistence.CompareAndSwap(s.CacheStore, key, value, version, expires)
+}
+
+func (s *expiringStore) CompareAndDelete(key string, version uint64) error {
+	return persistence.CompareAndDelete(s.CacheStore, key, version)
+}
+
+func TestLock_ExpireDuringRelease(t *testing.T) {
+	for name, newStore := range map[string]storetest.Factory{
+		"memory":    newInMemoryStore,
+		"redis":     newRedisStore,
+		"goredis":   newGoRedisStore,
+		"memcached": newMemcachedStore,
+	} {
+		t.Run(name, func(t *testing.T) {
+			store := &expiringStore{CacheStore: newStore(t, time.Hour), t: t}
+			lock, err := persistence.TryLock(store, "lock", time.Minute)
+			if err != nil {
+				t.Fatalf("Error taking the lock: %s", err)
+			}
+			if err := lock.Release(); err != persistence.ErrLockLost {
+				t.Errorf("Expected ErrLockLost releasing a lost lock, got %v", err)
+			}
+			if _, err := persistence.TryLock(store, "lock", time.Minute); err != persistence.ErrLocked {
+				t.Errorf("Expected the lock of the other owner to be kept, got %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,113 @@
+package persistence
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// Level is the severity of a log entry
+type Level int
+
+// Log levels
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "DEBUG"
+	case LevelInfo:
+		return "INFO"
+	case LevelWarn:
+		return "WARN"
+	case LevelError:
+		return "ERROR"
+	}
+	return fmt.Sprintf("LEVEL(%d)", int(l))
+}
+
+// Field is a key/value pair attached to a log entry, such as the key, route,
+// store or error the entry is about
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+// Logger receives the errors the cache and the stores can not return to their
+// caller
+type Logger interface {
+	Log(level Level, msg string, fields ...Field)
+}
+
+// NopLogger discards every entry, it is the default Logger
+type NopLogger struct{}
+
+// Log (see Logger interface)
+func (NopLogger) Log(level Level, msg string, fields ...Field) {}
+
+// SlogLogger is the part of the *slog.Logger API used by NewSlogLogger
+type SlogLogger interface {
+	Debug(msg string, args ...interface{})
+	Info(msg string, args ...interface{})
+	Warn(msg string, args ...interface{})
+	Error(msg string, args ...interface{})
+}
+
+type slogLogger struct {
+	l SlogLogger
+}
+
+// NewSlogLogger returns a Logger writing to a *slog.Logger, or to any logger
+// with the same API
+func NewSlogLogger(l SlogLogger) Logger {
+	return slogLogger{l}
+}
+
+// Log (see Logger interface)
+func (s slogLogger) Log(level Level, msg string, fields ...Field) {
+	args := make([]interface{}, 0, 2*len(fields))
+	for _, f := range fields {
+		args = append(args, f.Key, f.Value)
+	}
+	switch {
+	case level >= LevelError:
+		s.l.Error(msg, args...)
+	case level >= LevelWarn:
+		s.l.Warn(msg, args...)
+	case level >= LevelInfo:
+		s.l.Info(msg, args...)
+	default:
+		s.l.Debug(msg, args...)
+	}
+}
+
+type stdLogger struct {
+	l        *log.Logger
+	minLevel Level
+}
+
+// NewStdLogger returns a Logger writing the entries of at least minLevel to a
+// *log.Logger, as "LEVEL msg key=value ..."
+func NewStdLogger(l *log.Logger, minLevel Level) Logger {
+	return stdLogger{l, minLevel}
+}
+
+// Log (see Logger interface)
+func (s stdLogger) Log(level Level, msg string, fields ...Field) {
+	if level < s.minLevel {
+		return
+	}
+	var b strings.Builder
+	b.WriteString(level.String())
+	b.WriteByte(' ')
+	b.WriteString(msg)
+	for _, f := range fields {
+		fmt.Fprintf(&b, " %s=%v", f.Key, f.Value)
+	}
+	s.l.Output(2, b.String())
+}
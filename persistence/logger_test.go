@@ -0,0 +1,52 @@
+package persistence
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"testing"
+)
+
+type recordSlog struct {
+	entries []string
+}
+
+func (r *recordSlog) record(level, msg string, args []interface{}) {
+	r.entries = append(r.entries, fmt.Sprint(level, " ", msg, " ", args))
+}
+
+func (r *recordSlog) Debug(msg string, args ...interface{}) { r.record("debug", msg, args) }
+func (r *recordSlog) Info(msg string, args ...interface{})  { r.record("info", msg, args) }
+func (r *recordSlog) Warn(msg string, args ...interface{})  { r.record("warn", msg, args) }
+func (r *recordSlog) Error(msg string, args ...interface{}) { r.record("error", msg, args) }
+
+func TestSlogLogger(t *testing.T) {
+	rec := &recordSlog{}
+	logger := NewSlogLogger(rec)
+
+	logger.Log(LevelDebug, "debug")
+	logger.Log(LevelWarn, "failed", Field{"key", "k"}, Field{"error", errors.New("down")})
+	logger.Log(LevelError, "failed")
+
+	expected := []string{
+		"debug debug []",
+		"warn failed [key k error down]",
+		"error failed []",
+	}
+	if fmt.Sprint(rec.entries) != fmt.Sprint(expected) {
+		t.Errorf("Expected %q, got %q", expected, rec.entries)
+	}
+}
+
+func TestStdLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger := NewStdLogger(log.New(&buf, "", 0), LevelWarn)
+
+	logger.Log(LevelInfo, "ignored")
+	logger.Log(LevelError, "failed", Field{"key", "k"}, Field{"error", errors.New("down")})
+
+	if buf.String() != "ERROR failed key=k error=down\n" {
+		t.Errorf("Unexpected output %q", buf.String())
+	}
+}
@@ -64,15 +64,77 @@ func (c *MemcachedStore) Flush() error {
 	return ErrNotSupport
 }
 
-func (c *MemcachedStore) invoke(storeFn func(*memcache.Client, *memcache.Item) error,
-	key string, value interface{}, expire time.Duration) error {
+// TTL is not supported by the memcached protocol (see ExpiryStore interface)
+func (c *MemcachedStore) TTL(key string) (time.Duration, error) {
+	return 0, ErrNotSupport
+}
 
-	switch expire {
-	case DEFAULT:
-		expire = c.defaultExpiration
-	case FOREVER:
-		expire = time.Duration(0)
+// Touch (see ExpiryStore interface)
+func (c *MemcachedStore) Touch(key string, expires time.Duration) error {
+	return convertMemcacheError(c.Client.Touch(key, c.expiration(expires)))
+}
+
+// GetWithVersion (see CASStore interface). gomemcache keeps the CAS
+// identifier of its items unexported, the version is derived from the SHA-1
+// of the value as with redis.
+func (c *MemcachedStore) GetWithVersion(key string, value interface{}) (uint64, error) {
+	item, err := c.Client.Get(key)
+	if err != nil {
+		return 0, convertMemcacheError(err)
 	}
+	if err := utils.Deserialize(item.Value, value); err != nil {
+		return 0, err
+	}
+	return valueVersion(item.Value), nil
+}
+
+// CompareAndSwap (see CASStore interface). The item is read again and swapped
+// only if its value is still at version, memcached checks the CAS identifier
+// of that read while storing.
+func (c *MemcachedStore) CompareAndSwap(key string, value interface{}, version uint64, expires time.Duration) error {
+	b, err := utils.Serialize(value)
+	if err != nil {
+		return err
+	}
+	item, err := c.compare(key, version)
+	if err != nil {
+		return err
+	}
+	item.Value, item.Expiration = b, c.expiration(expires)
+	return convertMemcacheError(c.Client.CompareAndSwap(item))
+}
+
+// CompareAndDelete (see CASDeleter interface). The text protocol of memcached
+// has no CAS for deletes, the item is swapped with an expiration in the past.
+func (c *MemcachedStore) CompareAndDelete(key string, version uint64) error {
+	item, err := c.compare(key, version)
+	if err != nil {
+		return err
+	}
+	item.Expiration = -1
+	return convertMemcacheError(c.Client.CompareAndSwap(item))
+}
+
+// compare reads the item of key, ErrNotStored is returned when its value is
+// no longer at version
+func (c *MemcachedStore) compare(key string, version uint64) (*memcache.Item, error) {
+	item, err := c.Client.Get(key)
+	if err != nil {
+		return nil, convertMemcacheError(err)
+	}
+	if valueVersion(item.Value) != version {
+		return nil, ErrNotStored
+	}
+	return item, nil
+}
+
+// Scan is not supported by the memcached protocol (see Scanner interface)
+func (c *MemcachedStore) Scan(prefix, cursor string, count int) ([]KeyInfo, string, error) {
+	return nil, "", ErrNotSupport
+}
+
+func (c *MemcachedStore) invoke(storeFn func(*memcache.Client, *memcache.Item) error,
+	key string, value interface{}, expire time.Duration) error {
 
 	b, err := utils.Serialize(value)
 	if err != nil {
@@ -81,17 +143,29 @@ func (c *MemcachedStore) invoke(storeFn func(*memcache.Client, *memcache.Item) e
 	return convertMemcacheError(storeFn(c.Client, &memcache.Item{
 		Key:        key,
 		Value:      b,
-		Expiration: int32(expire / time.Second),
+		Expiration: c.expiration(expire),
 	}))
 }
 
+// expiration converts a CacheStore expiration to seconds, 0 means no
+// expiration
+func (c *MemcachedStore) expiration(expire time.Duration) int32 {
+	switch expire {
+	case DEFAULT:
+		expire = c.defaultExpiration
+	case FOREVER:
+		expire = time.Duration(0)
+	}
+	return int32(expire / time.Second)
+}
+
 func convertMemcacheError(err error) error {
 	switch err {
 	case nil:
 		return nil
 	case memcache.ErrCacheMiss:
 		return ErrCacheMiss
-	case memcache.ErrNotStored:
+	case memcache.ErrNotStored, memcache.ErrCASConflict:
 		return ErrNotStored
 	}
 
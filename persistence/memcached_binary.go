@@ -1,6 +1,7 @@
 package persistence
 
 import (
+	"sync"
 	"time"
 
 	"github.com/memcachier/mc"
@@ -8,20 +9,25 @@ import (
 )
 
 // MemcachedBinaryStore represents the cache with memcached persistence using
-// the binary protocol
+// the binary protocol.
+//
+// mc hashes the keys with a single hasher shared by the goroutines, so the
+// store serializes its calls to the client. The methods of the embedded
+// Client are not serialized and must not run concurrently with the store.
 type MemcachedBinaryStore struct {
 	*mc.Client
 	defaultExpiration time.Duration
+	mu                sync.Mutex
 }
 
 // NewMemcachedBinaryStore returns a MemcachedBinaryStore
 func NewMemcachedBinaryStore(hostList, username, password string, defaultExpiration time.Duration) *MemcachedBinaryStore {
-	return &MemcachedBinaryStore{mc.NewMC(hostList, username, password), defaultExpiration}
+	return &MemcachedBinaryStore{Client: mc.NewMC(hostList, username, password), defaultExpiration: defaultExpiration}
 }
 
 // NewMemcachedBinaryStoreWithConfig returns a MemcachedBinaryStore using the provided configuration
 func NewMemcachedBinaryStoreWithConfig(hostList, username, password string, defaultExpiration time.Duration, config *mc.Config) *MemcachedBinaryStore {
-	return &MemcachedBinaryStore{mc.NewMCwithConfig(hostList, username, password, config), defaultExpiration}
+	return &MemcachedBinaryStore{Client: mc.NewMCwithConfig(hostList, username, password, config), defaultExpiration: defaultExpiration}
 }
 
 // Set (see CacheStore interface)
@@ -31,7 +37,9 @@ func (s *MemcachedBinaryStore) Set(key string, value interface{}, expires time.D
 	if err != nil {
 		return err
 	}
+	s.mu.Lock()
 	_, err = s.Client.Set(key, string(b), 0, exp, 0)
+	s.mu.Unlock()
 	return convertMcError(err)
 }
 
@@ -42,7 +50,9 @@ func (s *MemcachedBinaryStore) Add(key string, value interface{}, expires time.D
 	if err != nil {
 		return err
 	}
+	s.mu.Lock()
 	_, err = s.Client.Add(key, string(b), 0, exp)
+	s.mu.Unlock()
 	return convertMcError(err)
 }
 
@@ -53,39 +63,119 @@ func (s *MemcachedBinaryStore) Replace(key string, value interface{}, expires ti
 	if err != nil {
 		return err
 	}
+	s.mu.Lock()
 	_, err = s.Client.Replace(key, string(b), 0, exp, 0)
+	s.mu.Unlock()
+	if err == mc.ErrNotFound {
+		// the binary protocol reports a missing key, other stores ErrNotStored
+		return ErrNotStored
+	}
 	return convertMcError(err)
 }
 
 // Get (see CacheStore interface)
 func (s *MemcachedBinaryStore) Get(key string, value interface{}) error {
+	s.mu.Lock()
 	val, _, _, err := s.Client.Get(key)
+	s.mu.Unlock()
 	if err != nil {
 		return convertMcError(err)
 	}
 	return utils.Deserialize([]byte(val), value)
 }
 
+// GetWithVersion (see CASStore interface), the version is the CAS identifier
+// memcached gives to the item
+func (s *MemcachedBinaryStore) GetWithVersion(key string, value interface{}) (uint64, error) {
+	s.mu.Lock()
+	val, _, cas, err := s.Client.Get(key)
+	s.mu.Unlock()
+	if err != nil {
+		return 0, convertMcError(err)
+	}
+	if err := utils.Deserialize([]byte(val), value); err != nil {
+		return 0, err
+	}
+	return cas, nil
+}
+
+// CompareAndSwap (see CASStore interface)
+func (s *MemcachedBinaryStore) CompareAndSwap(key string, value interface{}, version uint64, expires time.Duration) error {
+	if version == 0 {
+		// mc sets the key whatever its CAS identifier when given 0
+		return ErrNotStored
+	}
+	exp := s.getExpiration(expires)
+	b, err := utils.Serialize(value)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	_, err = s.Client.Set(key, string(b), 0, exp, version)
+	s.mu.Unlock()
+	return convertMcError(err)
+}
+
+// CompareAndDelete (see CASDeleter interface)
+func (s *MemcachedBinaryStore) CompareAndDelete(key string, version uint64) error {
+	if version == 0 {
+		// mc deletes the key whatever its CAS identifier when given 0
+		return ErrNotStored
+	}
+	s.mu.Lock()
+	err := s.Client.DelCAS(key, version)
+	s.mu.Unlock()
+	return convertMcError(err)
+}
+
+// Scan is not supported by the memcached protocol (see Scanner interface)
+func (s *MemcachedBinaryStore) Scan(prefix, cursor string, count int) ([]KeyInfo, string, error) {
+	return nil, "", ErrNotSupport
+}
+
 // Delete (see CacheStore interface)
 func (s *MemcachedBinaryStore) Delete(key string) error {
-	return convertMcError(s.Client.Del(key))
+	s.mu.Lock()
+	err := s.Client.Del(key)
+	s.mu.Unlock()
+	return convertMcError(err)
 }
 
 // Increment (see CacheStore interface)
 func (s *MemcachedBinaryStore) Increment(key string, delta uint64) (uint64, error) {
+	s.mu.Lock()
 	n, _, err := s.Client.Incr(key, delta, 0, 0xffffffff, 0)
+	s.mu.Unlock()
 	return n, convertMcError(err)
 }
 
 // Decrement (see CacheStore interface)
 func (s *MemcachedBinaryStore) Decrement(key string, delta uint64) (uint64, error) {
+	s.mu.Lock()
 	n, _, err := s.Client.Decr(key, delta, 0, 0xffffffff, 0)
+	s.mu.Unlock()
 	return n, convertMcError(err)
 }
 
 // Flush (see CacheStore interface)
 func (s *MemcachedBinaryStore) Flush() error {
-	return convertMcError(s.Client.Flush(0))
+	s.mu.Lock()
+	err := s.Client.Flush(0)
+	s.mu.Unlock()
+	return convertMcError(err)
+}
+
+// TTL is not supported by the memcached protocol (see ExpiryStore interface)
+func (s *MemcachedBinaryStore) TTL(key string) (time.Duration, error) {
+	return 0, ErrNotSupport
+}
+
+// Touch (see ExpiryStore interface)
+func (s *MemcachedBinaryStore) Touch(key string, expires time.Duration) error {
+	s.mu.Lock()
+	_, err := s.Client.Touch(key, s.getExpiration(expires))
+	s.mu.Unlock()
+	return convertMcError(err)
 }
 
 // getExpiration converts a gin-contrib/cache expiration in the form of a
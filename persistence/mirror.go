@@ -0,0 +1,408 @@
+package persistence
+
+import (
+	"reflect"
+	"sync"
+	"time"
+)
+
+// Kinds of divergence reported by a MirrorStore
+const (
+	// DivergenceMissing is a key found on the primary but not on a secondary
+	DivergenceMissing = "missing"
+	// DivergenceExtra is a key found on a secondary but not on the primary
+	DivergenceExtra = "extra"
+	// DivergenceValue is a key holding different values
+	DivergenceValue = "value"
+)
+
+// DivergenceObserver receives the differences a MirrorStore finds between its
+// primary and a secondary. metrics.Registry implements it.
+type DivergenceObserver interface {
+	ObserveDivergence(store, secondary, kind string)
+}
+
+// MirrorOptions configures a MirrorStore
+type MirrorOptions struct {
+	// Name labels the store in the logs and observations, "mirror" when empty
+	Name string
+
+	// ReadFallback reads from the secondaries, in the order they were added,
+	// when the primary misses or fails
+	ReadFallback bool
+
+	// ShadowReads reads every key found or missed on the primary from the
+	// secondaries too, and reports the differences to Observer and Logger
+	ShadowReads bool
+
+	Observer DivergenceObserver
+
+	// QueueSize bounds the writes and shadow reads waiting to run on each
+	// secondary, 1000 when 0. The operations coming when the queue is full
+	// are dropped and logged.
+	QueueSize int
+
+	// Logger receives the failed writes to the secondaries and the
+	// divergences, it can be changed later with SetLogger
+	Logger Logger
+}
+
+// MirrorStore writes to a primary store and to secondaries, to move a cache
+// from one backend to another without starting cold.
+//
+// The primary is the reference: its result is returned, and a write the
+// primary refused is not mirrored. Add and Replace accepted by the primary are
+// mirrored as a Set, so the secondaries converge whatever they held. The
+// errors of the secondaries are logged and never returned.
+//
+// The writes and shadow reads of a secondary run in the background, in the
+// order they were made, so a slow secondary never slows down the primary.
+// Wait blocks until they ran.
+type MirrorStore struct {
+	primary      CacheStore
+	name         string
+	readFallback bool
+	shadowReads  bool
+	observer     DivergenceObserver
+	queueSize    int
+
+	mu          sync.RWMutex
+	secondaries []*mirrorSecondary
+	logger      Logger
+}
+
+// mirrorSecondary is a secondary and the queue of the operations its worker
+// runs on it
+type mirrorSecondary struct {
+	name  string
+	store CacheStore
+	queue chan func()
+	done  chan struct{} // closed by RemoveSecondary
+}
+
+func (sec *mirrorSecondary) run() {
+	for {
+		select {
+		case f := <-sec.queue:
+			f()
+		case <-sec.done:
+			return
+		}
+	}
+}
+
+// NewMirrorStore returns a MirrorStore writing to primary, the secondaries are
+// added with AddSecondary
+func NewMirrorStore(primary CacheStore, options *MirrorOptions) *MirrorStore {
+	if options == nil {
+		options = &MirrorOptions{}
+	}
+	s := &MirrorStore{
+		primary:      primary,
+		name:         options.Name,
+		readFallback: options.ReadFallback,
+		shadowReads:  options.ShadowReads,
+		observer:     options.Observer,
+		queueSize:    options.QueueSize,
+		logger:       options.Logger,
+	}
+	if s.name == "" {
+		s.name = "mirror"
+	}
+	if s.queueSize <= 0 {
+		s.queueSize = 1000
+	}
+	if s.logger == nil {
+		s.logger = NopLogger{}
+	}
+	return s
+}
+
+// SetLogger reports the failed writes to the secondaries and the divergences
+// to l
+func (s *MirrorStore) SetLogger(l Logger) {
+	s.mu.Lock()
+	s.logger = l
+	s.mu.Unlock()
+}
+
+// AddSecondary mirrors the writes to store, name labels it in the logs and
+// observations
+func (s *MirrorStore) AddSecondary(name string, store CacheStore) {
+	sec := &mirrorSecondary{
+		name:  name,
+		store: store,
+		queue: make(chan func(), s.queueSize),
+		done:  make(chan struct{}),
+	}
+	go sec.run()
+	s.mu.Lock()
+	s.secondaries = append(s.secondaries, sec)
+	s.mu.Unlock()
+}
+
+// RemoveSecondary stops mirroring to the secondary name, the operations still
+// queued for it are dropped
+func (s *MirrorStore) RemoveSecondary(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, sec := range s.secondaries {
+		if sec.name == name {
+			s.secondaries = append(s.secondaries[:i:i], s.secondaries[i+1:]...)
+			close(sec.done)
+			return
+		}
+	}
+}
+
+// Wait blocks until the operations queued for the secondaries ran
+func (s *MirrorStore) Wait() {
+	secondaries, _ := s.snapshot()
+	for _, sec := range secondaries {
+		ran := make(chan struct{})
+		select {
+		case sec.queue <- func() { close(ran) }:
+		case <-sec.done:
+			continue
+		}
+		select {
+		case <-ran:
+		case <-sec.done:
+		}
+	}
+}
+
+func (s *MirrorStore) snapshot() ([]*mirrorSecondary, Logger) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.secondaries, s.logger
+}
+
+// enqueue queues f to run on sec, f is dropped and logged when the queue of sec
+// is full
+func (s *MirrorStore) enqueue(sec *mirrorSecondary, logger Logger, op, key string, f func()) {
+	select {
+	case sec.queue <- f:
+	default:
+		logger.Log(LevelWarn, "cache: mirror queue full, operation dropped",
+			Field{"store", s.name}, Field{"secondary", sec.name}, Field{"op", op}, Field{"key", key})
+	}
+}
+
+// mirror queues op for every secondary and logs its failures, misses and
+// refused writes included as the secondaries may lag behind
+func (s *MirrorStore) mirror(op, key string, f func(CacheStore) error) {
+	secondaries, logger := s.snapshot()
+	for _, sec := range secondaries {
+		sec := sec
+		s.enqueue(sec, logger, op, key, func() {
+			err := f(sec.store)
+			if err != nil && err != ErrCacheMiss && err != ErrNotStored {
+				logger.Log(LevelWarn, "cache: mirrored write failed",
+					Field{"store", s.name}, Field{"secondary", sec.name}, Field{"op", op}, Field{"key", key}, Field{"error", err})
+			}
+		})
+	}
+}
+
+// Get (see CacheStore interface)
+func (s *MirrorStore) Get(key string, value interface{}) error {
+	err := s.primary.Get(key, value)
+	if s.shadowReads && (err == nil || err == ErrCacheMiss) {
+		s.shadow(key, value, err == nil)
+	}
+	if err == nil || !s.readFallback {
+		return err
+	}
+	secondaries, _ := s.snapshot()
+	for _, sec := range secondaries {
+		if e := sec.store.Get(key, value); e == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// shadow queues reads of key on the secondaries, which report how they differ
+// from the value read on the primary, found tells whether the primary had the
+// key. The value is copied as the caller may reuse it, the data it refers to
+// is not.
+func (s *MirrorStore) shadow(key string, value interface{}, found bool) {
+	t := reflect.TypeOf(value)
+	if t == nil || t.Kind() != reflect.Ptr {
+		return
+	}
+	read := reflect.New(t.Elem()).Elem()
+	read.Set(reflect.ValueOf(value).Elem())
+	secondaries, logger := s.snapshot()
+	for _, sec := range secondaries {
+		sec := sec
+		s.enqueue(sec, logger, "get", key, func() {
+			s.compare(sec, logger, key, read, found)
+		})
+	}
+}
+
+// compare reads key from sec and reports how it differs from read, the value
+// read on the primary
+func (s *MirrorStore) compare(sec *mirrorSecondary, logger Logger, key string, read reflect.Value, found bool) {
+	other := reflect.New(read.Type())
+	err := sec.store.Get(key, other.Interface())
+	kind := ""
+	switch {
+	case err != nil && err != ErrCacheMiss:
+		logger.Log(LevelWarn, "cache: shadow read failed",
+			Field{"store", s.name}, Field{"secondary", sec.name}, Field{"key", key}, Field{"error", err})
+		return
+	case found && err == ErrCacheMiss:
+		kind = DivergenceMissing
+	case !found && err == nil:
+		kind = DivergenceExtra
+	case found && !reflect.DeepEqual(read.Interface(), other.Elem().Interface()):
+		kind = DivergenceValue
+	default:
+		return
+	}
+	logger.Log(LevelWarn, "cache: mirror diverged",
+		Field{"store", s.name}, Field{"secondary", sec.name}, Field{"key", key}, Field{"kind", kind})
+	if s.observer != nil {
+		s.observer.ObserveDivergence(s.name, sec.name, kind)
+	}
+}
+
+// Set (see CacheStore interface)
+func (s *MirrorStore) Set(key string, value interface{}, expires time.Duration) error {
+	if err := s.primary.Set(key, value, expires); err != nil {
+		return err
+	}
+	s.mirror("set", key, func(store CacheStore) error {
+		return store.Set(key, value, expires)
+	})
+	return nil
+}
+
+// Add (see CacheStore interface)
+func (s *MirrorStore) Add(key string, value interface{}, expires time.Duration) error {
+	if err := s.primary.Add(key, value, expires); err != nil {
+		return err
+	}
+	s.mirror("add", key, func(store CacheStore) error {
+		return store.Set(key, value, expires)
+	})
+	return nil
+}
+
+// Replace (see CacheStore interface)
+func (s *MirrorStore) Replace(key string, value interface{}, expires time.Duration) error {
+	if err := s.primary.Replace(key, value, expires); err != nil {
+		return err
+	}
+	s.mirror("replace", key, func(store CacheStore) error {
+		return store.Set(key, value, expires)
+	})
+	return nil
+}
+
+// Delete (see CacheStore interface)
+func (s *MirrorStore) Delete(key string) error {
+	err := s.primary.Delete(key)
+	if err != nil && err != ErrCacheMiss {
+		return err
+	}
+	// a miss on the primary may still be a hit on a secondary
+	s.mirror("delete", key, func(store CacheStore) error {
+		return store.Delete(key)
+	})
+	return err
+}
+
+// Increment (see CacheStore interface)
+func (s *MirrorStore) Increment(key string, delta uint64) (uint64, error) {
+	n, err := s.primary.Increment(key, delta)
+	if err != nil {
+		return n, err
+	}
+	s.mirror("increment", key, func(store CacheStore) error {
+		_, err := store.Increment(key, delta)
+		return err
+	})
+	return n, nil
+}
+
+// Decrement (see CacheStore interface)
+func (s *MirrorStore) Decrement(key string, delta uint64) (uint64, error) {
+	n, err := s.primary.Decrement(key, delta)
+	if err != nil {
+		return n, err
+	}
+	s.mirror("decrement", key, func(store CacheStore) error {
+		_, err := store.Decrement(key, delta)
+		return err
+	})
+	return n, nil
+}
+
+// TTL (see ExpiryStore interface)
+func (s *MirrorStore) TTL(key string) (time.Duration, error) {
+	return TTL(s.primary, key)
+}
+
+// Touch (see ExpiryStore interface)
+func (s *MirrorStore) Touch(key string, expires time.Duration) error {
+	if err := Touch(s.primary, key, expires); err != nil {
+		return err
+	}
+	s.mirror("touch", key, func(store CacheStore) error {
+		if err := Touch(store, key, expires); err != ErrNotSupport {
+			return err
+		}
+		return nil
+	})
+	return nil
+}
+
+// GetWithVersion (see CASStore interface), the version is the one of the
+// primary and the secondaries are never read
+func (s *MirrorStore) GetWithVersion(key string, value interface{}) (uint64, error) {
+	return GetWithVersion(s.primary, key, value)
+}
+
+// CompareAndSwap (see CASStore interface), a swap accepted by the primary is
+// mirrored as a Set
+func (s *MirrorStore) CompareAndSwap(key string, value interface{}, version uint64, expires time.Duration) error {
+	if err := CompareAndSwap(s.primary, key, value, version, expires); err != nil {
+		return err
+	}
+	s.mirror("compareandswap", key, func(store CacheStore) error {
+		return store.Set(key, value, expires)
+	})
+	return nil
+}
+
+// CompareAndDelete (see CASDeleter interface), a delete accepted by the
+// primary is mirrored as a Delete
+func (s *MirrorStore) CompareAndDelete(key string, version uint64) error {
+	if err := CompareAndDelete(s.primary, key, version); err != nil {
+		return err
+	}
+	s.mirror("compareanddelete", key, func(store CacheStore) error {
+		return store.Delete(key)
+	})
+	return nil
+}
+
+// Scan (see Scanner interface), only the primary is scanned
+func (s *MirrorStore) Scan(prefix, cursor string, count int) ([]KeyInfo, string, error) {
+	return Scan(s.primary, prefix, cursor, count)
+}
+
+// Flush (see CacheStore interface)
+func (s *MirrorStore) Flush() error {
+	if err := s.primary.Flush(); err != nil {
+		return err
+	}
+	s.mirror("flush", "", func(store CacheStore) error {
+		return store.Flush()
+	})
+	return nil
+}
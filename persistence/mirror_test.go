@@ -0,0 +1,174 @@
+package persistence
+
+import (
+	"bytes"
+	"log"
+	"strings"
+	"testing"
+	"time"
+)
+
+type divergenceRecorder []string
+
+func (r *divergenceRecorder) ObserveDivergence(store, secondary, kind string) {
+	*r = append(*r, store+"/"+secondary+"/"+kind)
+}
+
+func TestMirrorStore_Writes(t *testing.T) {
+	var buf bytes.Buffer
+	primary, secondary := NewInMemoryStore(time.Hour), NewInMemoryStore(time.Hour)
+	down := &downStore{InMemoryStore: NewInMemoryStore(time.Hour), down: true}
+	s := NewMirrorStore(primary, &MirrorOptions{Logger: NewStdLogger(log.New(&buf, "", 0), LevelWarn)})
+	s.AddSecondary("memory", secondary)
+	s.AddSecondary("down", down)
+
+	if err := s.Set("key", "value", DEFAULT); err != nil {
+		t.Fatalf("Expected the failure of a secondary to be ignored, got %s", err)
+	}
+	s.Wait()
+	var value string
+	if err := secondary.Get("key", &value); err != nil || value != "value" {
+		t.Errorf("Expected the write to be mirrored, got %q, %v", value, err)
+	}
+	if !strings.Contains(buf.String(), "WARN cache: mirrored write failed store=mirror secondary=down op=set key=key error=shard down") {
+		t.Errorf("Expected the failed write to be logged, got %q", buf.String())
+	}
+
+	// the secondary doesn't have the key yet, Replace is mirrored as a Set
+	if err := primary.Set("other", "old", DEFAULT); err != nil {
+		t.Fatalf("Error setting a value: %s", err)
+	}
+	if err := s.Replace("other", "new", DEFAULT); err != nil {
+		t.Fatalf("Error replacing a value: %s", err)
+	}
+	s.Wait()
+	if err := secondary.Get("other", &value); err != nil || value != "new" {
+		t.Errorf("Expected Replace to be mirrored, got %q, %v", value, err)
+	}
+
+	// a write refused by the primary is not mirrored
+	if err := s.Add("key", "added", DEFAULT); err != ErrNotStored {
+		t.Errorf("Expected ErrNotStored, got %v", err)
+	}
+	s.Wait()
+	if err := secondary.Get("key", &value); err != nil || value != "value" {
+		t.Errorf("Expected the secondary to be left alone, got %q, %v", value, err)
+	}
+}
+
+func TestMirrorStore_ReadFallback(t *testing.T) {
+	primary := &downStore{InMemoryStore: NewInMemoryStore(time.Hour)}
+	secondary := NewInMemoryStore(time.Hour)
+	s := NewMirrorStore(primary, &MirrorOptions{ReadFallback: true})
+	s.AddSecondary("memory", secondary)
+
+	if err := secondary.Set("key", "value", DEFAULT); err != nil {
+		t.Fatalf("Error setting a value: %s", err)
+	}
+	var value string
+	if err := s.Get("key", &value); err != nil || value != "value" {
+		t.Errorf("Expected a miss on the primary to fall back, got %q, %v", value, err)
+	}
+	primary.down = true
+	value = ""
+	if err := s.Get("key", &value); err != nil || value != "value" {
+		t.Errorf("Expected a failure of the primary to fall back, got %q, %v", value, err)
+	}
+	if err := s.Get("missing", &value); err != errShardDown {
+		t.Errorf("Expected the error of the primary when no secondary has the key, got %v", err)
+	}
+}
+
+func TestMirrorStore_ShadowReads(t *testing.T) {
+	var observed divergenceRecorder
+	primary, secondary := NewInMemoryStore(time.Hour), NewInMemoryStore(time.Hour)
+	s := NewMirrorStore(primary, &MirrorOptions{ShadowReads: true, Observer: &observed})
+	s.AddSecondary("memory", secondary)
+
+	primary.Set("missing", "value", DEFAULT)
+	secondary.Set("extra", "value", DEFAULT)
+	primary.Set("value", "a", DEFAULT)
+	secondary.Set("value", "b", DEFAULT)
+	s.Set("same", "value", DEFAULT)
+
+	var value string
+	for _, key := range []string{"missing", "extra", "value", "same"} {
+		s.Get(key, &value)
+	}
+	s.Wait()
+	expected := []string{"mirror/memory/missing", "mirror/memory/extra", "mirror/memory/value"}
+	if strings.Join(observed, ",") != strings.Join(expected, ",") {
+		t.Errorf("Expected %v, got %v", expected, observed)
+	}
+
+	s.RemoveSecondary("memory")
+	observed = nil
+	s.Get("value", &value)
+	s.Wait()
+	if len(observed) != 0 {
+		t.Errorf("Expected no shadow read once the secondary is removed, got %v", observed)
+	}
+}
+
+func TestMirrorStore_PrimaryErrors(t *testing.T) {
+	primary := &downStore{InMemoryStore: NewInMemoryStore(time.Hour), down: true}
+	secondary := NewInMemoryStore(time.Hour)
+	s := NewMirrorStore(primary, nil)
+	s.AddSecondary("memory", secondary)
+
+	if err := s.Set("key", "value", DEFAULT); err != errShardDown {
+		t.Errorf("Expected the error of the primary, got %v", err)
+	}
+	s.Wait()
+	var value string
+	if err := secondary.Get("key", &value); err != ErrCacheMiss {
+		t.Errorf("Expected a failed write not to be mirrored, got %q, %v", value, err)
+	}
+}
+
+// blockingStore blocks its writes until unblock is closed, started receives a
+// value when one starts
+type blockingStore struct {
+	*InMemoryStore
+	started chan struct{}
+	unblock chan struct{}
+}
+
+func (s *blockingStore) Set(key string, value interface{}, expires time.Duration) error {
+	s.started <- struct{}{}
+	<-s.unblock
+	return s.InMemoryStore.Set(key, value, expires)
+}
+
+func TestMirrorStore_QueueFull(t *testing.T) {
+	var buf bytes.Buffer
+	primary := NewInMemoryStore(time.Hour)
+	slow := &blockingStore{NewInMemoryStore(time.Hour), make(chan struct{}, 3), make(chan struct{})}
+	s := NewMirrorStore(primary, &MirrorOptions{QueueSize: 1, Logger: NewStdLogger(log.New(&buf, "", 0), LevelWarn)})
+	s.AddSecondary("slow", slow)
+
+	// the first write runs and blocks, the second is queued, the third dropped
+	for _, key := range []string{"a", "b", "c"} {
+		if err := s.Set(key, "value", DEFAULT); err != nil {
+			t.Fatalf("Error setting a value: %s", err)
+		}
+		if key == "a" {
+			<-slow.started
+		}
+	}
+	var value string
+	if err := primary.Get("c", &value); err != nil {
+		t.Errorf("Expected the primary not to wait for the secondary, got %v", err)
+	}
+	close(slow.unblock)
+	s.Wait()
+
+	for key, expected := range map[string]error{"a": nil, "b": nil, "c": ErrCacheMiss} {
+		if err := slow.Get(key, &value); err != expected {
+			t.Errorf("Expected %v reading %s from the secondary, got %v", expected, key, err)
+		}
+	}
+	if !strings.Contains(buf.String(), "WARN cache: mirror queue full, operation dropped store=mirror secondary=slow op=set key=c") {
+		t.Errorf("Expected the dropped write to be logged, got %q", buf.String())
+	}
+}
@@ -0,0 +1,271 @@
+package persistence
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PrefixFlusher is implemented by stores that are able to delete every key
+// starting with a given prefix without touching the rest of the keyspace.
+type PrefixFlusher interface {
+	FlushPrefix(prefix string) error
+}
+
+// PrefixedStore namespaces every key of the wrapped CacheStore with a prefix,
+// so several services can share one backend without colliding.
+//
+// Flush only removes the keys of the namespace. When the wrapped store
+// implements PrefixFlusher the keys are deleted directly, otherwise a
+// generation counter is stored next to the keys and Flush moves the namespace
+// to a new generation, leaving the old entries to expire on their own.
+//
+// The generation is read from the wrapped store, an extra Get per command, at
+// most once per second and remembered in between (see SetGenerationTTL): the
+// Flush of another process is seen up to a second later.
+//
+// The prefix and the keys are separated by a ':', which the prefix can not
+// contain: a namespace "a" would otherwise hold the keys, and flush the keys,
+// of a namespace "a:b". Namespaces are nested by wrapping PrefixedStores.
+type PrefixedStore struct {
+	store   CacheStore
+	prefix  string
+	flusher PrefixFlusher
+	genKey  string
+
+	mu         sync.Mutex
+	gen        uint64
+	genExpires time.Time
+	genTTL     time.Duration
+}
+
+// NewPrefixedStore returns a PrefixedStore wrapping store, it panics when
+// prefix contains a ':'
+func NewPrefixedStore(store CacheStore, prefix string) *PrefixedStore {
+	if strings.Contains(prefix, ":") {
+		panic("cache: NewPrefixedStore with a prefix containing ':', nest the PrefixedStores instead")
+	}
+	s := &PrefixedStore{
+		store:  store,
+		prefix: prefix + ":",
+		genKey: prefix + ".generation",
+		genTTL: time.Second,
+	}
+	if flusher, ok := store.(PrefixFlusher); ok {
+		s.flusher = flusher
+	}
+	return s
+}
+
+// SetGenerationTTL changes how long the generation of the namespace is
+// remembered, it is read from the wrapped store before every command with 0.
+func (s *PrefixedStore) SetGenerationTTL(ttl time.Duration) {
+	s.mu.Lock()
+	s.genTTL = ttl
+	s.genExpires = time.Time{}
+	s.mu.Unlock()
+}
+
+// Prefix returns the namespace of the store
+func (s *PrefixedStore) Prefix() string {
+	return s.prefix[:len(s.prefix)-1]
+}
+
+// Get (see CacheStore interface)
+func (s *PrefixedStore) Get(key string, value interface{}) error {
+	k, err := s.key(key)
+	if err != nil {
+		return err
+	}
+	return s.store.Get(k, value)
+}
+
+// Set (see CacheStore interface)
+func (s *PrefixedStore) Set(key string, value interface{}, expires time.Duration) error {
+	k, err := s.key(key)
+	if err != nil {
+		return err
+	}
+	return s.store.Set(k, value, expires)
+}
+
+// Add (see CacheStore interface)
+func (s *PrefixedStore) Add(key string, value interface{}, expires time.Duration) error {
+	k, err := s.key(key)
+	if err != nil {
+		return err
+	}
+	return s.store.Add(k, value, expires)
+}
+
+// Replace (see CacheStore interface)
+func (s *PrefixedStore) Replace(key string, value interface{}, expires time.Duration) error {
+	k, err := s.key(key)
+	if err != nil {
+		return err
+	}
+	return s.store.Replace(k, value, expires)
+}
+
+// Delete (see CacheStore interface)
+func (s *PrefixedStore) Delete(key string) error {
+	k, err := s.key(key)
+	if err != nil {
+		return err
+	}
+	return s.store.Delete(k)
+}
+
+// Increment (see CacheStore interface)
+func (s *PrefixedStore) Increment(key string, delta uint64) (uint64, error) {
+	k, err := s.key(key)
+	if err != nil {
+		return 0, err
+	}
+	return s.store.Increment(k, delta)
+}
+
+// Decrement (see CacheStore interface)
+func (s *PrefixedStore) Decrement(key string, delta uint64) (uint64, error) {
+	k, err := s.key(key)
+	if err != nil {
+		return 0, err
+	}
+	return s.store.Decrement(k, delta)
+}
+
+// TTL (see ExpiryStore interface)
+func (s *PrefixedStore) TTL(key string) (time.Duration, error) {
+	k, err := s.key(key)
+	if err != nil {
+		return 0, err
+	}
+	return TTL(s.store, k)
+}
+
+// Touch (see ExpiryStore interface)
+func (s *PrefixedStore) Touch(key string, expires time.Duration) error {
+	k, err := s.key(key)
+	if err != nil {
+		return err
+	}
+	return Touch(s.store, k, expires)
+}
+
+// GetWithVersion (see CASStore interface)
+func (s *PrefixedStore) GetWithVersion(key string, value interface{}) (uint64, error) {
+	k, err := s.key(key)
+	if err != nil {
+		return 0, err
+	}
+	return GetWithVersion(s.store, k, value)
+}
+
+// CompareAndSwap (see CASStore interface)
+func (s *PrefixedStore) CompareAndSwap(key string, value interface{}, version uint64, expires time.Duration) error {
+	k, err := s.key(key)
+	if err != nil {
+		return err
+	}
+	return CompareAndSwap(s.store, k, value, version, expires)
+}
+
+// CompareAndDelete (see CASDeleter interface)
+func (s *PrefixedStore) CompareAndDelete(key string, version uint64) error {
+	k, err := s.key(key)
+	if err != nil {
+		return err
+	}
+	return CompareAndDelete(s.store, k, version)
+}
+
+// Scan (see Scanner interface), the keys of the current namespace are listed
+// without their prefix
+func (s *PrefixedStore) Scan(prefix, cursor string, count int) ([]KeyInfo, string, error) {
+	namespace, err := s.key("")
+	if err != nil {
+		return nil, "", err
+	}
+	infos, next, err := Scan(s.store, namespace+prefix, cursor, count)
+	for i := range infos {
+		infos[i].Key = strings.TrimPrefix(infos[i].Key, namespace)
+	}
+	return infos, next, err
+}
+
+// Flush (see CacheStore interface)
+func (s *PrefixedStore) Flush() error {
+	if s.flusher != nil {
+		return s.flusher.FlushPrefix(s.prefix)
+	}
+	gen, err := s.store.Increment(s.genKey, 1)
+	if err == ErrCacheMiss {
+		// nothing was written under a generation yet
+		gen, err = s.loadGeneration()
+	}
+	if err != nil {
+		return err
+	}
+	s.remember(gen)
+	return nil
+}
+
+func (s *PrefixedStore) key(key string) (string, error) {
+	if s.flusher != nil {
+		return s.prefix + key, nil
+	}
+	gen, err := s.generation()
+	if err != nil {
+		return "", err
+	}
+	return s.prefix + strconv.FormatUint(gen, 10) + ":" + key, nil
+}
+
+// generation returns the current generation of the namespace, the one
+// remembered while it is fresh
+func (s *PrefixedStore) generation() (uint64, error) {
+	s.mu.Lock()
+	gen, fresh := s.gen, time.Now().Before(s.genExpires)
+	s.mu.Unlock()
+	if fresh {
+		return gen, nil
+	}
+	gen, err := s.loadGeneration()
+	if err != nil {
+		return 0, err
+	}
+	s.remember(gen)
+	return gen, nil
+}
+
+// remember keeps gen for the TTL of the generation. Generations only grow,
+// a load started before a Flush does not bring the previous one back.
+func (s *PrefixedStore) remember(gen uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	if gen < s.gen && now.Before(s.genExpires) {
+		return
+	}
+	s.gen = gen
+	s.genExpires = now.Add(s.genTTL)
+}
+
+// loadGeneration reads the generation of the namespace from the wrapped
+// store, creating it when it does not exist yet.
+func (s *PrefixedStore) loadGeneration() (uint64, error) {
+	var gen uint64
+	err := s.store.Get(s.genKey, &gen)
+	if err != ErrCacheMiss {
+		return gen, err
+	}
+	// start from the clock rather than from 1, an evicted counter must not
+	// bring an old generation back to life
+	err = s.store.Add(s.genKey, uint64(time.Now().UnixNano()), FOREVER)
+	if err != nil && err != ErrNotStored {
+		return 0, err
+	}
+	err = s.store.Get(s.genKey, &gen)
+	return gen, err
+}
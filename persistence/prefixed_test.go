@@ -0,0 +1,187 @@
+package persistence
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPrefixedStore_Flush(t *testing.T) {
+	backend := NewInMemoryStore(time.Hour)
+	foo := NewPrefixedStore(backend, "foo")
+	bar := NewPrefixedStore(backend, "bar")
+
+	if err := backend.Set("raw", "raw", DEFAULT); err != nil {
+		t.Fatalf("Error setting a value: %s", err)
+	}
+	if err := foo.Set("key", "foo", DEFAULT); err != nil {
+		t.Fatalf("Error setting a value: %s", err)
+	}
+	if err := bar.Set("key", "bar", DEFAULT); err != nil {
+		t.Fatalf("Error setting a value: %s", err)
+	}
+
+	var value string
+	if err := backend.Get("key", &value); err != ErrCacheMiss {
+		t.Errorf("Expected the key to be namespaced, got: %v", err)
+	}
+
+	if err := foo.Flush(); err != nil {
+		t.Fatalf("Error flushing: %s", err)
+	}
+	if err := foo.Get("key", &value); err != ErrCacheMiss {
+		t.Errorf("Expected ErrCacheMiss after flush, got: %v", err)
+	}
+	if err := bar.Get("key", &value); err != nil || value != "bar" {
+		t.Errorf("Expected bar to survive the flush, got %q: %v", value, err)
+	}
+	if err := backend.Get("raw", &value); err != nil || value != "raw" {
+		t.Errorf("Expected raw key to survive the flush, got %q: %v", value, err)
+	}
+
+	// a second store on the same namespace sees the new generation
+	other := NewPrefixedStore(backend, "foo")
+	if err := foo.Set("key", "new", DEFAULT); err != nil {
+		t.Fatalf("Error setting a value: %s", err)
+	}
+	if err := other.Get("key", &value); err != nil || value != "new" {
+		t.Errorf("Expected new, got %q: %v", value, err)
+	}
+}
+
+// countingStore counts the Gets of the wrapped store
+type countingStore struct {
+	*InMemoryStore
+	gets int
+}
+
+func (s *countingStore) Get(key string, value interface{}) error {
+	s.gets++
+	return s.InMemoryStore.Get(key, value)
+}
+
+func TestPrefixedStore_GenerationTTL(t *testing.T) {
+	backend := &countingStore{InMemoryStore: NewInMemoryStore(time.Hour)}
+	foo := NewPrefixedStore(backend, "foo")
+	foo.SetGenerationTTL(50 * time.Millisecond)
+	other := NewPrefixedStore(backend, "foo")
+
+	if err := foo.Set("key", "value", DEFAULT); err != nil {
+		t.Fatalf("Error setting a value: %s", err)
+	}
+	backend.gets = 0
+	var value string
+	for i := 0; i < 3; i++ {
+		if err := foo.Get("key", &value); err != nil || value != "value" {
+			t.Fatalf("Expected value, got %q: %v", value, err)
+		}
+	}
+	if backend.gets != 3 {
+		t.Errorf("Expected the generation to be remembered, got %d gets for 3", backend.gets)
+	}
+
+	// the flush of another store is seen once the generation is read again
+	if err := other.Flush(); err != nil {
+		t.Fatalf("Error flushing: %s", err)
+	}
+	if err := other.Get("key", &value); err != ErrCacheMiss {
+		t.Errorf("Expected ErrCacheMiss after flush, got: %v", err)
+	}
+	if err := foo.Get("key", &value); err != nil {
+		t.Errorf("Expected the previous generation to be remembered, got: %v", err)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if err := foo.Get("key", &value); err != ErrCacheMiss {
+		t.Errorf("Expected ErrCacheMiss once the generation is read again, got: %v", err)
+	}
+
+	foo.SetGenerationTTL(0)
+	backend.gets = 0
+	foo.Get("key", &value)
+	foo.Get("key", &value)
+	if backend.gets != 4 {
+		t.Errorf("Expected the generation to be read before every command, got %d gets for 2", backend.gets)
+	}
+}
+
+type prefixFlushStore struct {
+	*InMemoryStore
+	flushed []string
+}
+
+func (s *prefixFlushStore) FlushPrefix(prefix string) error {
+	s.flushed = append(s.flushed, prefix)
+	return nil
+}
+
+func TestPrefixedStore_FlushPrefix(t *testing.T) {
+	backend := &prefixFlushStore{InMemoryStore: NewInMemoryStore(time.Hour)}
+	store := NewPrefixedStore(backend, "foo")
+
+	if err := store.Set("key", "value", DEFAULT); err != nil {
+		t.Fatalf("Error setting a value: %s", err)
+	}
+	var value string
+	if err := backend.Get("foo:key", &value); err != nil || value != "value" {
+		t.Errorf("Expected the key to be stored as foo:key, got %q: %v", value, err)
+	}
+	if err := store.Flush(); err != nil {
+		t.Fatalf("Error flushing: %s", err)
+	}
+	if len(backend.flushed) != 1 || backend.flushed[0] != "foo:" {
+		t.Errorf("Expected FlushPrefix(foo:), got %v", backend.flushed)
+	}
+}
+
+func TestPrefixedStore_Nested(t *testing.T) {
+	fake := newFakeRedis(t)
+	defer fake.Close()
+	backend := NewRedisCache(fake.Addr(), "", time.Hour)
+	a := NewPrefixedStore(backend, "a")
+	ab := NewPrefixedStore(a, "b")
+	other := NewPrefixedStore(backend, "ab")
+
+	for _, s := range []CacheStore{a, ab, other} {
+		if err := s.Set("key", "value", DEFAULT); err != nil {
+			t.Fatalf("Error setting a value: %s", err)
+		}
+	}
+	var value string
+	if err := backend.Get("a:b:key", &value); err != ErrCacheMiss {
+		t.Errorf("Expected the nested namespace to be kept apart from the keys of a, got: %v", err)
+	}
+
+	// flushing the nested namespace leaves the keys of a alone
+	if err := ab.Flush(); err != nil {
+		t.Fatalf("Error flushing: %s", err)
+	}
+	if err := ab.Get("key", &value); err != ErrCacheMiss {
+		t.Errorf("Expected ErrCacheMiss after flush, got: %v", err)
+	}
+	if err := a.Get("key", &value); err != nil {
+		t.Errorf("Expected the keys of a to survive the flush of a:b, got: %v", err)
+	}
+
+	// flushing a flushes the namespaces nested in it, not the ones sharing
+	// its first letters
+	ab.Set("key", "value", DEFAULT)
+	if err := a.Flush(); err != nil {
+		t.Fatalf("Error flushing: %s", err)
+	}
+	for name, s := range map[string]CacheStore{"a": a, "a:b": ab} {
+		if err := s.Get("key", &value); err != ErrCacheMiss {
+			t.Errorf("Expected ErrCacheMiss in %s after flush, got: %v", name, err)
+		}
+	}
+	if err := other.Get("key", &value); err != nil {
+		t.Errorf("Expected the keys of ab to survive the flush of a, got: %v", err)
+	}
+}
+
+func TestPrefixedStore_RejectsSeparator(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Errorf("Expected NewPrefixedStore to panic with a prefix containing ':'")
+		}
+	}()
+	NewPrefixedStore(NewInMemoryStore(time.Hour), "a:b")
+}
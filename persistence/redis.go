@@ -1,6 +1,12 @@
 package persistence
 
 import (
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gin-contrib/cache/utils"
@@ -11,34 +17,84 @@ import (
 type RedisStore struct {
 	pool              *redis.Pool
 	defaultExpiration time.Duration
+	logger            Logger
+	sentinel          *redisSentinel
+	cluster           *redisCluster
 }
 
-// NewRedisCache returns a RedisStore
-// until redigo supports sharding/clustering, only one host will be in hostList
-func NewRedisCache(host string, password string, defaultExpiration time.Duration) *RedisStore {
-	var pool = &redis.Pool{
+// RedisOptions configures the connections of a RedisStore. The zero value
+// connects over TCP to the database 0 without authentication.
+type RedisOptions struct {
+	// Username and Password are sent with AUTH, the username needs the ACLs
+	// of redis 6 and newer
+	Username string
+	Password string
+
+	// SentinelUsername and SentinelPassword are sent with AUTH to sentinels
+	SentinelUsername string
+	SentinelPassword string
+
+	// DB is the database selected once connected, redis cluster only has 0
+	DB int
+
+	// TLSConfig enables TLS when set
+	TLSConfig *tls.Config
+
+	// DialTimeout bounds the time to connect, no limit when 0
+	DialTimeout time.Duration
+}
+
+// dial connects to address and authenticates with username and password
+func (o *RedisOptions) dial(address, username, password string) (redis.Conn, error) {
+	var options []redis.DialOption
+	if o.DialTimeout > 0 {
+		options = append(options, redis.DialConnectTimeout(o.DialTimeout))
+	}
+	if o.TLSConfig != nil {
+		options = append(options, redis.DialUseTLS(true), redis.DialTLSConfig(o.TLSConfig))
+	}
+	c, err := redis.Dial("tcp", address, options...)
+	if err != nil {
+		return nil, err
+	}
+	// AUTH is sent by hand as redigo does not support usernames
+	switch {
+	case len(username) > 0:
+		_, err = c.Do("AUTH", username, password)
+	case len(password) > 0:
+		_, err = c.Do("AUTH", password)
+	default:
+		// check with PING
+		_, err = c.Do("PING")
+	}
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// dialServer connects to the redis server at address
+func (o *RedisOptions) dialServer(address string) (redis.Conn, error) {
+	c, err := o.dial(address, o.Username, o.Password)
+	if err != nil {
+		return nil, err
+	}
+	if o.DB != 0 {
+		if _, err := c.Do("SELECT", o.DB); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// newRedisPool returns the pool of connections the redis stores use
+func newRedisPool(dial func() (redis.Conn, error)) *redis.Pool {
+	return &redis.Pool{
 		MaxIdle:     5,
 		IdleTimeout: 240 * time.Second,
-		Dial: func() (redis.Conn, error) {
-			// the redis protocol should probably be made sett-able
-			c, err := redis.Dial("tcp", host)
-			if err != nil {
-				return nil, err
-			}
-			if len(password) > 0 {
-				if _, err := c.Do("AUTH", password); err != nil {
-					c.Close()
-					return nil, err
-				}
-			} else {
-				// check with PING
-				if _, err := c.Do("PING"); err != nil {
-					c.Close()
-					return nil, err
-				}
-			}
-			return c, err
-		},
+		Dial:        dial,
 		// custom connection test method
 		TestOnBorrow: func(c redis.Conn, t time.Time) error {
 			if _, err := c.Do("PING"); err != nil {
@@ -47,54 +103,82 @@ func NewRedisCache(host string, password string, defaultExpiration time.Duration
 			return nil
 		},
 	}
-	return &RedisStore{pool, defaultExpiration}
+}
+
+// NewRedisCache returns a RedisStore connected to a single host, see
+// NewRedisSentinelCache and NewRedisClusterCache for the other deployments
+func NewRedisCache(host string, password string, defaultExpiration time.Duration) *RedisStore {
+	return NewRedisCacheWithOptions(host, &RedisOptions{Password: password}, defaultExpiration)
+}
+
+// NewRedisCacheWithOptions returns a RedisStore connected to a single host
+func NewRedisCacheWithOptions(host string, options *RedisOptions, defaultExpiration time.Duration) *RedisStore {
+	if options == nil {
+		options = &RedisOptions{}
+	}
+	return NewRedisCacheWithPool(newRedisPool(func() (redis.Conn, error) {
+		return options.dialServer(host)
+	}), defaultExpiration)
 }
 
 // NewRedisCacheWithPool returns a RedisStore using the provided pool
-// until redigo supports sharding/clustering, only one host will be in hostList
 func NewRedisCacheWithPool(pool *redis.Pool, defaultExpiration time.Duration) *RedisStore {
-	return &RedisStore{pool, defaultExpiration}
+	return &RedisStore{pool: pool, defaultExpiration: defaultExpiration, logger: NopLogger{}}
+}
+
+// SetLogger reports the errors the store can not return to l
+func (c *RedisStore) SetLogger(l Logger) {
+	c.logger = l
+	if c.sentinel != nil {
+		c.sentinel.setLogger(l)
+	}
+}
+
+// conn returns a connection to the server of key
+func (c *RedisStore) conn(key string) redis.Conn {
+	if c.cluster != nil {
+		return c.cluster.conn(key)
+	}
+	return c.pool.Get()
+}
+
+// eachMaster runs f with a connection to every master
+func (c *RedisStore) eachMaster(f func(conn redis.Conn) error) error {
+	if c.cluster != nil {
+		return c.cluster.eachMaster(f)
+	}
+	conn := c.pool.Get()
+	defer conn.Close()
+	return f(conn)
 }
 
 // Set (see CacheStore interface)
 func (c *RedisStore) Set(key string, value interface{}, expires time.Duration) error {
-	conn := c.pool.Get()
+	conn := c.conn(key)
 	defer conn.Close()
 	return c.invoke(conn.Do, key, value, expires)
 }
 
 // Add (see CacheStore interface)
 func (c *RedisStore) Add(key string, value interface{}, expires time.Duration) error {
-	conn := c.pool.Get()
+	conn := c.conn(key)
 	defer conn.Close()
-	if exists(conn, key) {
-		return ErrNotStored
-	}
-	return c.invoke(conn.Do, key, value, expires)
+	return c.invoke(conn.Do, key, value, expires, "NX")
 }
 
 // Replace (see CacheStore interface)
 func (c *RedisStore) Replace(key string, value interface{}, expires time.Duration) error {
-	conn := c.pool.Get()
+	conn := c.conn(key)
 	defer conn.Close()
-	if !exists(conn, key) {
-		return ErrNotStored
-	}
-	err := c.invoke(conn.Do, key, value, expires)
-	if value == nil {
-		return ErrNotStored
-	}
-
-	return err
-
+	return c.invoke(conn.Do, key, value, expires, "XX")
 }
 
 // Get (see CacheStore interface)
 func (c *RedisStore) Get(key string, ptrValue interface{}) error {
-	conn := c.pool.Get()
+	conn := c.conn(key)
 	defer conn.Close()
 	raw, err := conn.Do("GET", key)
-	if raw == nil {
+	if err == nil && raw == nil {
 		return ErrCacheMiss
 	}
 	item, err := redis.Bytes(raw, err)
@@ -104,100 +188,332 @@ func (c *RedisStore) Get(key string, ptrValue interface{}) error {
 	return utils.Deserialize(item, ptrValue)
 }
 
-func exists(conn redis.Conn, key string) bool {
-	retval, _ := redis.Bool(conn.Do("EXISTS", key))
-	return retval
-}
-
 // Delete (see CacheStore interface)
 func (c *RedisStore) Delete(key string) error {
-	conn := c.pool.Get()
+	conn := c.conn(key)
 	defer conn.Close()
-	if !exists(conn, key) {
+	n, err := redis.Int(conn.Do("DEL", key))
+	if err == nil && n == 0 {
 		return ErrCacheMiss
 	}
-	_, err := conn.Do("DEL", key)
 	return err
 }
 
 // Increment (see CacheStore interface)
 func (c *RedisStore) Increment(key string, delta uint64) (uint64, error) {
-	conn := c.pool.Get()
+	return c.count(key, delta, "incr")
+}
+
+// Decrement (see CacheStore interface)
+func (c *RedisStore) Decrement(key string, delta uint64) (newValue uint64, err error) {
+	return c.count(key, delta, "decr")
+}
+
+var counterScript = redis.NewScript(1, redisCounterScript)
+
+// count runs redisCounterScript. INCRBY and DECRBY can not be used as they
+// create missing keys, do not wrap around and go below zero.
+func (c *RedisStore) count(key string, delta uint64, op string) (uint64, error) {
+	conn := c.conn(key)
 	defer conn.Close()
-	// Check for existance *before* increment as per the cache contract.
-	// redis will auto create the key, and we don't want that. Since we need to do increment
-	// ourselves instead of natively via INCRBY (redis doesn't support wrapping), we get the value
-	// and do the exists check this way to minimize calls to Redis
-	val, err := conn.Do("GET", key)
-	if val == nil {
+	raw, err := counterScript.Do(conn, key, strconv.FormatUint(delta, 10), op)
+	if err == nil && raw == nil {
 		return 0, ErrCacheMiss
 	}
-	if err == nil {
-		currentVal, err := redis.Int64(val, nil)
-		if err != nil {
-			return 0, err
-		}
-		sum := currentVal + int64(delta)
-		_, err = conn.Do("SET", key, sum)
-		if err != nil {
-			return 0, err
-		}
-		return uint64(sum), nil
+	return redis.Uint64(raw, err)
+}
+
+// Retryable (see RetryClassifier interface). Increment and Decrement are
+// retried when the connection could not be made or the pool is exhausted,
+// before the command is sent; the other commands as IsRetryable tells.
+func (c *RedisStore) Retryable(op string, err error) bool {
+	if op != "increment" && op != "decrement" {
+		return IsRetryable(err)
 	}
+	return err == redis.ErrPoolExhausted || isDialError(err)
+}
+
+var touchScript = redis.NewScript(1, redisTouchScript)
 
-	return 0, err
+// TTL (see ExpiryStore interface)
+func (c *RedisStore) TTL(key string) (time.Duration, error) {
+	conn := c.conn(key)
+	defer conn.Close()
+	ms, err := redis.Int64(conn.Do("PTTL", key))
+	return redisTTL(ms, err)
 }
 
-// Decrement (see CacheStore interface)
-func (c *RedisStore) Decrement(key string, delta uint64) (newValue uint64, err error) {
-	conn := c.pool.Get()
+// redisTTL converts the reply of PTTL
+func redisTTL(ms int64, err error) (time.Duration, error) {
+	switch {
+	case err != nil:
+		return 0, err
+	case ms == -2:
+		return 0, ErrCacheMiss
+	case ms < 0:
+		return FOREVER, nil
+	}
+	return time.Duration(ms) * time.Millisecond, nil
+}
+
+// Touch (see ExpiryStore interface)
+func (c *RedisStore) Touch(key string, expires time.Duration) error {
+	conn := c.conn(key)
 	defer conn.Close()
-	// Check for existance *before* increment as per the cache contract.
-	// redis will auto create the key, and we don't want that, hence the exists call
-	if !exists(conn, key) {
+	ms := redisExpiration(expires, c.defaultExpiration)
+	touched, err := redis.Bool(touchScript.Do(conn, key, ms))
+	if err == nil && !touched {
+		return ErrCacheMiss
+	}
+	return err
+}
+
+var casScript = redis.NewScript(1, redisCASScript)
+
+// GetWithVersion (see CASStore interface). Redis does not version its keys,
+// the version is derived from the SHA-1 of the value: writing back a value
+// the key held before restores its version.
+func (c *RedisStore) GetWithVersion(key string, ptrValue interface{}) (uint64, error) {
+	conn := c.conn(key)
+	defer conn.Close()
+	raw, err := conn.Do("GET", key)
+	if err == nil && raw == nil {
 		return 0, ErrCacheMiss
 	}
-	// Decrement contract says you can only go to 0
-	// so we go fetch the value and if the delta is greater than the amount,
-	// 0 out the value
-	currentVal, err := redis.Int64(conn.Do("GET", key))
-	if err == nil && delta > uint64(currentVal) {
-		tempint, err := redis.Int64(conn.Do("DECRBY", key, currentVal))
-		return uint64(tempint), err
+	item, err := redis.Bytes(raw, err)
+	if err != nil {
+		return 0, err
+	}
+	if err := utils.Deserialize(item, ptrValue); err != nil {
+		return 0, err
+	}
+	return valueVersion(item), nil
+}
+
+// CompareAndSwap (see CASStore interface)
+func (c *RedisStore) CompareAndSwap(key string, value interface{}, version uint64, expires time.Duration) error {
+	b, err := utils.Serialize(value)
+	if err != nil {
+		return err
+	}
+	conn := c.conn(key)
+	defer conn.Close()
+	ms := redisExpiration(expires, c.defaultExpiration)
+	return redisCASResult(redis.Int(casScript.Do(conn, key, redisVersionArg(version), b, ms)))
+}
+
+var casDeleteScript = redis.NewScript(1, redisCASDeleteScript)
+
+// CompareAndDelete (see CASDeleter interface)
+func (c *RedisStore) CompareAndDelete(key string, version uint64) error {
+	conn := c.conn(key)
+	defer conn.Close()
+	return redisCASResult(redis.Int(casDeleteScript.Do(conn, key, redisVersionArg(version))))
+}
+
+// valueVersion returns the version of a serialized value, the first 8 bytes
+// of its SHA-1
+func valueVersion(b []byte) uint64 {
+	h := sha1.Sum(b)
+	return binary.BigEndian.Uint64(h[:8])
+}
+
+// redisVersionArg formats version the way redisCASScript compares it
+func redisVersionArg(version uint64) string {
+	return fmt.Sprintf("%016x", version)
+}
+
+// redisCASResult converts the reply of redisCASScript
+func redisCASResult(n int, err error) error {
+	switch {
+	case err != nil:
+		return err
+	case n < 0:
+		return ErrCacheMiss
+	case n == 0:
+		return ErrNotStored
 	}
-	tempint, err := redis.Int64(conn.Do("DECRBY", key, delta))
-	return uint64(tempint), err
+	return nil
 }
 
 // FlushAll (see CacheStore interface)
 func (c *RedisStore) Flush() error {
-	conn := c.pool.Get()
-	defer conn.Close()
-	_, err := conn.Do("FLUSHALL")
-	return err
+	return c.eachMaster(func(conn redis.Conn) error {
+		_, err := conn.Do("FLUSHALL")
+		return err
+	})
 }
 
-func (c *RedisStore) invoke(f func(string, ...interface{}) (interface{}, error),
-	key string, value interface{}, expires time.Duration) error {
+// FlushPrefix (see PrefixFlusher interface)
+func (c *RedisStore) FlushPrefix(prefix string) error {
+	return c.eachMaster(func(conn redis.Conn) error {
+		cursor := "0"
+		for {
+			values, err := redis.Values(conn.Do("SCAN", cursor, "MATCH", escapeGlob(prefix)+"*", "COUNT", 100))
+			if err != nil {
+				return err
+			}
+			cursor, err = redis.String(values[0], nil)
+			if err != nil {
+				return err
+			}
+			keys, err := redis.Strings(values[1], nil)
+			if err != nil {
+				return err
+			}
+			if err := c.del(conn, keys); err != nil {
+				return err
+			}
+			if cursor == "0" {
+				return nil
+			}
+		}
+	})
+}
 
-	switch expires {
-	case DEFAULT:
-		expires = c.defaultExpiration
-	case FOREVER:
-		expires = time.Duration(0)
+// Scan (see Scanner interface). The keys are listed with SCAN MATCH, from
+// every master of a cluster in turn, and their size and TTL are read in a
+// single round trip per page.
+func (c *RedisStore) Scan(prefix, cursor string, count int) ([]KeyInfo, string, error) {
+	node, next, err := parseNodeCursor(cursor)
+	if err != nil {
+		return nil, "", err
+	}
+	if next == "" {
+		next = "0"
 	}
+	var conn redis.Conn
+	nodes := 1
+	if c.cluster != nil {
+		addrs, err := c.cluster.masters()
+		if err != nil {
+			return nil, "", err
+		}
+		if node >= len(addrs) {
+			return nil, "", ErrInvalidCursor
+		}
+		nodes = len(addrs)
+		conn = c.cluster.pool(addrs[node]).Get()
+	} else if node > 0 {
+		return nil, "", ErrInvalidCursor
+	} else {
+		conn = c.pool.Get()
+	}
+	defer conn.Close()
 
-	b, err := utils.Serialize(value)
+	values, err := redis.Values(conn.Do("SCAN", next, "MATCH", escapeGlob(prefix)+"*", "COUNT", scanCount(count)))
+	if err != nil {
+		return nil, "", err
+	}
+	next, err = redis.String(values[0], nil)
+	if err != nil {
+		return nil, "", err
+	}
+	keys, err := redis.Strings(values[1], nil)
+	if err != nil {
+		return nil, "", err
+	}
+	infos, err := redisKeyInfos(conn, keys)
 	if err != nil {
+		return nil, "", err
+	}
+	if next == "0" {
+		next = ""
+	}
+	return infos, nodeCursor(node, next, nodes), nil
+}
+
+// redisKeyInfos pipelines STRLEN and PTTL for keys, the keys gone meanwhile
+// are left out. A key the server refuses to measure, one that isn't a string,
+// is listed with an unknown size.
+func redisKeyInfos(conn redis.Conn, keys []string) ([]KeyInfo, error) {
+	for _, key := range keys {
+		conn.Send("STRLEN", key)
+		conn.Send("PTTL", key)
+	}
+	if err := conn.Flush(); err != nil {
+		return nil, err
+	}
+	infos := make([]KeyInfo, 0, len(keys))
+	for _, key := range keys {
+		size, err := redis.Int(conn.Receive())
+		if _, refused := err.(redis.Error); refused {
+			size = -1
+		} else if err != nil {
+			return nil, err
+		}
+		ttl, err := redisTTL(redis.Int64(conn.Receive()))
+		if err == ErrCacheMiss {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, KeyInfo{key, size, ttl})
+	}
+	return infos, nil
+}
+
+// del deletes keys found on the server of conn. The keys of a cluster node
+// can belong to different slots, a single DEL would be refused.
+func (c *RedisStore) del(conn redis.Conn, keys []string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	if c.cluster == nil {
+		_, err := conn.Do("DEL", redis.Args{}.AddFlat(keys)...)
 		return err
 	}
+	for _, key := range keys {
+		if _, err := c.cluster.conn(key).Do("DEL", key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	if expires > 0 {
-		_, err := f("SETEX", key, int32(expires/time.Second), b)
+// escapeGlob escapes the characters redis treats as glob patterns in MATCH
+func escapeGlob(s string) string {
+	return globEscaper.Replace(s)
+}
+
+var globEscaper = strings.NewReplacer(`\`, `\\`, "*", `\*`, "?", `\?`, "[", `\[`, "]", `\]`)
+
+// invoke stores the value with a single SET, conditions such as NX or XX are
+// appended to the command and ErrNotStored is returned when they are not met
+func (c *RedisStore) invoke(f func(string, ...interface{}) (interface{}, error),
+	key string, value interface{}, expires time.Duration, conditions ...interface{}) error {
+
+	b, err := utils.Serialize(value)
+	if err != nil {
 		return err
 	}
 
-	_, err = f("SET", key, b)
+	args := []interface{}{key, b}
+	if ms := redisExpiration(expires, c.defaultExpiration); ms > 0 {
+		args = append(args, "PX", ms)
+	}
+	reply, err := f("SET", append(args, conditions...)...)
+	if err == nil && reply == nil {
+		return ErrNotStored
+	}
 	return err
+}
 
+// redisExpiration converts a CacheStore expiration to the milliseconds of the
+// PX option of SET, 0 means no expiration
+func redisExpiration(expires, defaultExpiration time.Duration) int64 {
+	switch expires {
+	case DEFAULT:
+		expires = defaultExpiration
+	case FOREVER:
+		return 0
+	}
+	if expires <= 0 {
+		return 0
+	}
+	if expires < time.Millisecond {
+		return 1
+	}
+	return int64(expires / time.Millisecond)
 }
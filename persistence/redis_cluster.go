@@ -0,0 +1,322 @@
+package persistence
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// NewRedisClusterCache returns a RedisStore for the redis cluster the nodes
+// at addrs belong to. Commands are sent to the master serving the hash slot
+// of their key, the slot map is loaded from the first node that answers and
+// follows the MOVED and ASK redirections of the cluster.
+func NewRedisClusterCache(addrs []string, options *RedisOptions, defaultExpiration time.Duration) *RedisStore {
+	if options == nil {
+		options = &RedisOptions{}
+	}
+	cluster := &redisCluster{
+		seeds:   append([]string(nil), addrs...),
+		options: options,
+		pools:   map[string]*redis.Pool{},
+	}
+	store := NewRedisCacheWithPool(nil, defaultExpiration)
+	store.cluster = cluster
+	return store
+}
+
+const (
+	redisClusterSlots = 16384
+
+	// redisClusterRedirects bounds the redirections followed by a command
+	redisClusterRedirects = 5
+)
+
+var errRedisClusterPipeline = errors.New("redis: pipelines are not supported by cluster connections")
+
+// redisCluster routes commands to the nodes of a redis cluster
+type redisCluster struct {
+	seeds   []string
+	options *RedisOptions
+
+	mu    sync.Mutex
+	slots []string // address of the master of each slot, nil until loaded
+	pools map[string]*redis.Pool
+}
+
+// conn returns a connection routing its commands by the slot of key
+func (c *redisCluster) conn(key string) redis.Conn {
+	return &redisClusterConn{cluster: c, key: key}
+}
+
+// pool returns the pool of the node at addr
+func (c *redisCluster) pool(addr string) *redis.Pool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	p, ok := c.pools[addr]
+	if !ok {
+		p = newRedisPool(func() (redis.Conn, error) {
+			return c.options.dialServer(addr)
+		})
+		c.pools[addr] = p
+	}
+	return p
+}
+
+// addr returns the address of the master of slot
+func (c *redisCluster) addr(slot int) (string, error) {
+	c.mu.Lock()
+	loaded := c.slots != nil
+	c.mu.Unlock()
+	if !loaded {
+		if err := c.refresh(); err != nil {
+			return "", err
+		}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if addr := c.slots[slot]; addr != "" {
+		return addr, nil
+	}
+	return "", fmt.Errorf("redis: no node serves the slot %d", slot)
+}
+
+// moved records the new master of slot
+func (c *redisCluster) moved(slot int, addr string) {
+	c.mu.Lock()
+	if c.slots != nil {
+		c.slots[slot] = addr
+	}
+	c.mu.Unlock()
+}
+
+// masters returns the addresses of the masters of the cluster
+func (c *redisCluster) masters() ([]string, error) {
+	if err := c.refresh(); err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	seen := map[string]bool{}
+	var addrs []string
+	for _, addr := range c.slots {
+		if addr != "" && !seen[addr] {
+			seen[addr] = true
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs, nil
+}
+
+// eachMaster runs f with a connection to every master
+func (c *redisCluster) eachMaster(f func(conn redis.Conn) error) error {
+	addrs, err := c.masters()
+	if err != nil {
+		return err
+	}
+	for _, addr := range addrs {
+		conn := c.pool(addr).Get()
+		err := f(conn)
+		conn.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// refresh loads the slot map from the first node that answers, the nodes
+// already known are asked before the seeds
+func (c *redisCluster) refresh() error {
+	c.mu.Lock()
+	var addrs []string
+	seen := map[string]bool{}
+	for _, addr := range append(c.slots, c.seeds...) {
+		if addr != "" && !seen[addr] {
+			seen[addr] = true
+			addrs = append(addrs, addr)
+		}
+	}
+	c.mu.Unlock()
+
+	var errs []error
+	for _, addr := range addrs {
+		slots, err := c.loadSlots(addr)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %s", addr, err))
+			continue
+		}
+		c.mu.Lock()
+		c.slots = slots
+		c.mu.Unlock()
+		return nil
+	}
+	if len(errs) == 0 {
+		return errors.New("redis: no cluster node configured")
+	}
+	return fmt.Errorf("redis: couldn't load the cluster slots: %v", errs)
+}
+
+// loadSlots reads the slot map with CLUSTER SLOTS from the node at addr
+func (c *redisCluster) loadSlots(addr string) ([]string, error) {
+	conn := c.pool(addr).Get()
+	defer conn.Close()
+	ranges, err := redis.Values(conn.Do("CLUSTER", "SLOTS"))
+	if err != nil {
+		return nil, err
+	}
+	host, _, _ := net.SplitHostPort(addr)
+	slots := make([]string, redisClusterSlots)
+	for _, r := range ranges {
+		// start, end, master, replicas...
+		fields, err := redis.Values(r, nil)
+		if err != nil || len(fields) < 3 {
+			return nil, fmt.Errorf("unexpected CLUSTER SLOTS reply %v", r)
+		}
+		start, err1 := redis.Int(fields[0], nil)
+		end, err2 := redis.Int(fields[1], nil)
+		node, err3 := redis.Values(fields[2], nil)
+		if err1 != nil || err2 != nil || err3 != nil || len(node) < 2 ||
+			start < 0 || end >= redisClusterSlots || start > end {
+			return nil, fmt.Errorf("unexpected CLUSTER SLOTS reply %v", r)
+		}
+		nodeHost, err1 := redis.String(node[0], nil)
+		port, err2 := redis.Int(node[1], nil)
+		if err1 != nil || err2 != nil {
+			return nil, fmt.Errorf("unexpected CLUSTER SLOTS reply %v", r)
+		}
+		if nodeHost == "" {
+			// the node does not know its own address
+			nodeHost = host
+		}
+		master := net.JoinHostPort(nodeHost, strconv.Itoa(port))
+		for slot := start; slot <= end; slot++ {
+			slots[slot] = master
+		}
+	}
+	return slots, nil
+}
+
+// redisClusterConn runs each command on the master of the slot of its key
+// with a connection of the pool of that node
+type redisClusterConn struct {
+	cluster *redisCluster
+	key     string
+}
+
+func (c *redisClusterConn) Close() error { return nil }
+
+func (c *redisClusterConn) Err() error { return nil }
+
+func (c *redisClusterConn) Send(string, ...interface{}) error { return errRedisClusterPipeline }
+
+func (c *redisClusterConn) Flush() error { return errRedisClusterPipeline }
+
+func (c *redisClusterConn) Receive() (interface{}, error) { return nil, errRedisClusterPipeline }
+
+// Do runs the command, following the redirections of the cluster
+func (c *redisClusterConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	if cmd == "" {
+		// redigo flushes the pending commands with an empty command
+		return nil, nil
+	}
+	slot := redisClusterSlot(c.key)
+	addr, err := c.cluster.addr(slot)
+	if err != nil {
+		return nil, err
+	}
+	asking, refreshed := false, false
+	for i := 0; i < redisClusterRedirects; i++ {
+		reply, sent, err := c.do(addr, asking, cmd, args...)
+		if err == nil {
+			return reply, nil
+		}
+		if _, ok := err.(redis.Error); !ok {
+			// a command sent may have been applied, it must not run twice
+			if sent {
+				return nil, err
+			}
+			// the node may be gone after a failover, reload the slots once
+			if refreshed || c.cluster.refresh() != nil {
+				return nil, err
+			}
+			refreshed = true
+			if addr, err = c.cluster.addr(slot); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		kind, target, ok := parseRedisRedirect(err.Error())
+		switch {
+		case !ok:
+			return reply, err
+		case kind == "MOVED":
+			c.cluster.moved(slot, target)
+			addr, asking = target, false
+		default:
+			// ASK: the key is being migrated, only this command is redirected
+			addr, asking = target, true
+		}
+	}
+	return nil, fmt.Errorf("redis: too many cluster redirections for %s", cmd)
+}
+
+// do runs the command on the node at addr, sent tells whether it was written
+// to the node: it was not when the connection could not be made or borrowed
+func (c *redisClusterConn) do(addr string, asking bool, cmd string, args ...interface{}) (reply interface{}, sent bool, err error) {
+	conn := c.cluster.pool(addr).Get()
+	defer conn.Close()
+	if err := conn.Err(); err != nil {
+		return nil, false, err
+	}
+	if asking {
+		if _, err := conn.Do("ASKING"); err != nil {
+			return nil, false, err
+		}
+	}
+	reply, err = conn.Do(cmd, args...)
+	return reply, true, err
+}
+
+// parseRedisRedirect parses the MOVED and ASK errors of a redis cluster,
+// formatted as "MOVED 3999 127.0.0.1:6381"
+func parseRedisRedirect(msg string) (kind, addr string, ok bool) {
+	fields := strings.Fields(msg)
+	if len(fields) != 3 || (fields[0] != "MOVED" && fields[0] != "ASK") {
+		return "", "", false
+	}
+	return fields[0], fields[2], true
+}
+
+// redisClusterSlot returns the hash slot of key. Only the part of the key
+// between the first { and the next } is hashed when it is not empty, so
+// related keys can be kept in the same slot.
+func redisClusterSlot(key string) int {
+	if start := strings.IndexByte(key, '{'); start >= 0 {
+		if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+	return int(crc16(key)) % redisClusterSlots
+}
+
+// crc16 is the CRC16-CCITT (XMODEM) checksum used by redis cluster
+func crc16(s string) uint16 {
+	var crc uint16
+	for i := 0; i < len(s); i++ {
+		crc ^= uint16(s[i]) << 8
+		for bit := 0; bit < 8; bit++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
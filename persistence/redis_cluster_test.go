@@ -0,0 +1,179 @@
+package persistence
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestRedisClusterSlot(t *testing.T) {
+	if crc := crc16("123456789"); crc != 0x31c3 {
+		t.Errorf("Expected the crc16 0x31c3, got %#x", crc)
+	}
+	for key, slot := range map[string]int{
+		"foo":                  12182,
+		"bar":                  5061,
+		"{user1000}.following": redisClusterSlot("user1000"),
+		"{user1000}.followers": redisClusterSlot("user1000"),
+		"foo{}{bar}":           redisClusterSlot("foo{}{bar}"),
+		"foo{{bar}}zap":        redisClusterSlot("{bar"),
+	} {
+		if s := redisClusterSlot(key); s != slot {
+			t.Errorf("Expected the slot %d for %q, got %d", slot, key, s)
+		}
+	}
+	if redisClusterSlot("foo{}{bar}") == redisClusterSlot("bar") {
+		t.Errorf("Expected an empty hash tag to be ignored")
+	}
+}
+
+func TestRedisClusterCache_Routing(t *testing.T) {
+	cluster := newFakeRedisCluster(t, 3)
+	defer cluster.Close()
+	store := NewRedisClusterCache(cluster.Addrs()[:1], nil, time.Hour)
+
+	for i := 0; i < 30; i++ {
+		key := fmt.Sprint("key", i)
+		if err := store.Set(key, i, DEFAULT); err != nil {
+			t.Fatalf("Error setting %s: %s", key, err)
+		}
+	}
+	used := map[int]bool{}
+	for i, node := range cluster.nodes {
+		for _, key := range node.Keys(0) {
+			if owner := cluster.Owner(redisClusterSlot(key)); owner != i {
+				t.Errorf("Expected %s on the node %d, found on %d", key, owner, i)
+			}
+			used[i] = true
+		}
+	}
+	if len(used) != 3 {
+		t.Errorf("Expected the keys on the 3 nodes, got %v", used)
+	}
+}
+
+func TestRedisClusterCache_Moved(t *testing.T) {
+	cluster := newFakeRedisCluster(t, 3)
+	defer cluster.Close()
+	store := NewRedisClusterCache(cluster.Addrs(), nil, time.Hour)
+
+	if err := store.Set("key", "value", DEFAULT); err != nil {
+		t.Fatalf("Error setting a value: %s", err)
+	}
+	slot := redisClusterSlot("key")
+	to := (cluster.Owner(slot) + 1) % 3
+	cluster.Move(slot, to)
+
+	var value string
+	if err := store.Get("key", &value); err != nil || value != "value" {
+		t.Errorf("Expected value after the slot moved, got %q: %v", value, err)
+	}
+	if n, err := store.Increment("key", 1); err == nil {
+		t.Errorf("Expected an error incrementing a string, got %d", n)
+	}
+	if err := store.Set("key", "new", DEFAULT); err != nil {
+		t.Fatalf("Error setting a value: %s", err)
+	}
+	if keys := cluster.nodes[to].Keys(0); len(keys) != 1 || keys[0] != "key" {
+		t.Errorf("Expected the key on the node %d, got %v", to, keys)
+	}
+}
+
+func TestRedisClusterCache_Ask(t *testing.T) {
+	cluster := newFakeRedisCluster(t, 2)
+	defer cluster.Close()
+	store := NewRedisClusterCache(cluster.Addrs(), nil, time.Hour)
+
+	for _, key := range []string{"{tag}moved", "{tag}kept"} {
+		if err := store.Set(key, key, DEFAULT); err != nil {
+			t.Fatalf("Error setting %s: %s", key, err)
+		}
+	}
+	slot := redisClusterSlot("{tag}")
+	owner := cluster.Owner(slot)
+	cluster.Migrate(slot, 1-owner, "{tag}moved")
+
+	var value string
+	for _, key := range []string{"{tag}moved", "{tag}kept"} {
+		if err := store.Get(key, &value); err != nil || value != key {
+			t.Errorf("Expected %s during the migration, got %q: %v", key, value, err)
+		}
+	}
+	// ASK does not change the slot map
+	if err := store.Delete("{tag}kept"); err != nil {
+		t.Errorf("Error deleting: %s", err)
+	}
+	if keys := cluster.nodes[owner].Keys(0); len(keys) != 0 {
+		t.Errorf("Expected the key deleted from the owner, got %v", keys)
+	}
+}
+
+func TestRedisClusterCache_FlushPrefix(t *testing.T) {
+	cluster := newFakeRedisCluster(t, 3)
+	defer cluster.Close()
+	store := NewRedisClusterCache(cluster.Addrs(), nil, time.Hour)
+
+	for i := 0; i < 20; i++ {
+		for _, prefix := range []string{"a:", "b:"} {
+			if err := store.Set(fmt.Sprint(prefix, i), i, DEFAULT); err != nil {
+				t.Fatalf("Error setting a value: %s", err)
+			}
+		}
+	}
+	if err := store.FlushPrefix("a:"); err != nil {
+		t.Fatalf("Error flushing the prefix: %s", err)
+	}
+	var i int
+	for n := 0; n < 20; n++ {
+		if err := store.Get(fmt.Sprint("a:", n), &i); err != ErrCacheMiss {
+			t.Errorf("Expected a:%d to be flushed, got: %v", n, err)
+		}
+		if err := store.Get(fmt.Sprint("b:", n), &i); err != nil || i != n {
+			t.Errorf("Expected b:%d to be kept, got %d: %v", n, i, err)
+		}
+	}
+}
+
+func TestRedisClusterCache_NodeDown(t *testing.T) {
+	cluster := newFakeRedisCluster(t, 2)
+	defer cluster.Close()
+	store := NewRedisClusterCache(cluster.Addrs(), nil, time.Hour)
+
+	if err := store.Set("key", "value", DEFAULT); err != nil {
+		t.Fatalf("Error setting a value: %s", err)
+	}
+	// the slot fails over to the other node, which then knows the new map
+	slot := redisClusterSlot("key")
+	from := cluster.Owner(slot)
+	cluster.Move(slot, 1-from)
+	cluster.nodes[from].Close()
+
+	var value string
+	if err := store.Get("key", &value); err != nil || value != "value" {
+		t.Errorf("Expected value from the new owner, got %q: %v", value, err)
+	}
+}
+
+func TestRedisClusterCache_LostReply(t *testing.T) {
+	cluster := newFakeRedisCluster(t, 2)
+	defer cluster.Close()
+	store := NewRedisClusterCache(cluster.Addrs(), nil, time.Hour)
+
+	if err := store.Set("counter", 1, DEFAULT); err != nil {
+		t.Fatalf("Error setting a value: %s", err)
+	}
+	// loads the script of the counters
+	if _, err := store.Increment("counter", 0); err != nil {
+		t.Fatalf("Error reading the counter: %s", err)
+	}
+	// the counter is applied but its reply is lost, it must not be sent again
+	node := cluster.nodes[cluster.Owner(redisClusterSlot("counter"))]
+	node.DropReplies("EVALSHA")
+	if _, err := store.Increment("counter", 1); err == nil {
+		t.Errorf("Expected the lost reply to be reported")
+	}
+	node.DropReplies("")
+	if n, err := store.Increment("counter", 0); err != nil || n != 2 {
+		t.Errorf("Expected the counter to be incremented once, got %d: %v", n, err)
+	}
+}
@@ -0,0 +1,134 @@
+package persistence
+
+// redisCounterScript increments (ARGV[2] == "incr") or decrements the
+// unsigned 64 bit counter stored at KEYS[1] by ARGV[1] in a single step, as
+// the CacheStore contract requires: a missing key is not created, increments
+// wrap around on overflow and decrements stop at zero. The expiration of the
+// key is kept.
+//
+// Lua numbers are doubles, so the counter is handled as two 32 bit halves to
+// stay exact over the whole uint64 range.
+const redisCounterScript = `
+local TWO32 = 4294967296
+
+local function parse(s)
+  if not string.match(s, '^%d+$') then
+    return nil
+  end
+  local hi, lo = 0, 0
+  for i = 1, #s do
+    lo = lo * 10 + tonumber(string.sub(s, i, i))
+    hi = hi * 10 + math.floor(lo / TWO32)
+    lo = lo % TWO32
+    if hi >= TWO32 then
+      return nil
+    end
+  end
+  return hi, lo
+end
+
+local function format(hi, lo)
+  if hi == 0 then
+    return tostring(lo)
+  end
+  local digits = {}
+  while hi > 0 or lo > 0 do
+    local t = (hi % 10) * TWO32 + lo
+    hi = math.floor(hi / 10)
+    lo = math.floor(t / 10)
+    digits[#digits + 1] = tostring(t % 10)
+  end
+  return string.reverse(table.concat(digits))
+end
+
+local current = redis.call('GET', KEYS[1])
+if not current then
+  return false
+end
+local ahi, alo = parse(current)
+if not ahi then
+  return redis.error_reply('ERR value is not an integer or out of range')
+end
+local bhi, blo = parse(ARGV[1])
+
+local hi, lo
+if ARGV[2] == 'incr' then
+  lo = alo + blo
+  hi = (ahi + bhi + math.floor(lo / TWO32)) % TWO32
+  lo = lo % TWO32
+elseif ahi < bhi or (ahi == bhi and alo <= blo) then
+  hi, lo = 0, 0
+else
+  lo = alo - blo
+  hi = ahi - bhi
+  if lo < 0 then
+    lo = lo + TWO32
+    hi = hi - 1
+  end
+end
+
+local value = format(hi, lo)
+local ttl = redis.call('PTTL', KEYS[1])
+if ttl > 0 then
+  redis.call('SET', KEYS[1], value, 'PX', ttl)
+else
+  redis.call('SET', KEYS[1], value)
+end
+return value
+`
+
+// redisTouchScript sets the expiration of KEYS[1] to ARGV[1] milliseconds,
+// or removes it when ARGV[1] is 0, and returns 0 when the key is missing.
+// PERSIST alone can not tell a missing key from one without expiration.
+const redisTouchScript = `
+if redis.call('EXISTS', KEYS[1]) == 0 then
+  return 0
+end
+if ARGV[1] == '0' then
+  redis.call('PERSIST', KEYS[1])
+else
+  redis.call('PEXPIRE', KEYS[1], ARGV[1])
+end
+return 1
+`
+
+// redisGetScript returns the value of KEYS[1]. A script runs on the master
+// where a GET can be routed to a lagging replica.
+const redisGetScript = `
+return redis.call('GET', KEYS[1])
+`
+
+// redisCASScript sets KEYS[1] to ARGV[2], expiring in ARGV[3] milliseconds or
+// never when ARGV[3] is 0, as long as the first 16 hexadecimal digits of the
+// SHA-1 of its current value are ARGV[1]. It returns 1 when the key was set,
+// 0 when its value changed and -1 when it is missing.
+const redisCASScript = `
+local current = redis.call('GET', KEYS[1])
+if not current then
+  return -1
+end
+if string.sub(redis.sha1hex(current), 1, 16) ~= ARGV[1] then
+  return 0
+end
+if ARGV[3] == '0' then
+  redis.call('SET', KEYS[1], ARGV[2])
+else
+  redis.call('SET', KEYS[1], ARGV[2], 'PX', ARGV[3])
+end
+return 1
+`
+
+// redisCASDeleteScript deletes KEYS[1] as long as the first 16 hexadecimal
+// digits of the SHA-1 of its current value are ARGV[1], and returns like
+// redisCASScript
+const redisCASDeleteScript = `
+local current = redis.call('GET', KEYS[1])
+if not current then
+  return -1
+end
+if string.sub(redis.sha1hex(current), 1, 16) ~= ARGV[1] then
+  return 0
+end
+redis.call('DEL', KEYS[1])
+return 1
+`
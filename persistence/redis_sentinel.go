@@ -0,0 +1,150 @@
+package persistence
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+// NewRedisSentinelCache returns a RedisStore connected to the master that the
+// sentinels at sentinelAddrs monitor as masterName. The sentinels are asked
+// again for the master whenever a connection is made, and connections to a
+// server that is no longer the master are dropped, so the store follows
+// failovers.
+func NewRedisSentinelCache(masterName string, sentinelAddrs []string, options *RedisOptions, defaultExpiration time.Duration) *RedisStore {
+	if options == nil {
+		options = &RedisOptions{}
+	}
+	s := &redisSentinel{
+		masterName: masterName,
+		addrs:      append([]string(nil), sentinelAddrs...),
+		options:    options,
+		logger:     NopLogger{},
+	}
+	pool := newRedisPool(s.dial)
+	pool.TestOnBorrow = func(c redis.Conn, t time.Time) error {
+		return testRedisMaster(c)
+	}
+	store := NewRedisCacheWithPool(pool, defaultExpiration)
+	store.sentinel = s
+	return store
+}
+
+// redisSentinel finds the master of a redis deployment watched by sentinels
+type redisSentinel struct {
+	masterName string
+	options    *RedisOptions
+
+	mu     sync.Mutex
+	addrs  []string // the sentinel that answered last comes first
+	master string
+	logger Logger
+}
+
+func (s *redisSentinel) setLogger(l Logger) {
+	s.mu.Lock()
+	s.logger = l
+	s.mu.Unlock()
+}
+
+// dial connects to the current master
+func (s *redisSentinel) dial() (redis.Conn, error) {
+	addr, err := s.discover()
+	if err != nil {
+		return nil, err
+	}
+	c, err := s.options.dialServer(addr)
+	if err != nil {
+		return nil, err
+	}
+	// the sentinels may not have noticed a failover yet
+	if err := testRedisMaster(c); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// discover asks the sentinels in turn for the address of the master
+func (s *redisSentinel) discover() (string, error) {
+	s.mu.Lock()
+	addrs := append([]string(nil), s.addrs...)
+	s.mu.Unlock()
+
+	var errs []error
+	for _, addr := range addrs {
+		master, err := s.query(addr)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %s", addr, err))
+			continue
+		}
+		s.found(addr, master)
+		return master, nil
+	}
+	if len(errs) == 0 {
+		return "", errors.New("redis: no sentinel configured")
+	}
+	return "", fmt.Errorf("redis: no sentinel knows the master %q: %v", s.masterName, errs)
+}
+
+func (s *redisSentinel) query(addr string) (string, error) {
+	c, err := s.options.dial(addr, s.options.SentinelUsername, s.options.SentinelPassword)
+	if err != nil {
+		return "", err
+	}
+	defer c.Close()
+	reply, err := redis.Strings(c.Do("SENTINEL", "get-master-addr-by-name", s.masterName))
+	if err == redis.ErrNil {
+		return "", errors.New("unknown master")
+	}
+	if err != nil {
+		return "", err
+	}
+	if len(reply) != 2 {
+		return "", fmt.Errorf("unexpected reply %q", reply)
+	}
+	return net.JoinHostPort(reply[0], reply[1]), nil
+}
+
+// found moves the sentinel at addr to the front, and logs master changes
+func (s *redisSentinel) found(addr, master string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, a := range s.addrs {
+		if a == addr {
+			copy(s.addrs[1:i+1], s.addrs[:i])
+			s.addrs[0] = addr
+			break
+		}
+	}
+	if s.master != master {
+		if s.master != "" {
+			s.logger.Log(LevelWarn, "cache: the redis master changed",
+				Field{"master", s.masterName}, Field{"from", s.master}, Field{"to", master})
+		}
+		s.master = master
+	}
+}
+
+// testRedisMaster returns an error unless c is connected to a master
+func testRedisMaster(c redis.Conn) error {
+	reply, err := redis.Values(c.Do("ROLE"))
+	if err != nil {
+		return err
+	}
+	if len(reply) == 0 {
+		return errors.New("redis: empty ROLE reply")
+	}
+	role, err := redis.String(reply[0], nil)
+	if err != nil {
+		return err
+	}
+	if role != "master" {
+		return fmt.Errorf("redis: the server is a %s, not the master", role)
+	}
+	return nil
+}
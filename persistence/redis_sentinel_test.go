@@ -0,0 +1,94 @@
+package persistence
+
+import (
+	"bytes"
+	"log"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRedisSentinelCache_Failover(t *testing.T) {
+	first, second := newFakeRedis(t), newFakeRedis(t)
+	defer first.Close()
+	defer second.Close()
+	down := newFakeRedis(t)
+	down.Close()
+	sentinel := newFakeRedis(t)
+	defer sentinel.Close()
+	sentinel.Monitor("mymaster", first.Addr())
+
+	store := NewRedisSentinelCache("mymaster", []string{down.Addr(), sentinel.Addr()}, nil, time.Hour)
+	var buf bytes.Buffer
+	store.SetLogger(NewStdLogger(log.New(&buf, "", 0), LevelDebug))
+
+	if err := store.Set("before", "value", DEFAULT); err != nil {
+		t.Fatalf("Error setting a value: %s", err)
+	}
+	if keys := first.Keys(0); len(keys) != 1 || keys[0] != "before" {
+		t.Errorf("Expected the key on the first master, got %v", keys)
+	}
+
+	// the second server is promoted
+	first.ReplicaOf(second.Addr())
+	sentinel.Monitor("mymaster", second.Addr())
+
+	if err := store.Set("after", "value", DEFAULT); err != nil {
+		t.Fatalf("Error setting a value after the failover: %s", err)
+	}
+	if keys := second.Keys(0); len(keys) != 1 || keys[0] != "after" {
+		t.Errorf("Expected the key on the new master, got %v", keys)
+	}
+	expected := "WARN cache: the redis master changed master=mymaster from=" + first.Addr() + " to=" + second.Addr()
+	if strings.TrimSpace(buf.String()) != expected {
+		t.Errorf("Expected the failover to be logged, got %q", buf.String())
+	}
+}
+
+func TestRedisSentinelCache_NotMaster(t *testing.T) {
+	master, replica := newFakeRedis(t), newFakeRedis(t)
+	defer master.Close()
+	defer replica.Close()
+	replica.ReplicaOf(master.Addr())
+	sentinel := newFakeRedis(t)
+	defer sentinel.Close()
+	// the sentinel has not noticed the failover yet
+	sentinel.Monitor("mymaster", replica.Addr())
+
+	store := NewRedisSentinelCache("mymaster", []string{sentinel.Addr()}, nil, time.Hour)
+	if err := store.Set("key", "value", DEFAULT); err == nil {
+		t.Errorf("Expected an error writing to a replica")
+	}
+	if keys := replica.Keys(0); len(keys) != 0 {
+		t.Errorf("Expected nothing written to the replica, got %v", keys)
+	}
+}
+
+func TestRedisSentinelCache_UnknownMaster(t *testing.T) {
+	sentinel := newFakeRedis(t)
+	defer sentinel.Close()
+
+	store := NewRedisSentinelCache("mymaster", []string{sentinel.Addr()}, nil, time.Hour)
+	if err := store.Set("key", "value", DEFAULT); err == nil {
+		t.Errorf("Expected an error for an unknown master")
+	}
+}
+
+func TestRedisSentinelCache_Auth(t *testing.T) {
+	master := newFakeRedis(t)
+	defer master.Close()
+	master.RequireAuth("cache", "secret")
+	sentinel := newFakeRedis(t)
+	defer sentinel.Close()
+	sentinel.RequireAuth("default", "sentinel")
+	sentinel.Monitor("mymaster", master.Addr())
+
+	store := NewRedisSentinelCache("mymaster", []string{sentinel.Addr()}, &RedisOptions{
+		Username:         "cache",
+		Password:         "secret",
+		SentinelPassword: "sentinel",
+	}, time.Hour)
+	if err := store.Set("key", "value", DEFAULT); err != nil {
+		t.Errorf("Error setting a value: %s", err)
+	}
+}
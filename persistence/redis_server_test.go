@@ -0,0 +1,58 @@
+package persistence_test
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/gin-contrib/cache/persistence"
+	"github.com/gin-contrib/cache/persistence/storetest"
+)
+
+// The fake of redis runs Go equivalents of the Lua scripts of the stores, the
+// scripts themselves only run against a real server. Set CACHE_TEST_REDIS to
+// the address of a server whose data can be flushed to run them:
+//
+//	CACHE_TEST_REDIS=localhost:6379 go test ./persistence
+func redisServerAddr(t *testing.T) string {
+	addr := os.Getenv("CACHE_TEST_REDIS")
+	if addr == "" {
+		t.Skip("CACHE_TEST_REDIS is not set")
+	}
+	return addr
+}
+
+var newRedisServerStore = func(t *testing.T, defaultExpiration time.Duration) persistence.CacheStore {
+	store := persistence.NewRedisCache(redisServerAddr(t), "", defaultExpiration)
+	if err := store.Flush(); err != nil {
+		t.Fatalf("couldn't flush redis: %s", err)
+	}
+	return store
+}
+
+func TestRedisServer(t *testing.T) {
+	storetest.Run(t, newRedisServerStore)
+}
+
+var newGoRedisServerStore = func(t *testing.T, defaultExpiration time.Duration) persistence.CacheStore {
+	store := persistence.NewGoRedisStore(redisServerAddr(t), "", defaultExpiration)
+	if err := store.Flush(); err != nil {
+		t.Fatalf("couldn't flush redis: %s", err)
+	}
+	return store
+}
+
+func TestGoRedisServer(t *testing.T) {
+	storetest.Run(t, newGoRedisServerStore)
+}
+
+func TestLock_RedisServer(t *testing.T) {
+	for name, newStore := range map[string]storetest.Factory{
+		"redis":   newRedisServerStore,
+		"goredis": newGoRedisServerStore,
+	} {
+		t.Run(name, func(t *testing.T) {
+			testLock(t, newStore)
+		})
+	}
+}
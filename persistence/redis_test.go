@@ -1,48 +1,96 @@
 package persistence
 
 import (
-	"net"
 	"testing"
 	"time"
 )
 
-// These tests require redis server running on localhost:6379 (the default)
-const redisTestServer = "localhost:6379"
-
-var newRedisStore = func(t *testing.T, defaultExpiration time.Duration) CacheStore {
-	c, err := net.Dial("tcp", redisTestServer)
-	if err == nil {
-		c.Write([]byte("flush_all\r\n"))
-		c.Close()
-		redisCache := NewRedisCache("localhost:6379", "", defaultExpiration)
-		redisCache.Flush()
-		return redisCache
-	}
-	t.Errorf("couldn't connect to redis on %s", redisTestServer)
-	t.FailNow()
-	panic("")
-}
+func TestRedisCache_IncrDecrKeepsExpiration(t *testing.T) {
+	fake := newFakeRedis(t)
+	defer fake.Close()
+	store := NewRedisCache(fake.Addr(), "", time.Hour)
 
-func TestRedisCache_TypicalGetSet(t *testing.T) {
-	typicalGetSet(t, newRedisStore)
+	if err := store.Set("int", 10, time.Hour); err != nil {
+		t.Fatalf("Error setting int: %s", err)
+	}
+	if _, err := store.Increment("int", 1); err != nil {
+		t.Fatalf("Error incrementing int: %s", err)
+	}
+	if _, err := store.Decrement("int", 1); err != nil {
+		t.Fatalf("Error decrementing int: %s", err)
+	}
+	if ttl := fake.TTL("int"); ttl <= 0 || ttl > int64(time.Hour/time.Millisecond) {
+		t.Errorf("Expected the expiration to be kept, got a ttl of %dms", ttl)
+	}
 }
 
-func TestRedisCache_IncrDecr(t *testing.T) {
-	incrDecr(t, newRedisStore)
-}
+func TestRedisCache_Options(t *testing.T) {
+	fake := newFakeRedis(t)
+	defer fake.Close()
+	fake.RequireAuth("cache", "secret")
 
-func TestRedisCache_Expiration(t *testing.T) {
-	expiration(t, newRedisStore)
+	store := NewRedisCacheWithOptions(fake.Addr(), &RedisOptions{
+		Username: "cache",
+		Password: "secret",
+		DB:       3,
+	}, time.Hour)
+	if err := store.Set("key", "value", DEFAULT); err != nil {
+		t.Fatalf("Error setting a value: %s", err)
+	}
+	if keys := fake.Keys(3); len(keys) != 1 || keys[0] != "key" {
+		t.Errorf("Expected the key in the database 3, got %v", keys)
+	}
+	if keys := fake.Keys(0); len(keys) != 0 {
+		t.Errorf("Expected the database 0 to be empty, got %v", keys)
+	}
+
+	store = NewRedisCacheWithOptions(fake.Addr(), &RedisOptions{Username: "cache", Password: "wrong"}, time.Hour)
+	if err := store.Set("key", "value", DEFAULT); err == nil {
+		t.Errorf("Expected an error with a wrong password")
+	}
 }
 
-func TestRedisCache_EmptyCache(t *testing.T) {
-	emptyCache(t, newRedisStore)
+func TestRedisCache_Password(t *testing.T) {
+	fake := newFakeRedis(t)
+	defer fake.Close()
+	fake.RequireAuth("default", "secret")
+
+	if err := NewRedisCache(fake.Addr(), "secret", time.Hour).Set("key", "value", DEFAULT); err != nil {
+		t.Errorf("Error setting a value: %s", err)
+	}
+	if err := NewRedisCache(fake.Addr(), "", time.Hour).Set("key", "value", DEFAULT); err == nil {
+		t.Errorf("Expected an error without the password")
+	}
 }
 
-func TestRedisCache_Replace(t *testing.T) {
-	testReplace(t, newRedisStore)
+func TestRedisCache_TLS(t *testing.T) {
+	fake, config := newFakeRedisTLS(t)
+	defer fake.Close()
+
+	store := NewRedisCacheWithOptions(fake.Addr(), &RedisOptions{TLSConfig: config}, time.Hour)
+	if err := store.Set("key", "value", DEFAULT); err != nil {
+		t.Fatalf("Error setting a value: %s", err)
+	}
+	var value string
+	if err := store.Get("key", &value); err != nil || value != "value" {
+		t.Errorf("Expected value, got %q: %v", value, err)
+	}
+
+	store = NewRedisCacheWithOptions(fake.Addr(), &RedisOptions{DialTimeout: time.Second}, time.Hour)
+	if err := store.Set("key", "value", DEFAULT); err == nil {
+		t.Errorf("Expected an error without TLS")
+	}
 }
 
-func TestRedisCache_Add(t *testing.T) {
-	testAdd(t, newRedisStore)
+func TestRedisCache_DeleteError(t *testing.T) {
+	fake := newFakeRedis(t)
+	store := NewRedisCache(fake.Addr(), "", time.Hour)
+	if err := store.Set("key", "value", DEFAULT); err != nil {
+		t.Fatalf("Error setting a value: %s", err)
+	}
+	fake.Close()
+
+	if err := store.Delete("key"); err == nil || err == ErrCacheMiss {
+		t.Errorf("Expected the network error deleting a key, got %v", err)
+	}
 }
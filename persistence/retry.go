@@ -0,0 +1,281 @@
+package persistence
+
+import (
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"syscall"
+	"time"
+)
+
+// RetryClassifier is implemented by stores that know which of their errors
+// are worth retrying. op is the lowercase name of the CacheStore method.
+//
+// A RetryStore only retries Increment and Decrement when the wrapped store
+// implements RetryClassifier and accepts the error, since a counter command
+// that reached the store before failing must not be applied twice.
+type RetryClassifier interface {
+	Retryable(op string, err error) bool
+}
+
+// IsRetryable is the default classification of a RetryStore: timeouts,
+// refused or reset connections and connections closed mid-reply are
+// transient, other errors are permanent. The cache outcomes, ErrCacheMiss,
+// ErrNotStored and ErrNotSupport, and ErrCircuitOpen are never retried.
+func IsRetryable(err error) bool {
+	switch err {
+	case nil, ErrCacheMiss, ErrNotStored, ErrNotSupport, ErrCircuitOpen:
+		return false
+	case ErrTimeout, io.EOF, io.ErrUnexpectedEOF:
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	return errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE)
+}
+
+// isDialError tells whether err is the failure to connect to the server, the
+// command was not sent then
+func isDialError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// RetryOptions configures a RetryStore
+type RetryOptions struct {
+	// MaxAttempts is the number of times a command is tried, 3 when 0
+	MaxAttempts int
+
+	// BaseDelay is the delay before the first retry, 10ms when 0. It doubles
+	// on every retry up to MaxDelay, 1s when 0, and a random jitter takes up
+	// to half of it off.
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+
+	// Retryable classifies the errors of the commands other than Increment
+	// and Decrement, IsRetryable when nil. It is not used when the store
+	// implements RetryClassifier.
+	Retryable func(err error) bool
+
+	// Logger receives the retries, it can be changed later with SetLogger
+	Logger Logger
+}
+
+// RetryStore retries the commands of the wrapped CacheStore failing with a
+// transient error, waiting longer after every attempt.
+//
+// Get, Set, Delete and Flush are idempotent, and so are Add, Replace and
+// CompareAndSwap: a retry of a write whose reply was lost reports ErrNotStored
+// for Add or CompareAndSwap, or ErrCacheMiss for Delete, although the first
+// attempt succeeded.
+type RetryStore struct {
+	store       CacheStore
+	maxAttempts int
+	baseDelay   time.Duration
+	maxDelay    time.Duration
+	retryable   func(error) bool
+	classifier  RetryClassifier
+	logger      Logger
+}
+
+// NewRetryStore returns a RetryStore wrapping store
+func NewRetryStore(store CacheStore, options *RetryOptions) *RetryStore {
+	if options == nil {
+		options = &RetryOptions{}
+	}
+	s := &RetryStore{
+		store:       store,
+		maxAttempts: options.MaxAttempts,
+		baseDelay:   options.BaseDelay,
+		maxDelay:    options.MaxDelay,
+		retryable:   options.Retryable,
+		logger:      options.Logger,
+	}
+	if s.maxAttempts <= 0 {
+		s.maxAttempts = 3
+	}
+	if s.baseDelay <= 0 {
+		s.baseDelay = 10 * time.Millisecond
+	}
+	if s.maxDelay <= 0 {
+		s.maxDelay = time.Second
+	}
+	if s.retryable == nil {
+		s.retryable = IsRetryable
+	}
+	if classifier, ok := store.(RetryClassifier); ok {
+		s.classifier = classifier
+	}
+	if s.logger == nil {
+		s.logger = NopLogger{}
+	}
+	return s
+}
+
+// SetLogger reports the retries to l
+func (s *RetryStore) SetLogger(l Logger) {
+	s.logger = l
+}
+
+// shouldRetry tells whether op can be tried again after err
+func (s *RetryStore) shouldRetry(op string, err error) bool {
+	if err == nil || err == ErrCacheMiss || err == ErrNotStored {
+		return false
+	}
+	if s.classifier != nil {
+		return s.classifier.Retryable(op, err)
+	}
+	if op == "increment" || op == "decrement" {
+		return false
+	}
+	return s.retryable(err)
+}
+
+// delay returns the wait before the retry following attempt, counted from 1
+func (s *RetryStore) delay(attempt int) time.Duration {
+	d := s.baseDelay
+	for i := 1; i < attempt && d < s.maxDelay; i++ {
+		d *= 2
+	}
+	if d > s.maxDelay {
+		d = s.maxDelay
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// do runs f until it succeeds, fails with an error that can't be retried or
+// MaxAttempts is reached
+func (s *RetryStore) do(op, key string, f func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := f()
+		if attempt >= s.maxAttempts || !s.shouldRetry(op, err) {
+			return err
+		}
+		d := s.delay(attempt)
+		s.logger.Log(LevelWarn, "cache: retrying store command",
+			Field{"op", op}, Field{"key", key}, Field{"attempt", attempt}, Field{"retry_in", d}, Field{"error", err})
+		time.Sleep(d)
+	}
+}
+
+// Get (see CacheStore interface)
+func (s *RetryStore) Get(key string, value interface{}) error {
+	return s.do("get", key, func() error {
+		return s.store.Get(key, value)
+	})
+}
+
+// Set (see CacheStore interface)
+func (s *RetryStore) Set(key string, value interface{}, expires time.Duration) error {
+	return s.do("set", key, func() error {
+		return s.store.Set(key, value, expires)
+	})
+}
+
+// Add (see CacheStore interface)
+func (s *RetryStore) Add(key string, value interface{}, expires time.Duration) error {
+	return s.do("add", key, func() error {
+		return s.store.Add(key, value, expires)
+	})
+}
+
+// Replace (see CacheStore interface)
+func (s *RetryStore) Replace(key string, value interface{}, expires time.Duration) error {
+	return s.do("replace", key, func() error {
+		return s.store.Replace(key, value, expires)
+	})
+}
+
+// Delete (see CacheStore interface)
+func (s *RetryStore) Delete(key string) error {
+	return s.do("delete", key, func() error {
+		return s.store.Delete(key)
+	})
+}
+
+// Increment (see CacheStore interface)
+func (s *RetryStore) Increment(key string, delta uint64) (uint64, error) {
+	var n uint64
+	err := s.do("increment", key, func() error {
+		var err error
+		n, err = s.store.Increment(key, delta)
+		return err
+	})
+	return n, err
+}
+
+// Decrement (see CacheStore interface)
+func (s *RetryStore) Decrement(key string, delta uint64) (uint64, error) {
+	var n uint64
+	err := s.do("decrement", key, func() error {
+		var err error
+		n, err = s.store.Decrement(key, delta)
+		return err
+	})
+	return n, err
+}
+
+// TTL (see ExpiryStore interface)
+func (s *RetryStore) TTL(key string) (time.Duration, error) {
+	var ttl time.Duration
+	err := s.do("ttl", key, func() error {
+		var err error
+		ttl, err = TTL(s.store, key)
+		return err
+	})
+	return ttl, err
+}
+
+// Touch (see ExpiryStore interface)
+func (s *RetryStore) Touch(key string, expires time.Duration) error {
+	return s.do("touch", key, func() error {
+		return Touch(s.store, key, expires)
+	})
+}
+
+// GetWithVersion (see CASStore interface)
+func (s *RetryStore) GetWithVersion(key string, value interface{}) (uint64, error) {
+	var version uint64
+	err := s.do("getwithversion", key, func() error {
+		var err error
+		version, err = GetWithVersion(s.store, key, value)
+		return err
+	})
+	return version, err
+}
+
+// CompareAndSwap (see CASStore interface)
+func (s *RetryStore) CompareAndSwap(key string, value interface{}, version uint64, expires time.Duration) error {
+	return s.do("compareandswap", key, func() error {
+		return CompareAndSwap(s.store, key, value, version, expires)
+	})
+}
+
+// CompareAndDelete (see CASDeleter interface)
+func (s *RetryStore) CompareAndDelete(key string, version uint64) error {
+	return s.do("compareanddelete", key, func() error {
+		return CompareAndDelete(s.store, key, version)
+	})
+}
+
+// Scan (see Scanner interface)
+func (s *RetryStore) Scan(prefix, cursor string, count int) ([]KeyInfo, string, error) {
+	var infos []KeyInfo
+	var next string
+	err := s.do("scan", prefix, func() error {
+		var err error
+		infos, next, err = Scan(s.store, prefix, cursor, count)
+		return err
+	})
+	return infos, next, err
+}
+
+// Flush (see CacheStore interface)
+func (s *RetryStore) Flush() error {
+	return s.do("flush", "", func() error {
+		return s.store.Flush()
+	})
+}
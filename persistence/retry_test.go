@@ -0,0 +1,168 @@
+package persistence
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// flakyStore fails the first failures calls of every command with err
+type flakyStore struct {
+	*InMemoryStore
+	err      error
+	failures int
+	calls    int
+}
+
+func (s *flakyStore) fail() error {
+	s.calls++
+	if s.calls <= s.failures {
+		return s.err
+	}
+	return nil
+}
+
+func (s *flakyStore) Set(key string, value interface{}, expires time.Duration) error {
+	if err := s.fail(); err != nil {
+		return err
+	}
+	return s.InMemoryStore.Set(key, value, expires)
+}
+
+func (s *flakyStore) Increment(key string, delta uint64) (uint64, error) {
+	if err := s.fail(); err != nil {
+		return 0, err
+	}
+	return s.InMemoryStore.Increment(key, delta)
+}
+
+// classifiedStore accepts to retry every error
+type classifiedStore struct {
+	*flakyStore
+	ops []string
+}
+
+func (s *classifiedStore) Retryable(op string, err error) bool {
+	s.ops = append(s.ops, op)
+	return true
+}
+
+func TestIsRetryable(t *testing.T) {
+	for _, err := range []error{
+		ErrTimeout,
+		io.EOF,
+		&net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED},
+		&net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET},
+		&net.DNSError{IsTimeout: true},
+	} {
+		if !IsRetryable(err) {
+			t.Errorf("Expected %v to be retryable", err)
+		}
+	}
+	for _, err := range []error{nil, ErrCacheMiss, ErrNotStored, ErrNotSupport, ErrCircuitOpen, errors.New("WRONGTYPE")} {
+		if IsRetryable(err) {
+			t.Errorf("Expected %v not to be retryable", err)
+		}
+	}
+}
+
+func TestRetryStore_Retries(t *testing.T) {
+	var buf bytes.Buffer
+	backend := &flakyStore{InMemoryStore: NewInMemoryStore(time.Hour), err: io.EOF, failures: 2}
+	s := NewRetryStore(backend, &RetryOptions{
+		BaseDelay: time.Millisecond,
+		Logger:    NewStdLogger(log.New(&buf, "", 0), LevelWarn),
+	})
+
+	if err := s.Set("key", "value", DEFAULT); err != nil {
+		t.Fatalf("Expected the third attempt to succeed, got %s", err)
+	}
+	if backend.calls != 3 {
+		t.Errorf("Expected 3 attempts, got %d", backend.calls)
+	}
+	if n := strings.Count(buf.String(), "WARN cache: retrying store command op=set key=key"); n != 2 {
+		t.Errorf("Expected 2 retries to be logged, got %q", buf.String())
+	}
+
+	backend.calls, backend.failures = 0, 5
+	if err := s.Set("key", "value", DEFAULT); err != io.EOF {
+		t.Errorf("Expected the error of the last attempt, got %v", err)
+	}
+	if backend.calls != 3 {
+		t.Errorf("Expected MaxAttempts attempts, got %d", backend.calls)
+	}
+
+	backend.calls, backend.err = 0, errors.New("permanent")
+	if err := s.Set("key", "value", DEFAULT); err == nil || backend.calls != 1 {
+		t.Errorf("Expected a permanent error not to be retried, got %v after %d attempts", err, backend.calls)
+	}
+}
+
+func TestRetryStore_Counters(t *testing.T) {
+	backend := &flakyStore{InMemoryStore: NewInMemoryStore(time.Hour), err: io.EOF, failures: 1}
+	backend.InMemoryStore.Set("counter", 1, DEFAULT)
+	s := NewRetryStore(backend, &RetryOptions{BaseDelay: time.Millisecond})
+	if _, err := s.Increment("counter", 1); err != io.EOF || backend.calls != 1 {
+		t.Errorf("Expected Increment not to be retried, got %v after %d attempts", err, backend.calls)
+	}
+
+	backend.calls = 0
+	classified := &classifiedStore{flakyStore: backend}
+	s = NewRetryStore(classified, &RetryOptions{BaseDelay: time.Millisecond})
+	if n, err := s.Increment("counter", 1); err != nil || n != 2 {
+		t.Errorf("Expected the store to allow the retry, got %d, %v", n, err)
+	}
+	if len(classified.ops) != 1 || classified.ops[0] != "increment" {
+		t.Errorf("Expected the store to be asked, got %v", classified.ops)
+	}
+}
+
+func TestRedisStores_Retryable(t *testing.T) {
+	addr := unusedAddr(t)
+	goRedis, err := NewGoRedisStoreWithOptions(&GoRedisOptions{Addrs: []string{addr}, LazyConnect: true}, time.Hour)
+	if err != nil {
+		t.Fatalf("Error creating the store: %s", err)
+	}
+	defer goRedis.Close()
+	for name, store := range map[string]interface {
+		CacheStore
+		RetryClassifier
+	}{
+		"redis":   NewRedisCache(addr, "", time.Hour),
+		"goredis": goRedis,
+	} {
+		// the server is down, the counter was not sent
+		_, err := store.Increment("counter", 1)
+		if err == nil {
+			t.Fatalf("%s: Expected an error without a server", name)
+		}
+		if !store.Retryable("increment", err) || !store.Retryable("decrement", err) {
+			t.Errorf("%s: Expected the counters to be retried after %v", name, err)
+		}
+		// the reply was lost, the counter may have been applied
+		if store.Retryable("increment", io.EOF) {
+			t.Errorf("%s: Expected the counters not to be retried after a lost reply", name)
+		}
+		if !store.Retryable("get", io.EOF) || store.Retryable("get", errors.New("WRONGTYPE")) {
+			t.Errorf("%s: Expected the other commands to be classified by IsRetryable", name)
+		}
+	}
+}
+
+func TestRetryStore_Delay(t *testing.T) {
+	s := NewRetryStore(NewInMemoryStore(time.Hour), &RetryOptions{BaseDelay: 10 * time.Millisecond, MaxDelay: 50 * time.Millisecond})
+	for attempt, max := range []time.Duration{10, 20, 40, 50, 50} {
+		max *= time.Millisecond
+		for i := 0; i < 20; i++ {
+			if d := s.delay(attempt + 1); d < max/2 || d > max {
+				t.Errorf("Expected the delay after attempt %d in [%s, %s], got %s", attempt+1, max/2, max, d)
+			}
+		}
+	}
+}
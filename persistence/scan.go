@@ -0,0 +1,85 @@
+package persistence
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrInvalidCursor is returned by Scan for a cursor it did not return
+var ErrInvalidCursor = errors.New("cache: invalid scan cursor.")
+
+// KeyInfo describes a key listed by Scan
+type KeyInfo struct {
+	Key string
+
+	// Size is the size of the stored value in bytes, -1 when the store can't
+	// tell it cheaply
+	Size int
+
+	// TTL is the time left before the key expires, FOREVER when it never
+	// does and 0 when the store can't tell it cheaply
+	TTL time.Duration
+}
+
+// Scanner is implemented by stores able to list their keys, for debugging
+// and admin tools
+type Scanner interface {
+	// Scan returns a page of the keys starting with prefix, and the cursor
+	// of the next page. The first page is read with an empty cursor, and an
+	// empty cursor is returned after the last one. count is a hint of the
+	// size of a page, 100 when 0 or less: a page can be larger, or empty
+	// while the cursor is not.
+	//
+	// Keys written or deleted during a scan may or may not be listed, the
+	// keys present for the whole scan are listed at least once.
+	Scan(prefix, cursor string, count int) ([]KeyInfo, string, error)
+}
+
+// Scan lists a page of the keys of store starting with prefix,
+// ErrNotSupport is returned when store is not a Scanner
+func Scan(store CacheStore, prefix, cursor string, count int) ([]KeyInfo, string, error) {
+	if s, ok := store.(Scanner); ok {
+		return s.Scan(prefix, cursor, count)
+	}
+	return nil, "", ErrNotSupport
+}
+
+// scanCount returns the page size to use for the count given to Scan
+func scanCount(count int) int {
+	if count <= 0 {
+		return 100
+	}
+	return count
+}
+
+// parseNodeCursor splits the cursor of a scan going over several nodes, or
+// shards, into the index of the node and the cursor within it. The empty
+// cursor starts at the first node.
+func parseNodeCursor(cursor string) (int, string, error) {
+	if cursor == "" {
+		return 0, "", nil
+	}
+	i := strings.IndexByte(cursor, ':')
+	if i < 0 {
+		return 0, "", ErrInvalidCursor
+	}
+	node, err := strconv.Atoi(cursor[:i])
+	if err != nil || node < 0 {
+		return 0, "", ErrInvalidCursor
+	}
+	return node, cursor[i+1:], nil
+}
+
+// nodeCursor returns the cursor of a scan going over nodes nodes, once the
+// node of index node returned next, which is empty when the node is done
+func nodeCursor(node int, next string, nodes int) string {
+	if next == "" {
+		node++
+		if node >= nodes {
+			return ""
+		}
+	}
+	return strconv.Itoa(node) + ":" + next
+}
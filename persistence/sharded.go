@@ -0,0 +1,402 @@
+package persistence
+
+import (
+	"errors"
+	"hash/crc32"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var errNoShards = errors.New("cache: no shard.")
+
+// ShardedOptions configures a ShardedStore
+type ShardedOptions struct {
+	// VirtualNodes is the number of points of each shard on the hash ring,
+	// 160 when 0. More points spread the keys more evenly.
+	VirtualNodes int
+
+	// FailureThreshold is the number of consecutive errors after which a
+	// shard is ejected, its keys then go to the next shard of the ring.
+	// Ejection is disabled when 0.
+	FailureThreshold int
+
+	// EjectTimeout is how long an ejected shard is skipped before a command
+	// is sent to it again, 30s when 0
+	EjectTimeout time.Duration
+
+	// Logger receives the ejections, it can be changed later with SetLogger
+	Logger Logger
+}
+
+// ShardedStore spreads the keys over several stores with consistent hashing,
+// adding or removing a shard only moves the keys the shard gains or loses.
+//
+// Every command on a key, counters included, goes to the shard owning the
+// key, and Flush flushes every shard. A shard ejected after failing is
+// skipped until EjectTimeout has passed: its keys are served by the next
+// shard of the ring meanwhile, and the values it holds may be stale once it
+// comes back.
+type ShardedStore struct {
+	virtualNodes     int
+	failureThreshold int
+	ejectTimeout     time.Duration
+
+	mu     sync.RWMutex
+	shards map[string]*shard
+	ring   []ringPoint // sorted by hash
+	logger Logger
+}
+
+type ringPoint struct {
+	hash  uint32
+	shard *shard
+}
+
+// shard is a store of a ShardedStore and its health
+type shard struct {
+	name  string
+	store CacheStore
+
+	mu           sync.Mutex
+	failures     int
+	ejectedUntil time.Time
+}
+
+// NewShardedStore returns a ShardedStore without shards, they are added with
+// AddShard
+func NewShardedStore(options *ShardedOptions) *ShardedStore {
+	if options == nil {
+		options = &ShardedOptions{}
+	}
+	s := &ShardedStore{
+		virtualNodes:     options.VirtualNodes,
+		failureThreshold: options.FailureThreshold,
+		ejectTimeout:     options.EjectTimeout,
+		shards:           map[string]*shard{},
+		logger:           options.Logger,
+	}
+	if s.virtualNodes <= 0 {
+		s.virtualNodes = 160
+	}
+	if s.ejectTimeout <= 0 {
+		s.ejectTimeout = 30 * time.Second
+	}
+	if s.logger == nil {
+		s.logger = NopLogger{}
+	}
+	return s
+}
+
+// SetLogger reports the ejected shards to l
+func (s *ShardedStore) SetLogger(l Logger) {
+	s.mu.Lock()
+	s.logger = l
+	s.mu.Unlock()
+}
+
+// AddShard adds store under name, or replaces the store of the shard name.
+// The position of a shard on the ring only depends on its name, so it must be
+// stable across restarts.
+func (s *ShardedStore) AddShard(name string, store CacheStore) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.shards[name] = &shard{name: name, store: store}
+	s.rebuild()
+}
+
+// RemoveShard removes the shard name, its keys go to the next shards of the
+// ring
+func (s *ShardedStore) RemoveShard(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.shards[name]; !ok {
+		return
+	}
+	delete(s.shards, name)
+	s.rebuild()
+}
+
+// Shards returns the names of the shards
+func (s *ShardedStore) Shards() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	names := make([]string, 0, len(s.shards))
+	for name := range s.shards {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Shard returns the name of the shard currently serving key, "" when the
+// store has no shard
+func (s *ShardedStore) Shard(key string) string {
+	sh, err := s.lookup(key)
+	if err != nil {
+		return ""
+	}
+	return sh.name
+}
+
+// rebuild computes the ring, s.mu must be held
+func (s *ShardedStore) rebuild() {
+	ring := make([]ringPoint, 0, len(s.shards)*s.virtualNodes)
+	for name, sh := range s.shards {
+		for i := 0; i < s.virtualNodes; i++ {
+			ring = append(ring, ringPoint{crc32.ChecksumIEEE([]byte(name + "#" + strconv.Itoa(i))), sh})
+		}
+	}
+	sort.Slice(ring, func(i, j int) bool {
+		if ring[i].hash != ring[j].hash {
+			return ring[i].hash < ring[j].hash
+		}
+		// the owner of colliding points must not depend on the map order
+		return ring[i].shard.name < ring[j].shard.name
+	})
+	s.ring = ring
+}
+
+// lookup returns the first shard that isn't ejected from the point of key on
+// the ring, or the owner of key when every shard is ejected
+func (s *ShardedStore) lookup(key string) (*shard, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if len(s.ring) == 0 {
+		return nil, errNoShards
+	}
+	h := crc32.ChecksumIEEE([]byte(key))
+	start := sort.Search(len(s.ring), func(i int) bool { return s.ring[i].hash >= h })
+	now := time.Now()
+	for i := 0; i < len(s.ring); i++ {
+		sh := s.ring[(start+i)%len(s.ring)].shard
+		if sh.available(now) {
+			return sh, nil
+		}
+	}
+	return s.ring[start%len(s.ring)].shard, nil
+}
+
+func (sh *shard) available(now time.Time) bool {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	return !now.Before(sh.ejectedUntil)
+}
+
+// report updates the health of sh after a command returned err
+func (s *ShardedStore) report(sh *shard, err error) {
+	if s.failureThreshold <= 0 {
+		return
+	}
+	failed := err != nil && err != ErrCacheMiss && err != ErrNotStored && err != ErrNotSupport
+	sh.mu.Lock()
+	if !failed {
+		recovered := !sh.ejectedUntil.IsZero()
+		sh.failures = 0
+		sh.ejectedUntil = time.Time{}
+		sh.mu.Unlock()
+		if recovered {
+			s.log(LevelInfo, "cache: shard is back", Field{"shard", sh.name})
+		}
+		return
+	}
+	sh.failures++
+	if sh.failures < s.failureThreshold {
+		sh.mu.Unlock()
+		return
+	}
+	sh.ejectedUntil = time.Now().Add(s.ejectTimeout)
+	failures := sh.failures
+	sh.mu.Unlock()
+	s.log(LevelWarn, "cache: shard ejected",
+		Field{"shard", sh.name}, Field{"failures", failures}, Field{"retry_in", s.ejectTimeout}, Field{"error", err})
+}
+
+func (s *ShardedStore) log(level Level, msg string, fields ...Field) {
+	s.mu.RLock()
+	l := s.logger
+	s.mu.RUnlock()
+	l.Log(level, msg, fields...)
+}
+
+// Get (see CacheStore interface)
+func (s *ShardedStore) Get(key string, value interface{}) error {
+	sh, err := s.lookup(key)
+	if err != nil {
+		return err
+	}
+	err = sh.store.Get(key, value)
+	s.report(sh, err)
+	return err
+}
+
+// Set (see CacheStore interface)
+func (s *ShardedStore) Set(key string, value interface{}, expires time.Duration) error {
+	sh, err := s.lookup(key)
+	if err != nil {
+		return err
+	}
+	err = sh.store.Set(key, value, expires)
+	s.report(sh, err)
+	return err
+}
+
+// Add (see CacheStore interface)
+func (s *ShardedStore) Add(key string, value interface{}, expires time.Duration) error {
+	sh, err := s.lookup(key)
+	if err != nil {
+		return err
+	}
+	err = sh.store.Add(key, value, expires)
+	s.report(sh, err)
+	return err
+}
+
+// Replace (see CacheStore interface)
+func (s *ShardedStore) Replace(key string, value interface{}, expires time.Duration) error {
+	sh, err := s.lookup(key)
+	if err != nil {
+		return err
+	}
+	err = sh.store.Replace(key, value, expires)
+	s.report(sh, err)
+	return err
+}
+
+// Delete (see CacheStore interface)
+func (s *ShardedStore) Delete(key string) error {
+	sh, err := s.lookup(key)
+	if err != nil {
+		return err
+	}
+	err = sh.store.Delete(key)
+	s.report(sh, err)
+	return err
+}
+
+// Increment (see CacheStore interface)
+func (s *ShardedStore) Increment(key string, delta uint64) (uint64, error) {
+	sh, err := s.lookup(key)
+	if err != nil {
+		return 0, err
+	}
+	n, err := sh.store.Increment(key, delta)
+	s.report(sh, err)
+	return n, err
+}
+
+// Decrement (see CacheStore interface)
+func (s *ShardedStore) Decrement(key string, delta uint64) (uint64, error) {
+	sh, err := s.lookup(key)
+	if err != nil {
+		return 0, err
+	}
+	n, err := sh.store.Decrement(key, delta)
+	s.report(sh, err)
+	return n, err
+}
+
+// TTL (see ExpiryStore interface)
+func (s *ShardedStore) TTL(key string) (time.Duration, error) {
+	sh, err := s.lookup(key)
+	if err != nil {
+		return 0, err
+	}
+	ttl, err := TTL(sh.store, key)
+	s.report(sh, err)
+	return ttl, err
+}
+
+// Touch (see ExpiryStore interface)
+func (s *ShardedStore) Touch(key string, expires time.Duration) error {
+	sh, err := s.lookup(key)
+	if err != nil {
+		return err
+	}
+	err = Touch(sh.store, key, expires)
+	s.report(sh, err)
+	return err
+}
+
+// GetWithVersion (see CASStore interface)
+func (s *ShardedStore) GetWithVersion(key string, value interface{}) (uint64, error) {
+	sh, err := s.lookup(key)
+	if err != nil {
+		return 0, err
+	}
+	version, err := GetWithVersion(sh.store, key, value)
+	s.report(sh, err)
+	return version, err
+}
+
+// CompareAndSwap (see CASStore interface)
+func (s *ShardedStore) CompareAndSwap(key string, value interface{}, version uint64, expires time.Duration) error {
+	sh, err := s.lookup(key)
+	if err != nil {
+		return err
+	}
+	err = CompareAndSwap(sh.store, key, value, version, expires)
+	s.report(sh, err)
+	return err
+}
+
+// CompareAndDelete (see CASDeleter interface)
+func (s *ShardedStore) CompareAndDelete(key string, version uint64) error {
+	sh, err := s.lookup(key)
+	if err != nil {
+		return err
+	}
+	err = CompareAndDelete(sh.store, key, version)
+	s.report(sh, err)
+	return err
+}
+
+// Scan (see Scanner interface), the shards are scanned in turn in the order
+// of their name, ejected ones included. Adding or removing a shard during a
+// scan can skip or repeat keys.
+func (s *ShardedStore) Scan(prefix, cursor string, count int) ([]KeyInfo, string, error) {
+	index, next, err := parseNodeCursor(cursor)
+	if err != nil {
+		return nil, "", err
+	}
+	names := s.Shards()
+	if len(names) == 0 {
+		return nil, "", errNoShards
+	}
+	if index >= len(names) {
+		return nil, "", ErrInvalidCursor
+	}
+	s.mu.RLock()
+	sh := s.shards[names[index]]
+	s.mu.RUnlock()
+	if sh == nil {
+		return nil, "", ErrInvalidCursor
+	}
+	infos, next, err := Scan(sh.store, prefix, next, count)
+	s.report(sh, err)
+	if err != nil {
+		return nil, "", err
+	}
+	return infos, nodeCursor(index, next, len(names)), nil
+}
+
+// Flush flushes every shard, ejected ones included, and returns the first
+// error met
+func (s *ShardedStore) Flush() error {
+	s.mu.RLock()
+	shards := make([]*shard, 0, len(s.shards))
+	for _, sh := range s.shards {
+		shards = append(shards, sh)
+	}
+	s.mu.RUnlock()
+	var first error
+	for _, sh := range shards {
+		err := sh.store.Flush()
+		s.report(sh, err)
+		if err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
@@ -0,0 +1,175 @@
+package persistence
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func shardOwners(s *ShardedStore, n int) []string {
+	owners := make([]string, n)
+	for i := range owners {
+		owners[i] = s.Shard("key" + strconv.Itoa(i))
+	}
+	return owners
+}
+
+func TestShardedStore_Remapping(t *testing.T) {
+	const keys = 10000
+	s := NewShardedStore(nil)
+	for _, name := range []string{"a", "b", "c"} {
+		s.AddShard(name, NewInMemoryStore(time.Hour))
+	}
+	before := shardOwners(s, keys)
+	counts := map[string]int{}
+	for _, owner := range before {
+		counts[owner]++
+	}
+	for name, n := range counts {
+		if n < keys/6 {
+			t.Errorf("Expected the keys to be spread evenly, shard %s has %d of %d", name, n, keys)
+		}
+	}
+
+	s.AddShard("d", NewInMemoryStore(time.Hour))
+	after := shardOwners(s, keys)
+	moved := 0
+	for i := range before {
+		if before[i] != after[i] {
+			moved++
+			if after[i] != "d" {
+				t.Fatalf("Expected key%d to move to the new shard, moved from %s to %s", i, before[i], after[i])
+			}
+		}
+	}
+	if moved == 0 || moved > keys/3 {
+		t.Errorf("Expected about a quarter of the keys to move, %d of %d did", moved, keys)
+	}
+
+	s.RemoveShard("d")
+	for i, owner := range shardOwners(s, keys) {
+		if owner != before[i] {
+			t.Fatalf("Expected key%d to go back to %s, got %s", i, before[i], owner)
+		}
+	}
+}
+
+// downStore fails Get and Set while down is set
+type downStore struct {
+	*InMemoryStore
+	down bool
+}
+
+var errShardDown = errors.New("shard down")
+
+func (s *downStore) Get(key string, value interface{}) error {
+	if s.down {
+		return errShardDown
+	}
+	return s.InMemoryStore.Get(key, value)
+}
+
+func (s *downStore) Set(key string, value interface{}, expires time.Duration) error {
+	if s.down {
+		return errShardDown
+	}
+	return s.InMemoryStore.Set(key, value, expires)
+}
+
+func TestShardedStore_Ejection(t *testing.T) {
+	var buf bytes.Buffer
+	s := NewShardedStore(&ShardedOptions{
+		FailureThreshold: 2,
+		EjectTimeout:     50 * time.Millisecond,
+		Logger:           NewStdLogger(log.New(&buf, "", 0), LevelInfo),
+	})
+	failing := &downStore{InMemoryStore: NewInMemoryStore(time.Hour)}
+	s.AddShard("a", failing)
+	s.AddShard("b", NewInMemoryStore(time.Hour))
+
+	key := ""
+	for i := 0; key == ""; i++ {
+		if k := "key" + strconv.Itoa(i); s.Shard(k) == "a" {
+			key = k
+		}
+	}
+
+	failing.down = true
+	var value string
+	for i := 0; i < 2; i++ {
+		if err := s.Get(key, &value); err != errShardDown {
+			t.Fatalf("Expected the error of the shard, got %v", err)
+		}
+	}
+	if owner := s.Shard(key); owner != "b" {
+		t.Fatalf("Expected the key to move to b once a is ejected, got %s", owner)
+	}
+	if err := s.Set(key, "value", DEFAULT); err != nil {
+		t.Fatalf("Error setting a value: %s", err)
+	}
+	if err := s.Get(key, &value); err != nil || value != "value" {
+		t.Errorf("Expected the value from b, got %q, %v", value, err)
+	}
+	if !strings.Contains(buf.String(), "WARN cache: shard ejected shard=a failures=2") {
+		t.Errorf("Expected the ejection to be logged, got %q", buf.String())
+	}
+
+	failing.down = false
+	time.Sleep(60 * time.Millisecond)
+	if owner := s.Shard(key); owner != "a" {
+		t.Fatalf("Expected a to be tried again after the timeout, got %s", owner)
+	}
+	if err := s.Get(key, &value); err != ErrCacheMiss {
+		t.Errorf("Expected a miss on a, got %q, %v", value, err)
+	}
+	if !strings.Contains(buf.String(), "INFO cache: shard is back shard=a") {
+		t.Errorf("Expected the recovery to be logged, got %q", buf.String())
+	}
+}
+
+func TestShardedStore_Routing(t *testing.T) {
+	a, b := NewInMemoryStore(time.Hour), NewInMemoryStore(time.Hour)
+	s := NewShardedStore(nil)
+	s.AddShard("a", a)
+	s.AddShard("b", b)
+
+	for i := 0; i < 20; i++ {
+		key := "counter" + strconv.Itoa(i)
+		if err := s.Set(key, 1, DEFAULT); err != nil {
+			t.Fatalf("Error setting a value: %s", err)
+		}
+		if n, err := s.Increment(key, 2); err != nil || n != 3 {
+			t.Fatalf("Expected 3, got %d, %v", n, err)
+		}
+		owner, other := a, b
+		if s.Shard(key) == "b" {
+			owner, other = b, a
+		}
+		var n int
+		if err := owner.Get(key, &n); err != nil || n != 3 {
+			t.Errorf("Expected the counter on its shard, got %d, %v", n, err)
+		}
+		if err := other.Get(key, &n); err != ErrCacheMiss {
+			t.Errorf("Expected the counter on one shard only, got %v", err)
+		}
+	}
+
+	if err := s.Flush(); err != nil {
+		t.Fatalf("Error flushing: %s", err)
+	}
+	for i := 0; i < 20; i++ {
+		key := "counter" + strconv.Itoa(i)
+		var n int
+		if a.Get(key, &n) != ErrCacheMiss || b.Get(key, &n) != ErrCacheMiss {
+			t.Errorf("Expected every shard to be flushed, %s is still there", key)
+		}
+	}
+
+	if err := NewShardedStore(nil).Set("key", "value", DEFAULT); err != errNoShards {
+		t.Errorf("Expected errNoShards without shards, got %v", err)
+	}
+}
@@ -0,0 +1,775 @@
+// Package storetest checks that a persistence.CacheStore behaves the way the
+// cache middleware expects. The built-in stores run it in their own tests and
+// third-party stores can do the same:
+//
+//	func TestMyStore(t *testing.T) {
+//		storetest.Run(t, func(t *testing.T, defaultExpiration time.Duration) persistence.CacheStore {
+//			return NewMyStore(defaultExpiration)
+//		})
+//	}
+//
+// The factory must return an empty store for every call. Run checks Flush on a
+// store of its own, then the other checks in parallel on a store per default
+// expiration, each check writing keys of its own. The checks of expirations
+// wait ExpirationWait for keys set to expire in a second.
+package storetest
+
+import (
+	"math"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-contrib/cache/persistence"
+)
+
+// ExpirationWait is how long the checks wait for a key set to expire in a
+// second to be gone. memcached counts expirations in whole seconds, a key may
+// be kept up to 2 seconds, stores with precise expirations can lower it.
+var ExpirationWait = 2 * time.Second
+
+// Factory returns an empty store using defaultExpiration for DEFAULT
+type Factory func(t *testing.T, defaultExpiration time.Duration) persistence.CacheStore
+
+// Run runs every check of the package as a subtest
+func Run(t *testing.T, newStore Factory) {
+	t.Run("Flush", func(t *testing.T) {
+		Flush(t, newStore)
+	})
+
+	// the checks writing keys of their own share the stores
+	stores := map[time.Duration]persistence.CacheStore{
+		time.Hour:   newStore(t, time.Hour),
+		time.Second: newStore(t, time.Second),
+	}
+	shared := func(t *testing.T, defaultExpiration time.Duration) persistence.CacheStore {
+		store, ok := stores[defaultExpiration]
+		if !ok {
+			t.Fatalf("No shared store with a default expiration of %s", defaultExpiration)
+		}
+		return store
+	}
+	checks := []struct {
+		name  string
+		check func(*testing.T, Factory)
+	}{
+		{"TypicalGetSet", TypicalGetSet},
+		{"Miss", Miss},
+		{"Expiration", Expiration},
+		{"Add", Add},
+		{"Replace", Replace},
+		{"AddReplaceExpiration", AddReplaceExpiration},
+		{"IncrDecr", IncrDecr},
+		{"CounterEdgeCases", CounterEdgeCases},
+		{"TTLTouch", TTLTouch},
+		{"CompareAndSwap", CompareAndSwap},
+		{"CompareAndDelete", CompareAndDelete},
+		{"ConcurrentCompareAndSwap", ConcurrentCompareAndSwap},
+		{"Scan", Scan},
+		{"ConcurrentIncrDecr", ConcurrentIncrDecr},
+		{"ConcurrentAdd", ConcurrentAdd},
+	}
+	// the group returns once its parallel subtests are done
+	t.Run("Shared", func(t *testing.T) {
+		for _, c := range checks {
+			check := c.check
+			t.Run(c.name, func(t *testing.T) {
+				t.Parallel()
+				check(t, shared)
+			})
+		}
+	})
+}
+
+// TypicalGetSet checks that a value can be read back
+func TypicalGetSet(t *testing.T, newStore Factory) {
+	var err error
+	cache := newStore(t, time.Hour)
+
+	value := "foo"
+	if err = cache.Set("getset:value", value, persistence.DEFAULT); err != nil {
+		t.Errorf("Error setting a value: %s", err)
+	}
+
+	value = ""
+	err = cache.Get("getset:value", &value)
+	if err != nil {
+		t.Errorf("Error getting a value: %s", err)
+	}
+	if value != "foo" {
+		t.Errorf("Expected to get foo back, got %s", value)
+	}
+}
+
+// Miss checks that every operation on a missing key reports
+// persistence.ErrCacheMiss, and Replace persistence.ErrNotStored
+func Miss(t *testing.T, newStore Factory) {
+	var err error
+	cache := newStore(t, time.Hour)
+
+	err = cache.Get("notexist", 0)
+	if err == nil {
+		t.Errorf("Error expected for non-existent key")
+	}
+	if err != persistence.ErrCacheMiss {
+		t.Errorf("Expected ErrCacheMiss for non-existent key: %s", err)
+	}
+
+	err = cache.Delete("notexist")
+	if err != persistence.ErrCacheMiss {
+		t.Errorf("Expected ErrCacheMiss for non-existent key: %s", err)
+	}
+
+	_, err = cache.Increment("notexist", 1)
+	if err != persistence.ErrCacheMiss {
+		t.Errorf("Expected cache miss incrementing non-existent key: %s", err)
+	}
+
+	_, err = cache.Decrement("notexist", 1)
+	if err != persistence.ErrCacheMiss {
+		t.Errorf("Expected cache miss decrementing non-existent key: %s", err)
+	}
+
+	err = cache.Replace("notexist", 1, persistence.DEFAULT)
+	if err != persistence.ErrNotStored {
+		t.Errorf("Expected ErrNotStored replacing non-existent key: %s", err)
+	}
+
+	// a deleted key is missing
+	if err = cache.Set("miss:deleted", 1, persistence.DEFAULT); err != nil {
+		t.Errorf("Error setting a value: %s", err)
+	}
+	if err = cache.Delete("miss:deleted"); err != nil {
+		t.Errorf("Error deleting a value: %s", err)
+	}
+	var i int
+	if err = cache.Get("miss:deleted", &i); err != persistence.ErrCacheMiss {
+		t.Errorf("Expected ErrCacheMiss for a deleted key: %s", err)
+	}
+	if err = cache.Delete("miss:deleted"); err != persistence.ErrCacheMiss {
+		t.Errorf("Expected ErrCacheMiss deleting a deleted key: %s", err)
+	}
+}
+
+// Expiration checks that Set honours DEFAULT, FOREVER and explicit expirations
+func Expiration(t *testing.T, newStore Factory) {
+	// memcached does not support expiration times less than 1 second.
+	var err error
+	cache := newStore(t, time.Second)
+	value := 10
+	if err = cache.Set("expiration:default", value, persistence.DEFAULT); err != nil {
+		t.Errorf("Error setting a value: %s", err)
+	}
+	if err = cache.Set("expiration:short", value, time.Second); err != nil {
+		t.Errorf("Error setting a value: %s", err)
+	}
+	if err = cache.Set("expiration:long", value, time.Hour); err != nil {
+		t.Errorf("Error setting a value: %s", err)
+	}
+	if err = cache.Set("expiration:forever", value, persistence.FOREVER); err != nil {
+		t.Errorf("Error setting a value: %s", err)
+	}
+	time.Sleep(ExpirationWait)
+
+	// Test Set w/ DEFAULT
+	if err = cache.Get("expiration:default", &value); err != persistence.ErrCacheMiss {
+		t.Errorf("Expected CacheMiss, but got: %s", err)
+	}
+	// Test Set w/ short time
+	if err = cache.Get("expiration:short", &value); err != persistence.ErrCacheMiss {
+		t.Errorf("Expected CacheMiss, but got: %s", err)
+	}
+	// Test Set w/ longer time.
+	if err = cache.Get("expiration:long", &value); err != nil {
+		t.Errorf("Expected to get the value, but got: %s", err)
+	}
+	// Test Set w/ forever.
+	if err = cache.Get("expiration:forever", &value); err != nil {
+		t.Errorf("Expected to get the value, but got: %s", err)
+	}
+}
+
+// Add checks that Add only stores missing or expired keys
+func Add(t *testing.T, newStore Factory) {
+	var err error
+	cache := newStore(t, time.Hour)
+	// Add to an empty cache.
+	if err = cache.Add("add:int", 1, time.Second); err != nil {
+		t.Errorf("Unexpected error adding to empty cache: %s", err)
+	}
+
+	// Try to add again. (fail)
+	if err = cache.Add("add:int", 2, time.Second); err != persistence.ErrNotStored {
+		t.Errorf("Expected ErrNotStored adding dupe to cache: %s", err)
+	}
+
+	// Wait for it to expire, and add again.
+	time.Sleep(ExpirationWait)
+	if err = cache.Add("add:int", 3, time.Second); err != nil {
+		t.Errorf("Unexpected error adding to cache: %s", err)
+	}
+
+	// Get and verify the value.
+	var i int
+	if err = cache.Get("add:int", &i); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	if i != 3 {
+		t.Errorf("Expected 3, got: %d", i)
+	}
+}
+
+// Replace checks that Replace only stores existing keys
+func Replace(t *testing.T, newStore Factory) {
+	var err error
+	cache := newStore(t, time.Hour)
+
+	// Replace in an empty cache.
+	if err = cache.Replace("notexist", 1, persistence.FOREVER); err != persistence.ErrNotStored {
+		t.Errorf("Replace in empty cache: expected ErrNotStored, got: %s", err)
+	}
+
+	// Set a value of 1, and replace it with 2
+	if err = cache.Set("replace:int", 1, time.Second); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+
+	if err = cache.Replace("replace:int", 2, time.Second); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	var i int
+	if err = cache.Get("replace:int", &i); err != nil {
+		t.Errorf("Unexpected error getting a replaced item: %s", err)
+	}
+	if i != 2 {
+		t.Errorf("Expected 2, got %d", i)
+	}
+
+	// Wait for it to expire and replace with 3 (unsuccessfully).
+	time.Sleep(ExpirationWait)
+	if err = cache.Replace("replace:int", 3, time.Second); err != persistence.ErrNotStored {
+		t.Errorf("Expected ErrNotStored, got: %s", err)
+	}
+	if err = cache.Get("replace:int", &i); err != persistence.ErrCacheMiss {
+		t.Errorf("Expected cache miss, got: %s", err)
+	}
+}
+
+// AddReplaceExpiration checks that Add and Replace honour DEFAULT and
+// FOREVER like Set does
+func AddReplaceExpiration(t *testing.T, newStore Factory) {
+	var err error
+	cache := newStore(t, time.Second)
+
+	if err = cache.Add("addreplace:default", 1, persistence.DEFAULT); err != nil {
+		t.Errorf("Unexpected error adding: %s", err)
+	}
+	if err = cache.Add("addreplace:forever", 1, persistence.FOREVER); err != nil {
+		t.Errorf("Unexpected error adding: %s", err)
+	}
+	if err = cache.Set("addreplace:replaced", 1, persistence.FOREVER); err != nil {
+		t.Errorf("Unexpected error setting: %s", err)
+	}
+	if err = cache.Replace("addreplace:replaced", 2, persistence.DEFAULT); err != nil {
+		t.Errorf("Unexpected error replacing: %s", err)
+	}
+	if err = cache.Set("addreplace:replacedForever", 1, persistence.DEFAULT); err != nil {
+		t.Errorf("Unexpected error setting: %s", err)
+	}
+	if err = cache.Replace("addreplace:replacedForever", 2, persistence.FOREVER); err != nil {
+		t.Errorf("Unexpected error replacing: %s", err)
+	}
+
+	time.Sleep(ExpirationWait)
+	var i int
+	if err = cache.Get("addreplace:default", &i); err != persistence.ErrCacheMiss {
+		t.Errorf("Expected Add w/ DEFAULT to expire, got: %v", err)
+	}
+	if err = cache.Get("addreplace:forever", &i); err != nil {
+		t.Errorf("Expected Add w/ FOREVER not to expire, got: %v", err)
+	}
+	if err = cache.Get("addreplace:replaced", &i); err != persistence.ErrCacheMiss {
+		t.Errorf("Expected Replace w/ DEFAULT to expire, got: %v", err)
+	}
+	if err = cache.Get("addreplace:replacedForever", &i); err != nil || i != 2 {
+		t.Errorf("Expected Replace w/ FOREVER not to expire, got %d: %v", i, err)
+	}
+}
+
+// IncrDecr checks the typical counter operations
+func IncrDecr(t *testing.T, newStore Factory) {
+	var err error
+	cache := newStore(t, time.Hour)
+
+	// Normal increment / decrement operation.
+	if err = cache.Set("incrdecr:int", 10, persistence.DEFAULT); err != nil {
+		t.Errorf("Error setting int: %s", err)
+	}
+	newValue, err := cache.Increment("incrdecr:int", 50)
+	if err != nil {
+		t.Errorf("Error incrementing int: %s", err)
+	}
+	if newValue != 60 {
+		t.Errorf("Expected 60, was %d", newValue)
+	}
+
+	if newValue, err = cache.Decrement("incrdecr:int", 50); err != nil {
+		t.Errorf("Error decrementing: %s", err)
+	}
+	if newValue != 10 {
+		t.Errorf("Expected 10, was %d", newValue)
+	}
+
+	// Increment wraparound
+	newValue, err = cache.Increment("incrdecr:int", math.MaxUint64-5)
+	if err != nil {
+		t.Errorf("Error wrapping around: %s", err)
+	}
+	if newValue != 4 {
+		t.Errorf("Expected wraparound 4, got %d", newValue)
+	}
+
+	// Decrement capped at 0
+	newValue, err = cache.Decrement("incrdecr:int", 25)
+	if err != nil {
+		t.Errorf("Error decrementing below 0: %s", err)
+	}
+	if newValue != 0 {
+		t.Errorf("Expected capped at 0, got %d", newValue)
+	}
+}
+
+// CounterEdgeCases checks the counters at their bounds and on values that
+// are not numbers
+func CounterEdgeCases(t *testing.T, newStore Factory) {
+	var err error
+	cache := newStore(t, time.Hour)
+
+	if err = cache.Set("counter:int", 7, persistence.DEFAULT); err != nil {
+		t.Errorf("Error setting int: %s", err)
+	}
+	// a zero delta reads the counter
+	if newValue, err := cache.Increment("counter:int", 0); err != nil || newValue != 7 {
+		t.Errorf("Expected 7 incrementing by 0, got %d: %v", newValue, err)
+	}
+	if newValue, err := cache.Decrement("counter:int", 0); err != nil || newValue != 7 {
+		t.Errorf("Expected 7 decrementing by 0, got %d: %v", newValue, err)
+	}
+	// decrementing to exactly 0, and once more
+	if newValue, err := cache.Decrement("counter:int", 7); err != nil || newValue != 0 {
+		t.Errorf("Expected 0, got %d: %v", newValue, err)
+	}
+	if newValue, err := cache.Decrement("counter:int", 1); err != nil || newValue != 0 {
+		t.Errorf("Expected capped at 0, got %d: %v", newValue, err)
+	}
+	// the counter is still there after reaching 0
+	if newValue, err := cache.Increment("counter:int", 1); err != nil || newValue != 1 {
+		t.Errorf("Expected 1, got %d: %v", newValue, err)
+	}
+
+	// the top of the range, then a wrap around to 0
+	if err = cache.Set("counter:max", uint64(math.MaxUint64-1), persistence.DEFAULT); err != nil {
+		t.Errorf("Error setting uint64: %s", err)
+	}
+	if newValue, err := cache.Increment("counter:max", 1); err != nil || newValue != math.MaxUint64 {
+		t.Errorf("Expected %d, got %d: %v", uint64(math.MaxUint64), newValue, err)
+	}
+	if newValue, err := cache.Increment("counter:max", 1); err != nil || newValue != 0 {
+		t.Errorf("Expected wraparound 0, got %d: %v", newValue, err)
+	}
+
+	// values that are not numbers can not be counted
+	if err = cache.Set("counter:string", "foo", persistence.DEFAULT); err != nil {
+		t.Errorf("Error setting a value: %s", err)
+	}
+	if _, err = cache.Increment("counter:string", 1); err == nil || err == persistence.ErrCacheMiss {
+		t.Errorf("Expected an error incrementing a string, got: %v", err)
+	}
+	if _, err = cache.Decrement("counter:string", 1); err == nil || err == persistence.ErrCacheMiss {
+		t.Errorf("Expected an error decrementing a string, got: %v", err)
+	}
+	var value string
+	if err = cache.Get("counter:string", &value); err != nil || value != "foo" {
+		t.Errorf("Expected the string to be left alone, got %q: %v", value, err)
+	}
+}
+
+// Flush checks that Flush drops every key. Stores returning
+// persistence.ErrNotSupport skip the check.
+func Flush(t *testing.T, newStore Factory) {
+	var err error
+	cache := newStore(t, time.Hour)
+
+	keys := []string{"a", "b", "c"}
+	for _, key := range keys {
+		if err = cache.Set(key, key, persistence.FOREVER); err != nil {
+			t.Errorf("Error setting a value: %s", err)
+		}
+	}
+	err = cache.Flush()
+	if err == persistence.ErrNotSupport {
+		t.Skip("the store does not support Flush")
+	}
+	if err != nil {
+		t.Fatalf("Error flushing: %s", err)
+	}
+	var value string
+	for _, key := range keys {
+		if err = cache.Get(key, &value); err != persistence.ErrCacheMiss {
+			t.Errorf("Expected ErrCacheMiss for %s after a flush, got: %v", key, err)
+		}
+	}
+
+	// the store is usable after a flush
+	if err = cache.Set("a", "new", persistence.DEFAULT); err != nil {
+		t.Errorf("Error setting a value: %s", err)
+	}
+	if err = cache.Get("a", &value); err != nil || value != "new" {
+		t.Errorf("Expected new, got %q: %v", value, err)
+	}
+}
+
+// TTLTouch checks that TTL reports the time left before a key expires and
+// that Touch changes it. Stores returning persistence.ErrNotSupport skip the
+// checks of the method they don't support.
+func TTLTouch(t *testing.T, newStore Factory) {
+	var err error
+	cache := newStore(t, time.Hour)
+
+	if err = cache.Set("ttl:short", "value", time.Second); err != nil {
+		t.Fatalf("Error setting a value: %s", err)
+	}
+	if err = cache.Set("ttl:forever", "value", persistence.FOREVER); err != nil {
+		t.Fatalf("Error setting a value: %s", err)
+	}
+	ttlSupported := true
+	ttl, err := persistence.TTL(cache, "ttl:short")
+	switch {
+	case err == persistence.ErrNotSupport:
+		ttlSupported = false
+	case err != nil:
+		t.Errorf("Error getting the TTL: %s", err)
+	case ttl <= 0 || ttl > time.Second:
+		t.Errorf("Expected a TTL of at most 1s, got %s", ttl)
+	}
+	if ttlSupported {
+		if ttl, err = persistence.TTL(cache, "ttl:forever"); err != nil || ttl != persistence.FOREVER {
+			t.Errorf("Expected a TTL of FOREVER, got %s: %v", ttl, err)
+		}
+		if _, err = persistence.TTL(cache, "notexist"); err != persistence.ErrCacheMiss {
+			t.Errorf("Expected ErrCacheMiss for the TTL of a missing key, got: %v", err)
+		}
+	}
+
+	err = persistence.Touch(cache, "ttl:short", time.Hour)
+	if err == persistence.ErrNotSupport {
+		t.Skip("the store does not support Touch")
+	}
+	if err != nil {
+		t.Fatalf("Error touching a value: %s", err)
+	}
+	if err = persistence.Touch(cache, "notexist", time.Hour); err != persistence.ErrCacheMiss {
+		t.Errorf("Expected ErrCacheMiss touching a missing key, got: %v", err)
+	}
+	if ttlSupported {
+		if ttl, err = persistence.TTL(cache, "ttl:short"); err != nil || ttl <= time.Second || ttl > time.Hour {
+			t.Errorf("Expected a TTL of about an hour after a touch, got %s: %v", ttl, err)
+		}
+	}
+	time.Sleep(ExpirationWait)
+	var value string
+	if err = cache.Get("ttl:short", &value); err != nil || value != "value" {
+		t.Errorf("Expected the touched value to be kept, got %q: %v", value, err)
+	}
+}
+
+// CompareAndSwap checks that CompareAndSwap only writes a key still at the
+// version read. Stores returning persistence.ErrNotSupport skip the check.
+func CompareAndSwap(t *testing.T, newStore Factory) {
+	var err error
+	cache := newStore(t, time.Hour)
+
+	if err = cache.Set("cas:doc", "v1", persistence.DEFAULT); err != nil {
+		t.Fatalf("Error setting a value: %s", err)
+	}
+	var value string
+	v1, err := persistence.GetWithVersion(cache, "cas:doc", &value)
+	if err == persistence.ErrNotSupport {
+		t.Skip("the store does not support compare-and-swap")
+	}
+	if err != nil || value != "v1" {
+		t.Fatalf("Expected v1, got %q: %v", value, err)
+	}
+	if err = persistence.CompareAndSwap(cache, "cas:doc", "v2", v1, time.Hour); err != nil {
+		t.Fatalf("Error swapping a value: %s", err)
+	}
+	v2, err := persistence.GetWithVersion(cache, "cas:doc", &value)
+	if err != nil || value != "v2" {
+		t.Fatalf("Expected v2, got %q: %v", value, err)
+	}
+	if v2 == v1 {
+		t.Errorf("Expected a new version after a swap, got %d again", v2)
+	}
+	if ttl, err := persistence.TTL(cache, "cas:doc"); err != persistence.ErrNotSupport && (err != nil || ttl <= 0 || ttl > time.Hour) {
+		t.Errorf("Expected the swapped value to expire within an hour, got %s: %v", ttl, err)
+	}
+
+	// the version read before the swap is stale
+	if err = persistence.CompareAndSwap(cache, "cas:doc", "v3", v1, persistence.DEFAULT); err != persistence.ErrNotStored {
+		t.Errorf("Expected ErrNotStored swapping with a stale version, got: %v", err)
+	}
+	// and so is the one read before another write
+	if err = cache.Set("cas:doc", "v4", persistence.DEFAULT); err != nil {
+		t.Fatalf("Error setting a value: %s", err)
+	}
+	if err = persistence.CompareAndSwap(cache, "cas:doc", "v5", v2, persistence.DEFAULT); err != persistence.ErrNotStored {
+		t.Errorf("Expected ErrNotStored swapping a value written since, got: %v", err)
+	}
+	if err = cache.Get("cas:doc", &value); err != nil || value != "v4" {
+		t.Errorf("Expected v4, got %q: %v", value, err)
+	}
+
+	if _, err = persistence.GetWithVersion(cache, "notexist", &value); err != persistence.ErrCacheMiss {
+		t.Errorf("Expected ErrCacheMiss reading a missing key, got: %v", err)
+	}
+	if err = cache.Delete("cas:doc"); err != nil {
+		t.Fatalf("Error deleting a value: %s", err)
+	}
+	if err = persistence.CompareAndSwap(cache, "cas:doc", "v6", v2, persistence.DEFAULT); err != persistence.ErrCacheMiss {
+		t.Errorf("Expected ErrCacheMiss swapping a deleted key, got: %v", err)
+	}
+}
+
+// CompareAndDelete checks that CompareAndDelete only deletes a key still at
+// the version read. Stores returning persistence.ErrNotSupport skip the check.
+func CompareAndDelete(t *testing.T, newStore Factory) {
+	var err error
+	cache := newStore(t, time.Hour)
+
+	if err = cache.Set("casdelete:doc", "v1", persistence.DEFAULT); err != nil {
+		t.Fatalf("Error setting a value: %s", err)
+	}
+	var value string
+	v1, err := persistence.GetWithVersion(cache, "casdelete:doc", &value)
+	if err == persistence.ErrNotSupport {
+		t.Skip("the store does not support compare-and-swap")
+	}
+	if err != nil {
+		t.Fatalf("Error reading a value: %s", err)
+	}
+	if err = cache.Set("casdelete:doc", "v2", persistence.DEFAULT); err != nil {
+		t.Fatalf("Error setting a value: %s", err)
+	}
+	err = persistence.CompareAndDelete(cache, "casdelete:doc", v1)
+	if err == persistence.ErrNotSupport {
+		t.Skip("the store does not support compare-and-delete")
+	}
+	if err != persistence.ErrNotStored {
+		t.Errorf("Expected ErrNotStored deleting a value written since, got: %v", err)
+	}
+	v2, err := persistence.GetWithVersion(cache, "casdelete:doc", &value)
+	if err != nil || value != "v2" {
+		t.Fatalf("Expected v2 to be kept, got %q: %v", value, err)
+	}
+
+	if err = persistence.CompareAndDelete(cache, "casdelete:doc", v2); err != nil {
+		t.Fatalf("Error deleting a value: %s", err)
+	}
+	if err = cache.Get("casdelete:doc", &value); err != persistence.ErrCacheMiss {
+		t.Errorf("Expected ErrCacheMiss for a deleted key, got: %v", err)
+	}
+	if err = persistence.CompareAndDelete(cache, "casdelete:doc", v2); err != persistence.ErrCacheMiss {
+		t.Errorf("Expected ErrCacheMiss deleting a deleted key, got: %v", err)
+	}
+	if err = cache.Add("casdelete:doc", "v3", persistence.DEFAULT); err != nil {
+		t.Errorf("Expected a deleted key to be added again, got: %v", err)
+	}
+}
+
+// ConcurrentCompareAndSwap checks that read-modify-write loops built on
+// CompareAndSwap do not lose updates under concurrency
+func ConcurrentCompareAndSwap(t *testing.T, newStore Factory) {
+	const workers, rounds = 5, 10
+	cache := newStore(t, time.Hour)
+
+	if err := cache.Set("cas:counter", 0, persistence.DEFAULT); err != nil {
+		t.Fatalf("Error setting counter: %s", err)
+	}
+	var n int
+	if _, err := persistence.GetWithVersion(cache, "cas:counter", &n); err == persistence.ErrNotSupport {
+		t.Skip("the store does not support compare-and-swap")
+	}
+	parallel(workers, func() {
+		for i := 0; i < rounds; i++ {
+			for {
+				var n int
+				version, err := persistence.GetWithVersion(cache, "cas:counter", &n)
+				if err != nil {
+					t.Errorf("Error reading counter: %s", err)
+					return
+				}
+				err = persistence.CompareAndSwap(cache, "cas:counter", n+1, version, persistence.DEFAULT)
+				if err == nil {
+					break
+				}
+				if err != persistence.ErrNotStored {
+					t.Errorf("Error swapping counter: %s", err)
+					return
+				}
+			}
+		}
+	})
+	if err := cache.Get("cas:counter", &n); err != nil || n != workers*rounds {
+		t.Errorf("Expected counter to be %d, got %d: %v", workers*rounds, n, err)
+	}
+}
+
+// Scan checks that paging through Scan lists the keys starting with a prefix
+// and their metadata. Stores returning persistence.ErrNotSupport skip the
+// check.
+func Scan(t *testing.T, newStore Factory) {
+	cache := newStore(t, time.Hour)
+
+	expected := map[string]bool{}
+	for _, key := range []string{"scan:a", "scan:b", "scan:c", "scan:d", "scan:e"} {
+		if err := cache.Set(key, key, time.Hour); err != nil {
+			t.Fatalf("Error setting a value: %s", err)
+		}
+		expected[key] = true
+	}
+	if err := cache.Set("scan:forever", "value", persistence.FOREVER); err != nil {
+		t.Fatalf("Error setting a value: %s", err)
+	}
+	expected["scan:forever"] = true
+	if err := cache.Set("noscan", "value", time.Hour); err != nil {
+		t.Fatalf("Error setting a value: %s", err)
+	}
+
+	found := map[string]persistence.KeyInfo{}
+	cursor, pages := "", 0
+	for {
+		infos, next, err := persistence.Scan(cache, "scan:", cursor, 2)
+		if err == persistence.ErrNotSupport {
+			t.Skip("the store does not support Scan")
+		}
+		if err != nil {
+			t.Fatalf("Error scanning: %s", err)
+		}
+		for _, info := range infos {
+			found[info.Key] = info
+		}
+		if pages++; next == "" || pages > 100 {
+			break
+		}
+		cursor = next
+	}
+	if len(found) != len(expected) {
+		t.Errorf("Expected %d keys, got %v", len(expected), found)
+	}
+	for key, info := range found {
+		if !expected[key] {
+			t.Errorf("Unexpected key %q", key)
+		}
+		if info.Size == 0 || info.Size < -1 {
+			t.Errorf("Expected a positive or unknown size for %q, got %d", key, info.Size)
+		}
+		switch {
+		case info.TTL == 0:
+		case key == "scan:forever" && info.TTL != persistence.FOREVER:
+			t.Errorf("Expected a TTL of FOREVER for %q, got %s", key, info.TTL)
+		case key != "scan:forever" && (info.TTL < 0 || info.TTL > time.Hour):
+			t.Errorf("Expected a TTL of at most an hour for %q, got %s", key, info.TTL)
+		}
+	}
+
+	if _, _, err := persistence.Scan(cache, "scan:", "not a cursor", 2); err == nil {
+		t.Errorf("Expected an error scanning from an invalid cursor")
+	}
+}
+
+// ConcurrentIncrDecr checks that increments and decrements do not lose
+// updates under concurrency
+func ConcurrentIncrDecr(t *testing.T, newStore Factory) {
+	const workers, rounds = 10, 50
+	cache := newStore(t, time.Hour)
+
+	if err := cache.Set("incr:counter", 0, persistence.DEFAULT); err != nil {
+		t.Fatalf("Error setting counter: %s", err)
+	}
+	run := func(op func() error) {
+		parallel(workers, func() {
+			for j := 0; j < rounds; j++ {
+				if err := op(); err != nil {
+					t.Errorf("Unexpected error: %s", err)
+					return
+				}
+			}
+		})
+	}
+
+	run(func() error {
+		_, err := cache.Increment("incr:counter", 2)
+		return err
+	})
+	if value, err := cache.Increment("incr:counter", 0); err != nil || value != 2*workers*rounds {
+		t.Errorf("Expected %d, got %d: %v", 2*workers*rounds, value, err)
+	}
+
+	// decrement three times as much as was incremented, it must stop at 0
+	run(func() error {
+		_, err := cache.Decrement("incr:counter", 3)
+		return err
+	})
+	if value, err := cache.Increment("incr:counter", 0); err != nil || value != 0 {
+		t.Errorf("Expected the counter capped at 0, got %d: %v", value, err)
+	}
+
+	// missing keys must not be created
+	run(func() error {
+		if _, err := cache.Increment("incr:missing", 1); err != persistence.ErrCacheMiss {
+			t.Errorf("Expected ErrCacheMiss, got: %v", err)
+		}
+		return nil
+	})
+	if _, err := cache.Decrement("incr:missing", 1); err != persistence.ErrCacheMiss {
+		t.Errorf("Expected the missing key not to be created, got: %v", err)
+	}
+}
+
+// ConcurrentAdd checks that exactly one of many concurrent Adds of a key
+// succeeds
+func ConcurrentAdd(t *testing.T, newStore Factory) {
+	const workers = 20
+	cache := newStore(t, time.Hour)
+
+	var mu sync.Mutex
+	added := 0
+	parallel(workers, func() {
+		err := cache.Add("add:concurrent", "value", persistence.DEFAULT)
+		switch err {
+		case nil:
+			mu.Lock()
+			added++
+			mu.Unlock()
+		case persistence.ErrNotStored:
+		default:
+			t.Errorf("Unexpected error adding: %s", err)
+		}
+	})
+	if added != 1 {
+		t.Errorf("Expected exactly one Add to succeed, %d did", added)
+	}
+}
+
+// parallel runs f in n goroutines and waits for them
+func parallel(n int, f func()) {
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			f()
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,210 @@
+package persistence
+
+import (
+	"context"
+	"hash/fnv"
+	"strconv"
+	"time"
+)
+
+// Tracer starts the spans of the cache operations. It is meant to be a thin
+// adapter over the tracing SDK of the application, such as OpenTelemetry, so
+// that none is imposed by this package.
+type Tracer interface {
+	// Start starts a span named name, child of the span carried by ctx, and
+	// returns a context carrying the new span
+	Start(ctx context.Context, name string) (context.Context, Span)
+}
+
+// Span is a traced operation started by a Tracer
+type Span interface {
+	SetAttribute(key string, value interface{})
+	SetError(err error)
+	End()
+}
+
+// ContextBinder is implemented by stores that use the context of the request
+// they serve, such as TracedStore to parent its spans.
+type ContextBinder interface {
+	WithContext(ctx context.Context) CacheStore
+}
+
+// NoopTracer is a Tracer whose spans do nothing
+type NoopTracer struct{}
+
+// Start (see Tracer interface)
+func (NoopTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	return ctx, noopSpan{}
+}
+
+type noopSpan struct{}
+
+func (noopSpan) SetAttribute(key string, value interface{}) {}
+func (noopSpan) SetError(err error)                         {}
+func (noopSpan) End()                                       {}
+
+// HashKey returns a short stable hash of key, used to tell keys apart in
+// traces and headers without exposing them
+func HashKey(key string) string {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return strconv.FormatUint(h.Sum64(), 16)
+}
+
+// TracedStore starts a span around every call of the wrapped CacheStore
+type TracedStore struct {
+	store  CacheStore
+	name   string
+	tracer Tracer
+	ctx    context.Context
+}
+
+// NewTracedStore returns a TracedStore, name is set as the cache.store
+// attribute of the spans
+func NewTracedStore(store CacheStore, name string, tracer Tracer) *TracedStore {
+	return &TracedStore{store, name, tracer, context.Background()}
+}
+
+// Name returns the name of the store
+func (s *TracedStore) Name() string {
+	return s.name
+}
+
+// WithContext returns a copy of the store whose spans are children of the
+// span carried by ctx (see ContextBinder interface)
+func (s *TracedStore) WithContext(ctx context.Context) CacheStore {
+	store := s.store
+	if binder, ok := store.(ContextBinder); ok {
+		store = binder.WithContext(ctx)
+	}
+	return &TracedStore{store, s.name, s.tracer, ctx}
+}
+
+func (s *TracedStore) start(op, key string) Span {
+	_, span := s.tracer.Start(s.ctx, "cache."+op)
+	span.SetAttribute("cache.store", s.name)
+	if key != "" {
+		span.SetAttribute("cache.key_hash", HashKey(key))
+	}
+	return span
+}
+
+func finish(span Span, err error) {
+	if err != nil && err != ErrCacheMiss {
+		span.SetError(err)
+	}
+	span.End()
+}
+
+// Get (see CacheStore interface)
+func (s *TracedStore) Get(key string, value interface{}) error {
+	span := s.start("get", key)
+	err := s.store.Get(key, value)
+	span.SetAttribute("cache.hit", err == nil)
+	finish(span, err)
+	return err
+}
+
+// Set (see CacheStore interface)
+func (s *TracedStore) Set(key string, value interface{}, expires time.Duration) error {
+	span := s.start("set", key)
+	err := s.store.Set(key, value, expires)
+	finish(span, err)
+	return err
+}
+
+// Add (see CacheStore interface)
+func (s *TracedStore) Add(key string, value interface{}, expires time.Duration) error {
+	span := s.start("add", key)
+	err := s.store.Add(key, value, expires)
+	finish(span, err)
+	return err
+}
+
+// Replace (see CacheStore interface)
+func (s *TracedStore) Replace(key string, value interface{}, expires time.Duration) error {
+	span := s.start("replace", key)
+	err := s.store.Replace(key, value, expires)
+	finish(span, err)
+	return err
+}
+
+// Delete (see CacheStore interface)
+func (s *TracedStore) Delete(key string) error {
+	span := s.start("delete", key)
+	err := s.store.Delete(key)
+	finish(span, err)
+	return err
+}
+
+// Increment (see CacheStore interface)
+func (s *TracedStore) Increment(key string, delta uint64) (uint64, error) {
+	span := s.start("increment", key)
+	n, err := s.store.Increment(key, delta)
+	finish(span, err)
+	return n, err
+}
+
+// Decrement (see CacheStore interface)
+func (s *TracedStore) Decrement(key string, delta uint64) (uint64, error) {
+	span := s.start("decrement", key)
+	n, err := s.store.Decrement(key, delta)
+	finish(span, err)
+	return n, err
+}
+
+// TTL (see ExpiryStore interface)
+func (s *TracedStore) TTL(key string) (time.Duration, error) {
+	span := s.start("ttl", key)
+	ttl, err := TTL(s.store, key)
+	finish(span, err)
+	return ttl, err
+}
+
+// Touch (see ExpiryStore interface)
+func (s *TracedStore) Touch(key string, expires time.Duration) error {
+	span := s.start("touch", key)
+	err := Touch(s.store, key, expires)
+	finish(span, err)
+	return err
+}
+
+// GetWithVersion (see CASStore interface)
+func (s *TracedStore) GetWithVersion(key string, value interface{}) (uint64, error) {
+	span := s.start("getwithversion", key)
+	version, err := GetWithVersion(s.store, key, value)
+	finish(span, err)
+	return version, err
+}
+
+// CompareAndSwap (see CASStore interface)
+func (s *TracedStore) CompareAndSwap(key string, value interface{}, version uint64, expires time.Duration) error {
+	span := s.start("compareandswap", key)
+	err := CompareAndSwap(s.store, key, value, version, expires)
+	finish(span, err)
+	return err
+}
+
+// CompareAndDelete (see CASDeleter interface)
+func (s *TracedStore) CompareAndDelete(key string, version uint64) error {
+	span := s.start("compareanddelete", key)
+	err := CompareAndDelete(s.store, key, version)
+	finish(span, err)
+	return err
+}
+
+// Scan (see Scanner interface)
+func (s *TracedStore) Scan(prefix, cursor string, count int) ([]KeyInfo, string, error) {
+	span := s.start("scan", "")
+	infos, next, err := Scan(s.store, prefix, cursor, count)
+	finish(span, err)
+	return infos, next, err
+}
+
+// Flush (see CacheStore interface)
+func (s *TracedStore) Flush() error {
+	span := s.start("flush", "")
+	err := s.store.Flush()
+	finish(span, err)
+	return err
+}
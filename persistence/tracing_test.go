@@ -0,0 +1,82 @@
+package persistence
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+type recordSpan struct {
+	name  string
+	ctx   context.Context
+	attrs map[string]interface{}
+	err   error
+	ended bool
+}
+
+func (s *recordSpan) SetAttribute(key string, value interface{}) { s.attrs[key] = value }
+func (s *recordSpan) SetError(err error)                         { s.err = err }
+func (s *recordSpan) End()                                       { s.ended = true }
+
+type recordTracer struct {
+	spans []*recordSpan
+}
+
+func (t *recordTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	span := &recordSpan{name: name, ctx: ctx, attrs: map[string]interface{}{}}
+	t.spans = append(t.spans, span)
+	return ctx, span
+}
+
+type failingStore struct {
+	*InMemoryStore
+	err error
+}
+
+func (s *failingStore) Set(key string, value interface{}, expires time.Duration) error {
+	return s.err
+}
+
+func TestTracedStore_Spans(t *testing.T) {
+	tracer := &recordTracer{}
+	failure := errors.New("down")
+	store := NewTracedStore(&failingStore{NewInMemoryStore(time.Hour), failure}, "memory", tracer)
+
+	type ctxKey struct{}
+	ctx := context.WithValue(context.Background(), ctxKey{}, "request")
+	bound := store.WithContext(ctx)
+
+	var value string
+	if err := bound.Get("key", &value); err != ErrCacheMiss {
+		t.Errorf("Expected ErrCacheMiss, got: %v", err)
+	}
+	if err := bound.Set("key", "value", DEFAULT); err != failure {
+		t.Errorf("Expected %v, got: %v", failure, err)
+	}
+
+	if len(tracer.spans) != 2 {
+		t.Fatalf("Expected 2 spans, got %d", len(tracer.spans))
+	}
+	get, set := tracer.spans[0], tracer.spans[1]
+	if get.name != "cache.get" || set.name != "cache.set" {
+		t.Errorf("Unexpected span names %q and %q", get.name, set.name)
+	}
+	for _, span := range tracer.spans {
+		if span.ctx.Value(ctxKey{}) != "request" {
+			t.Errorf("Expected %s to be started from the bound context", span.name)
+		}
+		if !span.ended {
+			t.Errorf("Expected %s to be ended", span.name)
+		}
+		if span.attrs["cache.key_hash"] != HashKey("key") || span.attrs["cache.store"] != "memory" {
+			t.Errorf("Unexpected attributes %v", span.attrs)
+		}
+	}
+	if get.attrs["cache.hit"] != false || get.err != nil {
+		t.Errorf("Expected a miss without error, got %v and %v", get.attrs["cache.hit"], get.err)
+	}
+	if set.err != failure {
+		t.Errorf("Expected the set error to be recorded, got %v", set.err)
+	}
+}
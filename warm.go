@@ -0,0 +1,206 @@
+package cache
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/gin-contrib/cache/persistence"
+)
+
+// WarmOptions configures Warm and StartWarmer
+type WarmOptions struct {
+	// Concurrency bounds the number of pages rendered at once, 4 when 0
+	Concurrency int
+
+	// Header is sent with every request, for the headers the handlers depend
+	// on. The Host is the one of the URL when absolute.
+	Header http.Header
+
+	// Before makes the pages already cached be rendered again once they
+	// expire within Before, so they are replaced before the visitors miss
+	// them. The pages cached in a store that can't report the TTL of its keys
+	// are then rendered again every time. Only the missing pages are rendered
+	// when 0.
+	Before time.Duration
+
+	// Interval is the period of the warmer started by StartWarmer, 1 minute
+	// when 0
+	Interval time.Duration
+}
+
+// WarmReport counts the pages of a Warm
+type WarmReport struct {
+	// Rendered is the number of pages the handlers rendered
+	Rendered int
+	// Skipped is the number of pages that were already cached
+	Skipped int
+	// Failed is the number of pages that could not be warmed: their URL is
+	// invalid, the store failed or the request answered with a 5xx
+	Failed int
+}
+
+// refreshKey is the context key of the requests of Warm rendering a page
+// that is still cached
+type refreshKey struct{}
+
+// refreshing tells whether the request carrying ctx must render its page
+// again
+func refreshing(ctx context.Context) bool {
+	refresh, _ := ctx.Value(refreshKey{}).(bool)
+	return refresh
+}
+
+// Warm renders the pages of urls that are not cached yet by replaying GET
+// requests through handler, usually the gin engine, so they are stored by
+// its page cache middlewares. urls are paths or absolute URLs, like the ones
+// ParseSitemap returns, and are looked up under the key CachePage gives them.
+// Warm returns once every page is handled, or with the error of ctx when it
+// is done first.
+func (ch *cache) Warm(ctx context.Context, handler http.Handler, urls []string, options *WarmOptions) (WarmReport, error) {
+	if options == nil {
+		options = &WarmOptions{}
+	}
+	concurrency := options.Concurrency
+	if concurrency <= 0 {
+		concurrency = 4
+	}
+	var report WarmReport
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, concurrency)
+	for _, raw := range urls {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			wg.Wait()
+			return report, ctx.Err()
+		}
+		wg.Add(1)
+		go func(raw string) {
+			defer func() { <-sem; wg.Done() }()
+			rendered, err := ch.warm(ctx, handler, raw, options)
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case err != nil:
+				report.Failed++
+				ch.logger.Log(persistence.LevelWarn, "cache: failed to warm the page",
+					persistence.Field{Key: "url", Value: raw},
+					persistence.Field{Key: "error", Value: err},
+				)
+			case rendered:
+				report.Rendered++
+			default:
+				report.Skipped++
+			}
+		}(raw)
+	}
+	wg.Wait()
+	return report, ctx.Err()
+}
+
+// warm renders the page of raw when it is missing or expires within
+// options.Before, and tells whether it did
+func (ch *cache) warm(ctx context.Context, handler http.Handler, raw string, options *WarmOptions) (bool, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return false, err
+	}
+	key := CreateKey(ch.parseUrl(u).RequestURI())
+	ttl, err := persistence.TTL(ch.store, key)
+	if err == persistence.ErrNotSupport {
+		// cached pages are then rendered again whenever Before is set
+		var page ResponseCache
+		if err = ch.store.Get(key, &page); err == nil {
+			ttl = 0
+		}
+	}
+	switch {
+	case err == persistence.ErrCacheMiss:
+	case err != nil:
+		return false, err
+	case options.Before <= 0 || ttl == persistence.FOREVER || ttl > options.Before:
+		return false, nil
+	default:
+		ctx = context.WithValue(ctx, refreshKey{}, true)
+	}
+
+	r, err := http.NewRequest("GET", raw, nil)
+	if err != nil {
+		return false, err
+	}
+	for name, values := range options.Header {
+		r.Header[name] = values
+	}
+	w := &warmWriter{header: http.Header{}, status: http.StatusOK}
+	handler.ServeHTTP(w, r.WithContext(ctx))
+	if w.status >= 500 {
+		return false, fmt.Errorf("cache: warming request answered %d", w.status)
+	}
+	return true, nil
+}
+
+// StartWarmer runs Warm every options.Interval in the background until ctx is
+// done. Set options.Before to keep the pages cached by rendering them again
+// before they expire.
+func (ch *cache) StartWarmer(ctx context.Context, handler http.Handler, urls []string, options *WarmOptions) {
+	if options == nil {
+		options = &WarmOptions{}
+	}
+	interval := options.Interval
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			ch.Warm(ctx, handler, urls, options)
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// warmWriter is the http.ResponseWriter of the requests of Warm, it keeps
+// the status and discards the body
+type warmWriter struct {
+	header http.Header
+	status int
+	wrote  bool
+}
+
+func (w *warmWriter) Header() http.Header { return w.header }
+
+func (w *warmWriter) WriteHeader(status int) {
+	if !w.wrote {
+		w.status, w.wrote = status, true
+	}
+}
+
+func (w *warmWriter) Write(data []byte) (int, error) {
+	w.wrote = true
+	return len(data), nil
+}
+
+// ParseSitemap returns the URLs listed by a sitemap.xml, for Warm. The
+// sitemaps listed by a sitemap index are returned as is.
+func ParseSitemap(r io.Reader) ([]string, error) {
+	var sitemap struct {
+		URLs     []string `xml:"url>loc"`
+		Sitemaps []string `xml:"sitemap>loc"`
+	}
+	if err := xml.NewDecoder(r).Decode(&sitemap); err != nil {
+		return nil, err
+	}
+	return append(sitemap.URLs, sitemap.Sitemaps...), nil
+}
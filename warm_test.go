@@ -0,0 +1,164 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-contrib/cache/persistence"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+// newWarmRouter returns a router caching its pages for expire, and the
+// counter of the pages it rendered
+func newWarmRouter(ch *cache, expire time.Duration) (*gin.Engine, *int64) {
+	var renders int64
+	router := gin.New()
+	router.GET("/fail", ch.CachePage(expire), func(c *gin.Context) {
+		c.String(500, "failed")
+	})
+	router.GET("/page/*path", ch.CachePage(expire), func(c *gin.Context) {
+		n := atomic.AddInt64(&renders, 1)
+		c.String(200, fmt.Sprint("render ", n, " ", c.Request.Host))
+	})
+	return router, &renders
+}
+
+func TestWarm(t *testing.T) {
+	logger := &recordLogger{}
+	ch := NewMemoryCache(time.Hour)
+	ch.SetLogger(logger)
+	router, renders := newWarmRouter(ch, time.Hour)
+	urls := []string{"/page/a", "/page/b", "http://example.com/page/c?x=1", "/fail", "%zz"}
+
+	report, err := ch.Warm(context.Background(), router, urls, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, WarmReport{Rendered: 3, Failed: 2}, report)
+	assert.Equal(t, int64(3), atomic.LoadInt64(renders))
+	assert.Len(t, logger.entries, 2)
+
+	w := performRequest("GET", "/page/c?x=1", router)
+	assert.True(t, strings.HasSuffix(w.Body.String(), " example.com"), "the host of the URL is kept")
+	assert.Equal(t, int64(3), atomic.LoadInt64(renders))
+
+	report, err = ch.Warm(context.Background(), router, urls, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, WarmReport{Skipped: 3, Failed: 2}, report)
+	assert.Equal(t, int64(3), atomic.LoadInt64(renders))
+}
+
+func TestWarmBefore(t *testing.T) {
+	ch := NewMemoryCache(time.Hour)
+	router, renders := newWarmRouter(ch, time.Minute)
+	performRequest("GET", "/page/a", router)
+
+	report, _ := ch.Warm(context.Background(), router, []string{"/page/a"}, &WarmOptions{Before: 30 * time.Second})
+	assert.Equal(t, WarmReport{Skipped: 1}, report)
+
+	report, _ = ch.Warm(context.Background(), router, []string{"/page/a"}, &WarmOptions{Before: 2 * time.Minute})
+	assert.Equal(t, WarmReport{Rendered: 1}, report)
+	assert.Equal(t, int64(2), atomic.LoadInt64(renders))
+	w := performRequest("GET", "/page/a", router)
+	assert.Equal(t, "render 2 ", w.Body.String())
+}
+
+func TestWarmRefreshJSON(t *testing.T) {
+	ch := NewMemoryCache(time.Hour)
+	n := 0
+	router := gin.New()
+	router.GET("/json", ch.CachePage(time.Minute), func(c *gin.Context) {
+		n++
+		c.JSON(200, gin.H{"n": n})
+	})
+	assert.Equal(t, `{"n":1}`, performRequest("GET", "/json", router).Body.String())
+
+	report, _ := ch.Warm(context.Background(), router, []string{"/json"}, &WarmOptions{Before: 2 * time.Minute})
+	assert.Equal(t, WarmReport{Rendered: 1}, report)
+	assert.Equal(t, `{"n":2}`, performRequest("GET", "/json", router).Body.String(), "the refreshed page replaces the cached one")
+}
+
+func TestWarmWithoutTTL(t *testing.T) {
+	// only the CacheStore methods of the in-memory store are visible
+	ch := NewCache(struct{ persistence.CacheStore }{persistence.NewInMemoryStore(time.Hour)})
+	router, renders := newWarmRouter(ch, time.Hour)
+	performRequest("GET", "/page/a", router)
+
+	report, _ := ch.Warm(context.Background(), router, []string{"/page/a", "/page/b"}, nil)
+	assert.Equal(t, WarmReport{Rendered: 1, Skipped: 1}, report)
+	report, _ = ch.Warm(context.Background(), router, []string{"/page/a", "/page/b"}, &WarmOptions{Before: time.Minute})
+	assert.Equal(t, WarmReport{Rendered: 2}, report)
+	assert.Equal(t, int64(4), atomic.LoadInt64(renders))
+}
+
+func TestWarmConcurrency(t *testing.T) {
+	var running, max int64
+	ch := NewMemoryCache(time.Hour)
+	router := gin.New()
+	router.GET("/page/*path", ch.CachePage(time.Hour), func(c *gin.Context) {
+		n := atomic.AddInt64(&running, 1)
+		defer atomic.AddInt64(&running, -1)
+		for {
+			m := atomic.LoadInt64(&max)
+			if n <= m || atomic.CompareAndSwapInt64(&max, m, n) {
+				break
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+		c.String(200, "page")
+	})
+	var urls []string
+	for i := 0; i < 20; i++ {
+		urls = append(urls, fmt.Sprint("/page/", i))
+	}
+
+	report, err := ch.Warm(context.Background(), router, urls, &WarmOptions{Concurrency: 3})
+	assert.NoError(t, err)
+	assert.Equal(t, 20, report.Rendered)
+	assert.True(t, max > 1 && max <= 3, "%d pages rendered at once", max)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = NewMemoryCache(time.Hour).Warm(ctx, router, urls, nil)
+	assert.Equal(t, context.Canceled, err)
+}
+
+func TestStartWarmer(t *testing.T) {
+	ch := NewMemoryCache(time.Hour)
+	router, renders := newWarmRouter(ch, time.Minute)
+	ctx, cancel := context.WithCancel(context.Background())
+	ch.StartWarmer(ctx, router, []string{"/page/a"}, &WarmOptions{Before: 2 * time.Minute, Interval: 10 * time.Millisecond})
+
+	deadline := time.Now().Add(time.Second)
+	for atomic.LoadInt64(renders) < 3 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	assert.True(t, atomic.LoadInt64(renders) >= 3, "the page is rendered again before it expires")
+	time.Sleep(20 * time.Millisecond)
+	n := atomic.LoadInt64(renders)
+	time.Sleep(30 * time.Millisecond)
+	assert.Equal(t, n, atomic.LoadInt64(renders), "the warmer stops with its context")
+}
+
+func TestParseSitemap(t *testing.T) {
+	urls, err := ParseSitemap(strings.NewReader(`<?xml version="1.0" encoding="UTF-8"?>
+<urlset xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">
+  <url><loc>https://example.com/</loc><lastmod>2020-01-01</lastmod></url>
+  <url><loc>https://example.com/news?page=2</loc></url>
+</urlset>`))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"https://example.com/", "https://example.com/news?page=2"}, urls)
+
+	urls, err = ParseSitemap(strings.NewReader(`<sitemapindex xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">
+  <sitemap><loc>https://example.com/sitemap-news.xml</loc></sitemap>
+</sitemapindex>`))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"https://example.com/sitemap-news.xml"}, urls)
+
+	_, err = ParseSitemap(strings.NewReader("not xml"))
+	assert.Error(t, err)
+}